@@ -0,0 +1,159 @@
+/*
+   Copyright 2021 VMware, Inc.
+   SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"fmt"
+	"github.com/vmware/cloud-director-named-disk-csi-driver/pkg/config"
+	"github.com/vmware/cloud-director-named-disk-csi-driver/pkg/vcdcsiclient"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// checkStep is a step of the self-test of the check command. run returns the details of the step to report, and a
+// step that returns errSkipped is reported as skipped.
+type checkStep struct {
+	name string
+	run  func() (string, error)
+}
+
+var errSkipped = fmt.Errorf("skipped")
+
+// newCheckCommand returns the command that tests the cloud config and the access of the driver to VCD without
+// running the driver, so that an install can be diagnosed outside of Kubernetes
+func newCheckCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "check",
+		Short: "Check the cloud config and the access of the driver to VCD",
+		Long: "Load the cloud config and its secrets, log in to VCD, refresh the bearer token and resolve the org, " +
+			"VDC and vApp of the cluster, printing the result and duration of every step. " +
+			"The command exits with a non-zero status if any step fails.",
+		PreRun: func(cmd *cobra.Command, args []string) {
+			// the driver is not run, so it needs no endpoint
+			cmd.Flags().SetAnnotation("endpoint", cobra.BashCompOneRequiredFlag, []string{"false"})
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			if !runCheck(cmd.OutOrStdout()) {
+				os.Exit(1)
+			}
+		},
+	}
+}
+
+// runCheck runs the steps of the self-test in order and writes their report to out, skipping the steps after the
+// first failure. It returns true if no step failed.
+func runCheck(out io.Writer) bool {
+	var cloudConfig *config.CloudConfig
+	var vcdClient *vcdcsiclient.Client
+	steps := []checkStep{
+		{
+			name: "load cloud config",
+			run: func() (_ string, err error) {
+				cloudConfig, err = loadCloudConfig(cloudConfigFlag)
+				return "", err
+			},
+		},
+		{
+			name: "load secrets",
+			run: func() (string, error) {
+				if err := config.SetAuthorization(cloudConfig); err != nil {
+					return "", fmt.Errorf("unable to set authorization in config: [%v]", err)
+				}
+				return "", nil
+			},
+		},
+		{
+			name: "create VCD client",
+			run: func() (_ string, err error) {
+				vcdClient, err = newVCDClient(cloudConfig)
+				return "", err
+			},
+		},
+		{
+			name: "refresh bearer token",
+			run: func() (string, error) {
+				if err := vcdClient.RefreshBearerToken(); err != nil {
+					return "", fmt.Errorf("unable to refresh bearer token: [%v]", err)
+				}
+				return "", nil
+			},
+		},
+		{
+			name: "resolve org",
+			run: func() (string, error) {
+				org, err := vcdClient.VCDClient.GetOrgByNameOrId(cloudConfig.VCD.Org)
+				if err != nil {
+					return "", fmt.Errorf("unable to get org [%s]: [%v]", cloudConfig.VCD.Org, err)
+				}
+				return fmt.Sprintf("org [%s] has ID [%s]", org.Org.Name, org.Org.ID), nil
+			},
+		},
+		{
+			name: "resolve VDC",
+			run: func() (string, error) {
+				vdc := vcdClient.GetVDC()
+				if vdc == nil {
+					return "", fmt.Errorf("client has no VDC [%s]", cloudConfig.VCD.VDC)
+				}
+				return fmt.Sprintf("VDC [%s] has ID [%s]", vdc.Vdc.Name, vdc.Vdc.ID), nil
+			},
+		},
+		{
+			name: "resolve vApp",
+			run: func() (string, error) {
+				if cloudConfig.VCD.VAppName == "" {
+					return "", errSkipped
+				}
+				vApp, err := vcdClient.GetVDC().GetVAppByName(cloudConfig.VCD.VAppName, true)
+				if err != nil {
+					return "", fmt.Errorf("unable to get vApp [%s]: [%v]", cloudConfig.VCD.VAppName, err)
+				}
+				return fmt.Sprintf("vApp [%s] has ID [%s]", vApp.VApp.Name, vApp.VApp.ID), nil
+			},
+		},
+	}
+
+	report := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	passed := true
+	for _, step := range steps {
+		if !passed {
+			fmt.Fprintf(report, "SKIP\t%s\t-\n", step.name)
+			continue
+		}
+
+		startTime := time.Now()
+		details, err := step.run()
+		duration := time.Since(startTime).Round(time.Millisecond)
+		switch {
+		case err == errSkipped:
+			fmt.Fprintf(report, "SKIP\t%s\t-\n", step.name)
+		case err != nil:
+			fmt.Fprintf(report, "FAIL\t%s\t%v\t%v\n", step.name, duration, err)
+			passed = false
+		default:
+			fmt.Fprintf(report, "PASS\t%s\t%v\t%s\n", step.name, duration, details)
+		}
+	}
+	report.Flush()
+
+	if vcdClient != nil {
+		// the session of the check is logged out, since VCD limits the sessions of a user
+		if err := vcdClient.Close(); err != nil {
+			fmt.Fprintf(out, "unable to close VCD client: [%v]\n", err)
+		}
+	}
+	if passed {
+		fmt.Fprintln(out, "check passed")
+	} else {
+		fmt.Fprintln(out, "check failed")
+	}
+
+	return passed
+}
@@ -6,20 +6,28 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"github.com/vmware/cloud-director-named-disk-csi-driver/pkg/config"
 	"github.com/vmware/cloud-director-named-disk-csi-driver/pkg/csi"
 	"github.com/vmware/cloud-director-named-disk-csi-driver/pkg/vcdcsiclient"
 	"github.com/vmware/cloud-director-named-disk-csi-driver/version"
-	"github.com/vmware/cloud-provider-for-cloud-director/pkg/vcdsdk"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 	"k8s.io/component-base/logs"
 	"k8s.io/klog"
+	klogv2 "k8s.io/klog/v2"
 )
 
 var (
@@ -27,10 +35,59 @@ var (
 	nodeIDFlag      string
 	cloudConfigFlag string
 	upgradeRDEFlag  bool
+	metricsAddrFlag string
+	vcdInfoFlag     bool
+
+	volumeNamePrefixFlag string
+	dryRunFlag           bool
+	recordEventsFlag     bool
+
+	diskDescriptionTemplateFlag string
+	mirroredPVCKeysFlag         string
+
+	minVolumeSizeFlag string
+	maxVolumeSizeFlag string
+
+	vAppScopedVMSearchFlag bool
+	vmIDTopologyFlag       bool
+	maxVolumesPerNodeFlag  int64
+
+	attachDetachBusyRetriesFlag int
+	allowOfflineAttachFlag      bool
+
+	maxConcurrentOperationsFlag int
+
+	credentialsWatchIntervalFlag time.Duration
+
+	detachWaitTimeoutFlag time.Duration
+
+	deleteTransitionTimeoutFlag time.Duration
+
+	deviceReadyTimeoutFlag  time.Duration
+	deviceReadyIntervalFlag time.Duration
+
+	startupJitterFlag time.Duration
+
+	reaperIntervalFlag    time.Duration
+	reaperGracePeriodFlag time.Duration
+
+	attachmentReconcileIntervalFlag time.Duration
+	attachmentRepairIntervalFlag    time.Duration
+)
+
+const (
+	// startupAuthAttempts is how many times the VCD client is created before the driver gives up on starting
+	startupAuthAttempts = 5
+	// startupAuthRetryDelay is the delay before the second creation of the VCD client, which doubles with every
+	// attempt and is jittered
+	startupAuthRetryDelay = 5 * time.Second
 )
 
 func init() {
 	flag.Set("logtostderr", "true")
+	// the pods of a cluster that restart together should not share the jitter of their delays and of the backoff
+	// of their VCD calls
+	rand.Seed(time.Now().UnixNano())
 }
 
 func main() {
@@ -53,12 +110,17 @@ func main() {
 			// are migrated to fully utilize klog instead of glog.
 			klogFlags := flag.NewFlagSet("klog", flag.ExitOnError)
 			klog.InitFlags(klogFlags)
+			// the VCD client logs through klog/v2, which has its own flags
+			klogV2Flags := flag.NewFlagSet("klog/v2", flag.ExitOnError)
+			klogv2.InitFlags(klogV2Flags)
 
 			// Sync the glog and klog flags.
 			cmd.Flags().VisitAll(func(f1 *pflag.Flag) {
-				f2 := klogFlags.Lookup(f1.Name)
-				if f2 != nil {
-					value := f1.Value.String()
+				value := f1.Value.String()
+				if f2 := klogFlags.Lookup(f1.Name); f2 != nil {
+					f2.Value.Set(value)
+				}
+				if f2 := klogV2Flags.Lookup(f1.Name); f2 != nil {
 					f2.Value.Set(value)
 				}
 			})
@@ -81,6 +143,96 @@ func main() {
 	cmd.PersistentFlags().StringVar(&cloudConfigFlag, "cloud-config", "", "CSI driver cloud config")
 	cmd.MarkPersistentFlagRequired("cloud-config")
 
+	cmd.PersistentFlags().StringVar(&metricsAddrFlag, "metrics-address", "",
+		"address to serve prometheus metrics at /metrics, e.g. :9090; metrics are not served if empty")
+	cmd.PersistentFlags().BoolVar(&vcdInfoFlag, "debug-vcd-info", false,
+		"serve the VCD host, org, VDC, vApp and user of the driver, without secrets, at /debug/vcdinfo of the "+
+			"metrics address")
+
+	cmd.PersistentFlags().StringVar(&volumeNamePrefixFlag, "volume-name-prefix", "",
+		"prefix of the names of the disks created by the driver, to tell apart the disks of clusters sharing a VDC")
+
+	cmd.PersistentFlags().BoolVar(&dryRunFlag, "dry-run", false,
+		"log the disk operations that would modify VCD, such as creates and attaches, instead of running them")
+
+	cmd.PersistentFlags().StringVar(&diskDescriptionTemplateFlag, "disk-description-template", "",
+		"text/template of the descriptions of the disks created by the driver, e.g. "+
+			"'{{.ClusterID}}/{{.Namespace}}/{{.PVCName}}'; the descriptions identify the disks of the cluster if empty")
+
+	cmd.PersistentFlags().StringVar(&mirroredPVCKeysFlag, "mirrored-pvc-keys", "",
+		"comma-separated keys of the annotations, or else the labels, of PVCs that are copied to the metadata of "+
+			"their disks; requires --extra-create-metadata of the external-provisioner")
+
+	cmd.PersistentFlags().StringVar(&minVolumeSizeFlag, "min-volume-size", "",
+		"minimum size of the volumes created by the driver, e.g. 1Gi; volumes are not bounded below if empty")
+	cmd.PersistentFlags().StringVar(&maxVolumeSizeFlag, "max-volume-size", "",
+		"maximum size of the volumes created by the driver, e.g. 2Ti; volumes are not bounded above if empty")
+
+	cmd.PersistentFlags().BoolVar(&vAppScopedVMSearchFlag, "vapp-scoped-vm-search", false,
+		"find the VMs of the nodes only in the vApp of the cluster instead of also searching the whole VDC, "+
+			"e.g. for standalone VMs")
+
+	// the flag should be set for both the csi controller and the csi nodes
+	cmd.PersistentFlags().BoolVar(&vmIDTopologyFlag, "vm-id-topology", false,
+		"report the ID of the VM of a node in its topology, and find the VMs of the nodes by the IDs in the labels of "+
+			"the nodes instead of searching the VDC for their names")
+
+	cmd.PersistentFlags().Int64Var(&maxVolumesPerNodeFlag, "max-volumes-per-node", 15,
+		"most volumes that can be attached to a node, which the node reports to the scheduler; at most 60 for the "+
+			"4 SCSI buses of a VM")
+
+	cmd.PersistentFlags().IntVar(&attachDetachBusyRetriesFlag, "attach-detach-busy-retries", 3,
+		"number of times an attach or detach that VCD rejects because the VM is busy is retried; 0 disables retries")
+	cmd.PersistentFlags().BoolVar(&allowOfflineAttachFlag, "allow-offline-attach", false,
+		"attach disks to the VMs of nodes that are powered off, which VCD adds offline instead of hot-adding them; "+
+			"such attaches fail otherwise")
+
+	cmd.PersistentFlags().IntVar(&maxConcurrentOperationsFlag, "max-concurrent-operations", 0,
+		"most creations, deletions, resizes, attaches and detaches of disks that the controller runs in VCD at a "+
+			"time, beyond which requests wait until their deadline; not limited if 0")
+
+	cmd.PersistentFlags().DurationVar(&credentialsWatchIntervalFlag, "credentials-watch-interval", 0,
+		"interval at which the credentials secret mounted to "+config.CredentialsDir+" is checked for changes, "+
+			"e.g. a rotated password, which the VCD clients are updated with; 0 disables the check")
+
+	cmd.PersistentFlags().DurationVar(&detachWaitTimeoutFlag, "detach-wait-timeout", time.Minute,
+		"how long an unpublish waits for VCD to report a detached disk as no longer attached to the node, so that "+
+			"it can be attached to another node; 0 disables the wait")
+	cmd.PersistentFlags().DurationVar(&deleteTransitionTimeoutFlag, "delete-transition-timeout",
+		vcdcsiclient.DefaultDeleteTransitionTimeout,
+		"how long a delete waits for a disk that VCD reports as in use or in transition, e.g. while it is still "+
+			"being detached, to become deletable before failing with a retryable error")
+
+	cmd.PersistentFlags().DurationVar(&deviceReadyTimeoutFlag, "device-ready-timeout", 2*time.Minute,
+		"how long a stage waits for the device of a just attached disk to appear on the node before it fails")
+	cmd.PersistentFlags().DurationVar(&deviceReadyIntervalFlag, "device-ready-interval", time.Second,
+		"interval at which a stage looks for the device of a just attached disk on the node")
+
+	cmd.PersistentFlags().DurationVar(&startupJitterFlag, "startup-jitter", 0,
+		"longest random delay before the driver first authenticates to VCD, to spread the logins of the pods of a "+
+			"cluster that restart together, e.g. 30s; 0 disables the delay")
+
+	// events are opt-in and should only be recorded by the csi controller, whose service account may create them
+	cmd.PersistentFlags().BoolVar(&recordEventsFlag, "record-events", false,
+		"record Kubernetes events on the PVCs and PVs whose disks fail to be created, deleted, resized, attached or detached")
+
+	// the reaper is opt-in and should only be enabled for the csi controller
+	cmd.PersistentFlags().DurationVar(&reaperIntervalFlag, "orphaned-disk-reap-interval", 0,
+		"interval at which disks created by the driver without a PV are deleted; disks are not reaped if 0")
+	cmd.PersistentFlags().DurationVar(&reaperGracePeriodFlag, "orphaned-disk-grace-period", time.Hour,
+		"duration for which a disk should have no PV before it is reaped")
+
+	// the attachments are only tracked by the csi controller, which publishes and unpublishes the volumes
+	cmd.PersistentFlags().DurationVar(&attachmentReconcileIntervalFlag, "attachment-reconcile-interval", 0,
+		"interval at which the attachments of disks tracked in the attached disks metrics are corrected from VCD; "+
+			"attachments are not reconciled if 0")
+	cmd.PersistentFlags().DurationVar(&attachmentRepairIntervalFlag, "attachment-repair-interval", 0,
+		"interval at which disks attached to VMs that are no longer nodes of the cluster, without a "+
+			"VolumeAttachment, are force-detached; attachments are not repaired if 0")
+
+	// the check command tests the cloud config and the access to VCD without running the driver
+	cmd.AddCommand(newCheckCommand())
+
 	logs.InitLogs()
 	defer logs.FlushLogs()
 
@@ -93,6 +245,14 @@ func main() {
 
 func runCommand() {
 
+	var metricsMux *http.ServeMux
+	if metricsAddrFlag != "" {
+		metricsMux = http.NewServeMux()
+		go serveMetrics(metricsAddrFlag, metricsMux)
+	} else if vcdInfoFlag {
+		panic(fmt.Errorf("--debug-vcd-info needs --metrics-address"))
+	}
+
 	d, err := csi.NewDriver(nodeIDFlag, endpointFlag)
 	if err != nil {
 		panic(fmt.Errorf("unable to create new driver: [%v]", err))
@@ -103,15 +263,9 @@ func runCommand() {
 		panic(fmt.Errorf("ENV NODE_ID is not set"))
 	}
 
-	f, err := os.Open(cloudConfigFlag)
+	cloudConfig, err := loadCloudConfig(cloudConfigFlag)
 	if err != nil {
-		panic(fmt.Errorf("unable to read cloud config: [%v]", err))
-	}
-	defer f.Close()
-
-	cloudConfig, err := config.ParseCloudConfig(f)
-	if err != nil {
-		panic(fmt.Errorf("unable to parse configuration: [%v]", err))
+		panic(err)
 	}
 
 	for {
@@ -120,13 +274,217 @@ func runCommand() {
 			break
 		}
 
-		waitTime := 10 * time.Second
+		waitTime := 10*time.Second + jitter(5*time.Second)
 		klog.Infof("Unable to set authorization in config: [%v]", err)
 		klog.Infof("Waiting for [%v] before trying again...", waitTime)
 		time.Sleep(waitTime)
 	}
 
-	vcdClient, err := vcdsdk.NewVCDClientFromSecrets(
+	if startupJitterFlag > 0 {
+		startupDelay := jitter(startupJitterFlag)
+		klog.Infof("Waiting for [%v] before authenticating to VCD", startupDelay)
+		time.Sleep(startupDelay)
+	}
+	vcdClient, err := newVCDClientWithRetries(cloudConfig)
+	if err != nil {
+		panic(err)
+	}
+
+	if cloudConfig.ClusterID == "" {
+		cloudConfig.ClusterID = os.Getenv("CLUSTER_ID")
+		klog.Infof("Using ClusterID [%s] from env since config has an empty string", cloudConfig.ClusterID)
+	}
+
+	if err = vcdcsiclient.ValidateVolumeNamePrefix(volumeNamePrefixFlag); err != nil {
+		panic(fmt.Errorf("invalid --volume-name-prefix: [%v]", err))
+	}
+	diskManager := &vcdcsiclient.DiskManager{
+		VCDClient:               vcdClient,
+		ClusterID:               cloudConfig.ClusterID,
+		VAppName:                cloudConfig.VCD.VAppName,
+		DryRun:                  dryRunFlag,
+		VolumeNamePrefix:        volumeNamePrefixFlag,
+		VAppScopedVMSearch:      vAppScopedVMSearchFlag,
+		AllowOfflineAttach:      allowOfflineAttachFlag,
+		DeleteTransitionTimeout: deleteTransitionTimeoutFlag,
+	}
+	if deleteTransitionTimeoutFlag <= 0 {
+		panic(fmt.Errorf("--delete-transition-timeout [%v] should be positive", deleteTransitionTimeoutFlag))
+	}
+	if vAppScopedVMSearchFlag && cloudConfig.VCD.VAppName == "" {
+		panic(fmt.Errorf("--vapp-scoped-vm-search needs the vAppName of the cloud config"))
+	}
+	if vcdInfoFlag {
+		metricsMux.Handle(vcdcsiclient.VCDInfoPath, vcdcsiclient.NewVCDInfoHandler(diskManager))
+	}
+	if dryRunFlag {
+		klog.Infof("Running in dry run mode: disks will not be created, deleted, resized, attached or detached")
+	}
+	if diskDescriptionTemplateFlag != "" {
+		// the reaper only deletes the disks with the default description, which identifies the disks of the cluster
+		if reaperIntervalFlag > 0 {
+			panic(fmt.Errorf("--disk-description-template cannot be set with --orphaned-disk-reap-interval"))
+		}
+		diskDescriptionTemplate, err := csi.ParseDiskDescriptionTemplate(diskDescriptionTemplateFlag)
+		if err != nil {
+			panic(fmt.Errorf("invalid --disk-description-template: [%v]", err))
+		}
+		d.SetDiskDescriptionTemplate(diskDescriptionTemplate)
+	}
+	minVolumeSizeBytes, err := csi.ParseVolumeSize(minVolumeSizeFlag)
+	if err != nil {
+		panic(fmt.Errorf("invalid --min-volume-size: [%v]", err))
+	}
+	maxVolumeSizeBytes, err := csi.ParseVolumeSize(maxVolumeSizeFlag)
+	if err != nil {
+		panic(fmt.Errorf("invalid --max-volume-size: [%v]", err))
+	}
+	if err = d.SetVolumeSizeLimits(minVolumeSizeBytes, maxVolumeSizeBytes); err != nil {
+		panic(fmt.Errorf("invalid volume size limits: [%v]", err))
+	}
+	if err = d.SetMaxVolumesPerNode(maxVolumesPerNodeFlag); err != nil {
+		panic(fmt.Errorf("invalid --max-volumes-per-node: [%v]", err))
+	}
+	if err = d.SetAttachDetachBusyRetries(attachDetachBusyRetriesFlag); err != nil {
+		panic(fmt.Errorf("invalid --attach-detach-busy-retries: [%v]", err))
+	}
+	if err = d.SetMaxConcurrentOperations(maxConcurrentOperationsFlag); err != nil {
+		panic(fmt.Errorf("invalid --max-concurrent-operations: [%v]", err))
+	}
+	if err = d.SetDetachWaitTimeout(detachWaitTimeoutFlag); err != nil {
+		panic(fmt.Errorf("invalid --detach-wait-timeout: [%v]", err))
+	}
+	if err = d.SetDeviceReadyPolling(deviceReadyTimeoutFlag, deviceReadyIntervalFlag); err != nil {
+		panic(fmt.Errorf("invalid --device-ready-timeout or --device-ready-interval: [%v]", err))
+	}
+	if vmIDTopologyFlag {
+		nodeVMIDReader, err := csi.NewNodeVMIDReader()
+		if err != nil {
+			panic(fmt.Errorf("unable to create reader of VM IDs of nodes: [%v]", err))
+		}
+		d.SetVMIDTopology(nodeVMIDReader)
+	}
+	if mirroredPVCKeysFlag != "" {
+		pvcMetadataReader, err := csi.NewPVCMetadataReader()
+		if err != nil {
+			panic(fmt.Errorf("unable to create reader of PVCs: [%v]", err))
+		}
+		if err = d.SetMirroredPVCKeys(pvcMetadataReader, strings.Split(mirroredPVCKeysFlag, ",")); err != nil {
+			panic(fmt.Errorf("invalid --mirrored-pvc-keys: [%v]", err))
+		}
+	}
+	if recordEventsFlag {
+		eventRecorder, err := csi.NewEventRecorder()
+		if err != nil {
+			panic(fmt.Errorf("unable to create recorder of events: [%v]", err))
+		}
+		d.SetEventRecorder(eventRecorder)
+	}
+	if err = d.Setup(diskManager, cloudConfig.VCD.VAppName, nodeID, upgradeRDEFlag); err != nil {
+		panic(fmt.Errorf("error while setting up driver: [%v]", err))
+	}
+
+	if credentialsWatchIntervalFlag > 0 {
+		watcher, err := csi.NewCredentialsWatcher(vcdClient, cloudConfig, config.CredentialsDir,
+			credentialsWatchIntervalFlag)
+		if err != nil {
+			panic(fmt.Errorf("unable to create watcher of credentials: [%v]", err))
+		}
+		go watcher.Run(context.Background())
+	}
+
+	if reaperIntervalFlag > 0 {
+		reaper, err := csi.NewDiskReaper(diskManager, reaperIntervalFlag, reaperGracePeriodFlag)
+		if err != nil {
+			panic(fmt.Errorf("unable to create reaper of orphaned disks: [%v]", err))
+		}
+		go reaper.Run(context.Background())
+	}
+
+	if attachmentReconcileIntervalFlag > 0 {
+		go func() {
+			if err := d.RunAttachmentReconciler(context.Background(), attachmentReconcileIntervalFlag); err != nil {
+				klog.Errorf("unable to reconcile attachments of disks: [%v]", err)
+			}
+		}()
+	}
+
+	if attachmentRepairIntervalFlag > 0 {
+		repairer, err := d.NewAttachmentRepairer(attachmentRepairIntervalFlag)
+		if err != nil {
+			panic(fmt.Errorf("unable to create repairer of attachments: [%v]", err))
+		}
+		go repairer.Run(context.Background())
+	}
+
+	// the VCD sessions of the clients are logged out on shutdown, since VCD limits the sessions of a user
+	go closeClientsOnSignal()
+
+	// blocking call
+	if err = d.Run(); err != nil {
+		panic(fmt.Errorf("error while running driver: [%v]", err))
+	}
+}
+
+// loadCloudConfig reads and parses the cloud config at path
+func loadCloudConfig(path string) (*config.CloudConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read cloud config: [%v]", err)
+	}
+	defer f.Close()
+
+	cloudConfig, err := config.ParseCloudConfig(f)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse configuration: [%v]", err)
+	}
+
+	return cloudConfig, nil
+}
+
+// newVCDClient creates the VCD client of the cluster from cloudConfig, whose authorization should be set
+func newVCDClient(cloudConfig *config.CloudConfig) (*vcdcsiclient.Client, error) {
+	insecure := true
+	var clientOptions []vcdcsiclient.ClientOption
+	if cloudConfig.VCD.CACertFile != "" {
+		caCert, err := ioutil.ReadFile(cloudConfig.VCD.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA certificate [%s]: [%v]", cloudConfig.VCD.CACertFile, err)
+		}
+		insecure = false
+		clientOptions = append(clientOptions, vcdcsiclient.WithCACert(caCert))
+	}
+	if cloudConfig.VCD.APIVersion != "" {
+		clientOptions = append(clientOptions, vcdcsiclient.WithAPIVersion(cloudConfig.VCD.APIVersion))
+	}
+	if cloudConfig.VCD.ProxyURL != "" {
+		clientOptions = append(clientOptions, vcdcsiclient.WithProxyURL(cloudConfig.VCD.ProxyURL))
+	}
+	if cloudConfig.VCD.HTTPTimeout != 0 {
+		clientOptions = append(clientOptions, vcdcsiclient.WithHTTPTimeout(cloudConfig.VCD.HTTPTimeout))
+	}
+	if cloudConfig.VCD.OrgVDCCacheTTL != 0 {
+		clientOptions = append(clientOptions, vcdcsiclient.WithOrgVDCCacheTTL(cloudConfig.VCD.OrgVDCCacheTTL))
+	}
+	if len(cloudConfig.VCD.FailoverHosts) > 0 {
+		clientOptions = append(clientOptions, vcdcsiclient.WithFailoverHosts(cloudConfig.VCD.FailoverHosts...))
+	}
+	if cloudConfig.VCD.OperationOrg != "" {
+		clientOptions = append(clientOptions, vcdcsiclient.WithOperationOrg(cloudConfig.VCD.OperationOrg))
+	}
+	if cloudConfig.VCD.MaxAPIRequestsPerSecond != 0 {
+		clientOptions = append(clientOptions,
+			vcdcsiclient.WithMaxAPIRequestsPerSecond(cloudConfig.VCD.MaxAPIRequestsPerSecond))
+	}
+	if cloudConfig.VCD.RefreshTokenFile != "" {
+		clientOptions = append(clientOptions, vcdcsiclient.WithRefreshTokenFile(cloudConfig.VCD.RefreshTokenFile))
+	}
+	if cloudConfig.VCD.DebugLogMaxBodyBytes != 0 {
+		clientOptions = append(clientOptions,
+			vcdcsiclient.WithDebugLogMaxBodyBytes(cloudConfig.VCD.DebugLogMaxBodyBytes))
+	}
+
+	vcdClient, err := vcdcsiclient.NewVCDClientFromSecrets(
 		cloudConfig.VCD.Host,
 		cloudConfig.VCD.Org,
 		cloudConfig.VCD.VDC,
@@ -134,27 +492,63 @@ func runCommand() {
 		cloudConfig.VCD.User,
 		cloudConfig.VCD.Secret,
 		cloudConfig.VCD.RefreshToken,
+		insecure,
 		true,
-		true,
+		clientOptions...,
 	)
 	if err != nil {
-		panic(fmt.Errorf("unable to initiate vcd client: [%v]", err))
+		return nil, fmt.Errorf("unable to initiate vcd client: [%v]", err)
 	}
 
-	if cloudConfig.ClusterID == "" {
-		cloudConfig.ClusterID = os.Getenv("CLUSTER_ID")
-		klog.Infof("Using ClusterID [%s] from env since config has an empty string", cloudConfig.ClusterID)
+	return vcdClient, nil
+}
+
+// newVCDClientWithRetries creates the VCD client of the cluster, trying again with a jittered exponential backoff
+// since VCD may reject the logins of many pods that start together
+func newVCDClientWithRetries(cloudConfig *config.CloudConfig) (*vcdcsiclient.Client, error) {
+	delay := startupAuthRetryDelay
+	for attempt := 1; ; attempt++ {
+		vcdClient, err := newVCDClient(cloudConfig)
+		if err == nil || attempt >= startupAuthAttempts {
+			return vcdClient, err
+		}
+
+		// wait between half and all of the delay
+		waitTime := delay/2 + jitter(delay/2)
+		klog.Infof("Unable to create VCD client on attempt [%d/%d]: [%v]; trying again in [%v]", attempt,
+			startupAuthAttempts, err, waitTime)
+		time.Sleep(waitTime)
+		delay *= 2
 	}
+}
 
-	if err = d.Setup(&vcdcsiclient.DiskManager{
-		VCDClient: vcdClient,
-		ClusterID: cloudConfig.ClusterID,
-	}, cloudConfig.VCD.VAppName, nodeID, upgradeRDEFlag); err != nil {
-		panic(fmt.Errorf("error while setting up driver: [%v]", err))
+// jitter returns a random duration between 0 and max
+func jitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
 	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
 
-	// blocking call
-	if err = d.Run(); err != nil {
-		panic(fmt.Errorf("error while running driver: [%v]", err))
+// closeClientsOnSignal closes the VCD clients and exits once the driver is asked to stop
+func closeClientsOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+
+	klog.Infof("Received signal [%v]; closing VCD clients", sig)
+	if err := vcdcsiclient.CloseClients(); err != nil {
+		klog.Errorf("unable to close VCD clients: [%v]", err)
+	}
+	os.Exit(0)
+}
+
+// serveMetrics serves the metrics with mux at addr. The debug handlers are added to mux once the driver is set up.
+func serveMetrics(addr string, mux *http.ServeMux) {
+	mux.Handle("/metrics", promhttp.Handler())
+
+	klog.Infof("Serving metrics at [%s/metrics]", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		klog.Errorf("unable to serve metrics at [%s]: [%v]", addr, err)
 	}
 }
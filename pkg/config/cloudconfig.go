@@ -12,7 +12,9 @@ import (
 	"io"
 	"io/ioutil"
 	"k8s.io/klog"
+	"path/filepath"
 	"strings"
+	"time"
 )
 
 // VCDConfig :
@@ -21,7 +23,40 @@ type VCDConfig struct {
 	VDC      string `yaml:"vdc"`
 	Org      string `yaml:"org"`
 	UserOrg  string // this defaults to Org or a prefix of User
-	VAppName string `yaml:"vAppName"`
+	VAppName string `yaml:"vAppName"` // this is empty if the VMs of the nodes are not in a vApp
+
+	// FailoverHosts are the hosts of the same VCD that the driver fails over to, in order, when the host that it
+	// authenticated with last is unreachable, e.g. the standby of an active/standby pair
+	FailoverHosts []string `yaml:"failoverHosts"`
+
+	// CACertFile is the path to a PEM encoded CA certificate used to verify the VCD host. If it is not set, the
+	// certificate of the VCD host is not verified.
+	CACertFile string `yaml:"caCertFile"`
+
+	// APIVersion is the VCD API version used by the driver. It defaults to the version supported by vcdsdk.
+	APIVersion string `yaml:"apiVersion"`
+
+	// ProxyURL is the proxy used to reach the VCD host. If it is not set, the proxy is obtained from the
+	// HTTPS_PROXY, HTTP_PROXY and NO_PROXY environment variables.
+	ProxyURL string `yaml:"proxyURL"`
+
+	// HTTPTimeout is the timeout of each request to the VCD host, e.g. "45s". It defaults to 30s.
+	HTTPTimeout time.Duration `yaml:"httpTimeout"`
+
+	// OrgVDCCacheTTL is how long the org and VDC are reused when the bearer token is refreshed, e.g. "10m". It
+	// defaults to 5m.
+	OrgVDCCacheTTL time.Duration `yaml:"orgVDCCacheTTL"`
+
+	// OperationOrg is the org that the disk operations of a system administrator run in, e.g. the org of the
+	// cluster. They run in the system org if it is not set.
+	OperationOrg string `yaml:"operationOrg"`
+
+	// MaxAPIRequestsPerSecond limits the rate of requests to the VCD host. The rate is not limited if it is not set.
+	MaxAPIRequestsPerSecond float64 `yaml:"maxAPIRequestsPerSecond"`
+
+	// DebugLogMaxBodyBytes is the length that the bodies of the requests to the VCD host and of its responses, which
+	// are logged with -v=6, are truncated to. It defaults to 4096.
+	DebugLogMaxBodyBytes int `yaml:"debugLogMaxBodyBytes"`
 
 	// The User, Secret and RefreshToken are obtained from a secret mounted to /etc/kubernetes/vcloud/basic-auth
 	// with files at username, password and refreshToken respectively.
@@ -30,8 +65,21 @@ type VCDConfig struct {
 	User         string
 	Secret       string
 	RefreshToken string
+	// RefreshTokenFile is the file that the RefreshToken was read from. The file is read again whenever the bearer
+	// token is refreshed, so that a rotated RefreshToken is used without restarting the driver.
+	RefreshTokenFile string
 }
 
+// CredentialsDir is the directory that the secret with the credentials of the VCD user is mounted to
+const CredentialsDir = "/etc/kubernetes/vcloud/basic-auth"
+
+// RefreshTokenFile is the file of the secret mounted to CredentialsDir that has the refresh token
+const RefreshTokenFile = CredentialsDir + "/refreshToken"
+
+// CredentialsFiles are the files of the secret mounted to a credentials directory that have the username, password
+// and refresh token, in that order
+var CredentialsFiles = []string{"username", "password", "refreshToken"}
+
 // CloudConfig contains the config that will be read from the secret
 type CloudConfig struct {
 	VCD       VCDConfig `yaml:"vcd"`
@@ -49,18 +97,30 @@ func ParseCloudConfig(configReader io.Reader) (*CloudConfig, error) {
 		return nil, fmt.Errorf("Unable to decode yaml file: [%v]", err)
 	}
 	config.VCD.Host = strings.TrimRight(config.VCD.Host, "/")
+	for i := range config.VCD.FailoverHosts {
+		config.VCD.FailoverHosts[i] = strings.TrimRight(config.VCD.FailoverHosts[i], "/")
+	}
 	return config, validateCloudConfig(config)
 }
 
 func SetAuthorization(config *CloudConfig) error {
-	refreshToken, err := ioutil.ReadFile("/etc/kubernetes/vcloud/basic-auth/refreshToken")
+	return SetAuthorizationFromDir(config, CredentialsDir)
+}
+
+// SetAuthorizationFromDir sets the credentials of config from the files of the secret mounted to dir
+func SetAuthorizationFromDir(config *CloudConfig, dir string) error {
+	refreshTokenFile := filepath.Join(dir, "refreshToken")
+	refreshToken, err := ioutil.ReadFile(refreshTokenFile)
 	if err != nil {
 		klog.Infof("Unable to get refresh token: [%v]", err)
 	} else {
 		config.VCD.RefreshToken = strings.TrimSuffix(string(refreshToken), "\n")
+		if config.VCD.RefreshToken != "" {
+			config.VCD.RefreshTokenFile = refreshTokenFile
+		}
 	}
 
-	username, err := ioutil.ReadFile("/etc/kubernetes/vcloud/basic-auth/username")
+	username, err := ioutil.ReadFile(filepath.Join(dir, "username"))
 	if err != nil {
 		klog.Infof("Unable to get username: [%v]", err)
 	} else {
@@ -76,7 +136,7 @@ func SetAuthorization(config *CloudConfig) error {
 		config.VCD.UserOrg = strings.TrimSuffix(config.VCD.Org, "\n")
 	}
 
-	secret, err := ioutil.ReadFile("/etc/kubernetes/vcloud/basic-auth/password")
+	secret, err := ioutil.ReadFile(filepath.Join(dir, "password"))
 	if err != nil {
 		klog.Infof("Unable to get password: [%v]", err)
 	} else {
@@ -113,8 +173,21 @@ func validateCloudConfig(config *CloudConfig) error {
 		return fmt.Errorf("need a valid vCloud Organization VDC")
 	}
 
-	if config.VCD.VAppName == "" {
-		return fmt.Errorf("need a valid vApp name")
+	if config.VCD.HTTPTimeout < 0 {
+		return fmt.Errorf("http timeout [%v] should not be negative", config.VCD.HTTPTimeout)
+	}
+
+	if config.VCD.OrgVDCCacheTTL < 0 {
+		return fmt.Errorf("org and VDC cache ttl [%v] should not be negative", config.VCD.OrgVDCCacheTTL)
+	}
+
+	if config.VCD.MaxAPIRequestsPerSecond < 0 {
+		return fmt.Errorf("max API requests per second [%v] should not be negative",
+			config.VCD.MaxAPIRequestsPerSecond)
+	}
+
+	if config.VCD.DebugLogMaxBodyBytes < 0 {
+		return fmt.Errorf("debug log max body bytes [%d] should not be negative", config.VCD.DebugLogMaxBodyBytes)
 	}
 
 	return nil
@@ -10,6 +10,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -36,6 +37,8 @@ func TestCloudConfig(t *testing.T) {
 		assert.NoError(t, err, "Error closing config file [%s], testConfigFilePath")
 	}()
 
-	_, err = ParseCloudConfig(configReader)
+	config, err := ParseCloudConfig(configReader)
 	assert.NoError(t, err, "Unable to parse config file")
+	assert.Equal(t, 45*time.Second, config.VCD.HTTPTimeout, "http timeout should be parsed as a duration")
+	assert.Equal(t, 10*time.Minute, config.VCD.OrgVDCCacheTTL, "org and VDC cache ttl should be parsed as a duration")
 }
@@ -0,0 +1,256 @@
+/*
+   Copyright 2021 VMware, Inc.
+   SPDX-License-Identifier: Apache-2.0
+*/
+
+package csi
+
+import (
+	"context"
+	"fmt"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"k8s.io/klog"
+	"net/http"
+	"time"
+)
+
+// attachmentLister lists the attachments of the volumes of the driver that the cluster expects, and the nodes of the
+// cluster
+type attachmentLister interface {
+	// ListExpectedAttachments returns the IDs of the nodes that each volume ID is expected to be attached to
+	ListExpectedAttachments(ctx context.Context) (map[string]map[string]bool, error)
+	ListNodeIDs(ctx context.Context) (map[string]bool, error)
+}
+
+// diskAttachment is the attachment of the disk of a volume to a VM
+type diskAttachment struct {
+	volumeID string
+	vmName   string
+}
+
+// AttachmentRepairer detaches the disks of the cluster from the VMs that are no longer nodes of the cluster, and that
+// no VolumeAttachment expects them to be attached to. Such attachments are left behind when a node is removed while a
+// disk is attached to its VM, and they make the attaches of the disk to other nodes fail.
+type AttachmentRepairer struct {
+	cs               *controllerServer
+	attachmentLister attachmentLister
+	interval         time.Duration
+
+	// suspected has the orphaned attachments found by the last check. An attachment is only detached if the next
+	// check still finds it orphaned, so that an attachment is not detached while its node registers.
+	suspected map[diskAttachment]bool
+}
+
+// NewAttachmentRepairer creates an AttachmentRepairer that checks the attachments of the disks of the cluster every
+// interval. It lists the VolumeAttachments, PVs and nodes with the service account of the pod.
+func (d *VCDDriver) NewAttachmentRepairer(interval time.Duration) (*AttachmentRepairer, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("attachment repair interval [%v] should be positive", interval)
+	}
+	cs, ok := d.cs.(*controllerServer)
+	if !ok {
+		return nil, fmt.Errorf("attachments cannot be repaired before the driver is set up")
+	}
+	if cs.DiskManager.GetClusterID() == "" {
+		return nil, fmt.Errorf("attachments cannot be repaired without a cluster ID to tell the disks of the cluster " +
+			"apart")
+	}
+
+	lister, err := newKubeAttachmentLister()
+	if err != nil {
+		return nil, fmt.Errorf("unable to create lister of attachments: [%v]", err)
+	}
+
+	return &AttachmentRepairer{
+		cs:               cs,
+		attachmentLister: lister,
+		interval:         interval,
+		suspected:        make(map[diskAttachment]bool),
+	}, nil
+}
+
+// Run repairs the attachments every interval until ctx is done
+func (repairer *AttachmentRepairer) Run(ctx context.Context) {
+	klog.Infof("Repairing orphaned attachments of disks every [%v]", repairer.interval)
+
+	ticker := time.NewTicker(repairer.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := repairer.repair(ctx); err != nil {
+				klog.Errorf("unable to repair attachments of disks: [%v]", err)
+			}
+		}
+	}
+}
+
+// repair detaches the disks of the cluster from the VMs that they were found orphaned on by the last check too, and
+// reports the VolumeAttachments of the nodes that no longer exist, which Kubernetes detaches once the node is gone
+func (repairer *AttachmentRepairer) repair(ctx context.Context) error {
+	cs := repairer.cs
+
+	// the disks are listed before the VolumeAttachments, which are created before their disks are attached, so that
+	// the attachments made in between are expected
+	disks, err := cs.DiskManager.ListDisksForCluster(cs.DiskManager.GetClusterID())
+	if err != nil {
+		return fmt.Errorf("unable to list disks of cluster [%s]: [%v]", cs.DiskManager.GetClusterID(), err)
+	}
+	expected, err := repairer.attachmentLister.ListExpectedAttachments(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to list VolumeAttachments of the cluster: [%v]", err)
+	}
+	nodeIDs, err := repairer.attachmentLister.ListNodeIDs(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to list nodes of the cluster: [%v]", err)
+	}
+
+	suspected := make(map[diskAttachment]bool)
+	for _, disk := range disks {
+		volumeID := cs.getVolumeID(cs.DiskManager, disk.Name)
+		attachedVMs := make(map[string]bool, len(disk.AttachedVMs))
+		for _, vmName := range disk.AttachedVMs {
+			attachedVMs[vmName] = true
+			// the volume handle of a static PV can be the URN of its disk instead of its name
+			if expected[volumeID][vmName] || expected[disk.ID][vmName] || nodeIDs[vmName] {
+				continue
+			}
+
+			attachment := diskAttachment{volumeID: volumeID, vmName: vmName}
+			if !repairer.suspected[attachment] {
+				klog.Warningf("Volume [%s] is attached to VM [%s], which is not a node of the cluster, without a "+
+					"VolumeAttachment; it will be force-detached if it still is at the next check", volumeID, vmName)
+				suspected[attachment] = true
+				continue
+			}
+
+			klog.Warningf("Force-detaching orphaned volume [%s] from VM [%s], which is not a node of the cluster",
+				volumeID, vmName)
+			if _, err = cs.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{
+				VolumeId: volumeID,
+				NodeId:   vmName,
+			}); err != nil {
+				klog.Errorf("unable to force-detach orphaned volume [%s] from VM [%s]; it may need to be detached "+
+					"in VCD: [%v]", volumeID, vmName, err)
+				suspected[attachment] = true
+				continue
+			}
+			klog.Warningf("Force-detached orphaned volume [%s] from VM [%s]", volumeID, vmName)
+		}
+
+		for _, expectedVolumeID := range []string{volumeID, disk.ID} {
+			for nodeID := range expected[expectedVolumeID] {
+				if !nodeIDs[nodeID] && !attachedVMs[nodeID] {
+					klog.Warningf("VolumeAttachment of volume [%s] to node [%s] is stale, since the node no longer "+
+						"exists and the disk is not attached to its VM", expectedVolumeID, nodeID)
+				}
+			}
+		}
+	}
+	repairer.suspected = suspected
+
+	return nil
+}
+
+// kubeAttachmentLister lists the VolumeAttachments of the driver and the nodes from the Kubernetes API of the cluster
+// that the pod runs in
+type kubeAttachmentLister struct {
+	client   *kubeAPIClient
+	pvLister *kubePVLister
+}
+
+func newKubeAttachmentLister() (*kubeAttachmentLister, error) {
+	client, err := newKubeAPIClient()
+	if err != nil {
+		return nil, err
+	}
+
+	return &kubeAttachmentLister{
+		client:   client,
+		pvLister: &kubePVLister{client: client},
+	}, nil
+}
+
+// volumeAttachmentList has the fields of a list of VolumeAttachments that are needed to find the expected attachments
+type volumeAttachmentList struct {
+	Metadata struct {
+		Continue string `json:"continue"`
+	} `json:"metadata"`
+	Items []struct {
+		Spec struct {
+			Attacher string `json:"attacher"`
+			NodeName string `json:"nodeName"`
+			Source   struct {
+				PersistentVolumeName string `json:"persistentVolumeName"`
+			} `json:"source"`
+		} `json:"spec"`
+	} `json:"items"`
+}
+
+// nodeList has the fields of a list of nodes that are needed to find the nodes of the cluster
+type nodeList struct {
+	Metadata struct {
+		Continue string `json:"continue"`
+	} `json:"metadata"`
+	Items []struct {
+		Metadata struct {
+			Name string `json:"name"`
+		} `json:"metadata"`
+	} `json:"items"`
+}
+
+// ListExpectedAttachments returns the nodes of the VolumeAttachments of the driver by the volume handles of their PVs.
+// The names of the nodes are the names of their VMs.
+func (lister *kubeAttachmentLister) ListExpectedAttachments(ctx context.Context) (map[string]map[string]bool, error) {
+	volumeIDsByPV, err := lister.pvLister.listVolumeIDsByPV(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	expected := make(map[string]map[string]bool)
+	continueToken := ""
+	for {
+		volumeAttachments := &volumeAttachmentList{}
+		if err = lister.client.do(ctx, http.MethodGet,
+			"/apis/storage.k8s.io/v1/volumeattachments?"+listQuery(continueToken), nil,
+			volumeAttachments); err != nil {
+			return nil, fmt.Errorf("unable to list VolumeAttachments: [%v]", err)
+		}
+		for _, volumeAttachment := range volumeAttachments.Items {
+			volumeID, ok := volumeIDsByPV[volumeAttachment.Spec.Source.PersistentVolumeName]
+			if volumeAttachment.Spec.Attacher != Name || !ok {
+				continue
+			}
+			if expected[volumeID] == nil {
+				expected[volumeID] = make(map[string]bool)
+			}
+			expected[volumeID][volumeAttachment.Spec.NodeName] = true
+		}
+		if volumeAttachments.Metadata.Continue == "" {
+			return expected, nil
+		}
+		continueToken = volumeAttachments.Metadata.Continue
+	}
+}
+
+// ListNodeIDs returns the names of the nodes of the cluster, which are the names of their VMs
+func (lister *kubeAttachmentLister) ListNodeIDs(ctx context.Context) (map[string]bool, error) {
+	nodeIDs := make(map[string]bool)
+	continueToken := ""
+	for {
+		nodes := &nodeList{}
+		if err := lister.client.do(ctx, http.MethodGet, "/api/v1/nodes?"+listQuery(continueToken), nil,
+			nodes); err != nil {
+			return nil, fmt.Errorf("unable to list nodes: [%v]", err)
+		}
+		for _, kubeNode := range nodes.Items {
+			nodeIDs[kubeNode.Metadata.Name] = true
+		}
+		if nodes.Metadata.Continue == "" {
+			return nodeIDs, nil
+		}
+		continueToken = nodes.Metadata.Continue
+	}
+}
@@ -0,0 +1,258 @@
+/*
+   Copyright 2021 VMware, Inc.
+   SPDX-License-Identifier: Apache-2.0
+*/
+
+package csi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/vmware/cloud-director-named-disk-csi-driver/pkg/vcdcsiclient"
+	"k8s.io/klog"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	attachedDisksGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "vcd_csi",
+			Name:      "attached_disks",
+			Help:      "Number of disks attached to the VM of each node, as tracked by the controller.",
+		},
+		[]string{"node"},
+	)
+	clusterAttachedDisksGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "vcd_csi",
+			Name:      "cluster_attached_disks",
+			Help: "Number of attachments of disks to the VMs of the nodes of the cluster, as tracked by the " +
+				"controller. A shareable disk counts once for each node.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(attachedDisksGauge, clusterAttachedDisksGauge)
+}
+
+// attachmentTracker tracks the volumes attached to each node from the publishes and unpublishes of the controller,
+// and reports them in the attached disks metrics. The attachments are reconciled with VCD, since volumes can be
+// attached or detached outside of the driver, and the controller does not know of the attachments made before it
+// started.
+type attachmentTracker struct {
+	lock sync.Mutex
+	// volumesByNode has the IDs of the volumes attached to each node
+	volumesByNode map[string]map[string]bool
+	// changed has the volumes that were published or unpublished since the reconciliation in progress started, if
+	// any, whose attachments it should keep since VCD may have reported them before the change
+	changed map[string]bool
+}
+
+func newAttachmentTracker() *attachmentTracker {
+	return &attachmentTracker{volumesByNode: make(map[string]map[string]bool)}
+}
+
+// attached records that the volume volumeID was published to the node nodeID
+func (tracker *attachmentTracker) attached(volumeID string, nodeID string) {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	if tracker.volumesByNode[nodeID] == nil {
+		tracker.volumesByNode[nodeID] = make(map[string]bool)
+	}
+	tracker.volumesByNode[nodeID][volumeID] = true
+	tracker.markChanged(volumeID)
+	tracker.updateMetrics()
+}
+
+// detached records that the volume volumeID was unpublished from the node nodeID
+func (tracker *attachmentTracker) detached(volumeID string, nodeID string) {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	delete(tracker.volumesByNode[nodeID], volumeID)
+	tracker.markChanged(volumeID)
+	tracker.updateMetrics()
+}
+
+// markChanged keeps the change of the attachments of volumeID from the reconciliation in progress. The caller should
+// hold tracker.lock.
+func (tracker *attachmentTracker) markChanged(volumeID string) {
+	if tracker.changed != nil {
+		tracker.changed[volumeID] = true
+	}
+}
+
+// startReconcile returns the IDs of the tracked volumes, whose attachments are compared with those VCD reports
+func (tracker *attachmentTracker) startReconcile() []string {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	tracker.changed = make(map[string]bool)
+	volumes := make(map[string]bool)
+	for _, nodeVolumes := range tracker.volumesByNode {
+		for volumeID := range nodeVolumes {
+			volumes[volumeID] = true
+		}
+	}
+	volumeIDs := make([]string, 0, len(volumes))
+	for volumeID := range volumes {
+		volumeIDs = append(volumeIDs, volumeID)
+	}
+	sort.Strings(volumeIDs)
+
+	return volumeIDs
+}
+
+// finishReconcile replaces the tracked attachments of the volumes of nodesByVolume with the nodes that VCD reports
+// them attached to, except for the volumes published or unpublished since the reconciliation started. It returns the
+// number of attachments that were corrected.
+func (tracker *attachmentTracker) finishReconcile(nodesByVolume map[string][]string) int {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	changed := tracker.changed
+	tracker.changed = nil
+
+	corrected := 0
+	for volumeID, nodeIDs := range nodesByVolume {
+		if changed[volumeID] {
+			continue
+		}
+		attachedNodes := make(map[string]bool, len(nodeIDs))
+		for _, nodeID := range nodeIDs {
+			attachedNodes[nodeID] = true
+			if !tracker.volumesByNode[nodeID][volumeID] {
+				klog.Infof("Volume [%s] is attached to node [%s] in VCD but was not tracked as attached",
+					volumeID, nodeID)
+				if tracker.volumesByNode[nodeID] == nil {
+					tracker.volumesByNode[nodeID] = make(map[string]bool)
+				}
+				tracker.volumesByNode[nodeID][volumeID] = true
+				corrected++
+			}
+		}
+		for nodeID, nodeVolumes := range tracker.volumesByNode {
+			if nodeVolumes[volumeID] && !attachedNodes[nodeID] {
+				klog.Infof("Volume [%s] was tracked as attached to node [%s] but is not attached in VCD",
+					volumeID, nodeID)
+				delete(nodeVolumes, volumeID)
+				corrected++
+			}
+		}
+	}
+	tracker.updateMetrics()
+
+	return corrected
+}
+
+// attachedCount returns the number of volumes tracked as attached to the node nodeID
+func (tracker *attachmentTracker) attachedCount(nodeID string) int {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	return len(tracker.volumesByNode[nodeID])
+}
+
+// updateMetrics sets the attached disks metrics from the tracked attachments. The nodes without attached volumes are
+// dropped from the metrics. The caller should hold tracker.lock.
+func (tracker *attachmentTracker) updateMetrics() {
+	total := 0
+	for nodeID, nodeVolumes := range tracker.volumesByNode {
+		if len(nodeVolumes) == 0 {
+			delete(tracker.volumesByNode, nodeID)
+			attachedDisksGauge.DeleteLabelValues(nodeID)
+			continue
+		}
+		attachedDisksGauge.WithLabelValues(nodeID).Set(float64(len(nodeVolumes)))
+		total += len(nodeVolumes)
+	}
+	clusterAttachedDisksGauge.Set(float64(total))
+}
+
+// RunAttachmentReconciler reconciles the attachments tracked by the controller with those of VCD right away and then
+// every interval until ctx is done
+func (d *VCDDriver) RunAttachmentReconciler(ctx context.Context, interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("attachment reconcile interval [%v] should be positive", interval)
+	}
+	cs, ok := d.cs.(*controllerServer)
+	if !ok {
+		return fmt.Errorf("attachments cannot be reconciled before the driver is set up")
+	}
+
+	klog.Infof("Reconciling attachments of disks with VCD every [%v]", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := cs.reconcileAttachments(); err != nil {
+			klog.Errorf("unable to reconcile attachments of disks: [%v]", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// reconcileAttachments corrects the tracked attachments with the VMs that VCD reports the disks attached to. The
+// disks of the cluster are listed with their attachments, and the other tracked disks, such as those of static PVs or
+// of other VDCs, are read one at a time.
+func (cs *controllerServer) reconcileAttachments() error {
+	trackedVolumeIDs := cs.attachments.startReconcile()
+
+	nodesByVolume := make(map[string][]string)
+	if clusterID := cs.DiskManager.GetClusterID(); clusterID != "" {
+		disks, err := cs.DiskManager.ListDisksForCluster(clusterID)
+		if err != nil {
+			cs.attachments.finishReconcile(nil)
+			return fmt.Errorf("unable to list disks of cluster [%s]: [%v]", clusterID, err)
+		}
+		for _, disk := range disks {
+			nodesByVolume[disk.Name] = disk.AttachedVMs
+		}
+	}
+	for _, volumeID := range trackedVolumeIDs {
+		if _, ok := nodesByVolume[volumeID]; ok {
+			continue
+		}
+		nodeIDs, err := cs.getVolumeAttachedNodes(volumeID)
+		if err != nil {
+			// the tracked attachments of the volume are kept until it can be read
+			klog.Errorf("unable to find nodes that volume [%s] is attached to: [%v]", volumeID, err)
+			continue
+		}
+		nodesByVolume[volumeID] = nodeIDs
+	}
+
+	if corrected := cs.attachments.finishReconcile(nodesByVolume); corrected > 0 {
+		klog.Infof("Corrected [%d] tracked attachments of disks from VCD", corrected)
+	}
+	return nil
+}
+
+// getVolumeAttachedNodes returns the node IDs of the VMs that the disk of the volume volumeID is attached to, which
+// are none if the disk does not exist
+func (cs *controllerServer) getVolumeAttachedNodes(volumeID string) ([]string, error) {
+	diskManager, diskName, err := cs.getVolumeDiskManager(volumeID)
+	if err != nil {
+		return nil, err
+	}
+
+	disk, err := diskManager.GetDiskByName(diskName)
+	if err != nil {
+		if errors.Is(err, vcdcsiclient.ErrDiskNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return disk.AttachedVMs, nil
+}
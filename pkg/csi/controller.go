@@ -7,16 +7,19 @@ package csi
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/vmware/cloud-director-named-disk-csi-driver/pkg/util"
 	"github.com/vmware/cloud-director-named-disk-csi-driver/pkg/vcdcsiclient"
-	"github.com/vmware/cloud-provider-for-cloud-director/pkg/vcdsdk"
-	"github.com/vmware/go-vcloud-director/v2/govcd"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
 	"k8s.io/klog"
-	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 )
 
 const (
@@ -25,20 +28,74 @@ const (
 	DefaultDiskSizeInGb = int64(1)
 )
 
+// allocations of the disks that the parameter allocation names, of which only thin can be required
+const (
+	AllocationThin        = "thin"
+	AllocationThick       = "thick"
+	AllocationEagerZeroed = "eagerzeroed"
+)
+
 const (
 	BusTypeParameter        = "busType"
 	BusSubTypeParameter     = "busSubType"
+	BusNumberParameter      = "busNumber"
+	UnitNumberParameter     = "unitNumber"
 	StorageProfileParameter = "storageProfile"
 	FileSystemParameter     = "filesystem"
+	ShareableParameter      = "shareable"
+	SharingTypeParameter    = "sharingType"
+	IopsParameter           = "iops"
+	AllocationParameter     = "allocation"
+	VDCParameter            = "vdc"
 	EphemeralVolumeContext  = "csi.storage.k8s.io/ephemeral"
 
+	// EncryptionPolicyParameter is the name or the URN of the VCD encryption policy that the disk is encrypted at rest
+	// with, which VCD 10.4 added
+	EncryptionPolicyParameter = "encryptionPolicy"
+
+	// parameters set by the external-provisioner when it runs with --extra-create-metadata
+	PVCNameParameter      = "csi.storage.k8s.io/pvc/name"
+	PVCNamespaceParameter = "csi.storage.k8s.io/pvc/namespace"
+	PVNameParameter       = "csi.storage.k8s.io/pv/name"
+
+	// metadata keys of the disks that relate them to their PVC
+	PVCNameMetadataKey      = "k8s-pvc-name"
+	PVCNamespaceMetadataKey = "k8s-namespace"
+	PVNameMetadataKey       = "k8s-pv-name"
+	ClusterIDMetadataKey    = vcdcsiclient.ClusterIDMetadataKey
+	// VolumeModeMetadataKey records whether the disk was created for a block or a filesystem volume
+	VolumeModeMetadataKey = "k8s-volume-mode"
+
+	VolumeModeBlock      = "Block"
+	VolumeModeFilesystem = "Filesystem"
+
 	DiskIDAttribute     = "diskID"
 	VMFullNameAttribute = "vmID"
 	DiskUUIDAttribute   = "diskUUID"
 	FileSystemAttribute = "filesystem"
+	// VDCAttribute is the VDC of the disk of a volume, which is set in the volume context for the node
+	VDCAttribute = "vdc"
+	// EncryptedAttribute is whether VCD encrypts the disk of a volume at rest, which is set in the volume context
+	EncryptedAttribute = "encrypted"
+	// ReadOnlyAttribute is set in the publish context of a volume published read-only, so that the node stages it
+	// read-only as well
+	ReadOnlyAttribute = "readonly"
+)
+
+const (
+	// DefaultFileSystem is used for volumes for which neither the StorageClass nor the capability sets a filesystem
+	DefaultFileSystem = "ext4"
 )
 
 var (
+	// SupportedFileSystems are the filesystems that volumes can be formatted with and grown on the node
+	SupportedFileSystems = map[string]bool{
+		"ext2": true,
+		"ext3": true,
+		"ext4": true,
+		"xfs":  true,
+	}
+
 	// BusTypesFromValues is a map of different possible BusTypes from id to string
 	BusTypesFromValues = map[string]string{
 		"5":  "IDE",
@@ -49,19 +106,28 @@ var (
 
 type controllerServer struct {
 	Driver      *VCDDriver
-	DiskManager *vcdcsiclient.DiskManager
-	VAppName    string
+	DiskManager vcdcsiclient.VCDDiskManager
+
+	// vdcDiskManagers are the disk managers of the VDCs other than the configured one that volumes are in
+	vdcDiskManagersLock sync.Mutex
+	vdcDiskManagers     map[string]vcdcsiclient.VCDDiskManager
+
+	vmLocks vmLocks
+	// operations bounds the mutating VCD operations in flight
+	operations *operationLimiter
+	// attachments are the volumes published to each node, which are reported in the attached disks metrics
+	attachments *attachmentTracker
 }
 
-// NewControllerService creates a controllerService
-func NewControllerService(driver *VCDDriver, vcdClient *vcdsdk.Client, clusterID string, vAppName string) csi.ControllerServer {
+// NewControllerService creates a controllerService that manages the disks with diskManager, whose settings are
+// also used for the disks of other VDCs
+func NewControllerService(driver *VCDDriver, diskManager vcdcsiclient.VCDDiskManager) csi.ControllerServer {
 	return &controllerServer{
-		Driver: driver,
-		DiskManager: &vcdcsiclient.DiskManager{
-			VCDClient: vcdClient,
-			ClusterID: clusterID,
-		},
-		VAppName: vAppName,
+		Driver:          driver,
+		DiskManager:     diskManager,
+		vdcDiskManagers: make(map[string]vcdcsiclient.VCDDiskManager),
+		attachments:     newAttachmentTracker(),
+		operations:      newOperationLimiter(driver.maxConcurrentOperations),
 	}
 }
 
@@ -79,85 +145,625 @@ func (cs *controllerServer) isDiskShareable(volumeCapabilities []*csi.VolumeCapa
 	return false
 }
 
+// containsString returns whether the node IDs nodeIDs, e.g. those that a disk is attached to, contain nodeID
+func containsString(nodeIDs []string, nodeID string) bool {
+	for _, id := range nodeIDs {
+		if id == nodeID {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (cs *controllerServer) CreateVolume(ctx context.Context,
 	req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
 	if req == nil {
 		return nil, status.Errorf(codes.InvalidArgument, "CreateVolume: req should not be nil")
 	}
 
-	klog.Infof("CreateVolume: called with req [%#v]", *req)
+	klog.Infof("CreateVolume: called with req [%v]", redactSecrets(req))
 
-	if err := cs.DiskManager.VCDClient.RefreshBearerToken(); err != nil {
+	// the disk is created in the VDC of the StorageClass, or else in the VDC of the nodes that the volume should be
+	// accessible from
+	vdcName := getRequestedVDC(req.GetAccessibilityRequirements())
+	if vdcParameter, ok := req.GetParameters()[VDCParameter]; ok {
+		if !isVDCAccessible(req.GetAccessibilityRequirements(), vdcParameter) {
+			return nil, status.Errorf(codes.InvalidArgument,
+				"CreateVolume: VDC [%s] of parameter [%s] is not in the requisite topologies [%v]", vdcParameter,
+				VDCParameter, req.GetAccessibilityRequirements().GetRequisite())
+		}
+		vdcName = vdcParameter
+	}
+	diskManager, err := cs.getDiskManagerForVDC(vdcName)
+	if err != nil {
+		return nil, status.Errorf(vdcErrorCode(err),
+			"CreateVolume: unable to use VDC [%s] of the accessibility requirements: [%v]", vdcName, err)
+	}
+	if err = diskManager.RefreshBearerTokenWithContext(ctx); err != nil {
 		return nil, fmt.Errorf("error while obtaining access token: [%v]", err)
 	}
 
-	diskName := req.GetName()
-	if len(diskName) == 0 {
+	if len(req.GetName()) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Volume name not provided")
 	}
+	diskName := diskManager.GetDiskName(req.GetName())
 
 	volumeCapabilities := req.GetVolumeCapabilities()
 	if volumeCapabilities == nil || len(volumeCapabilities) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "CreateVolume: VolumeCapabilities should be provided")
 	}
+	// the fsType of the mount capabilities is set from the csi.storage.k8s.io/fstype parameter of the StorageClass
+	fsType := req.GetParameters()[FileSystemParameter]
 	for _, volumeCapability := range volumeCapabilities {
 		if _, ok := VolumeCapabilityAccessModesStringMap[volumeCapability.AccessMode.Mode.String()]; !ok {
 			return nil, status.Errorf(codes.Unavailable, "CreateVolume: volume capability [%s] not supported",
 				volumeCapability.String())
 		}
+		capabilityFsType := volumeCapability.GetMount().GetFsType()
+		if capabilityFsType == "" {
+			continue
+		}
+		if fsType == "" {
+			fsType = capabilityFsType
+		} else if fsType != capabilityFsType {
+			return nil, status.Errorf(codes.InvalidArgument,
+				"CreateVolume: fs type [%s] of volume capability does not match fs type [%s]",
+				capabilityFsType, fsType)
+		}
+	}
+	if fsType == "" {
+		fsType = DefaultFileSystem
+		klog.Infof("No FS specified for raw disk [%s]. Hence defaulting to [%s].", diskName, fsType)
+	}
+	if !SupportedFileSystems[fsType] {
+		return nil, status.Errorf(codes.InvalidArgument, "CreateVolume: fs type [%s] not supported", fsType)
+	}
+	if _, err := parseMkfsOptions(req.GetParameters()[MkfsOptionsParameter], fsType); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "CreateVolume: invalid parameter [%s]: [%v]",
+			MkfsOptionsParameter, err)
+	}
+
+	// a volume is restored from a snapshot of a disk of its VDC, or cloned from a volume of its VDC, since VCD
+	// creates a disk from a snapshot or a copy of a disk in the VDC of the source disk
+	contentSource := req.GetVolumeContentSource()
+	var snapshot *vcdcsiclient.DiskSnapshot
+	var sourceDisk *vcdcsiclient.Disk
+	source := ""
+	if snapshotSource := contentSource.GetSnapshot(); snapshotSource != nil {
+		if snapshot, sourceDisk, err = cs.getSourceSnapshot(diskManager, snapshotSource.GetSnapshotId()); err != nil {
+			return nil, err
+		}
+		source = fmt.Sprintf("snapshot [%s]", snapshotSource.GetSnapshotId())
+	}
+	if volumeSource := contentSource.GetVolume(); volumeSource != nil {
+		if sourceDisk, err = cs.getSourceVolume(diskManager, volumeSource.GetVolumeId()); err != nil {
+			return nil, err
+		}
+		source = fmt.Sprintf("volume [%s]", volumeSource.GetVolumeId())
 	}
 
 	shareable := cs.isDiskShareable(volumeCapabilities)
+	if shareableParameter, ok := req.GetParameters()[ShareableParameter]; ok {
+		requestedShareable, err := strconv.ParseBool(shareableParameter)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "CreateVolume: invalid value [%s] of parameter [%s]: [%v]",
+				shareableParameter, ShareableParameter, err)
+		}
+		if shareable && !requestedShareable {
+			return nil, status.Errorf(codes.InvalidArgument,
+				"CreateVolume: multi-node access modes cannot be provided by a disk that is not shareable")
+		}
+		shareable = requestedShareable
+	}
+	sharingType, err := getSharingType(req.GetParameters(), shareable)
+	if err != nil {
+		return nil, err
+	}
+	if sharingType != "" && sharingType != vcdcsiclient.DiskSharingTypeNone {
+		shareable = true
+	}
 
 	var volSizeBytes int64 = DefaultDiskSizeInGb * GbToBytes
+	// a volume without a requested size should not be rejected for being smaller than the minimum of the driver
+	if volSizeBytes < cs.Driver.minVolumeSizeBytes {
+		volSizeBytes = cs.Driver.minVolumeSizeBytes
+	}
 	if req.GetCapacityRange() != nil && req.GetCapacityRange().RequiredBytes != 0 {
 		volSizeBytes = req.GetCapacityRange().GetRequiredBytes()
 	}
-	sizeMB := int64(math.Ceil(float64(volSizeBytes) / float64(MbToBytes)))
-	klog.Infof("CreateVolume: requesting volume [%s] with size [%d] MiB, shareable [%v]",
-		diskName, sizeMB, shareable)
+	if err := cs.Driver.checkVolumeSize(volSizeBytes); err != nil {
+		return nil, status.Errorf(codes.OutOfRange, "CreateVolume: volume [%s]: %v", diskName, err)
+	}
+	sizeMB := bytesToMB(volSizeBytes)
+	// a volume restored from a snapshot or cloned from a volume is at least as large as its source
+	if snapshot != nil && sizeMB < snapshot.SizeMB {
+		sizeMB = snapshot.SizeMB
+	} else if snapshot == nil && sourceDisk != nil && sizeMB < sourceDisk.SizeMB {
+		sizeMB = sourceDisk.SizeMB
+	}
+	if err := checkCapacityLimit(sizeMB, req.GetCapacityRange().GetLimitBytes()); err != nil {
+		return nil, status.Errorf(codes.OutOfRange, "CreateVolume: volume [%s]: %v", diskName, err)
+	}
+	klog.Infof("CreateVolume: requesting volume [%s] with size [%d] MiB, shareable [%v], sharing type [%s]",
+		diskName, sizeMB, shareable, sharingType)
 
+	// the node finds the device of a disk by its SCSI UUID, hence disks are only attached to SCSI adapters
 	busType := vcdcsiclient.VCDBusTypeSCSI
+	if busTypeParameter, ok := req.GetParameters()[BusTypeParameter]; ok &&
+		busTypeParameter != BusTypesFromValues[busType] {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"CreateVolume: value [%s] of parameter [%s] should be [%s]", busTypeParameter, BusTypeParameter,
+			BusTypesFromValues[busType])
+	}
 	busSubType := vcdcsiclient.VCDBusSubTypeVirtualSCSI
+	if busSubTypeParameter, ok := req.GetParameters()[BusSubTypeParameter]; ok {
+		if _, ok = vcdcsiclient.SCSIAdapterTypes[busSubTypeParameter]; !ok {
+			return nil, status.Errorf(codes.InvalidArgument,
+				"CreateVolume: value [%s] of parameter [%s] is not a SCSI bus sub type", busSubTypeParameter,
+				BusSubTypeParameter)
+		}
+		busSubType = busSubTypeParameter
+	}
+	if _, _, err = getDiskPosition(req.GetParameters()); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "CreateVolume: %v", err)
+	}
 
 	storageProfile, _ := req.Parameters[StorageProfileParameter]
+	encryptionPolicy, ok := req.GetParameters()[EncryptionPolicyParameter]
+	if ok && strings.TrimSpace(encryptionPolicy) == "" {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"CreateVolume: parameter [%s] should be the name or the URN of a VCD encryption policy",
+			EncryptionPolicyParameter)
+	}
+
+	iops := int64(0)
+	if iopsParameter, ok := req.GetParameters()[IopsParameter]; ok {
+		var err error
+		if iops, err = strconv.ParseInt(iopsParameter, 10, 64); err != nil || iops <= 0 {
+			return nil, status.Errorf(codes.InvalidArgument,
+				"CreateVolume: value [%s] of parameter [%s] should be a positive integer", iopsParameter, IopsParameter)
+		}
+	}
 
-	disk, err := cs.DiskManager.CreateDisk(diskName, sizeMB, busType,
-		busSubType, "", storageProfile, shareable)
+	if sourceDisk != nil {
+		if err = checkSourceDisk(sourceDisk, source, diskName, shareable, busSubType, encryptionPolicy,
+			iops); err != nil {
+			return nil, err
+		}
+	}
+
+	if allocation, ok := req.GetParameters()[AllocationParameter]; ok {
+		if err := checkDiskAllocation(diskManager, allocation, storageProfile); err != nil {
+			return nil, err
+		}
+	}
+
+	// a retried CreateVolume should return the disk created by an earlier attempt
+	disk, err := diskManager.FindDiskByName(diskName)
 	if err != nil {
-		if rdeErr := cs.DiskManager.AddToErrorSet(util.DiskCreateError, "", diskName, map[string]interface{}{"Detailed Error": err.Error()}); rdeErr != nil {
-			klog.Errorf("unable to add error [%s] into [CSI.Errors] in RDE [%s], %v", util.DiskCreateError, cs.DiskManager.ClusterID, rdeErr)
+		return nil, status.Errorf(codes.Internal, "unable to check if disk [%s] already exists: [%v]",
+			diskName, err)
+	}
+	if disk != nil {
+		existingSizeBytes := disk.SizeMB * MbToBytes
+		requiredBytes, limitBytes := req.GetCapacityRange().GetRequiredBytes(), req.GetCapacityRange().GetLimitBytes()
+		if existingSizeBytes < requiredBytes || (limitBytes > 0 && existingSizeBytes > limitBytes) {
+			return nil, status.Errorf(codes.AlreadyExists,
+				"disk [%s] already exists with size [%d]MB that is incompatible with the requested capacity [%v]",
+				diskName, disk.SizeMB, req.GetCapacityRange())
+		}
+		if storageProfile != "" && !disk.HasStorageProfile(storageProfile) {
+			return nil, status.Errorf(codes.AlreadyExists,
+				"disk [%s] already exists with a storage profile other than [%s]", diskName, storageProfile)
+		}
+		if disk.Shareable != shareable {
+			return nil, status.Errorf(codes.AlreadyExists,
+				"disk [%s] already exists with shareable [%v] instead of [%v]", diskName, disk.Shareable, shareable)
+		}
+		if sharingType != "" && disk.SharingType != "" && disk.SharingType != sharingType {
+			return nil, status.Errorf(codes.AlreadyExists,
+				"disk [%s] already exists with sharing type [%s] instead of [%s]", diskName, disk.SharingType,
+				sharingType)
+		}
+		if disk.BusType != busType || disk.BusSubType != busSubType {
+			return nil, status.Errorf(codes.AlreadyExists,
+				"disk [%s] already exists with bus [%s/%s] instead of [%s/%s]", diskName, disk.BusType,
+				disk.BusSubType, busType, busSubType)
+		}
+		if iops > 0 && disk.IOPS != iops {
+			return nil, status.Errorf(codes.AlreadyExists,
+				"disk [%s] already exists with IOPS [%d] instead of [%d]", diskName, disk.IOPS, iops)
+		}
+		if encryptionPolicy != "" && !disk.HasEncryptionPolicy(encryptionPolicy) {
+			return nil, status.Errorf(codes.AlreadyExists,
+				"disk [%s] already exists without encryption policy [%s]", diskName, encryptionPolicy)
+		}
+
+		klog.Infof("Disk [%s] of size [%d]MB already exists", diskName, disk.SizeMB)
+		// the metadata may not have been set by the earlier attempt
+		if err = cs.setDiskMetadata(ctx, diskManager, diskName, getVolumeMode(volumeCapabilities),
+			req.GetParameters()); err != nil {
+			return nil, status.Errorf(codes.Internal, "unable to set metadata of disk [%s]: [%v]", diskName, err)
 		}
-		return nil, fmt.Errorf("unable to create disk [%s] with sise [%d]MB: [%v]",
-			diskName, sizeMB, err)
+		return cs.getCreateVolumeResponse(diskManager, disk, fsType, req.GetParameters(), contentSource), nil
 	}
-	if removeErrorRdeErr := cs.DiskManager.RemoveFromErrorSet(util.DiskCreateError, "", diskName); removeErrorRdeErr != nil {
-		klog.Errorf("unable to remove error [%s] from [CSI.Errors] in RDE [%s]", util.DiskCreateError, cs.DiskManager.ClusterID)
+
+	description, err := cs.getCreateDiskDescription(diskManager, diskName, req)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "unable to get description of disk [%s]: [%v]", diskName, err)
+	}
+	releaseOperation, err := cs.operations.acquire(ctx, fmt.Sprintf("create disk [%s]", diskName))
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case snapshot != nil:
+		disk, err = diskManager.CreateDiskFromSnapshotWithContext(ctx, diskName, snapshot.ID, storageProfile,
+			sizeMB*MbToBytes)
+	case sourceDisk != nil:
+		// the copy is independent of the source disk, which can be deleted before it
+		disk, err = diskManager.CloneDiskWithContext(ctx, sourceDisk.Name, diskName, storageProfile,
+			sizeMB*MbToBytes)
+	default:
+		disk, err = diskManager.CreateDiskWithContext(ctx, diskName, sizeMB, busType,
+			busSubType, description, storageProfile, shareable, sharingType, encryptionPolicy, iops)
+	}
+	releaseOperation()
+	if err != nil {
+		if rdeErr := diskManager.AddToErrorSet(util.DiskCreateError, "", diskName, map[string]interface{}{"Detailed Error": err.Error()}); rdeErr != nil {
+			klog.Errorf("unable to add error [%s] into [CSI.Errors] in RDE [%s], %v", util.DiskCreateError, diskManager.GetClusterID(), rdeErr)
+		}
+		cs.Driver.eventRecorder.RecordPVCWarning(req.GetParameters()[PVCNamespaceParameter],
+			req.GetParameters()[PVCNameParameter], EventReasonDiskCreateFailed,
+			fmt.Sprintf("unable to create disk [%s] of size [%d]MB in VDC [%s]: [%v]", diskName, sizeMB,
+				diskManager.GetVDCName(), err))
+		return nil, createDiskError(err, diskName, sizeMB, diskManager.GetVDCName())
+	}
+	if removeErrorRdeErr := diskManager.RemoveFromErrorSet(util.DiskCreateError, "", diskName); removeErrorRdeErr != nil {
+		klog.Errorf("unable to remove error [%s] from [CSI.Errors] in RDE [%s]", util.DiskCreateError, diskManager.GetClusterID())
 	}
 	klog.Infof("Successfully created disk [%s] of size [%d]MB", diskName, sizeMB)
 
+	if err = cs.setDiskMetadata(ctx, diskManager, diskName, getVolumeMode(volumeCapabilities),
+		req.GetParameters()); err != nil {
+		return nil, status.Errorf(codes.Internal, "unable to set metadata of disk [%s]: [%v]", diskName, err)
+	}
+
+	return cs.getCreateVolumeResponse(diskManager, disk, fsType, req.GetParameters(), contentSource), nil
+}
+
+// getSharingType returns the VCD sharing type of parameter SharingTypeParameter of parameters, or an empty string if
+// it is not set. A sharing type other than None makes the disk shareable, hence it is rejected for a disk that is not
+// shareable since parameter ShareableParameter is false.
+func getSharingType(parameters map[string]string, shareable bool) (string, error) {
+	sharingType, ok := parameters[SharingTypeParameter]
+	if !ok {
+		return "", nil
+	}
+
+	valid := false
+	for _, diskSharingType := range vcdcsiclient.DiskSharingTypes {
+		valid = valid || sharingType == diskSharingType
+	}
+	if !valid {
+		return "", status.Errorf(codes.InvalidArgument,
+			"CreateVolume: value [%s] of parameter [%s] should be one of [%s]", sharingType, SharingTypeParameter,
+			strings.Join(vcdcsiclient.DiskSharingTypes, ", "))
+	}
+	if _, explicit := parameters[ShareableParameter]; explicit && !shareable &&
+		sharingType != vcdcsiclient.DiskSharingTypeNone {
+		return "", status.Errorf(codes.InvalidArgument,
+			"CreateVolume: parameter [%s] [%s] needs a shareable disk, but parameter [%s] is false",
+			SharingTypeParameter, sharingType, ShareableParameter)
+	}
+	if sharingType == vcdcsiclient.DiskSharingTypeNone && shareable {
+		return "", status.Errorf(codes.InvalidArgument,
+			"CreateVolume: parameter [%s] [%s] cannot provide a shareable disk", SharingTypeParameter, sharingType)
+	}
+
+	return sharingType, nil
+}
+
+// checkDiskAllocation returns an error if the disks of storageProfile cannot be allocated as allocation. VCD does not
+// take the allocation of a named disk in its create params; the disks are provisioned thin if the VDC is thin
+// provisioned and lazily zeroed thick otherwise, whatever their storage profile. Hence the driver cannot request a
+// thick or eager zeroed disk, and rejects them, and a thin disk is only allowed in a thin provisioned VDC.
+func checkDiskAllocation(diskManager vcdcsiclient.VCDDiskManager, allocation string, storageProfile string) error {
+	switch allocation {
+	case AllocationThin:
+	case AllocationThick, AllocationEagerZeroed:
+		return status.Errorf(codes.InvalidArgument,
+			"CreateVolume: allocation [%s] of parameter [%s] is not supported since VCD does not take the allocation "+
+				"of a named disk, only [%s] can be required", allocation, AllocationParameter, AllocationThin)
+	default:
+		return status.Errorf(codes.InvalidArgument,
+			"CreateVolume: value [%s] of parameter [%s] should be [%s]", allocation, AllocationParameter,
+			AllocationThin)
+	}
+
+	thinProvisioned, err := diskManager.GetVDCThinProvisioned()
+	if err != nil {
+		return status.Errorf(codes.Internal, "CreateVolume: unable to check allocation [%s] in VDC [%s]: [%v]",
+			allocation, diskManager.GetVDCName(), err)
+	}
+	if !thinProvisioned {
+		if storageProfile == "" {
+			storageProfile = "default"
+		}
+		return status.Errorf(codes.InvalidArgument,
+			"CreateVolume: allocation [%s] is not allowed on storage profile [%s] of VDC [%s], whose disks are "+
+				"allocated [%s]", allocation, storageProfile, diskManager.GetVDCName(), AllocationThick)
+	}
+
+	return nil
+}
+
+// getCreateDiskDescription returns the description of the disk diskName created for req, which is rendered from the
+// template of the driver if it has one
+func (cs *controllerServer) getCreateDiskDescription(diskManager vcdcsiclient.VCDDiskManager, diskName string,
+	req *csi.CreateVolumeRequest) (string, error) {
+
+	if cs.Driver.diskDescriptionTemplate == nil {
+		return getDiskDescription(diskManager.GetClusterID()), nil
+	}
+
+	parameters := req.GetParameters()
+	return renderDiskDescription(cs.Driver.diskDescriptionTemplate, &DiskDescriptionData{
+		ClusterID:      diskManager.GetClusterID(),
+		DiskName:       diskName,
+		VolumeName:     req.GetName(),
+		PVName:         parameters[PVNameParameter],
+		PVCName:        parameters[PVCNameParameter],
+		Namespace:      parameters[PVCNamespaceParameter],
+		VDC:            diskManager.GetVDCName(),
+		StorageProfile: parameters[StorageProfileParameter],
+		Parameters:     parameters,
+	})
+}
+
+// recordPVWarning records a warning event on the PV of the disk diskName, which is named in the metadata of the disk
+func (cs *controllerServer) recordPVWarning(diskManager vcdcsiclient.VCDDiskManager, diskName string, reason string,
+	message string) {
+
+	if cs.Driver.eventRecorder == nil {
+		return
+	}
+	metadata, err := diskManager.GetDiskMetadata(diskName)
+	if err != nil {
+		klog.Errorf("unable to get metadata of disk [%s] to record event [%s]: [%v]", diskName, reason, err)
+		return
+	}
+	if metadata[PVNameMetadataKey] == "" {
+		klog.Infof("Not recording event [%s] as disk [%s] has no PV in its metadata", reason, diskName)
+		return
+	}
+
+	cs.Driver.eventRecorder.RecordPVWarning(metadata[PVNameMetadataKey], reason, message)
+}
+
+// diskErrorCode returns the gRPC code of the kind of the error err of the disk manager, or code if it is of none
+func diskErrorCode(err error, code codes.Code) codes.Code {
+	switch {
+	case errors.Is(err, vcdcsiclient.ErrDiskNotFound), errors.Is(err, vcdcsiclient.ErrSnapshotNotFound):
+		return codes.NotFound
+	case errors.Is(err, vcdcsiclient.ErrDiskAttached), errors.Is(err, vcdcsiclient.ErrAttachUnsupported),
+		errors.Is(err, vcdcsiclient.ErrSnapshotsUnsupported):
+		return codes.FailedPrecondition
+	case errors.Is(err, vcdcsiclient.ErrDiskExists):
+		return codes.AlreadyExists
+	case errors.Is(err, vcdcsiclient.ErrVCDThrottled), errors.Is(err, vcdcsiclient.ErrDiskInTransition):
+		// the sidecars retry an unavailable request with a backoff instead of reporting it as failed
+		return codes.Unavailable
+	case errors.Is(err, vcdcsiclient.ErrQuotaExceeded):
+		return codes.ResourceExhausted
+	case errors.Is(err, vcdcsiclient.ErrAccessDenied):
+		return codes.PermissionDenied
+	case errors.Is(err, vcdcsiclient.ErrInvalidDisk):
+		return codes.InvalidArgument
+	}
+
+	return code
+}
+
+// createDiskErrorHints tell users what to do about the errors of the creation of a disk that are not bugs
+var createDiskErrorHints = []struct {
+	kind error
+	hint string
+}{
+	{vcdcsiclient.ErrQuotaExceeded, "the storage quota of the VDC or of its storage profile is exceeded; free up " +
+		"storage or ask the VCD administrator to raise the quota"},
+	{vcdcsiclient.ErrAccessDenied, "the VCD user of the driver lacks the rights to create disks in the VDC; grant " +
+		"them to its role"},
+	{vcdcsiclient.ErrDiskExists, "a disk with the same name but other properties already exists in the VDC; delete " +
+		"it or use another name"},
+	{vcdcsiclient.ErrInvalidDisk, "VCD rejected the size or the properties of the disk; check the requested size " +
+		"and the parameters of the StorageClass"},
+	{vcdcsiclient.ErrVCDThrottled, "VCD is throttling requests; the creation will be retried"},
+}
+
+// createDiskError returns the gRPC error of the failed creation of the disk diskName of sizeMB in the VDC vdcName,
+// with a hint for the errors that users can act on
+func createDiskError(err error, diskName string, sizeMB int64, vdcName string) error {
+	message := fmt.Sprintf("unable to create disk [%s] with size [%d]MB in VDC [%s]", diskName, sizeMB, vdcName)
+	for _, createDiskErrorHint := range createDiskErrorHints {
+		if errors.Is(err, createDiskErrorHint.kind) {
+			message = fmt.Sprintf("%s since %s", message, createDiskErrorHint.hint)
+			break
+		}
+	}
+
+	return status.Errorf(diskErrorCode(err, codes.Internal), "%s: [%v]", message, err)
+}
+
+// getVolumeMode returns the volume mode of a volume with volumeCapabilities
+func getVolumeMode(volumeCapabilities []*csi.VolumeCapability) string {
+	for _, volumeCapability := range volumeCapabilities {
+		if volumeCapability.GetBlock() != nil {
+			return VolumeModeBlock
+		}
+	}
+
+	return VolumeModeFilesystem
+}
+
+// setDiskMetadata records the volume mode of the disk diskName, and relates it to the cluster and to the PVC in the
+// parameters of its CreateVolume request, if the provisioner passes them
+func (cs *controllerServer) setDiskMetadata(ctx context.Context, diskManager vcdcsiclient.VCDDiskManager,
+	diskName string, volumeMode string, parameters map[string]string) error {
+
+	// the metadata of the driver takes precedence, although the keys of its metadata cannot be mirrored
+	metadata := cs.getMirroredPVCMetadata(ctx, parameters)
+	if metadata == nil {
+		metadata = make(map[string]string)
+	}
+	metadata[VolumeModeMetadataKey] = volumeMode
+	if diskManager.GetClusterID() != "" {
+		metadata[ClusterIDMetadataKey] = diskManager.GetClusterID()
+	}
+	for parameter, metadataKey := range map[string]string{
+		PVCNameParameter:      PVCNameMetadataKey,
+		PVCNamespaceParameter: PVCNamespaceMetadataKey,
+		PVNameParameter:       PVNameMetadataKey,
+	} {
+		if value := parameters[parameter]; value != "" {
+			metadata[metadataKey] = value
+		}
+	}
+	return diskManager.SetDiskMetadata(ctx, diskName, metadata)
+}
+
+// getDiskPosition returns the bus and unit numbers in parameters that a disk should be attached at, which are nil if
+// they are not set
+func getDiskPosition(parameters map[string]string) (*int, *int, error) {
+	var position [2]*int
+	for idx, parameter := range []string{BusNumberParameter, UnitNumberParameter} {
+		value, ok := parameters[parameter]
+		if !ok {
+			continue
+		}
+		number, err := strconv.Atoi(value)
+		if err != nil || number < 0 {
+			return nil, nil, fmt.Errorf("value [%s] of parameter [%s] should be a non-negative integer", value,
+				parameter)
+		}
+		position[idx] = &number
+	}
+	if position[0] != nil && position[1] == nil {
+		return nil, nil, fmt.Errorf("parameter [%s] requires parameter [%s]", BusNumberParameter,
+			UnitNumberParameter)
+	}
+
+	return position[0], position[1], nil
+}
+
+// getCreateVolumeResponse describes the volume of disk that is to be formatted with fsType. The capacity is the size
+// of disk as read back from VCD rather than the requested one, since VCD sizes disks in whole MB. The position to
+// attach the disk at is kept from the parameters of the CreateVolume request.
+func (cs *controllerServer) getCreateVolumeResponse(diskManager vcdcsiclient.VCDDiskManager, disk *vcdcsiclient.Disk,
+	fsType string, parameters map[string]string, contentSource *csi.VolumeContentSource) *csi.CreateVolumeResponse {
+
 	attributes := make(map[string]string)
 	attributes[BusTypeParameter] = BusTypesFromValues[disk.BusType]
 	attributes[BusSubTypeParameter] = disk.BusSubType
-	attributes[StorageProfileParameter] = disk.StorageProfile.Name
-	attributes[DiskIDAttribute] = disk.Id
-
-	fsType := ""
-	ok := false
-	if fsType, ok = req.Parameters[FileSystemParameter]; !ok {
-		fsType = "ext4"
-		klog.Infof("No FS specified for raw disk [%s]. Hence defaulting to [%s].", diskName, fsType)
+	if disk.StorageProfile != "" {
+		attributes[StorageProfileParameter] = disk.StorageProfile
+	} else if storageProfile := parameters[StorageProfileParameter]; storageProfile != "" {
+		attributes[StorageProfileParameter] = storageProfile
 	}
+	attributes[DiskIDAttribute] = disk.ID
+	attributes[VDCAttribute] = diskManager.GetVDCName()
+	attributes[EncryptedAttribute] = strconv.FormatBool(disk.Encrypted)
+
 	attributes[FileSystemParameter] = fsType
+	for _, parameter := range []string{BusNumberParameter, UnitNumberParameter, MkfsOptionsParameter} {
+		if value, ok := parameters[parameter]; ok {
+			attributes[parameter] = value
+		}
+	}
 
-	resp := &csi.CreateVolumeResponse{
+	return &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
-			VolumeId:      disk.Name,
-			CapacityBytes: sizeMB * MbToBytes,
-			VolumeContext: attributes,
+			VolumeId:           cs.getVolumeID(diskManager, disk.Name),
+			CapacityBytes:      disk.SizeMB * MbToBytes,
+			VolumeContext:      attributes,
+			AccessibleTopology: getAccessibleTopology(diskManager.GetVDCName()),
+			ContentSource:      contentSource,
 		},
 	}
-	return resp, nil
+}
+
+// getSourceSnapshot returns the snapshot snapshotID that a volume created with diskManager is restored from, which
+// should be a snapshot of a disk of the VDC of diskManager, and the disk of the snapshot
+func (cs *controllerServer) getSourceSnapshot(diskManager vcdcsiclient.VCDDiskManager,
+	snapshotID string) (*vcdcsiclient.DiskSnapshot, *vcdcsiclient.Disk, error) {
+	snapshotDiskManager, snapshotURN, err := cs.getVolumeDiskManager(snapshotID)
+	if err != nil || !vcdcsiclient.IsDiskSnapshotURN(snapshotURN) {
+		return nil, nil, status.Errorf(codes.NotFound,
+			"CreateVolume: snapshot [%s] is not a snapshot of a disk: [%v]", snapshotID, err)
+	}
+	if snapshotDiskManager.GetVDCName() != diskManager.GetVDCName() {
+		return nil, nil, status.Errorf(codes.InvalidArgument,
+			"CreateVolume: snapshot [%s] of VDC [%s] cannot be restored into VDC [%s]", snapshotID,
+			snapshotDiskManager.GetVDCName(), diskManager.GetVDCName())
+	}
+
+	snapshot, err := diskManager.GetDiskSnapshot(snapshotURN)
+	if err != nil {
+		return nil, nil, status.Errorf(diskErrorCode(err, codes.Internal),
+			"CreateVolume: unable to get snapshot [%s]: [%v]", snapshotID, err)
+	}
+	sourceDisk, err := diskManager.GetDiskByName(snapshot.DiskName)
+	if err != nil {
+		return nil, nil, status.Errorf(diskErrorCode(err, codes.Internal),
+			"CreateVolume: unable to get disk [%s] of snapshot [%s]: [%v]", snapshot.DiskName, snapshotID, err)
+	}
+
+	return snapshot, sourceDisk, nil
+}
+
+// getSourceVolume returns the disk of the volume volumeID that a volume created with diskManager is cloned from,
+// which should be a volume of the VDC of diskManager
+func (cs *controllerServer) getSourceVolume(diskManager vcdcsiclient.VCDDiskManager,
+	volumeID string) (*vcdcsiclient.Disk, error) {
+	volumeDiskManager, diskName, err := cs.getVolumeDiskManager(volumeID)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "CreateVolume: volume [%s] is not a volume of a disk: [%v]",
+			volumeID, err)
+	}
+	if volumeDiskManager.GetVDCName() != diskManager.GetVDCName() {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"CreateVolume: volume [%s] of VDC [%s] cannot be cloned into VDC [%s]", volumeID,
+			volumeDiskManager.GetVDCName(), diskManager.GetVDCName())
+	}
+
+	sourceDisk, err := diskManager.GetDiskByName(diskName)
+	if err != nil {
+		return nil, status.Errorf(diskErrorCode(err, codes.Internal),
+			"CreateVolume: unable to get disk of volume [%s]: [%v]", volumeID, err)
+	}
+
+	return sourceDisk, nil
+}
+
+// checkSourceDisk returns an error if the disk diskName created from source, a snapshot of sourceDisk or sourceDisk
+// itself, cannot have the requested properties. VCD creates the disk with the bus and the sharing of sourceDisk, and
+// without an encryption policy or IOPS.
+func checkSourceDisk(sourceDisk *vcdcsiclient.Disk, source string, diskName string, shareable bool,
+	busSubType string, encryptionPolicy string, iops int64) error {
+	if encryptionPolicy != "" || iops > 0 {
+		return status.Errorf(codes.InvalidArgument,
+			"CreateVolume: parameters [%s] and [%s] cannot be set for volume [%s] created from %s",
+			EncryptionPolicyParameter, IopsParameter, diskName, source)
+	}
+	if sourceDisk.Shareable != shareable || sourceDisk.BusSubType != busSubType {
+		return status.Errorf(codes.InvalidArgument,
+			"CreateVolume: volume [%s] created from %s should have the bus sub type [%s] and shareable [%v] of "+
+				"disk [%s] instead of [%s] and [%v]", diskName, source, sourceDisk.BusSubType, sourceDisk.Shareable,
+			sourceDisk.Name, busSubType, shareable)
+	}
+
+	return nil
 }
 
 func (cs *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
@@ -165,26 +771,52 @@ func (cs *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVol
 		return nil, fmt.Errorf("req should not be nil")
 	}
 
-	klog.Infof("DeleteVolume: called with req [%#v]", *req)
+	klog.Infof("DeleteVolume: called with req [%v]", redactSecrets(req))
 	volumeID := req.GetVolumeId()
 
-	if err := cs.DiskManager.VCDClient.RefreshBearerToken(); err != nil {
+	diskManager, diskName, err := cs.getVolumeDiskManager(volumeID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "DeleteVolume failed: [%v]", err)
+	}
+	if err = diskManager.RefreshBearerTokenWithContext(ctx); err != nil {
 		return nil, fmt.Errorf("error while obtaining access token: [%v]", err)
 	}
-	//volumeID is a diskName
-	err := cs.DiskManager.DeleteDisk(volumeID)
+
+	// VCD refuses to delete an attached disk with an error that tells nothing of the attachment
+	vmNames, err := diskManager.AttachmentState(diskName)
 	if err != nil {
-		if err == govcd.ErrorEntityNotFound {
+		if errors.Is(err, vcdcsiclient.ErrDiskNotFound) {
 			klog.Infof("Volume [%s] is already deleted.", volumeID)
 			return &csi.DeleteVolumeResponse{}, nil
 		}
-		if rdeErr := cs.DiskManager.AddToErrorSet(util.DiskDeleteError, "", volumeID, map[string]interface{}{"Detailed Error": err.Error()}); rdeErr != nil {
-			klog.Errorf("unable to add error [%s] into [CSI.Errors] in RDE [%s], %v", util.DiskDeleteError, cs.DiskManager.ClusterID, rdeErr)
+		return nil, status.Errorf(codes.Internal, "DeleteVolume: unable to get attachment of disk [%s]: [%v]",
+			diskName, err)
+	}
+	if len(vmNames) > 0 {
+		return nil, status.Errorf(codes.FailedPrecondition,
+			"DeleteVolume: volume [%s] is still attached to nodes [%s]", volumeID, strings.Join(vmNames, ","))
+	}
+
+	releaseOperation, err := cs.operations.acquire(ctx, fmt.Sprintf("delete disk [%s]", diskName))
+	if err != nil {
+		return nil, err
+	}
+	err = diskManager.DeleteDiskWithContext(ctx, diskName)
+	releaseOperation()
+	if err != nil {
+		if errors.Is(err, vcdcsiclient.ErrDiskNotFound) {
+			klog.Infof("Volume [%s] is already deleted.", volumeID)
+			return &csi.DeleteVolumeResponse{}, nil
 		}
-		return nil, status.Errorf(codes.Internal, "DeleteVolume failed: [%v]", err)
+		if rdeErr := diskManager.AddToErrorSet(util.DiskDeleteError, "", diskName, map[string]interface{}{"Detailed Error": err.Error()}); rdeErr != nil {
+			klog.Errorf("unable to add error [%s] into [CSI.Errors] in RDE [%s], %v", util.DiskDeleteError, diskManager.GetClusterID(), rdeErr)
+		}
+		cs.recordPVWarning(diskManager, diskName, EventReasonDiskDeleteFailed,
+			fmt.Sprintf("unable to delete disk [%s]: [%v]", diskName, err))
+		return nil, status.Errorf(diskErrorCode(err, codes.Internal), "DeleteVolume failed: [%v]", err)
 	}
-	if removeErrorRdeErr := cs.DiskManager.RemoveFromErrorSet(util.DiskDeleteError, "", volumeID); removeErrorRdeErr != nil {
-		klog.Errorf("unable to remove error [%s] from [CSI.Errors] in RDE [%s]", util.DiskDeleteError, cs.DiskManager.ClusterID)
+	if removeErrorRdeErr := diskManager.RemoveFromErrorSet(util.DiskDeleteError, "", diskName); removeErrorRdeErr != nil {
+		klog.Errorf("unable to remove error [%s] from [CSI.Errors] in RDE [%s]", util.DiskDeleteError, diskManager.GetClusterID())
 	}
 	klog.Infof("Volume %s deleted successfully", req.VolumeId)
 	return &csi.DeleteVolumeResponse{}, nil
@@ -197,22 +829,27 @@ func (cs *controllerServer) ControllerPublishVolume(ctx context.Context,
 		return nil, status.Errorf(codes.InvalidArgument,
 			"ControllerPublishVolume: req should not be nil")
 	}
-	klog.Infof("ControllerPublishVolume: called with req [%#v]", *req)
-
-	if err := cs.DiskManager.VCDClient.RefreshBearerToken(); err != nil {
-		return nil, fmt.Errorf("error while obtaining access token: [%v]", err)
-	}
+	klog.Infof("ControllerPublishVolume: called with req [%v]", redactSecrets(req))
 
 	nodeID := req.GetNodeId()
 	if len(nodeID) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "ControllerPublishVolume: NodeId must be provided")
 	}
 
-	diskName := req.GetVolumeId()
-	if len(diskName) == 0 {
+	volumeID := req.GetVolumeId()
+	if len(volumeID) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "ControllerPublishVolume: VolumeId must be provided")
 	}
 
+	// the VM of the node is looked up in the VDC of the disk, since a disk can only be attached to the VMs of its VDC
+	diskManager, diskName, err := cs.getVolumeDiskManager(volumeID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "ControllerPublishVolume failed: [%v]", err)
+	}
+	if err = diskManager.RefreshBearerTokenWithContext(ctx); err != nil {
+		return nil, fmt.Errorf("error while obtaining access token: [%v]", err)
+	}
+
 	// Get basic params from volumeContext and add it to publishContext, so that it can be used for static PV
 	// provisioned volumes
 	volumeCapability := req.GetVolumeCapability()
@@ -221,58 +858,112 @@ func (cs *controllerServer) ControllerPublishVolume(ctx context.Context,
 			"ControllerPublishVolume: Volume capability not provided")
 	}
 	mountDetails := volumeCapability.GetMount()
-	if mountDetails == nil {
+	if mountDetails == nil && volumeCapability.GetBlock() == nil {
 		return nil, status.Error(codes.InvalidArgument,
-			"ControllerPublishVolume: Volume capability does not have mount capabilities set")
+			"ControllerPublishVolume: Volume capability does not have mount or block capabilities set")
 	}
 
-	klog.Infof("Getting node details for [%s]", nodeID)
-	vdcManager, err := vcdsdk.NewVDCManager(cs.DiskManager.VCDClient, cs.DiskManager.VCDClient.ClusterOrgName, cs.DiskManager.VCDClient.ClusterOVDCName)
+	busNumber, unitNumber, err := getDiskPosition(req.GetVolumeContext())
 	if err != nil {
-		return nil, fmt.Errorf("unable to get vdcManager: [%v]", err)
+		return nil, status.Errorf(codes.InvalidArgument, "ControllerPublishVolume: %v", err)
 	}
-	vm, err := vdcManager.FindVMByName(cs.VAppName, nodeID)
+
+	klog.Infof("Getting node details for [%s]", nodeID)
+	vm, err := cs.findNodeVM(ctx, diskManager, nodeID)
 	if err != nil {
 		return nil, fmt.Errorf("unable to find VM for node [%s]: [%v]", nodeID, err)
 	}
 
 	klog.Infof("Getting disk details for [%s]", diskName)
-	disk, err := cs.DiskManager.GetDiskByName(diskName)
+	disk, err := diskManager.GetDiskByName(diskName)
 	if err != nil {
-		if rdeErr := cs.DiskManager.AddToErrorSet(util.DiskQueryError, "", diskName, map[string]interface{}{"Detailed Error": fmt.Errorf("unable query disk [%s]: [%v]",
+		if rdeErr := diskManager.AddToErrorSet(util.DiskQueryError, "", diskName, map[string]interface{}{"Detailed Error": fmt.Errorf("unable query disk [%s]: [%v]",
 			diskName, err)}); rdeErr != nil {
-			klog.Errorf("unable to unable to add error [%s] into [CSI.Errors] in RDE [%s], %v", util.DiskQueryError, cs.DiskManager.ClusterID, rdeErr)
+			klog.Errorf("unable to unable to add error [%s] into [CSI.Errors] in RDE [%s], %v", util.DiskQueryError, diskManager.GetClusterID(), rdeErr)
 		}
 		return nil, fmt.Errorf("unable to find disk [%s]: [%v]", diskName, err)
 	}
-	if removeErrorRdeErr := cs.DiskManager.RemoveFromErrorSet(util.DiskQueryError, "", diskName); removeErrorRdeErr != nil {
-		klog.Errorf("unable to remove error [%s] from [CSI.Errors] in RDE [%s]", util.DiskQueryError, cs.DiskManager.ClusterID)
+	if removeErrorRdeErr := diskManager.RemoveFromErrorSet(util.DiskQueryError, "", diskName); removeErrorRdeErr != nil {
+		klog.Errorf("unable to remove error [%s] from [CSI.Errors] in RDE [%s]", util.DiskQueryError, diskManager.GetClusterID())
 	}
 	klog.Infof("Obtained disk: [%#v]\n", disk)
 
-	klog.Infof("Attaching volume [%s] to node [%s]", diskName, nodeID)
-	err = cs.DiskManager.AttachVolume(vm, disk)
+	// a disk that is not shareable is detached from its node before it is attached to another one
+	if !disk.Shareable && cs.isDiskShareable([]*csi.VolumeCapability{volumeCapability}) {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"ControllerPublishVolume: disk [%s] is not shareable, hence cannot be published with access mode [%s]",
+			diskName, volumeCapability.GetAccessMode().GetMode().String())
+	}
+
+	// the attaches and detaches of the disks of a VM are serialized, since VCD rejects those of a busy VM
+	unlockVM, err := cs.vmLocks.acquire(ctx, vm.VM.HREF)
+	if err != nil {
+		return nil, status.FromContextError(err).Err()
+	}
+	defer unlockVM()
+	releaseOperation, err := cs.operations.acquire(ctx, fmt.Sprintf("attach disk [%s] to node [%s]", diskName,
+		nodeID))
+	if err != nil {
+		return nil, err
+	}
+	defer releaseOperation()
+
+	// a retried attach finds the disk already attached, which VCD would fail
+	attachedNodeIDs, err := diskManager.AttachmentState(diskName)
 	if err != nil {
-		if rdeErr := cs.DiskManager.AddToErrorSet(util.DiskAttachError, "", diskName, map[string]interface{}{"Detailed Error": err.Error(), "VM Info": nodeID}); rdeErr != nil {
-			klog.Errorf("unable to add error [%s] into [CSI.Errors] in RDE [%s], %v", util.DiskAttachError, cs.DiskManager.ClusterID, rdeErr)
+		if errors.Is(err, vcdcsiclient.ErrDiskNotFound) {
+			return nil, status.Errorf(codes.NotFound, "Volume [%s] does not exist", diskName)
 		}
-		if err == govcd.ErrorEntityNotFound {
+		return nil, status.Errorf(codes.Internal, "unable to find VMs that disk [%s] is attached to: [%v]",
+			diskName, err)
+	}
+	attached := containsString(attachedNodeIDs, vm.VM.Name)
+	if !attached && !disk.Shareable && len(attachedNodeIDs) > 0 {
+		return nil, status.Errorf(codes.FailedPrecondition,
+			"disk [%s] is not shareable and is attached to node [%s]", diskName, attachedNodeIDs[0])
+	}
+
+	if attached {
+		klog.Infof("Volume [%s] already attached to node [%s]", diskName, nodeID)
+	} else if err = cs.retryIfVMBusy(ctx, fmt.Sprintf("attach disk [%s] to node [%s]", diskName, nodeID),
+		func() error {
+			return diskManager.AttachVolumeAtWithContext(ctx, vm, disk, busNumber, unitNumber)
+		}); err != nil {
+		if rdeErr := diskManager.AddToErrorSet(util.DiskAttachError, "", diskName, map[string]interface{}{"Detailed Error": err.Error(), "VM Info": nodeID}); rdeErr != nil {
+			klog.Errorf("unable to add error [%s] into [CSI.Errors] in RDE [%s], %v", util.DiskAttachError, diskManager.GetClusterID(), rdeErr)
+		}
+		cs.recordPVWarning(diskManager, diskName, EventReasonDiskAttachFailed,
+			fmt.Sprintf("unable to attach disk [%s] to node [%s]: [%v]", diskName, nodeID, err))
+		if errors.Is(err, vcdcsiclient.ErrDiskNotFound) {
 			return nil, status.Errorf(codes.NotFound, "could not provision disk [%s] in vcd", diskName)
 		}
-		return nil, err
+		return nil, status.Errorf(diskErrorCode(err, codes.Internal), "unable to attach disk [%s] to node [%s]: [%v]",
+			diskName, nodeID, err)
 	}
-	if removeErrorRdeErr := cs.DiskManager.RemoveFromErrorSet(util.DiskAttachError, "", diskName); removeErrorRdeErr != nil {
-		klog.Errorf("unable to remove error [%s] from [CSI.Errors] in RDE [%s]", util.DiskAttachError, cs.DiskManager.ClusterID)
+	if removeErrorRdeErr := diskManager.RemoveFromErrorSet(util.DiskAttachError, "", diskName); removeErrorRdeErr != nil {
+		klog.Errorf("unable to remove error [%s] from [CSI.Errors] in RDE [%s]", util.DiskAttachError, diskManager.GetClusterID())
 	}
 	klog.Infof("Successfully attached volume %s to node %s ", diskName, nodeID)
+	cs.attachments.attached(volumeID, nodeID)
+
+	fsType := mountDetails.GetFsType()
+	if fsType == "" {
+		fsType = req.GetVolumeContext()[FileSystemParameter]
+	}
+
+	publishContext := map[string]string{
+		VMFullNameAttribute: vm.VM.Name,
+		DiskIDAttribute:     diskName,
+		DiskUUIDAttribute:   disk.UUID,
+		FileSystemAttribute: fsType,
+	}
+	if req.GetReadonly() {
+		// VCD has no read-only attachments of disks, hence the node protects the volume by mounting it read-only
+		publishContext[ReadOnlyAttribute] = "true"
+	}
 
 	return &csi.ControllerPublishVolumeResponse{
-		PublishContext: map[string]string{
-			VMFullNameAttribute: vm.VM.Name,
-			DiskIDAttribute:     diskName,
-			DiskUUIDAttribute:   disk.UUID,
-			FileSystemAttribute: mountDetails.FsType,
-		},
+		PublishContext: publishContext,
 	}, nil
 }
 
@@ -282,11 +973,7 @@ func (cs *controllerServer) ControllerUnpublishVolume(ctx context.Context,
 	if req == nil {
 		return nil, status.Errorf(codes.InvalidArgument, "ControllerUnpublishVolume: req should not be nil")
 	}
-	klog.Infof("ControllerUnpublishVolume: called with req [%#v]", *req)
-
-	if err := cs.DiskManager.VCDClient.RefreshBearerToken(); err != nil {
-		return nil, fmt.Errorf("error while obtaining access token: [%v]", err)
-	}
+	klog.Infof("ControllerUnpublishVolume: called with req [%v]", redactSecrets(req))
 
 	nodeID := req.GetNodeId()
 	if len(nodeID) == 0 {
@@ -300,79 +987,623 @@ func (cs *controllerServer) ControllerUnpublishVolume(ctx context.Context,
 			"ControllerUnpublishVolume: Volume ID must be provided")
 	}
 
-	vdcManager, err := vcdsdk.NewVDCManager(cs.DiskManager.VCDClient, cs.DiskManager.VCDClient.ClusterOrgName, cs.DiskManager.VCDClient.ClusterOVDCName)
+	diskManager, diskName, err := cs.getVolumeDiskManager(volumeID)
 	if err != nil {
-		return nil, fmt.Errorf("unable to get vdcManager: [%v]", err)
+		return nil, status.Errorf(codes.Internal, "ControllerUnpublishVolume failed: [%v]", err)
+	}
+	if err = diskManager.RefreshBearerTokenWithContext(ctx); err != nil {
+		return nil, fmt.Errorf("error while obtaining access token: [%v]", err)
 	}
-	vm, err := vdcManager.FindVMByName(cs.VAppName, nodeID)
+
+	// a disk that is deleted or already detached from the node is unpublished, hence retries succeed
+	attachedNodeIDs, err := diskManager.AttachmentState(diskName)
+	if err != nil {
+		if errors.Is(err, vcdcsiclient.ErrDiskNotFound) {
+			klog.Infof("Volume [%s] does not exist, hence it is unpublished from node [%s]", volumeID, nodeID)
+			cs.attachments.detached(volumeID, nodeID)
+			return &csi.ControllerUnpublishVolumeResponse{}, nil
+		}
+		return nil, status.Errorf(codes.Internal, "unable to find VM that disk [%s] is attached to: [%v]",
+			volumeID, err)
+	}
+	if len(attachedNodeIDs) == 0 {
+		klog.Infof("Volume [%s] is not attached, hence it is unpublished from node [%s]", volumeID, nodeID)
+		cs.attachments.detached(volumeID, nodeID)
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
+	}
+	klog.Infof("Volume [%s] is attached to nodes [%s]", volumeID, strings.Join(attachedNodeIDs, ","))
+
+	vm, err := cs.findNodeVM(ctx, diskManager, nodeID)
 	if err != nil {
 		return nil, status.Errorf(codes.NotFound,
 			"Could not find VM with nodeID [%s] from which to detach [%s]", nodeID, volumeID)
 	}
+	if !containsString(attachedNodeIDs, vm.VM.Name) {
+		klog.Infof("Volume [%s] is not attached to node [%s], hence it is unpublished from it", volumeID, nodeID)
+		cs.attachments.detached(volumeID, nodeID)
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
+	}
 
-	err = cs.DiskManager.DetachVolume(vm, volumeID)
+	unlockVM, err := cs.vmLocks.acquire(ctx, vm.VM.HREF)
 	if err != nil {
-		if rdeErr := cs.DiskManager.AddToErrorSet(util.DiskDetachError, "", volumeID, map[string]interface{}{"Detailed Error": err.Error(), "VM Info": nodeID}); rdeErr != nil {
-			klog.Errorf("unable to add error [%s] into [CSI.Errors] in RDE [%s], %v", util.DiskDetachError, cs.DiskManager.ClusterID, rdeErr)
+		return nil, status.FromContextError(err).Err()
+	}
+	defer unlockVM()
+	releaseOperation, err := cs.operations.acquire(ctx, fmt.Sprintf("detach disk [%s] from node [%s]", diskName,
+		nodeID))
+	if err != nil {
+		return nil, err
+	}
+	defer releaseOperation()
+
+	err = cs.retryIfVMBusy(ctx, fmt.Sprintf("detach disk [%s] from node [%s]", diskName, nodeID), func() error {
+		return diskManager.DetachVolumeWithContext(ctx, vm, diskName)
+	})
+	if err != nil {
+		if rdeErr := diskManager.AddToErrorSet(util.DiskDetachError, "", diskName, map[string]interface{}{"Detailed Error": err.Error(), "VM Info": nodeID}); rdeErr != nil {
+			klog.Errorf("unable to add error [%s] into [CSI.Errors] in RDE [%s], %v", util.DiskDetachError, diskManager.GetClusterID(), rdeErr)
 		}
-		if err == govcd.ErrorEntityNotFound {
+		cs.recordPVWarning(diskManager, diskName, EventReasonDiskDetachFailed,
+			fmt.Sprintf("unable to detach disk [%s] from node [%s]: [%v]", diskName, nodeID, err))
+		if errors.Is(err, vcdcsiclient.ErrDiskNotFound) {
 			return nil, status.Errorf(codes.NotFound, "Volume [%s] does not exist", volumeID)
 		}
 
-		return nil, err
+		return nil, status.Errorf(diskErrorCode(err, codes.Internal),
+			"unable to detach disk [%s] from node [%s]: [%v]", diskName, nodeID, err)
 	}
-	if removeErrorRdeErr := cs.DiskManager.RemoveFromErrorSet(util.DiskDetachError, "", volumeID); removeErrorRdeErr != nil {
-		klog.Errorf("unable to remove error [%s] from [CSI.Errors] in RDE [%s]", util.DiskDetachError, cs.DiskManager.ClusterID)
+	// a disk that is still attached to the node once it is unpublished cannot be attached to another node
+	if cs.Driver.detachWaitTimeout > 0 {
+		waitCtx, cancel := context.WithTimeout(ctx, cs.Driver.detachWaitTimeout)
+		err = diskManager.WaitForDiskDetached(waitCtx, vm, diskName, cs.Driver.detachPollInterval)
+		cancel()
+		if err != nil {
+			return nil, status.Errorf(codes.DeadlineExceeded,
+				"disk [%s] was detached but is not yet released by node [%s] after [%v]: [%v]", diskName, nodeID,
+				cs.Driver.detachWaitTimeout, err)
+		}
+	}
+	if removeErrorRdeErr := diskManager.RemoveFromErrorSet(util.DiskDetachError, "", diskName); removeErrorRdeErr != nil {
+		klog.Errorf("unable to remove error [%s] from [CSI.Errors] in RDE [%s]", util.DiskDetachError, diskManager.GetClusterID())
 	}
 	klog.Infof("Volume [%s] unpublished successfully", volumeID)
+	cs.attachments.detached(volumeID, nodeID)
 
 	return &csi.ControllerUnpublishVolumeResponse{}, nil
 }
 
 func (cs *controllerServer) ValidateVolumeCapabilities(ctx context.Context,
 	req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "ValidateVolumeCapabilities not implemented")
+
+	if req == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "ValidateVolumeCapabilities: req should not be nil")
+	}
+	klog.Infof("ValidateVolumeCapabilities: called with req [%v]", redactSecrets(req))
+
+	volumeID := req.GetVolumeId()
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "ValidateVolumeCapabilities: VolumeId must be provided")
+	}
+
+	volumeCapabilities := req.GetVolumeCapabilities()
+	if len(volumeCapabilities) == 0 {
+		return nil, status.Error(codes.InvalidArgument,
+			"ValidateVolumeCapabilities: VolumeCapabilities should be provided")
+	}
+
+	diskManager, diskName, err := cs.getVolumeDiskManager(volumeID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "ValidateVolumeCapabilities failed: [%v]", err)
+	}
+	if err = diskManager.RefreshBearerTokenWithContext(ctx); err != nil {
+		return nil, fmt.Errorf("error while obtaining access token: [%v]", err)
+	}
+
+	disk, err := diskManager.GetDiskByName(diskName)
+	if err != nil {
+		if errors.Is(err, vcdcsiclient.ErrDiskNotFound) {
+			return nil, status.Errorf(codes.NotFound, "Volume [%s] does not exist", volumeID)
+		}
+		return nil, fmt.Errorf("unable to find disk [%s]: [%v]", volumeID, err)
+	}
+
+	// disks created by earlier versions of the driver, or for static PVs, have no volume mode and can be used in both
+	metadata, err := diskManager.GetDiskMetadata(diskName)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "unable to get metadata of disk [%s]: [%v]", volumeID, err)
+	}
+	volumeMode := metadata[VolumeModeMetadataKey]
+
+	// volumes are formatted on the node, or handed over as raw block devices
+	for _, volumeCapability := range volumeCapabilities {
+		if _, ok := VolumeCapabilityAccessModesStringMap[volumeCapability.GetAccessMode().GetMode().String()]; !ok {
+			return &csi.ValidateVolumeCapabilitiesResponse{
+				Message: fmt.Sprintf("access mode of volume capability [%s] not supported",
+					volumeCapability.String()),
+			}, nil
+		}
+		if volumeCapability.GetMount() == nil && volumeCapability.GetBlock() == nil {
+			return &csi.ValidateVolumeCapabilitiesResponse{
+				Message: fmt.Sprintf("access type of volume capability [%s] not supported",
+					volumeCapability.String()),
+			}, nil
+		}
+		if fsType := volumeCapability.GetMount().GetFsType(); fsType != "" && !SupportedFileSystems[fsType] {
+			return &csi.ValidateVolumeCapabilitiesResponse{
+				Message: fmt.Sprintf("fs type [%s] of volume capability [%s] not supported", fsType,
+					volumeCapability.String()),
+			}, nil
+		}
+		if capabilityVolumeMode := getVolumeMode([]*csi.VolumeCapability{volumeCapability}); volumeMode != "" &&
+			capabilityVolumeMode != volumeMode {
+			return &csi.ValidateVolumeCapabilitiesResponse{
+				Message: fmt.Sprintf("disk [%s] was created for volume mode [%s] instead of [%s]", volumeID,
+					volumeMode, capabilityVolumeMode),
+			}, nil
+		}
+	}
+	// only a shareable disk can be attached to more than one node
+	if !disk.Shareable && cs.isDiskShareable(volumeCapabilities) {
+		return &csi.ValidateVolumeCapabilitiesResponse{
+			Message: fmt.Sprintf("disk [%s] is not shareable, hence multi-node access modes are not supported",
+				volumeID),
+		}, nil
+	}
+
+	return &csi.ValidateVolumeCapabilitiesResponse{
+		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
+			VolumeContext:      req.GetVolumeContext(),
+			VolumeCapabilities: volumeCapabilities,
+			Parameters:         req.GetParameters(),
+		},
+	}, nil
 }
 
 func (cs *controllerServer) ListVolumes(ctx context.Context,
 	req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "ListVolumes not implemented")
+
+	if req == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "ListVolumes: req should not be nil")
+	}
+	klog.Infof("ListVolumes: called with req [%v]", redactSecrets(req))
+
+	maxEntries := req.GetMaxEntries()
+	if maxEntries < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "ListVolumes: max entries [%d] should not be negative",
+			maxEntries)
+	}
+	startingToken := req.GetStartingToken()
+	if startingToken != "" {
+		if offset, err := strconv.Atoi(startingToken); err != nil || offset < 0 {
+			return nil, status.Errorf(codes.Aborted, "ListVolumes: invalid starting token [%s]", startingToken)
+		}
+	}
+
+	if err := cs.DiskManager.RefreshBearerTokenWithContext(ctx); err != nil {
+		return nil, fmt.Errorf("error while obtaining access token: [%v]", err)
+	}
+
+	// only the volumes of the configured VDC are listed
+	disks, nextToken, err := cs.DiskManager.ListDisks(startingToken, int(maxEntries))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "ListVolumes failed: [%v]", err)
+	}
+
+	entries := make([]*csi.ListVolumesResponse_Entry, len(disks))
+	for idx, disk := range disks {
+		entries[idx] = &csi.ListVolumesResponse_Entry{
+			Volume: &csi.Volume{
+				VolumeId:           disk.Name,
+				CapacityBytes:      disk.SizeMB * MbToBytes,
+				AccessibleTopology: getAccessibleTopology(cs.DiskManager.GetVDCName()),
+			},
+		}
+	}
+	klog.Infof("ListVolumes: returning [%d] volumes with next token [%s]", len(entries), nextToken)
+
+	return &csi.ListVolumesResponse{
+		Entries:   entries,
+		NextToken: nextToken,
+	}, nil
 }
 
 func (cs *controllerServer) GetCapacity(ctx context.Context,
 	req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "GetCapacity not implemented")
+
+	if req == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "GetCapacity: req should not be nil")
+	}
+	klog.Infof("GetCapacity: called with req [%v]", redactSecrets(req))
+
+	vdcName := req.GetAccessibleTopology().GetSegments()[TopologyVDCKey]
+	diskManager, err := cs.getDiskManagerForVDC(vdcName)
+	if err != nil {
+		return nil, status.Errorf(vdcErrorCode(err), "GetCapacity failed for VDC [%s]: [%v]", vdcName, err)
+	}
+	if err = diskManager.RefreshBearerTokenWithContext(ctx); err != nil {
+		return nil, fmt.Errorf("error while obtaining access token: [%v]", err)
+	}
+
+	storageProfile := req.GetParameters()[StorageProfileParameter]
+	capacity, err := diskManager.GetVDCCapacity(storageProfile)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "GetCapacity failed for storage profile [%s]: [%v]",
+			storageProfile, err)
+	}
+	klog.Infof("GetCapacity: storage profile [%s] has [%d] bytes available", storageProfile, capacity)
+
+	return &csi.GetCapacityResponse{
+		AvailableCapacity: capacity,
+	}, nil
 }
 
 func (cs *controllerServer) ControllerGetCapabilities(ctx context.Context,
 	req *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
-	klog.Infof("ControllerGetCapabilities: called with args [%#v]", *req)
+	klog.Infof("ControllerGetCapabilities: called with args [%v]", redactSecrets(req))
 	return &csi.ControllerGetCapabilitiesResponse{
 		Capabilities: cs.Driver.controllerServiceCapabilities,
 	}, nil
 }
 
+// getCSISnapshot returns the CSI snapshot of the snapshot of a disk in the VDC of diskManager. The IDs of the
+// snapshots are the URNs of their VCD snapshots, prefixed with the VDC of their disks as those of the volumes.
+func (cs *controllerServer) getCSISnapshot(diskManager vcdcsiclient.VCDDiskManager,
+	snapshot *vcdcsiclient.DiskSnapshot) *csi.Snapshot {
+	return &csi.Snapshot{
+		SnapshotId:     cs.getVolumeID(diskManager, snapshot.ID),
+		SourceVolumeId: cs.getVolumeID(diskManager, snapshot.DiskName),
+		SizeBytes:      snapshot.SizeMB * MbToBytes,
+		CreationTime:   timestamppb.New(snapshot.CreationTime),
+		ReadyToUse:     snapshot.ReadyToUse,
+	}
+}
+
 func (cs *controllerServer) CreateSnapshot(ctx context.Context,
 	req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
-	return nil, status.Error(codes.InvalidArgument, "CreateSnapshot not implemented")
+
+	if req == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "CreateSnapshot: req should not be nil")
+	}
+	klog.Infof("CreateSnapshot: called with req [%v]", redactSecrets(req))
+
+	snapName := req.GetName()
+	if len(snapName) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "CreateSnapshot: Name must be provided")
+	}
+	sourceVolumeID := req.GetSourceVolumeId()
+	if len(sourceVolumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "CreateSnapshot: SourceVolumeId must be provided")
+	}
+
+	diskManager, diskName, err := cs.getVolumeDiskManager(sourceVolumeID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "CreateSnapshot failed: [%v]", err)
+	}
+	if err = diskManager.RefreshBearerTokenWithContext(ctx); err != nil {
+		return nil, fmt.Errorf("error while obtaining access token: [%v]", err)
+	}
+
+	releaseOperation, err := cs.operations.acquire(ctx, fmt.Sprintf("snapshot disk [%s]", diskName))
+	if err != nil {
+		return nil, err
+	}
+	// the snapshot of the disk with the same name is returned if it exists, so that retries are idempotent
+	snapshot, err := diskManager.CreateDiskSnapshotWithContext(ctx, diskName, snapName)
+	releaseOperation()
+	if err != nil {
+		return nil, status.Errorf(diskErrorCode(err, codes.Internal), "CreateSnapshot failed: [%v]", err)
+	}
+	klog.Infof("CreateSnapshot: created snapshot [%s] of volume [%s]", snapshot.ID, sourceVolumeID)
+
+	return &csi.CreateSnapshotResponse{
+		Snapshot: cs.getCSISnapshot(diskManager, snapshot),
+	}, nil
 }
 
 func (cs *controllerServer) DeleteSnapshot(ctx context.Context,
 	req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
-	return nil, status.Error(codes.InvalidArgument, "DeleteSnapshot not implemented")
+
+	if req == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "DeleteSnapshot: req should not be nil")
+	}
+	klog.Infof("DeleteSnapshot: called with req [%v]", redactSecrets(req))
+
+	snapshotID := req.GetSnapshotId()
+	if len(snapshotID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "DeleteSnapshot: SnapshotId must be provided")
+	}
+	diskManager, snapshotURN, err := cs.getVolumeDiskManager(snapshotID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "DeleteSnapshot failed: [%v]", err)
+	}
+	if !vcdcsiclient.IsDiskSnapshotURN(snapshotURN) {
+		// the driver never returned the ID, hence there is no such snapshot to delete
+		klog.Infof("Snapshot [%s] is not a snapshot of a disk and is already deleted.", snapshotID)
+		return &csi.DeleteSnapshotResponse{}, nil
+	}
+	if err = diskManager.RefreshBearerTokenWithContext(ctx); err != nil {
+		return nil, fmt.Errorf("error while obtaining access token: [%v]", err)
+	}
+
+	releaseOperation, err := cs.operations.acquire(ctx, fmt.Sprintf("delete snapshot [%s]", snapshotURN))
+	if err != nil {
+		return nil, err
+	}
+	err = diskManager.DeleteDiskSnapshotWithContext(ctx, snapshotURN)
+	releaseOperation()
+	if err != nil {
+		return nil, status.Errorf(diskErrorCode(err, codes.Internal), "DeleteSnapshot failed: [%v]", err)
+	}
+	klog.Infof("Snapshot %s deleted successfully", snapshotID)
+
+	return &csi.DeleteSnapshotResponse{}, nil
+}
+
+// getDiskCSISnapshots returns the CSI snapshots of the disk diskName in the VDC of diskManager sorted by their IDs,
+// which are none if the disk is deleted or VCD does not snapshot it
+func (cs *controllerServer) getDiskCSISnapshots(diskManager vcdcsiclient.VCDDiskManager,
+	diskName string) ([]*csi.Snapshot, error) {
+	snapshots, err := diskManager.ListDiskSnapshots(diskName)
+	if err != nil {
+		if errors.Is(err, vcdcsiclient.ErrSnapshotsUnsupported) || errors.Is(err, vcdcsiclient.ErrDiskNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].ID < snapshots[j].ID
+	})
+
+	csiSnapshots := make([]*csi.Snapshot, len(snapshots))
+	for idx := range snapshots {
+		csiSnapshots[idx] = cs.getCSISnapshot(diskManager, &snapshots[idx])
+	}
+	return csiSnapshots, nil
+}
+
+// listSnapshots returns the snapshots with the ID snapshotID and of the volume sourceVolumeID, if they are not empty,
+// or else the snapshots of the disks of the configured VDC, sorted by their source volumes and IDs. The snapshots and
+// the volumes that do not exist have no snapshots.
+func (cs *controllerServer) listSnapshots(ctx context.Context, snapshotID string,
+	sourceVolumeID string) ([]*csi.Snapshot, error) {
+	if snapshotID != "" {
+		diskManager, snapshotURN, err := cs.getVolumeDiskManager(snapshotID)
+		if err != nil || !vcdcsiclient.IsDiskSnapshotURN(snapshotURN) {
+			return nil, nil
+		}
+		if err = diskManager.RefreshBearerTokenWithContext(ctx); err != nil {
+			return nil, fmt.Errorf("error while obtaining access token: [%v]", err)
+		}
+		snapshot, err := diskManager.GetDiskSnapshot(snapshotURN)
+		if err != nil {
+			if errors.Is(err, vcdcsiclient.ErrSnapshotNotFound) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		csiSnapshot := cs.getCSISnapshot(diskManager, snapshot)
+		if sourceVolumeID != "" && csiSnapshot.GetSourceVolumeId() != sourceVolumeID {
+			return nil, nil
+		}
+		return []*csi.Snapshot{csiSnapshot}, nil
+	}
+
+	if sourceVolumeID != "" {
+		// reconciliation asks for the snapshots of volumes that may have been deleted, which have none
+		diskManager, diskName, err := cs.getVolumeDiskManager(sourceVolumeID)
+		if err != nil {
+			klog.Infof("ListSnapshots: volume [%s] has no snapshots: [%v]", sourceVolumeID, err)
+			return nil, nil
+		}
+		if err = diskManager.RefreshBearerTokenWithContext(ctx); err != nil {
+			return nil, fmt.Errorf("error while obtaining access token: [%v]", err)
+		}
+		return cs.getDiskCSISnapshots(diskManager, diskName)
+	}
+
+	if err := cs.DiskManager.RefreshBearerTokenWithContext(ctx); err != nil {
+		return nil, fmt.Errorf("error while obtaining access token: [%v]", err)
+	}
+	// only the snapshots of the volumes of the configured VDC are listed
+	disks, _, err := cs.DiskManager.ListDisks("", 0)
+	if err != nil {
+		return nil, err
+	}
+	var csiSnapshots []*csi.Snapshot
+	for _, disk := range disks {
+		diskSnapshots, err := cs.getDiskCSISnapshots(cs.DiskManager, disk.Name)
+		if err != nil {
+			return nil, err
+		}
+		csiSnapshots = append(csiSnapshots, diskSnapshots...)
+	}
+	return csiSnapshots, nil
 }
 
 func (cs *controllerServer) ListSnapshots(ctx context.Context,
 	req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
-	return nil, status.Error(codes.InvalidArgument, "ListSnapshots not implemented")
+
+	if req == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "ListSnapshots: req should not be nil")
+	}
+	klog.Infof("ListSnapshots: called with req [%v]", redactSecrets(req))
+
+	maxEntries := req.GetMaxEntries()
+	if maxEntries < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "ListSnapshots: max entries [%d] should not be negative",
+			maxEntries)
+	}
+	offset := 0
+	startingToken := req.GetStartingToken()
+	if startingToken != "" {
+		var err error
+		if offset, err = strconv.Atoi(startingToken); err != nil || offset < 0 {
+			return nil, status.Errorf(codes.Aborted, "ListSnapshots: invalid starting token [%s]", startingToken)
+		}
+	}
+
+	snapshots, err := cs.listSnapshots(ctx, req.GetSnapshotId(), req.GetSourceVolumeId())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "ListSnapshots failed: [%v]", err)
+	}
+	if offset > len(snapshots) {
+		return nil, status.Errorf(codes.Aborted, "ListSnapshots: starting token [%s] is past the [%d] snapshots",
+			startingToken, len(snapshots))
+	}
+
+	// the tokens are the offsets of the pages in the sorted snapshots
+	end, nextToken := len(snapshots), ""
+	if maxEntries > 0 && offset+int(maxEntries) < len(snapshots) {
+		end = offset + int(maxEntries)
+		nextToken = strconv.Itoa(end)
+	}
+	entries := make([]*csi.ListSnapshotsResponse_Entry, 0, end-offset)
+	for _, snapshot := range snapshots[offset:end] {
+		entries = append(entries, &csi.ListSnapshotsResponse_Entry{
+			Snapshot: snapshot,
+		})
+	}
+	klog.Infof("ListSnapshots: returning [%d] snapshots with next token [%s]", len(entries), nextToken)
+
+	return &csi.ListSnapshotsResponse{
+		Entries:   entries,
+		NextToken: nextToken,
+	}, nil
 }
 
 func (cs *controllerServer) ControllerExpandVolume(ctx context.Context,
 	req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
-	return nil, status.Error(codes.InvalidArgument, "ControllerExpandVolume not implemented")
+
+	if req == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "ControllerExpandVolume: req should not be nil")
+	}
+	klog.Infof("ControllerExpandVolume: called with req [%v]", redactSecrets(req))
+
+	volumeID := req.GetVolumeId()
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "ControllerExpandVolume: VolumeId must be provided")
+	}
+
+	capacityRange := req.GetCapacityRange()
+	if capacityRange == nil || capacityRange.GetRequiredBytes() <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "ControllerExpandVolume: RequiredBytes must be provided")
+	}
+	requiredBytes, limitBytes := capacityRange.GetRequiredBytes(), capacityRange.GetLimitBytes()
+	if limitBytes > 0 && requiredBytes > limitBytes {
+		return nil, status.Errorf(codes.OutOfRange,
+			"ControllerExpandVolume: required bytes [%d] exceed limit bytes [%d]", requiredBytes, limitBytes)
+	}
+
+	diskManager, diskName, err := cs.getVolumeDiskManager(volumeID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "ControllerExpandVolume failed: [%v]", err)
+	}
+	if err = diskManager.RefreshBearerTokenWithContext(ctx); err != nil {
+		return nil, fmt.Errorf("error while obtaining access token: [%v]", err)
+	}
+
+	disk, err := diskManager.GetDiskByName(diskName)
+	if err != nil {
+		if errors.Is(err, vcdcsiclient.ErrDiskNotFound) {
+			return nil, status.Errorf(codes.NotFound, "Volume [%s] does not exist", volumeID)
+		}
+		return nil, fmt.Errorf("unable to find disk [%s]: [%v]", volumeID, err)
+	}
+	currentBytes := disk.SizeMB * MbToBytes
+	if limitBytes > 0 && currentBytes > limitBytes {
+		return nil, status.Errorf(codes.OutOfRange,
+			"ControllerExpandVolume: volume [%s] of [%d] bytes cannot be shrunk to at most [%d] bytes",
+			volumeID, currentBytes, limitBytes)
+	}
+
+	sizeMB := bytesToMB(requiredBytes)
+	if err = checkCapacityLimit(sizeMB, limitBytes); err != nil {
+		return nil, status.Errorf(codes.OutOfRange, "ControllerExpandVolume: volume [%s]: %v", volumeID, err)
+	}
+	klog.Infof("ControllerExpandVolume: expanding volume [%s] from [%d] MiB to [%d] MiB",
+		volumeID, disk.SizeMB, sizeMB)
+	releaseOperation, err := cs.operations.acquire(ctx, fmt.Sprintf("resize disk [%s]", diskName))
+	if err != nil {
+		return nil, err
+	}
+	err = diskManager.ResizeDiskWithContext(ctx, diskName, sizeMB*MbToBytes)
+	releaseOperation()
+	if err != nil {
+		if rdeErr := diskManager.AddToErrorSet(util.DiskResizeError, "", diskName, map[string]interface{}{"Detailed Error": err.Error()}); rdeErr != nil {
+			klog.Errorf("unable to add error [%s] into [CSI.Errors] in RDE [%s], %v", util.DiskResizeError, diskManager.GetClusterID(), rdeErr)
+		}
+		cs.recordPVWarning(diskManager, diskName, EventReasonDiskResizeFailed,
+			fmt.Sprintf("unable to resize disk [%s] to [%d]MB: [%v]", diskName, sizeMB, err))
+		if errors.Is(err, vcdcsiclient.ErrDiskNotFound) {
+			return nil, status.Errorf(codes.NotFound, "Volume [%s] does not exist", volumeID)
+		}
+		return nil, status.Errorf(diskErrorCode(err, codes.Internal), "ControllerExpandVolume failed: [%v]", err)
+	}
+	if removeErrorRdeErr := diskManager.RemoveFromErrorSet(util.DiskResizeError, "", diskName); removeErrorRdeErr != nil {
+		klog.Errorf("unable to remove error [%s] from [CSI.Errors] in RDE [%s]", util.DiskResizeError, diskManager.GetClusterID())
+	}
+
+	capacityBytes := sizeMB * MbToBytes
+	if currentBytes > capacityBytes {
+		capacityBytes = currentBytes
+	}
+	// a raw block volume has no filesystem to grow on the node
+	nodeExpansionRequired := true
+	if volumeCapability := req.GetVolumeCapability(); volumeCapability != nil && volumeCapability.GetBlock() != nil {
+		nodeExpansionRequired = false
+	}
+	klog.Infof("Volume [%s] expanded successfully to [%d] bytes", volumeID, capacityBytes)
+
+	return &csi.ControllerExpandVolumeResponse{
+		CapacityBytes:         capacityBytes,
+		NodeExpansionRequired: nodeExpansionRequired,
+	}, nil
 }
 
 func (cs *controllerServer) ControllerGetVolume(ctx context.Context,
 	req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
-	return nil, status.Error(codes.InvalidArgument, "ControllerGetVolume not implemented")
+
+	if req == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "ControllerGetVolume: req should not be nil")
+	}
+	klog.Infof("ControllerGetVolume: called with req [%v]", redactSecrets(req))
+
+	volumeID := req.GetVolumeId()
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "ControllerGetVolume: VolumeId must be provided")
+	}
+
+	diskManager, diskName, err := cs.getVolumeDiskManager(volumeID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "ControllerGetVolume failed: [%v]", err)
+	}
+	if err = diskManager.RefreshBearerTokenWithContext(ctx); err != nil {
+		return nil, fmt.Errorf("error while obtaining access token: [%v]", err)
+	}
+
+	disk, err := diskManager.GetDiskByName(diskName)
+	if err != nil {
+		if errors.Is(err, vcdcsiclient.ErrDiskNotFound) {
+			return nil, status.Errorf(codes.NotFound, "Volume [%s] does not exist", volumeID)
+		}
+		return nil, status.Errorf(codes.Internal, "unable to get disk [%s]: [%v]", volumeID, err)
+	}
+
+	volumeContext := make(map[string]string)
+	if disk.StorageProfile != "" {
+		volumeContext[StorageProfileParameter] = disk.StorageProfile
+	}
+
+	return &csi.ControllerGetVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId:           volumeID,
+			CapacityBytes:      disk.SizeMB * MbToBytes,
+			VolumeContext:      volumeContext,
+			AccessibleTopology: getAccessibleTopology(diskManager.GetVDCName()),
+		},
+		Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
+			// the node ID of a node is the name of its VM
+			PublishedNodeIds: disk.AttachedVMs,
+		},
+	}, nil
 }
@@ -0,0 +1,1559 @@
+/*
+   Copyright 2021 VMware, Inc.
+   SPDX-License-Identifier: Apache-2.0
+*/
+
+package csi
+
+import (
+	"context"
+	"fmt"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware/cloud-director-named-disk-csi-driver/pkg/config"
+	"github.com/vmware/cloud-director-named-disk-csi-driver/pkg/vcdcsiclient"
+	"github.com/vmware/cloud-director-named-disk-csi-driver/pkg/vcdcsiclient/fake"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newFakeControllerServer returns a controller server that manages disks in memory for the cluster "cluster-1" in
+// the VDC "vdc", with the VM of the node "node-1"
+func newFakeControllerServer(t *testing.T) (*controllerServer, *fake.DiskManager) {
+	driver, err := NewDriver("node-1", "unix:///tmp/csi.sock")
+	require.NoError(t, err, "driver should be created")
+
+	diskManager := fake.NewDiskManager("cluster-1", "vdc")
+	diskManager.AddVM("node-1")
+	return NewControllerService(driver, diskManager).(*controllerServer), diskManager
+}
+
+func newCreateVolumeRequest(name string, requiredBytes int64) *csi.CreateVolumeRequest {
+	return &csi.CreateVolumeRequest{
+		Name: name,
+		CapacityRange: &csi.CapacityRange{
+			RequiredBytes: requiredBytes,
+		},
+		VolumeCapabilities: []*csi.VolumeCapability{
+			{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{},
+				},
+				AccessMode: &csi.VolumeCapability_AccessMode{
+					Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+				},
+			},
+		},
+		Parameters: map[string]string{
+			PVCNameParameter:      "pvc-1",
+			PVCNamespaceParameter: "default",
+		},
+	}
+}
+
+func TestCreateVolume(t *testing.T) {
+	cs, diskManager := newFakeControllerServer(t)
+	ctx := context.Background()
+
+	resp, err := cs.CreateVolume(ctx, newCreateVolumeRequest("pvc-1", GbToBytes))
+	require.NoError(t, err, "volume should be created")
+	assert.Equal(t, "pvc-1", resp.GetVolume().GetVolumeId(), "volume ID should be the name of the disk")
+	assert.Equal(t, GbToBytes, resp.GetVolume().GetCapacityBytes(), "volume should have the requested capacity")
+	assert.Equal(t, DefaultFileSystem, resp.GetVolume().GetVolumeContext()[FileSystemParameter],
+		"volume without an fs type should have the default one")
+	assert.Equal(t, "vdc", resp.GetVolume().GetVolumeContext()[VDCAttribute], "VDC of the disk should be set")
+
+	metadata, err := diskManager.GetDiskMetadata("pvc-1")
+	require.NoError(t, err, "metadata of the disk should be found")
+	assert.Equal(t, "cluster-1", metadata[ClusterIDMetadataKey], "disk should be related to the cluster")
+	assert.Equal(t, "pvc-1", metadata[PVCNameMetadataKey], "disk should be related to its PVC")
+	assert.Equal(t, VolumeModeFilesystem, metadata[VolumeModeMetadataKey], "volume mode should be recorded")
+
+	retriedResp, err := cs.CreateVolume(ctx, newCreateVolumeRequest("pvc-1", GbToBytes))
+	require.NoError(t, err, "retried creation should succeed")
+	assert.Equal(t, resp.GetVolume().GetVolumeContext()[DiskIDAttribute],
+		retriedResp.GetVolume().GetVolumeContext()[DiskIDAttribute], "retried creation should return the same disk")
+
+	_, err = cs.CreateVolume(ctx, newCreateVolumeRequest("pvc-1", 2*GbToBytes))
+	assert.Equal(t, codes.AlreadyExists, status.Code(err),
+		"creation of an existing disk with a larger capacity should fail")
+
+	diskManager.SetError(fake.OperationCreateDisk, fmt.Errorf("quota exceeded"))
+	_, err = cs.CreateVolume(ctx, newCreateVolumeRequest("pvc-2", GbToBytes))
+	assert.Error(t, err, "creation should fail with the error of VCD")
+	disk, err := diskManager.FindDiskByName("pvc-2")
+	assert.NoError(t, err, "disk should be looked up")
+	assert.Nil(t, disk, "failed creation should leave no disk")
+}
+
+func TestDeleteVolume(t *testing.T) {
+	cs, diskManager := newFakeControllerServer(t)
+	ctx := context.Background()
+
+	_, err := cs.CreateVolume(ctx, newCreateVolumeRequest("pvc-1", GbToBytes))
+	require.NoError(t, err, "volume should be created")
+
+	_, err = cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: "pvc-1"})
+	require.NoError(t, err, "volume should be deleted")
+	disk, err := diskManager.FindDiskByName("pvc-1")
+	assert.NoError(t, err, "disk should be looked up")
+	assert.Nil(t, disk, "disk of a deleted volume should not exist")
+
+	_, err = cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: "pvc-1"})
+	assert.NoError(t, err, "deleting a missing volume should succeed")
+
+	createResp, err := cs.CreateVolume(ctx, newCreateVolumeRequest("pvc-2", GbToBytes))
+	require.NoError(t, err, "volume should be created")
+	_, err = cs.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+		VolumeId:         "pvc-2",
+		NodeId:           "node-1",
+		VolumeCapability: newCreateVolumeRequest("pvc-2", GbToBytes).GetVolumeCapabilities()[0],
+		VolumeContext:    createResp.GetVolume().GetVolumeContext(),
+	})
+	require.NoError(t, err, "volume should be published")
+	_, err = cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: "pvc-2"})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), "deleting an attached volume should fail")
+	assert.Contains(t, err.Error(), "node-1", "error should name the node of the attachment")
+	disk, err = diskManager.FindDiskByName("pvc-2")
+	assert.NoError(t, err, "disk should be looked up")
+	assert.NotNil(t, disk, "disk of an attached volume should not be deleted")
+
+	diskManager.SetError(fake.OperationRefresh, fmt.Errorf("unauthorized"))
+	_, err = cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: "pvc-1"})
+	assert.Error(t, err, "deletion should fail if the token cannot be refreshed")
+}
+
+func TestControllerPublishVolume(t *testing.T) {
+	cs, diskManager := newFakeControllerServer(t)
+	ctx := context.Background()
+	diskManager.AddVM("node-2")
+
+	createResp, err := cs.CreateVolume(ctx, newCreateVolumeRequest("pvc-1", GbToBytes))
+	require.NoError(t, err, "volume should be created")
+	publishReq := func(nodeID string) *csi.ControllerPublishVolumeRequest {
+		return &csi.ControllerPublishVolumeRequest{
+			VolumeId:         "pvc-1",
+			NodeId:           nodeID,
+			VolumeCapability: newCreateVolumeRequest("pvc-1", GbToBytes).GetVolumeCapabilities()[0],
+			VolumeContext:    createResp.GetVolume().GetVolumeContext(),
+		}
+	}
+
+	diskManager.SetError(fake.OperationAttachDisk, fmt.Errorf("unable to reconfigure VM"))
+	_, err = cs.ControllerPublishVolume(ctx, publishReq("node-1"))
+	assert.Error(t, err, "publishing should fail with the error of VCD")
+	assert.Empty(t, diskManager.AttachedVMs("pvc-1"), "failed attachment should leave the disk detached")
+	diskManager.SetError(fake.OperationAttachDisk, nil)
+
+	resp, err := cs.ControllerPublishVolume(ctx, publishReq("node-1"))
+	require.NoError(t, err, "volume should be published")
+	assert.Equal(t, "node-1", resp.GetPublishContext()[VMFullNameAttribute], "VM of the node should be published")
+	assert.Equal(t, []string{"node-1"}, diskManager.AttachedVMs("pvc-1"), "disk should be attached to the node")
+
+	_, err = cs.ControllerPublishVolume(ctx, publishReq("node-1"))
+	assert.NoError(t, err, "retried publishing should succeed")
+
+	_, err = cs.ControllerPublishVolume(ctx, publishReq("node-2"))
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err),
+		"publishing a disk that is not shareable to another node should fail")
+
+	_, err = cs.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{
+		VolumeId: "pvc-1",
+		NodeId:   "node-1",
+	})
+	require.NoError(t, err, "volume should be unpublished")
+	assert.Empty(t, diskManager.AttachedVMs("pvc-1"), "disk should be detached from the node")
+}
+
+func TestControllerPublishSharedVolume(t *testing.T) {
+	cs, diskManager := newFakeControllerServer(t)
+	ctx := context.Background()
+	diskManager.AddVM("node-2")
+
+	createReq := newCreateVolumeRequest("pvc-1", GbToBytes)
+	createReq.VolumeCapabilities[0].AccessMode.Mode = csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER
+	createResp, err := cs.CreateVolume(ctx, createReq)
+	require.NoError(t, err, "shareable volume should be created")
+	publishReq := func(nodeID string) *csi.ControllerPublishVolumeRequest {
+		return &csi.ControllerPublishVolumeRequest{
+			VolumeId:         "pvc-1",
+			NodeId:           nodeID,
+			VolumeCapability: createReq.GetVolumeCapabilities()[0],
+			VolumeContext:    createResp.GetVolume().GetVolumeContext(),
+		}
+	}
+
+	for _, nodeID := range []string{"node-1", "node-2"} {
+		_, err = cs.ControllerPublishVolume(ctx, publishReq(nodeID))
+		require.NoError(t, err, "shareable volume should be published to node [%s]", nodeID)
+	}
+	assert.Equal(t, []string{"node-1", "node-2"}, diskManager.AttachedVMs("pvc-1"),
+		"shareable disk should be attached to both nodes")
+
+	// VCD fails to attach a disk to a VM that it is already attached to
+	diskManager.SetError(fake.OperationAttachDisk, fmt.Errorf("disk is already attached"))
+	for _, nodeID := range []string{"node-1", "node-2"} {
+		_, err = cs.ControllerPublishVolume(ctx, publishReq(nodeID))
+		assert.NoError(t, err, "retried publishing of shareable volume to node [%s] should not attach the disk again",
+			nodeID)
+	}
+}
+
+func TestControllerUnpublishVolumeRetried(t *testing.T) {
+	cs, diskManager := newFakeControllerServer(t)
+	ctx := context.Background()
+	diskManager.AddVM("node-2")
+
+	createResp, err := cs.CreateVolume(ctx, newCreateVolumeRequest("pvc-1", GbToBytes))
+	require.NoError(t, err, "volume should be created")
+	_, err = cs.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+		VolumeId:         "pvc-1",
+		NodeId:           "node-1",
+		VolumeCapability: newCreateVolumeRequest("pvc-1", GbToBytes).GetVolumeCapabilities()[0],
+		VolumeContext:    createResp.GetVolume().GetVolumeContext(),
+	})
+	require.NoError(t, err, "volume should be published")
+	unpublishReq := func(nodeID string) *csi.ControllerUnpublishVolumeRequest {
+		return &csi.ControllerUnpublishVolumeRequest{
+			VolumeId: "pvc-1",
+			NodeId:   nodeID,
+		}
+	}
+
+	// VCD fails to detach a disk from a VM that it is not attached to
+	diskManager.SetError(fake.OperationDetachDisk, fmt.Errorf("disk is not attached"))
+	_, err = cs.ControllerUnpublishVolume(ctx, unpublishReq("node-2"))
+	assert.NoError(t, err, "unpublishing from a node that the disk is not attached to should not detach the disk")
+	assert.Equal(t, []string{"node-1"}, diskManager.AttachedVMs("pvc-1"),
+		"disk should stay attached to the node that it is published to")
+	diskManager.SetError(fake.OperationDetachDisk, nil)
+
+	_, err = cs.ControllerUnpublishVolume(ctx, unpublishReq("node-1"))
+	require.NoError(t, err, "volume should be unpublished")
+	assert.Empty(t, diskManager.AttachedVMs("pvc-1"), "disk should be detached from the node")
+
+	diskManager.SetError(fake.OperationDetachDisk, fmt.Errorf("disk is not attached"))
+	_, err = cs.ControllerUnpublishVolume(ctx, unpublishReq("node-1"))
+	assert.NoError(t, err, "retried unpublishing should succeed")
+}
+
+func TestSnapshots(t *testing.T) {
+	cs, diskManager := newFakeControllerServer(t)
+	ctx := context.Background()
+	_, err := cs.CreateVolume(ctx, newCreateVolumeRequest("pvc-1", GbToBytes))
+	require.NoError(t, err, "volume should be created")
+
+	resp, err := cs.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{SourceVolumeId: "pvc-1", Name: "snapshot-1"})
+	require.NoError(t, err, "snapshot should be created")
+	snapshot := resp.GetSnapshot()
+	assert.True(t, vcdcsiclient.IsDiskSnapshotURN(snapshot.GetSnapshotId()), "snapshot ID should be its URN")
+	assert.Equal(t, "pvc-1", snapshot.GetSourceVolumeId(), "snapshot should reference its volume")
+	assert.EqualValues(t, GbToBytes, snapshot.GetSizeBytes(), "snapshot should have the size of its volume")
+	assert.NotNil(t, snapshot.GetCreationTime(), "snapshot should have a creation time")
+	assert.True(t, snapshot.GetReadyToUse(), "snapshot should be ready to use")
+
+	resp, err = cs.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{SourceVolumeId: "pvc-1", Name: "snapshot-1"})
+	require.NoError(t, err, "snapshot that exists should be returned")
+	assert.Equal(t, snapshot.GetSnapshotId(), resp.GetSnapshot().GetSnapshotId(),
+		"snapshot with the same name should not be created again")
+
+	listResp, err := cs.ListSnapshots(ctx, &csi.ListSnapshotsRequest{})
+	require.NoError(t, err, "snapshots should be listed")
+	require.Len(t, listResp.GetEntries(), 1, "the snapshot should be listed")
+	assert.Equal(t, snapshot.GetSnapshotId(), listResp.GetEntries()[0].GetSnapshot().GetSnapshotId(),
+		"listed snapshot should be the created one")
+
+	_, err = cs.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{SourceVolumeId: "pvc-1"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), "snapshot without a name should be rejected")
+	_, err = cs.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{SourceVolumeId: "missing-pvc", Name: "snapshot-2"})
+	assert.Equal(t, codes.NotFound, status.Code(err), "snapshot of a missing volume should not be found")
+	diskManager.SetError(fake.OperationCreateSnapshot, vcdcsiclient.NewDiskError(
+		vcdcsiclient.ErrSnapshotsUnsupported, "pvc-1", nil))
+	_, err = cs.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{SourceVolumeId: "pvc-1", Name: "snapshot-2"})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err),
+		"snapshot of a disk that VCD does not snapshot should fail clearly")
+	diskManager.SetError(fake.OperationCreateSnapshot, nil)
+
+	_, err = cs.DeleteSnapshot(ctx, &csi.DeleteSnapshotRequest{SnapshotId: snapshot.GetSnapshotId()})
+	require.NoError(t, err, "snapshot should be deleted")
+	_, err = cs.DeleteSnapshot(ctx, &csi.DeleteSnapshotRequest{SnapshotId: snapshot.GetSnapshotId()})
+	assert.NoError(t, err, "deleting a deleted snapshot should succeed")
+	_, err = cs.DeleteSnapshot(ctx, &csi.DeleteSnapshotRequest{SnapshotId: "snapshot-1"})
+	assert.NoError(t, err, "deleting a snapshot that the driver never created should succeed")
+	listResp, err = cs.ListSnapshots(ctx, &csi.ListSnapshotsRequest{})
+	require.NoError(t, err, "snapshots should be listed")
+	assert.Empty(t, listResp.GetEntries(), "deleted snapshot should not be listed")
+
+	advertised := map[csi.ControllerServiceCapability_RPC_Type]bool{}
+	for _, capability := range cs.Driver.controllerServiceCapabilities {
+		advertised[capability.GetRpc().GetType()] = true
+	}
+	assert.True(t, advertised[csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT],
+		"creating and deleting snapshots should be advertised")
+}
+
+func TestListSnapshots(t *testing.T) {
+	cs, _ := newFakeControllerServer(t)
+	ctx := context.Background()
+	var snapshotIDs []string
+	for _, snapshot := range []struct{ volumeID, name string }{
+		{"pvc-1", "snapshot-1"}, {"pvc-1", "snapshot-2"}, {"pvc-2", "snapshot-3"},
+	} {
+		_, err := cs.CreateVolume(ctx, newCreateVolumeRequest(snapshot.volumeID, GbToBytes))
+		require.NoError(t, err, "volume should be created")
+		resp, err := cs.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{SourceVolumeId: snapshot.volumeID,
+			Name: snapshot.name})
+		require.NoError(t, err, "snapshot should be created")
+		snapshotIDs = append(snapshotIDs, resp.GetSnapshot().GetSnapshotId())
+	}
+	listSnapshotIDs := func(req *csi.ListSnapshotsRequest) []string {
+		resp, err := cs.ListSnapshots(ctx, req)
+		require.NoError(t, err, "snapshots should be listed for [%#v]", req)
+		ids := make([]string, 0)
+		for _, entry := range resp.GetEntries() {
+			ids = append(ids, entry.GetSnapshot().GetSnapshotId())
+		}
+		return ids
+	}
+
+	assert.Equal(t, snapshotIDs, listSnapshotIDs(&csi.ListSnapshotsRequest{}), "every snapshot should be listed")
+	assert.Equal(t, snapshotIDs[1:2], listSnapshotIDs(&csi.ListSnapshotsRequest{SnapshotId: snapshotIDs[1]}),
+		"only the snapshot with the ID should be listed")
+	assert.Empty(t, listSnapshotIDs(&csi.ListSnapshotsRequest{SnapshotId: snapshotIDs[1], SourceVolumeId: "pvc-2"}),
+		"snapshot of another volume should not be listed")
+	assert.Empty(t, listSnapshotIDs(&csi.ListSnapshotsRequest{SnapshotId: vcdcsiclient.DiskSnapshotURNPrefix + "404"}),
+		"missing snapshot should not be listed")
+	assert.Empty(t, listSnapshotIDs(&csi.ListSnapshotsRequest{SnapshotId: "snapshot-1"}),
+		"snapshot that the driver never created should not be listed")
+	assert.Equal(t, snapshotIDs[:2], listSnapshotIDs(&csi.ListSnapshotsRequest{SourceVolumeId: "pvc-1"}),
+		"only the snapshots of the volume should be listed")
+	assert.Empty(t, listSnapshotIDs(&csi.ListSnapshotsRequest{SourceVolumeId: "missing-pvc"}),
+		"missing volume should have no snapshots")
+
+	resp, err := cs.ListSnapshots(ctx, &csi.ListSnapshotsRequest{MaxEntries: 2})
+	require.NoError(t, err, "first page of snapshots should be listed")
+	require.Len(t, resp.GetEntries(), 2, "first page should have the max entries")
+	assert.Equal(t, "2", resp.GetNextToken(), "first page should have the token of the next page")
+	resp, err = cs.ListSnapshots(ctx, &csi.ListSnapshotsRequest{MaxEntries: 2, StartingToken: resp.GetNextToken()})
+	require.NoError(t, err, "last page of snapshots should be listed")
+	require.Len(t, resp.GetEntries(), 1, "last page should have the remaining snapshot")
+	assert.Equal(t, snapshotIDs[2], resp.GetEntries()[0].GetSnapshot().GetSnapshotId(),
+		"last page should continue the first one")
+	assert.Empty(t, resp.GetNextToken(), "last page should have no next token")
+
+	for _, startingToken := range []string{"page-2", "-1", "4"} {
+		_, err = cs.ListSnapshots(ctx, &csi.ListSnapshotsRequest{StartingToken: startingToken})
+		assert.Equal(t, codes.Aborted, status.Code(err), "starting token [%s] should be rejected", startingToken)
+	}
+	_, err = cs.ListSnapshots(ctx, &csi.ListSnapshotsRequest{MaxEntries: -1})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), "negative max entries should be rejected")
+
+	advertised := false
+	for _, capability := range cs.Driver.controllerServiceCapabilities {
+		advertised = advertised || capability.GetRpc().GetType() == csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS
+	}
+	assert.True(t, advertised, "listing snapshots should be advertised")
+}
+
+func TestCreateVolumeFromSnapshot(t *testing.T) {
+	cs, diskManager := newFakeControllerServer(t)
+	ctx := context.Background()
+	_, err := cs.CreateVolume(ctx, newCreateVolumeRequest("pvc-1", GbToBytes))
+	require.NoError(t, err, "volume should be created")
+	snapshotResp, err := cs.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{SourceVolumeId: "pvc-1", Name: "snapshot-1"})
+	require.NoError(t, err, "snapshot should be created")
+	snapshotID := snapshotResp.GetSnapshot().GetSnapshotId()
+	newRestoreRequest := func(name string, requiredBytes int64, snapshotID string) *csi.CreateVolumeRequest {
+		req := newCreateVolumeRequest(name, requiredBytes)
+		req.VolumeContentSource = &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Snapshot{
+				Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: snapshotID},
+			},
+		}
+		return req
+	}
+
+	resp, err := cs.CreateVolume(ctx, newRestoreRequest("pvc-2", GbToBytes/2, snapshotID))
+	require.NoError(t, err, "volume should be restored from the snapshot")
+	assert.Equal(t, GbToBytes, resp.GetVolume().GetCapacityBytes(),
+		"volume smaller than the snapshot should have the size of the snapshot")
+	assert.Equal(t, snapshotID, resp.GetVolume().GetContentSource().GetSnapshot().GetSnapshotId(),
+		"volume should have the snapshot as its content source")
+	retriedResp, err := cs.CreateVolume(ctx, newRestoreRequest("pvc-2", GbToBytes/2, snapshotID))
+	require.NoError(t, err, "retried restore should succeed")
+	assert.Equal(t, resp.GetVolume().GetVolumeContext()[DiskIDAttribute],
+		retriedResp.GetVolume().GetVolumeContext()[DiskIDAttribute], "retried restore should return the same disk")
+
+	resp, err = cs.CreateVolume(ctx, newRestoreRequest("pvc-3", 2*GbToBytes, snapshotID))
+	require.NoError(t, err, "larger volume should be restored from the snapshot")
+	assert.Equal(t, 2*GbToBytes, resp.GetVolume().GetCapacityBytes(), "volume should have the requested size")
+
+	req := newRestoreRequest("pvc-4", GbToBytes/2, snapshotID)
+	req.CapacityRange.LimitBytes = GbToBytes / 2
+	_, err = cs.CreateVolume(ctx, req)
+	assert.Equal(t, codes.OutOfRange, status.Code(err), "snapshot larger than the limit should not be restored")
+	req = newRestoreRequest("pvc-4", GbToBytes, snapshotID)
+	req.Parameters[IopsParameter] = "500"
+	_, err = cs.CreateVolume(ctx, req)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), "restored volume should not take IOPS")
+	req = newRestoreRequest("pvc-4", GbToBytes, snapshotID)
+	req.Parameters[EncryptionPolicyParameter] = "policy-1"
+	_, err = cs.CreateVolume(ctx, req)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), "restored volume should not take an encryption policy")
+	_, err = cs.CreateVolume(ctx, newRestoreRequest("pvc-4", GbToBytes, vcdcsiclient.DiskSnapshotURNPrefix+"404"))
+	assert.Equal(t, codes.NotFound, status.Code(err), "missing snapshot should not be restored")
+	_, err = cs.CreateVolume(ctx, newRestoreRequest("pvc-4", GbToBytes, "snapshot-1"))
+	assert.Equal(t, codes.NotFound, status.Code(err), "snapshot that the driver never created should not be found")
+	disk, err := diskManager.FindDiskByName("pvc-4")
+	assert.NoError(t, err, "disk should be looked up")
+	assert.Nil(t, disk, "failed restores should leave no disk")
+}
+
+func TestCreateVolumeFromVolume(t *testing.T) {
+	cs, diskManager := newFakeControllerServer(t)
+	ctx := context.Background()
+	createResp, err := cs.CreateVolume(ctx, newCreateVolumeRequest("pvc-1", GbToBytes))
+	require.NoError(t, err, "volume should be created")
+	newCloneRequest := func(name string, requiredBytes int64, volumeID string) *csi.CreateVolumeRequest {
+		req := newCreateVolumeRequest(name, requiredBytes)
+		req.VolumeContentSource = &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Volume{
+				Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: volumeID},
+			},
+		}
+		return req
+	}
+
+	resp, err := cs.CreateVolume(ctx, newCloneRequest("pvc-2", GbToBytes/2, "pvc-1"))
+	require.NoError(t, err, "volume should be cloned")
+	assert.Equal(t, GbToBytes, resp.GetVolume().GetCapacityBytes(),
+		"clone smaller than its source should have the size of the source")
+	assert.Equal(t, "pvc-1", resp.GetVolume().GetContentSource().GetVolume().GetVolumeId(),
+		"clone should have its source volume as its content source")
+	resp, err = cs.CreateVolume(ctx, newCloneRequest("pvc-3", 2*GbToBytes, "pvc-1"))
+	require.NoError(t, err, "larger volume should be cloned")
+	assert.Equal(t, 2*GbToBytes, resp.GetVolume().GetCapacityBytes(), "clone should have the requested size")
+
+	_, err = cs.CreateVolume(ctx, newCloneRequest("pvc-4", GbToBytes, "missing-pvc"))
+	assert.Equal(t, codes.NotFound, status.Code(err), "missing volume should not be cloned")
+	_, err = cs.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+		VolumeId:         "pvc-1",
+		NodeId:           "node-1",
+		VolumeCapability: newCreateVolumeRequest("pvc-1", GbToBytes).GetVolumeCapabilities()[0],
+		VolumeContext:    createResp.GetVolume().GetVolumeContext(),
+	})
+	require.NoError(t, err, "volume should be published")
+	_, err = cs.CreateVolume(ctx, newCloneRequest("pvc-4", GbToBytes, "pvc-1"))
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), "attached volume should not be cloned")
+	disk, err := diskManager.FindDiskByName("pvc-4")
+	assert.NoError(t, err, "disk should be looked up")
+	assert.Nil(t, disk, "failed clones should leave no disk")
+
+	_, err = cs.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{VolumeId: "pvc-1",
+		NodeId: "node-1"})
+	require.NoError(t, err, "volume should be unpublished")
+	_, err = cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: "pvc-1"})
+	require.NoError(t, err, "source volume should be deleted")
+	_, err = cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: "pvc-2"})
+	require.NoError(t, err, "clone should be deleted on its own")
+}
+
+func TestControllerPublishVolumeToPoweredOffVM(t *testing.T) {
+	cs, diskManager := newFakeControllerServer(t)
+	ctx := context.Background()
+	diskManager.PowerOffVM("node-1")
+
+	createResp, err := cs.CreateVolume(ctx, newCreateVolumeRequest("pvc-1", GbToBytes))
+	require.NoError(t, err, "volume should be created")
+	publishReq := &csi.ControllerPublishVolumeRequest{
+		VolumeId:         "pvc-1",
+		NodeId:           "node-1",
+		VolumeCapability: newCreateVolumeRequest("pvc-1", GbToBytes).GetVolumeCapabilities()[0],
+		VolumeContext:    createResp.GetVolume().GetVolumeContext(),
+	}
+
+	_, err = cs.ControllerPublishVolume(ctx, publishReq)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err),
+		"publishing to a powered off VM should fail unless offline attaches are allowed")
+	assert.Empty(t, diskManager.AttachedVMs("pvc-1"), "disk should not be attached to the powered off VM")
+
+	diskManager.AllowOfflineAttach = true
+	_, err = cs.ControllerPublishVolume(ctx, publishReq)
+	require.NoError(t, err, "volume should be published to a powered off VM once offline attaches are allowed")
+	assert.Equal(t, []string{"node-1"}, diskManager.AttachedVMs("pvc-1"), "disk should be attached offline")
+}
+
+// gaugeValue returns the value of the gauge name with the label values labels from the default registry, or -1 if
+// the registry has no such gauge
+func gaugeValue(t *testing.T, name string, labels map[string]string) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	require.NoError(t, err, "metrics should be gathered")
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			metricLabels := make(map[string]string)
+			for _, label := range metric.GetLabel() {
+				metricLabels[label.GetName()] = label.GetValue()
+			}
+			if assert.ObjectsAreEqual(labels, metricLabels) {
+				return metric.GetGauge().GetValue()
+			}
+		}
+	}
+	return -1
+}
+
+func TestAttachmentTracking(t *testing.T) {
+	cs, diskManager := newFakeControllerServer(t)
+	ctx := context.Background()
+	diskManager.AddVM("node-metrics")
+
+	publishReq := func(volumeID string, nodeID string) *csi.ControllerPublishVolumeRequest {
+		return &csi.ControllerPublishVolumeRequest{
+			VolumeId:         volumeID,
+			NodeId:           nodeID,
+			VolumeCapability: newCreateVolumeRequest(volumeID, GbToBytes).GetVolumeCapabilities()[0],
+		}
+	}
+	for _, volumeID := range []string{"pvc-1", "pvc-2", "pvc-3"} {
+		_, err := cs.CreateVolume(ctx, newCreateVolumeRequest(volumeID, GbToBytes))
+		require.NoError(t, err, "volume [%s] should be created", volumeID)
+	}
+	for _, volumeID := range []string{"pvc-1", "pvc-2"} {
+		_, err := cs.ControllerPublishVolume(ctx, publishReq(volumeID, "node-metrics"))
+		require.NoError(t, err, "volume [%s] should be published", volumeID)
+	}
+	_, err := cs.ControllerPublishVolume(ctx, publishReq("pvc-3", "node-1"))
+	require.NoError(t, err, "volume should be published")
+	_, err = cs.ControllerPublishVolume(ctx, publishReq("pvc-1", "node-metrics"))
+	require.NoError(t, err, "retried publishing should succeed")
+
+	assert.Equal(t, 2, cs.attachments.attachedCount("node-metrics"), "published volumes should be tracked")
+	assert.Equal(t, 2.0, gaugeValue(t, "vcd_csi_attached_disks", map[string]string{"node": "node-metrics"}),
+		"attached disks of the node should be reported")
+	assert.Equal(t, 3.0, gaugeValue(t, "vcd_csi_cluster_attached_disks", map[string]string{}),
+		"attached disks of the cluster should be reported")
+
+	_, err = cs.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{
+		VolumeId: "pvc-2",
+		NodeId:   "node-metrics",
+	})
+	require.NoError(t, err, "volume should be unpublished")
+	assert.Equal(t, 1, cs.attachments.attachedCount("node-metrics"), "unpublished volume should not be tracked")
+	assert.Equal(t, 1.0, gaugeValue(t, "vcd_csi_attached_disks", map[string]string{"node": "node-metrics"}),
+		"attached disks of the node should be updated")
+
+	// pvc-1 is detached and pvc-2 attached outside of the driver
+	vm, err := diskManager.FindVMByNodeID("node-metrics")
+	require.NoError(t, err, "vm should be found")
+	require.NoError(t, diskManager.DetachVolumeWithContext(ctx, vm, "pvc-1"), "disk should be detached")
+	disk, err := diskManager.GetDiskByName("pvc-2")
+	require.NoError(t, err, "disk should be found")
+	require.NoError(t, diskManager.AttachVolumeAtWithContext(ctx, vm, disk, nil, nil), "disk should be attached")
+	assert.Equal(t, 1, cs.attachments.attachedCount("node-metrics"), "drift should not be tracked until reconciled")
+
+	diskManager.SetError(fake.OperationListDisks, fmt.Errorf("unable to list disks"))
+	assert.Error(t, cs.reconcileAttachments(), "reconciliation should fail if the disks cannot be listed")
+	diskManager.SetError(fake.OperationListDisks, nil)
+
+	require.NoError(t, cs.reconcileAttachments(), "attachments should be reconciled")
+	assert.Equal(t, 1, cs.attachments.attachedCount("node-metrics"), "attachments should be corrected from VCD")
+	assert.True(t, cs.attachments.volumesByNode["node-metrics"]["pvc-2"], "disk attached outside of the driver "+
+		"should be tracked")
+	assert.Equal(t, 1, cs.attachments.attachedCount("node-1"), "attachments that did not drift should be kept")
+	assert.Equal(t, 2.0, gaugeValue(t, "vcd_csi_cluster_attached_disks", map[string]string{}),
+		"attached disks of the cluster should be corrected")
+
+	// the disk of a volume deleted outside of the driver is no longer attached
+	cs.attachments.attached("pvc-missing", "node-1")
+	require.NoError(t, cs.reconcileAttachments(), "attachments should be reconciled")
+	assert.Equal(t, 1, cs.attachments.attachedCount("node-1"), "missing disk should not be tracked")
+
+	cs.attachments.startReconcile()
+	cs.attachments.detached("pvc-3", "node-1")
+	cs.attachments.finishReconcile(map[string][]string{"pvc-3": {"node-1"}})
+	assert.Zero(t, cs.attachments.attachedCount("node-1"),
+		"volume unpublished during the reconciliation should keep its attachments")
+	assert.Equal(t, -1.0, gaugeValue(t, "vcd_csi_attached_disks", map[string]string{"node": "node-1"}),
+		"node without attached disks should not be reported")
+}
+
+func TestCreateVolumeSizeLimits(t *testing.T) {
+	cs, _ := newFakeControllerServer(t)
+	ctx := context.Background()
+	require.NoError(t, cs.Driver.SetVolumeSizeLimits(2*GbToBytes, 4*GbToBytes), "size limits should be set")
+
+	_, err := cs.CreateVolume(ctx, newCreateVolumeRequest("pvc-1", GbToBytes))
+	assert.Equal(t, codes.OutOfRange, status.Code(err), "volume smaller than the minimum should not be created")
+	assert.Contains(t, err.Error(), fmt.Sprintf("[%d] bytes", GbToBytes), "error should name the requested size")
+	assert.Contains(t, err.Error(), fmt.Sprintf("minimum [%d bytes], maximum [%d bytes]", 2*GbToBytes, 4*GbToBytes),
+		"error should name both bounds")
+	_, err = cs.CreateVolume(ctx, newCreateVolumeRequest("pvc-1", 10*GbToBytes))
+	assert.Equal(t, codes.OutOfRange, status.Code(err), "volume larger than the maximum should not be created")
+
+	resp, err := cs.CreateVolume(ctx, newCreateVolumeRequest("pvc-1", 4*GbToBytes))
+	require.NoError(t, err, "volume of the maximum size should be created")
+	assert.Equal(t, 4*GbToBytes, resp.GetVolume().GetCapacityBytes(), "volume should have the requested capacity")
+
+	req := newCreateVolumeRequest("pvc-2", 0)
+	req.CapacityRange = nil
+	resp, err = cs.CreateVolume(ctx, req)
+	require.NoError(t, err, "volume without a requested size should be created")
+	assert.Equal(t, 2*GbToBytes, resp.GetVolume().GetCapacityBytes(), "volume should have the minimum size")
+
+	assert.Error(t, cs.Driver.SetVolumeSizeLimits(4*GbToBytes, 2*GbToBytes),
+		"minimum larger than the maximum should not be set")
+}
+
+func TestParseVolumeSize(t *testing.T) {
+	for size, expected := range map[string]int64{
+		"":      0,
+		"1024":  1024,
+		"10Ti":  10 << 40,
+		"512Mi": 512 << 20,
+		"5G":    5 * 1000 * 1000 * 1000,
+	} {
+		sizeBytes, err := ParseVolumeSize(size)
+		require.NoError(t, err, "size [%s] should be parsed", size)
+		assert.Equal(t, expected, sizeBytes, "unexpected bytes of size [%s]", size)
+	}
+	for _, size := range []string{"-1Gi", "Gi", "1.5Gi", "1Xi", "9999999Pi"} {
+		_, err := ParseVolumeSize(size)
+		assert.Error(t, err, "size [%s] should not be parsed", size)
+	}
+}
+
+func TestBytesToMB(t *testing.T) {
+	for requiredBytes, expected := range map[int64]int64{
+		0:                  0,
+		1:                  1,
+		MbToBytes - 1:      1,
+		MbToBytes:          1,
+		MbToBytes + 1:      2,
+		GbToBytes:          1024,
+		GbToBytes + 1:      1025,
+		1000 * 1000 * 1000: 954,
+	} {
+		assert.Equal(t, expected, bytesToMB(requiredBytes), "unexpected MB of [%d] bytes", requiredBytes)
+	}
+
+	assert.NoError(t, checkCapacityLimit(1, 0), "size without a limit should be accepted")
+	assert.NoError(t, checkCapacityLimit(1, MbToBytes), "size of the limit should be accepted")
+	assert.Error(t, checkCapacityLimit(bytesToMB(MbToBytes+1), MbToBytes+512),
+		"size rounded up beyond the limit should not be accepted")
+}
+
+func TestCreateVolumeRoundsUpToMB(t *testing.T) {
+	cs, _ := newFakeControllerServer(t)
+	ctx := context.Background()
+
+	resp, err := cs.CreateVolume(ctx, newCreateVolumeRequest("pvc-1", GbToBytes+1))
+	require.NoError(t, err, "volume should be created")
+	assert.Equal(t, GbToBytes+MbToBytes, resp.GetVolume().GetCapacityBytes(),
+		"volume should be rounded up to the next MB")
+
+	req := newCreateVolumeRequest("pvc-2", GbToBytes+1)
+	req.CapacityRange.LimitBytes = GbToBytes + 2
+	_, err = cs.CreateVolume(ctx, req)
+	assert.Equal(t, codes.OutOfRange, status.Code(err), "volume rounded up beyond its limit should not be created")
+
+	req = newCreateVolumeRequest("pvc-3", 1)
+	req.Parameters[StorageProfileParameter] = "gold"
+	resp, err = cs.CreateVolume(ctx, req)
+	require.NoError(t, err, "volume should be created")
+	assert.Equal(t, MbToBytes, resp.GetVolume().GetCapacityBytes(), "capacity should be the size of the created disk")
+	assert.Equal(t, "gold", resp.GetVolume().GetVolumeContext()[StorageProfileParameter],
+		"storage profile of the disk should be set")
+}
+
+func TestToUnavailableIfHostUnreachable(t *testing.T) {
+	err := toUnavailableIfHostUnreachable(status.Errorf(codes.Internal,
+		"unable to create disk: [dial tcp 10.0.0.1:443: connect: connection refused]"))
+	assert.Equal(t, codes.Unavailable, status.Code(err), "unreachable VCD host should be reported as unavailable")
+	assert.Contains(t, err.Error(), "connection refused", "message of the error should be kept")
+
+	err = toUnavailableIfHostUnreachable(status.Errorf(codes.NotFound, "volume [pvc-1] does not exist"))
+	assert.Equal(t, codes.NotFound, status.Code(err), "other errors should be kept")
+	err = toUnavailableIfHostUnreachable(fmt.Errorf("unable to refresh: [no such host]"))
+	assert.Equal(t, codes.Unavailable, status.Code(err), "plain unreachable errors should be reported as unavailable")
+}
+
+func TestControllerOperationsAbandonedWithContext(t *testing.T) {
+	cs, diskManager := newFakeControllerServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := cs.CreateVolume(ctx, newCreateVolumeRequest("pvc-1", GbToBytes))
+	assert.Error(t, err, "creation should fail once the caller has given up")
+	disk, err := diskManager.FindDiskByName("pvc-1")
+	assert.NoError(t, err, "disk should be looked up")
+	assert.Nil(t, disk, "disk should not be created once the caller has given up")
+
+	_, err = cs.CreateVolume(context.Background(), newCreateVolumeRequest("pvc-1", GbToBytes))
+	require.NoError(t, err, "volume should be created")
+	_, err = cs.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{
+		VolumeId:      "pvc-1",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 2 * GbToBytes},
+	})
+	assert.Error(t, err, "expansion should fail once the caller has given up")
+	disk, err = diskManager.GetDiskByName("pvc-1")
+	require.NoError(t, err, "disk should be found")
+	assert.Equal(t, GbToBytes/MbToBytes, disk.SizeMB, "disk should not be resized once the caller has given up")
+}
+
+func TestCreateVolumeWithAllocation(t *testing.T) {
+	cs, diskManager := newFakeControllerServer(t)
+	ctx := context.Background()
+	withAllocation := func(name string, allocation string) *csi.CreateVolumeRequest {
+		req := newCreateVolumeRequest(name, GbToBytes)
+		req.Parameters[AllocationParameter] = allocation
+		return req
+	}
+
+	_, err := cs.CreateVolume(ctx, withAllocation("pvc-1", AllocationThin))
+	assert.Equal(t, codes.InvalidArgument, status.Code(err),
+		"thin disk should not be created in a VDC that is not thin provisioned")
+	assert.Contains(t, err.Error(), "[thick]", "error should name the allocation of the profile")
+	for _, allocation := range []string{AllocationThick, AllocationEagerZeroed} {
+		diskManager.ThinProvisioned = allocation == AllocationEagerZeroed
+		_, err = cs.CreateVolume(ctx, withAllocation("pvc-1", allocation))
+		assert.Equal(t, codes.InvalidArgument, status.Code(err),
+			"disk with allocation [%s] should be rejected since VCD does not take it", allocation)
+	}
+	_, err = cs.CreateVolume(ctx, withAllocation("pvc-1", "sparse"))
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), "unknown allocation should not be accepted")
+
+	diskManager.ThinProvisioned = true
+	_, err = cs.CreateVolume(ctx, withAllocation("pvc-1", AllocationThin))
+	assert.NoError(t, err, "thin disk should be created in a thin provisioned VDC")
+
+	diskManager.SetError(fake.OperationGetVDCThinProvisioned, fmt.Errorf("forbidden"))
+	_, err = cs.CreateVolume(ctx, newCreateVolumeRequest("pvc-2", GbToBytes))
+	assert.NoError(t, err, "disk without an allocation should be created without checking the VDC")
+}
+
+func TestNodeGetInfo(t *testing.T) {
+	driver, err := NewDriver("node-1", "unix:///tmp/csi.sock")
+	require.NoError(t, err, "driver should be created")
+	nodeServer := NewNodeService(driver, "node-1", "vdc")
+
+	resp, err := nodeServer.NodeGetInfo(context.Background(), &csi.NodeGetInfoRequest{})
+	require.NoError(t, err, "node info should be returned")
+	assert.Equal(t, "node-1", resp.NodeId, "node ID should be the name of the VM of the node")
+	assert.Equal(t, int64(defaultMaxVolumesPerNode), resp.MaxVolumesPerNode,
+		"node should report the default maximum number of volumes")
+	assert.Equal(t, map[string]string{TopologyVDCKey: "vdc"}, resp.AccessibleTopology.GetSegments(),
+		"node should report its VDC as its topology")
+
+	require.NoError(t, driver.SetMaxVolumesPerNode(30), "max volumes per node should be set")
+	resp, err = nodeServer.NodeGetInfo(context.Background(), &csi.NodeGetInfoRequest{})
+	require.NoError(t, err, "node info should be returned")
+	assert.Equal(t, int64(30), resp.MaxVolumesPerNode, "node should report the configured maximum number of volumes")
+
+	nodeServer.(*nodeService).VMID = "7d5a3d2c-0d15-4d3c-9bb6-c1f1f9a3c2e1"
+	resp, err = nodeServer.NodeGetInfo(context.Background(), &csi.NodeGetInfoRequest{})
+	require.NoError(t, err, "node info should be returned")
+	assert.Equal(t, map[string]string{TopologyVDCKey: "vdc", TopologyVMKey: "7d5a3d2c-0d15-4d3c-9bb6-c1f1f9a3c2e1"},
+		resp.AccessibleTopology.GetSegments(), "node should report the ID of its VM in its topology")
+
+	assert.Error(t, driver.SetMaxVolumesPerNode(0), "node should be able to have a volume")
+	assert.Error(t, driver.SetMaxVolumesPerNode(maxSCSIVolumesPerNode+1),
+		"node should not have more volumes than its SCSI buses")
+}
+
+// fakeNodeVMIDReader returns the VM IDs of the nodes from a map
+type fakeNodeVMIDReader map[string]string
+
+func (reader fakeNodeVMIDReader) GetNodeVMID(ctx context.Context, nodeID string) (string, error) {
+	return reader[nodeID], nil
+}
+
+func TestFindNodeVMByID(t *testing.T) {
+	cs, diskManager := newFakeControllerServer(t)
+	ctx := context.Background()
+	diskManager.AddVM("node-2")
+	assert.Equal(t, "node-1", findNodeVMID(diskManager, "node-1"), "node should report the UUID of its VM")
+	assert.Empty(t, findNodeVMID(diskManager, "node-3"), "node without a VM should report no VM ID")
+
+	cs.Driver.nodeVMIDReader = fakeNodeVMIDReader{"node-1": "node-1", "node-2": "node-1"}
+	diskManager.SetError(fake.OperationFindVM, fmt.Errorf("VDC should not be searched"))
+	vm, err := cs.findNodeVM(ctx, diskManager, "node-1")
+	require.NoError(t, err, "VM should be found by its ID")
+	assert.Equal(t, "node-1", vm.VM.Name, "VM of the node should be found")
+
+	createResp, err := cs.CreateVolume(ctx, newCreateVolumeRequest("pvc-1", GbToBytes))
+	require.NoError(t, err, "volume should be created")
+	_, err = cs.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+		VolumeId:         "pvc-1",
+		NodeId:           "node-1",
+		VolumeCapability: newCreateVolumeRequest("pvc-1", GbToBytes).GetVolumeCapabilities()[0],
+		VolumeContext:    createResp.GetVolume().GetVolumeContext(),
+	})
+	assert.NoError(t, err, "volume should be published to the VM found by its ID")
+
+	_, err = cs.findNodeVM(ctx, diskManager, "node-2")
+	assert.Error(t, err, "VM of another node should not be used")
+	diskManager.SetError(fake.OperationFindVM, nil)
+	vm, err = cs.findNodeVM(ctx, diskManager, "node-2")
+	require.NoError(t, err, "VM should be found by name if the VM of the ID is of another node")
+	assert.Equal(t, "node-2", vm.VM.Name, "VM of the node should be found by name")
+
+	diskManager.SetError(fake.OperationFindVMByID, fmt.Errorf("VM not found"))
+	vm, err = cs.findNodeVM(ctx, diskManager, "node-1")
+	require.NoError(t, err, "VM should be found by name if it is not found by its ID")
+	assert.Equal(t, "node-1", vm.VM.Name, "VM of the node should be found by name")
+}
+
+// fakeAttachmentLister returns the expected attachments and the nodes that it is created with
+type fakeAttachmentLister struct {
+	expected map[string]map[string]bool
+	nodeIDs  map[string]bool
+}
+
+func (lister *fakeAttachmentLister) ListExpectedAttachments(ctx context.Context) (map[string]map[string]bool,
+	error) {
+	return lister.expected, nil
+}
+
+func (lister *fakeAttachmentLister) ListNodeIDs(ctx context.Context) (map[string]bool, error) {
+	return lister.nodeIDs, nil
+}
+
+func TestAttachmentRepairer(t *testing.T) {
+	cs, diskManager := newFakeControllerServer(t)
+	ctx := context.Background()
+	diskManager.AddVM("node-2")
+	diskManager.AddVM("node-3")
+	for volumeID, nodeID := range map[string]string{"pvc-1": "node-1", "pvc-2": "node-2", "pvc-3": "node-3"} {
+		createResp, err := cs.CreateVolume(ctx, newCreateVolumeRequest(volumeID, GbToBytes))
+		require.NoError(t, err, "volume should be created")
+		_, err = cs.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+			VolumeId:         volumeID,
+			NodeId:           nodeID,
+			VolumeCapability: newCreateVolumeRequest(volumeID, GbToBytes).GetVolumeCapabilities()[0],
+			VolumeContext:    createResp.GetVolume().GetVolumeContext(),
+		})
+		require.NoError(t, err, "volume should be published")
+	}
+
+	// node-2 was removed from the cluster, and node-3 has a volume attached outside of Kubernetes
+	repairer := &AttachmentRepairer{
+		cs: cs,
+		attachmentLister: &fakeAttachmentLister{
+			expected: map[string]map[string]bool{"pvc-1": {"node-1": true}, "pvc-4": {"node-4": true}},
+			nodeIDs:  map[string]bool{"node-1": true, "node-3": true},
+		},
+		interval:  time.Minute,
+		suspected: make(map[diskAttachment]bool),
+	}
+	require.NoError(t, repairer.repair(ctx), "attachments should be checked")
+	assert.Equal(t, []string{"node-2"}, diskManager.AttachedVMs("pvc-2"),
+		"orphaned attachment should not be detached at the first check")
+
+	require.NoError(t, repairer.repair(ctx), "attachments should be repaired")
+	assert.Empty(t, diskManager.AttachedVMs("pvc-2"), "orphaned attachment should be force-detached")
+	assert.Equal(t, []string{"node-1"}, diskManager.AttachedVMs("pvc-1"), "expected attachment should be kept")
+	assert.Equal(t, []string{"node-3"}, diskManager.AttachedVMs("pvc-3"),
+		"attachment to a node of the cluster should be kept")
+	assert.Empty(t, repairer.suspected, "no attachment should be suspected once repaired")
+
+	diskManager.SetError(fake.OperationListDisks, fmt.Errorf("VCD unreachable"))
+	assert.Error(t, repairer.repair(ctx), "repair should fail if the disks cannot be listed")
+}
+
+func TestSetDeviceReadyPolling(t *testing.T) {
+	driver, err := NewDriver("node-1", "unix:///tmp/csi.sock")
+	require.NoError(t, err, "driver should be created")
+	assert.Equal(t, defaultDeviceReadyTimeout, driver.deviceReadyTimeout, "default timeout should be set")
+	assert.Equal(t, defaultDeviceReadyInterval, driver.deviceReadyInterval, "default interval should be set")
+
+	require.NoError(t, driver.SetDeviceReadyPolling(5*time.Minute, 2*time.Second), "polling should be set")
+	assert.Equal(t, 5*time.Minute, driver.deviceReadyTimeout, "timeout should be set")
+	assert.Equal(t, 2*time.Second, driver.deviceReadyInterval, "interval should be set")
+
+	assert.Error(t, driver.SetDeviceReadyPolling(0, time.Second), "timeout should be positive")
+	assert.Error(t, driver.SetDeviceReadyPolling(time.Minute, 0), "interval should be positive")
+	assert.Error(t, driver.SetDeviceReadyPolling(time.Second, time.Minute),
+		"interval should not be longer than the timeout")
+	assert.Equal(t, 5*time.Minute, driver.deviceReadyTimeout, "invalid polling should not be set")
+}
+
+func TestOperationLimiter(t *testing.T) {
+	limiter := newOperationLimiter(2)
+	releaseFirst, err := limiter.acquire(context.Background(), "create disk [pvc-1]")
+	require.NoError(t, err, "first operation should run")
+	releaseSecond, err := limiter.acquire(context.Background(), "create disk [pvc-2]")
+	require.NoError(t, err, "second operation should run")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = limiter.acquire(ctx, "create disk [pvc-3]")
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err), "operation beyond the limit should wait for its deadline")
+
+	acquired := make(chan error)
+	go func() {
+		release, err := limiter.acquire(context.Background(), "create disk [pvc-4]")
+		if err == nil {
+			release()
+		}
+		acquired <- err
+	}()
+	releaseFirst()
+	select {
+	case err := <-acquired:
+		assert.NoError(t, err, "waiting operation should run once a slot is released")
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiting operation should run once a slot is released")
+	}
+	releaseSecond()
+
+	unlimited := newOperationLimiter(0)
+	for i := 0; i < 10; i++ {
+		_, err := unlimited.acquire(context.Background(), "create disk")
+		require.NoError(t, err, "operations should not be limited")
+	}
+}
+
+func TestSetMaxConcurrentOperations(t *testing.T) {
+	driver, err := NewDriver("node-1", "unix:///tmp/csi.sock")
+	require.NoError(t, err, "driver should be created")
+	assert.Equal(t, 0, driver.maxConcurrentOperations, "operations should not be limited by default")
+
+	require.NoError(t, driver.SetMaxConcurrentOperations(4), "limit should be set")
+	assert.Equal(t, 4, driver.maxConcurrentOperations, "limit should be set")
+	assert.Error(t, driver.SetMaxConcurrentOperations(-1), "limit should not be negative")
+	assert.Equal(t, 4, driver.maxConcurrentOperations, "invalid limit should not be set")
+}
+
+func TestRescanSCSIHosts(t *testing.T) {
+	scsiHostPath := t.TempDir()
+	for _, host := range []string{"host0", "host1"} {
+		require.NoError(t, os.Mkdir(filepath.Join(scsiHostPath, host), 0700), "host should be created")
+		require.NoError(t, ioutil.WriteFile(filepath.Join(scsiHostPath, host, "scan"), nil, 0600),
+			"scan file should be created")
+	}
+
+	require.NoError(t, rescanSCSIHosts(scsiHostPath), "SCSI hosts should be rescanned")
+	for _, host := range []string{"host0", "host1"} {
+		scan, err := ioutil.ReadFile(filepath.Join(scsiHostPath, host, "scan"))
+		require.NoError(t, err, "scan file should be read")
+		assert.Equal(t, "- - -", string(scan), "all channels, targets and LUNs of [%s] should be scanned", host)
+	}
+
+	assert.NoError(t, rescanSCSIHosts(filepath.Join(scsiHostPath, "missing")),
+		"node without SCSI hosts should not fail")
+}
+
+func TestAttachDetachRetriedWhileVMBusy(t *testing.T) {
+	cs, diskManager := newFakeControllerServer(t)
+	ctx := context.Background()
+	cs.Driver.attachDetachRetryDelay = time.Millisecond
+	busy := fmt.Errorf("API Error: 400: [ BUSY_ENTITY ] The entity VM node-1 is busy completing an operation")
+
+	createResp, err := cs.CreateVolume(ctx, newCreateVolumeRequest("pvc-1", GbToBytes))
+	require.NoError(t, err, "volume should be created")
+	publishReq := &csi.ControllerPublishVolumeRequest{
+		VolumeId:         "pvc-1",
+		NodeId:           "node-1",
+		VolumeCapability: newCreateVolumeRequest("pvc-1", GbToBytes).GetVolumeCapabilities()[0],
+		VolumeContext:    createResp.GetVolume().GetVolumeContext(),
+	}
+	unpublishReq := &csi.ControllerUnpublishVolumeRequest{VolumeId: "pvc-1", NodeId: "node-1"}
+
+	diskManager.SetErrorTimes(fake.OperationAttachDisk, busy, defaultAttachDetachBusyRetries+1)
+	_, err = cs.ControllerPublishVolume(ctx, publishReq)
+	assert.Error(t, err, "attach should fail once the VM stays busy past the retries")
+
+	diskManager.SetErrorTimes(fake.OperationAttachDisk, busy, defaultAttachDetachBusyRetries)
+	_, err = cs.ControllerPublishVolume(ctx, publishReq)
+	require.NoError(t, err, "attach should be retried while the VM is busy")
+
+	diskManager.SetErrorTimes(fake.OperationDetachDisk, busy, 1)
+	_, err = cs.ControllerUnpublishVolume(ctx, unpublishReq)
+	require.NoError(t, err, "detach should be retried while the VM is busy")
+
+	_, err = cs.ControllerPublishVolume(ctx, publishReq)
+	require.NoError(t, err, "volume should be published")
+	diskManager.SetErrorTimes(fake.OperationDetachDisk, fmt.Errorf("forbidden"), 1)
+	_, err = cs.ControllerUnpublishVolume(ctx, unpublishReq)
+	assert.Error(t, err, "detach should not be retried if the VM is not busy")
+}
+
+func TestVMLocks(t *testing.T) {
+	var locks vmLocks
+	unlock, err := locks.acquire(context.Background(), "vm-1")
+	require.NoError(t, err, "lock of the VM should be acquired")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = locks.acquire(ctx, "vm-1")
+	assert.Equal(t, context.DeadlineExceeded, err, "lock of a busy VM should not be acquired before the deadline")
+	unlockOther, err := locks.acquire(context.Background(), "vm-2")
+	require.NoError(t, err, "lock of another VM should be acquired")
+	unlockOther()
+
+	unlock()
+	unlock, err = locks.acquire(context.Background(), "vm-1")
+	require.NoError(t, err, "released lock of the VM should be acquired")
+	unlock()
+	assert.Empty(t, locks.locks, "unused locks should be dropped")
+}
+
+// fakeCredentialsUpdater records the credentials that it is updated with, and rejects the password rejectedPassword
+type fakeCredentialsUpdater struct {
+	rejectedPassword string
+	updates          []credentials
+}
+
+func (updater *fakeCredentialsUpdater) UpdateCredentials(ctx context.Context, userOrg string, user string,
+	password string, refreshToken string) error {
+
+	if password == updater.rejectedPassword {
+		return fmt.Errorf("unauthorized")
+	}
+	updater.updates = append(updater.updates, credentials{userOrg, user, password, refreshToken})
+	return nil
+}
+
+func TestCredentialsWatcher(t *testing.T) {
+	dir := t.TempDir()
+	writeCredentials := func(username string, password string) {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "username"), []byte(username+"\n"), 0600),
+			"username should be written")
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "password"), []byte(password+"\n"), 0600),
+			"password should be written")
+	}
+	writeCredentials("user", "password")
+	cloudConfig := &config.CloudConfig{VCD: config.VCDConfig{Org: "org"}}
+	require.NoError(t, config.SetAuthorizationFromDir(cloudConfig, dir), "credentials should be read")
+	updater := &fakeCredentialsUpdater{rejectedPassword: "rejected"}
+	watcher, err := NewCredentialsWatcher(updater, cloudConfig, dir, time.Minute)
+	require.NoError(t, err, "watcher should be created")
+	ctx := context.Background()
+
+	require.NoError(t, watcher.check(ctx), "unchanged credentials should be checked")
+	assert.Empty(t, updater.updates, "client should not be updated with unchanged credentials")
+
+	writeCredentials("other-org/user-2", "password-2")
+	require.NoError(t, watcher.check(ctx), "changed credentials should be applied")
+	assert.Equal(t, []credentials{{"other-org", "user-2", "password-2", ""}}, updater.updates,
+		"client should be updated with the changed credentials")
+
+	writeCredentials("", "")
+	assert.Error(t, watcher.check(ctx), "malformed credentials should not be applied")
+	writeCredentials("user-2", "rejected")
+	assert.Error(t, watcher.check(ctx), "rejected credentials should be reported")
+	require.NoError(t, watcher.check(ctx), "rejected credentials should not be applied again until they change")
+	assert.Len(t, updater.updates, 1, "client should keep the last good credentials")
+
+	writeCredentials("user-3", "password-3")
+	require.NoError(t, watcher.check(ctx), "changed credentials should be applied")
+	assert.Equal(t, credentials{"org", "user-3", "password-3", ""}, updater.updates[1],
+		"user without an org should be in the org of the cluster")
+
+	_, err = NewCredentialsWatcher(updater, cloudConfig, dir, 0)
+	assert.Error(t, err, "watcher should check the credentials periodically")
+}
+
+func TestControllerUnpublishVolumeWaitsForDetach(t *testing.T) {
+	cs, diskManager := newFakeControllerServer(t)
+	ctx := context.Background()
+	cs.Driver.detachPollInterval = time.Millisecond
+
+	createResp, err := cs.CreateVolume(ctx, newCreateVolumeRequest("pvc-1", GbToBytes))
+	require.NoError(t, err, "volume should be created")
+	publishReq := &csi.ControllerPublishVolumeRequest{
+		VolumeId:         "pvc-1",
+		NodeId:           "node-1",
+		VolumeCapability: newCreateVolumeRequest("pvc-1", GbToBytes).GetVolumeCapabilities()[0],
+		VolumeContext:    createResp.GetVolume().GetVolumeContext(),
+	}
+	unpublishReq := &csi.ControllerUnpublishVolumeRequest{VolumeId: "pvc-1", NodeId: "node-1"}
+
+	_, err = cs.ControllerPublishVolume(ctx, publishReq)
+	require.NoError(t, err, "volume should be published")
+	diskManager.DetachPolls = 3
+	_, err = cs.ControllerUnpublishVolume(ctx, unpublishReq)
+	require.NoError(t, err, "volume should be unpublished once the disk is released")
+
+	_, err = cs.ControllerPublishVolume(ctx, publishReq)
+	require.NoError(t, err, "volume should be published")
+	diskManager.DetachPolls = 1000
+	require.NoError(t, cs.Driver.SetDetachWaitTimeout(10*time.Millisecond), "detach wait timeout should be set")
+	_, err = cs.ControllerUnpublishVolume(ctx, unpublishReq)
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err),
+		"unpublish should fail if the disk is not released before the timeout")
+
+	_, err = cs.ControllerPublishVolume(ctx, publishReq)
+	require.NoError(t, err, "volume should be published")
+	require.NoError(t, cs.Driver.SetDetachWaitTimeout(0), "detach wait should be disabled")
+	_, err = cs.ControllerUnpublishVolume(ctx, unpublishReq)
+	assert.NoError(t, err, "unpublish should not wait for the disk to be released if the wait is disabled")
+
+	assert.Error(t, cs.Driver.SetDetachWaitTimeout(-time.Second), "negative detach wait timeout should not be set")
+}
+
+func TestImportedVolume(t *testing.T) {
+	cs, diskManager := newFakeControllerServer(t)
+	ctx := context.Background()
+
+	// a disk created outside the driver has none of the metadata of the driver
+	disk, err := diskManager.CreateDiskWithContext(ctx, "imported-disk", 1024, "", "", "", "", false, "", "", 0)
+	require.NoError(t, err, "disk should be created outside the driver")
+	volumeCapability := newCreateVolumeRequest("imported-disk", GbToBytes).GetVolumeCapabilities()[0]
+
+	for _, volumeID := range []string{"imported-disk", disk.ID} {
+		resp, err := cs.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+			VolumeId:         volumeID,
+			NodeId:           "node-1",
+			VolumeCapability: volumeCapability,
+		})
+		require.NoError(t, err, "imported volume [%s] should be published", volumeID)
+		assert.Equal(t, disk.UUID, resp.GetPublishContext()[DiskUUIDAttribute],
+			"UUID of the imported disk should be published")
+		assert.Equal(t, []string{"node-1"}, diskManager.AttachedVMs("imported-disk"),
+			"imported disk should be attached to the node")
+
+		validateResp, err := cs.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{
+			VolumeId:           volumeID,
+			VolumeCapabilities: []*csi.VolumeCapability{volumeCapability},
+		})
+		require.NoError(t, err, "capabilities of imported volume [%s] should be validated", volumeID)
+		assert.NotNil(t, validateResp.GetConfirmed(), "imported volume should support the capability")
+
+		_, err = cs.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{
+			VolumeId: volumeID,
+			NodeId:   "node-1",
+		})
+		require.NoError(t, err, "imported volume [%s] should be unpublished", volumeID)
+		assert.Empty(t, diskManager.AttachedVMs("imported-disk"), "imported disk should be detached")
+	}
+
+	_, err = cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: "imported-disk"})
+	require.NoError(t, err, "imported volume should be deleted")
+	foundDisk, err := diskManager.FindDiskByName("imported-disk")
+	assert.NoError(t, err, "disk should be looked up")
+	assert.Nil(t, foundDisk, "disk of a deleted imported volume should not exist")
+}
+
+func TestCreateVolumeInUnusableVDC(t *testing.T) {
+	cs, diskManager := newFakeControllerServer(t)
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		err  error
+		code codes.Code
+	}{
+		{fmt.Errorf("unable to get VDC [vdc-2]: [%w]", vcdcsiclient.ErrVDCNotFound), codes.InvalidArgument},
+		{fmt.Errorf("unable to get bearer token: [connection refused]"), codes.Unavailable},
+		{vcdcsiclient.NewDiskError(vcdcsiclient.ErrAccessDenied, "", nil), codes.PermissionDenied},
+	} {
+		diskManager.SetError(fake.OperationForVDC, tc.err)
+		req := newCreateVolumeRequest("pvc-1", GbToBytes)
+		req.Parameters[VDCParameter] = "vdc-2"
+		_, err := cs.CreateVolume(ctx, req)
+		assert.Equal(t, tc.code, status.Code(err), "CreateVolume in a VDC failing with [%v] should fail with its code",
+			tc.err)
+	}
+}
+
+func TestParseMkfsOptions(t *testing.T) {
+	args, err := parseMkfsOptions("-b 4096  -E lazy_itable_init=0,nodiscard", "ext4")
+	require.NoError(t, err, "allowed options should be parsed")
+	assert.Equal(t, []string{"-b", "4096", "-E", "lazy_itable_init=0,nodiscard"}, args,
+		"options should be split into arguments")
+	args, err = parseMkfsOptions("-d su=64k,sw=4 -m reflink=1", "xfs")
+	require.NoError(t, err, "allowed options of xfs should be parsed")
+	assert.Len(t, args, 4, "options of xfs should be split into arguments")
+	args, err = parseMkfsOptions(" ", "ext4")
+	assert.NoError(t, err, "empty options should be parsed")
+	assert.Nil(t, args, "empty options should have no arguments")
+
+	for _, mkfsOptions := range []string{"-n", "-b", "-b 4k", "-E root_owner=0:0", "-E stride=$(reboot)",
+		"-b 4096 /dev/sdb", "-d file=1"} {
+		_, err = parseMkfsOptions(mkfsOptions, "ext4")
+		assert.Error(t, err, "options [%s] should be rejected", mkfsOptions)
+	}
+	_, err = parseMkfsOptions("-N 100", "ext4")
+	assert.NoError(t, err, "number of inodes should be set for ext4")
+	_, err = parseMkfsOptions("-N 100", "xfs")
+	require.Error(t, err, "ext4 option should be rejected for xfs")
+	assert.Contains(t, err.Error(), "-b size", "error should name the allowed options")
+}
+
+func TestCreateVolumeWithMkfsOptions(t *testing.T) {
+	cs, _ := newFakeControllerServer(t)
+	ctx := context.Background()
+
+	req := newCreateVolumeRequest("pvc-1", GbToBytes)
+	req.Parameters[MkfsOptionsParameter] = "-b 4096 -E lazy_itable_init=0"
+	resp, err := cs.CreateVolume(ctx, req)
+	require.NoError(t, err, "volume with allowed mkfs options should be created")
+	assert.Equal(t, "-b 4096 -E lazy_itable_init=0", resp.GetVolume().GetVolumeContext()[MkfsOptionsParameter],
+		"mkfs options should be passed to the node")
+
+	req = newCreateVolumeRequest("pvc-2", GbToBytes)
+	req.Parameters[MkfsOptionsParameter] = "-O ^has_journal"
+	_, err = cs.CreateVolume(ctx, req)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), "volume with disallowed mkfs options should be rejected")
+}
+
+func TestCreateVolumeWithSharingType(t *testing.T) {
+	cs, diskManager := newFakeControllerServer(t)
+	ctx := context.Background()
+
+	req := newCreateVolumeRequest("pvc-1", GbToBytes)
+	req.Parameters[SharingTypeParameter] = vcdcsiclient.DiskSharingTypeDisk
+	_, err := cs.CreateVolume(ctx, req)
+	require.NoError(t, err, "volume with a sharing type should be created")
+	disk, err := diskManager.GetDiskByName("pvc-1")
+	require.NoError(t, err, "disk of the volume should be created")
+	assert.Equal(t, vcdcsiclient.DiskSharingTypeDisk, disk.SharingType, "disk should have the sharing type")
+	assert.True(t, disk.Shareable, "disk with a sharing type should be shareable")
+
+	req.Parameters[SharingTypeParameter] = vcdcsiclient.DiskSharingTypeController
+	_, err = cs.CreateVolume(ctx, req)
+	assert.Equal(t, codes.AlreadyExists, status.Code(err), "volume with another sharing type should conflict")
+
+	for _, parameters := range []map[string]string{
+		{SharingTypeParameter: "CrossVAppSharing"},
+		{SharingTypeParameter: vcdcsiclient.DiskSharingTypeDisk, ShareableParameter: "false"},
+		{SharingTypeParameter: vcdcsiclient.DiskSharingTypeNone, ShareableParameter: "true"},
+	} {
+		req = newCreateVolumeRequest("pvc-2", GbToBytes)
+		for key, value := range parameters {
+			req.Parameters[key] = value
+		}
+		_, err = cs.CreateVolume(ctx, req)
+		assert.Equal(t, codes.InvalidArgument, status.Code(err), "volume with parameters [%v] should be rejected",
+			parameters)
+	}
+}
+
+func TestCreateVolumeWithEncryptionPolicy(t *testing.T) {
+	cs, diskManager := newFakeControllerServer(t)
+	ctx := context.Background()
+
+	req := newCreateVolumeRequest("pvc-1", GbToBytes)
+	req.Parameters[EncryptionPolicyParameter] = "gold-encryption"
+	resp, err := cs.CreateVolume(ctx, req)
+	require.NoError(t, err, "volume with an encryption policy should be created")
+	assert.Equal(t, "true", resp.GetVolume().GetVolumeContext()[EncryptedAttribute],
+		"volume context should report that the disk is encrypted")
+	disk, err := diskManager.GetDiskByName("pvc-1")
+	require.NoError(t, err, "disk of the volume should be created")
+	assert.Equal(t, "gold-encryption", disk.EncryptionPolicy, "disk should have the encryption policy")
+
+	req.Parameters[EncryptionPolicyParameter] = "silver-encryption"
+	_, err = cs.CreateVolume(ctx, req)
+	assert.Equal(t, codes.AlreadyExists, status.Code(err), "volume with another encryption policy should conflict")
+
+	resp, err = cs.CreateVolume(ctx, newCreateVolumeRequest("pvc-2", GbToBytes))
+	require.NoError(t, err, "volume without an encryption policy should be created")
+	assert.Equal(t, "false", resp.GetVolume().GetVolumeContext()[EncryptedAttribute],
+		"volume context should report that the disk is not encrypted")
+
+	req = newCreateVolumeRequest("pvc-3", GbToBytes)
+	req.Parameters[EncryptionPolicyParameter] = " "
+	_, err = cs.CreateVolume(ctx, req)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), "volume with an empty encryption policy should be "+
+		"rejected")
+}
+
+func TestGetStageFsType(t *testing.T) {
+	assert.Equal(t, DefaultFileSystem, getStageFsType(""), "unformatted device should get the default fs")
+	assert.Equal(t, "xfs", getStageFsType("xfs"), "formatted device should keep its fs")
+	assert.Equal(t, DefaultFileSystem, getStageFsType("ntfs"),
+		"device with an unsupported fs should get the default fs, which it is rejected for")
+}
+
+func TestDiskErrorCodes(t *testing.T) {
+	for _, testCase := range []struct {
+		err  error
+		code codes.Code
+	}{
+		{vcdcsiclient.NewDiskError(vcdcsiclient.ErrDiskNotFound, "pvc-1", nil), codes.NotFound},
+		{fmt.Errorf("unable to delete disk: %w", vcdcsiclient.NewDiskError(vcdcsiclient.ErrDiskAttached, "pvc-1",
+			nil)), codes.FailedPrecondition},
+		{vcdcsiclient.NewDiskError(vcdcsiclient.ErrDiskExists, "pvc-1", nil), codes.AlreadyExists},
+		{vcdcsiclient.NewDiskError(vcdcsiclient.ErrVCDThrottled, "pvc-1", nil), codes.Unavailable},
+		{vcdcsiclient.NewDiskError(vcdcsiclient.ErrDiskInTransition, "pvc-1", nil), codes.Unavailable},
+		{vcdcsiclient.NewDiskError(vcdcsiclient.ErrQuotaExceeded, "pvc-1", nil), codes.ResourceExhausted},
+		{vcdcsiclient.NewDiskError(vcdcsiclient.ErrAccessDenied, "pvc-1", nil), codes.PermissionDenied},
+		{vcdcsiclient.NewDiskError(vcdcsiclient.ErrInvalidDisk, "pvc-1", nil), codes.InvalidArgument},
+		{fmt.Errorf("unable to reconfigure VM"), codes.Internal},
+	} {
+		assert.Equal(t, testCase.code, diskErrorCode(testCase.err, codes.Internal),
+			"error [%v] should have its code", testCase.err)
+	}
+
+	cs, diskManager := newFakeControllerServer(t)
+	ctx := context.Background()
+	createResp, err := cs.CreateVolume(ctx, newCreateVolumeRequest("pvc-1", GbToBytes))
+	require.NoError(t, err, "volume should be created")
+	diskManager.SetError(fake.OperationAttachDisk, vcdcsiclient.NewDiskError(vcdcsiclient.ErrVCDThrottled, "pvc-1",
+		fmt.Errorf("API Error: 429: too many requests")))
+	_, err = cs.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+		VolumeId:         "pvc-1",
+		NodeId:           "node-1",
+		VolumeCapability: newCreateVolumeRequest("pvc-1", GbToBytes).GetVolumeCapabilities()[0],
+		VolumeContext:    createResp.GetVolume().GetVolumeContext(),
+	})
+	assert.Equal(t, codes.Unavailable, status.Code(err), "throttled attach should be retried by the sidecar")
+
+	diskManager.SetError(fake.OperationDeleteDisk, vcdcsiclient.NewDiskError(vcdcsiclient.ErrDiskInTransition,
+		"pvc-1", fmt.Errorf("disk [pvc-1] is still in use or in transition after [4] retries of its delete")))
+	_, err = cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: "pvc-1"})
+	assert.Equal(t, codes.Unavailable, status.Code(err),
+		"delete of a disk in transition should be retried by the provisioner")
+}
+
+func TestCreateVolumeErrors(t *testing.T) {
+	cs, diskManager := newFakeControllerServer(t)
+	ctx := context.Background()
+
+	for _, testCase := range []struct {
+		kind    error
+		code    codes.Code
+		message string
+	}{
+		{vcdcsiclient.ErrQuotaExceeded, codes.ResourceExhausted, "storage quota"},
+		{vcdcsiclient.ErrAccessDenied, codes.PermissionDenied, "lacks the rights"},
+		{vcdcsiclient.ErrDiskExists, codes.AlreadyExists, "same name"},
+		{vcdcsiclient.ErrInvalidDisk, codes.InvalidArgument, "requested size"},
+	} {
+		diskManager.SetError(fake.OperationCreateDisk, vcdcsiclient.NewDiskError(testCase.kind, "pvc-1",
+			fmt.Errorf("API Error: 400: rejected")))
+		_, err := cs.CreateVolume(ctx, newCreateVolumeRequest("pvc-1", GbToBytes))
+		assert.Equal(t, testCase.code, status.Code(err), "creation failing with [%v] should have its code",
+			testCase.kind)
+		assert.Contains(t, status.Convert(err).Message(), testCase.message,
+			"creation failing with [%v] should tell what to do", testCase.kind)
+		assert.Contains(t, status.Convert(err).Message(), "API Error: 400: rejected",
+			"creation should report the error of VCD")
+	}
+}
+
+func TestRedactSecrets(t *testing.T) {
+	req := &csi.NodeStageVolumeRequest{
+		VolumeId: "pvc-1",
+		Secrets:  map[string]string{"password": "secret"},
+		VolumeContext: map[string]string{"diskID": "urn:vcloud:disk:1", "refreshToken": "secret",
+			"VCD_PASSWORD": "secret"},
+		PublishContext: map[string]string{"diskUUID": "6000c29"},
+	}
+	redacted, ok := redactSecrets(req).(*csi.NodeStageVolumeRequest)
+	require.True(t, ok, "redacted request should be of the type of the request")
+	assert.Equal(t, map[string]string{"password": redactedValue}, redacted.Secrets, "secrets should be redacted")
+	assert.Equal(t, map[string]string{"diskID": "urn:vcloud:disk:1", "refreshToken": redactedValue,
+		"VCD_PASSWORD": redactedValue}, redacted.VolumeContext, "entries with secret keys should be redacted")
+	assert.Equal(t, req.PublishContext, redacted.PublishContext, "fields that are not secrets should be kept")
+	assert.Equal(t, "secret", req.VolumeContext["refreshToken"], "request should not be changed")
+	assert.Equal(t, "secret", req.Secrets["password"], "request should not be changed")
+	assert.NotContains(t, fmt.Sprintf("%v", redactSecrets(req)), "secret\"", "logged request should not have secrets")
+
+	assert.Equal(t, "not a request", redactSecrets("not a request"), "value that is not a message should be kept")
+}
+
+func TestLogAndRecoverGRPC(t *testing.T) {
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/CreateVolume"}
+	req := &csi.CreateVolumeRequest{Name: "pvc-1"}
+
+	var requestIDs []string
+	for i := 0; i < 2; i++ {
+		resp, err := logAndRecoverGRPC(context.Background(), req, info,
+			func(ctx context.Context, req interface{}) (interface{}, error) {
+				requestIDs = append(requestIDs, vcdcsiclient.RequestID(ctx))
+				return &csi.CreateVolumeResponse{}, nil
+			})
+		assert.NoError(t, err, "RPC should succeed")
+		assert.Equal(t, &csi.CreateVolumeResponse{}, resp, "response of the handler should be returned")
+	}
+	require.Len(t, requestIDs, 2, "handler should be called for every RPC")
+	assert.NotEmpty(t, requestIDs[0], "RPC should have a request ID")
+	assert.NotEqual(t, requestIDs[0], requestIDs[1], "every RPC should have its own request ID")
+
+	_, err := logAndRecoverGRPC(context.Background(), req, info,
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			return nil, status.Error(codes.NotFound, "not found")
+		})
+	assert.Equal(t, codes.NotFound, status.Code(err), "error of the handler should be returned")
+
+	resp, err := logAndRecoverGRPC(context.Background(), req, info,
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			panic("unexpected")
+		})
+	assert.Nil(t, resp, "panicking RPC should not have a response")
+	assert.Equal(t, codes.Internal, status.Code(err), "panic should fail the RPC as internal")
+	assert.Contains(t, err.Error(), "unexpected", "error should have the panic")
+}
+
+// fakePVCMetadataReader returns the labels and annotations of the PVCs from maps by the namespace/name of the PVCs
+type fakePVCMetadataReader struct {
+	labels      map[string]map[string]string
+	annotations map[string]map[string]string
+}
+
+func (reader *fakePVCMetadataReader) GetPVCMetadata(ctx context.Context, namespace string,
+	name string) (map[string]string, map[string]string, error) {
+
+	key := namespace + "/" + name
+	if reader.labels[key] == nil && reader.annotations[key] == nil {
+		return nil, nil, fmt.Errorf("PVC [%s] not found", key)
+	}
+	return reader.labels[key], reader.annotations[key], nil
+}
+
+func TestCreateVolumeWithMirroredPVCKeys(t *testing.T) {
+	cs, diskManager := newFakeControllerServer(t)
+	ctx := context.Background()
+	assert.Error(t, cs.Driver.SetMirroredPVCKeys(&PVCMetadataReader{}, []string{PVCNameMetadataKey}),
+		"metadata keys of the driver should not be mirrored")
+	assert.Error(t, cs.Driver.SetMirroredPVCKeys(&PVCMetadataReader{}, []string{"team", " "}),
+		"empty keys should not be mirrored")
+	require.NoError(t, cs.Driver.SetMirroredPVCKeys(&PVCMetadataReader{}, []string{"team", "app", "cost-center"}),
+		"keys should be mirrored")
+	cs.Driver.pvcMetadataReader = &fakePVCMetadataReader{
+		labels:      map[string]map[string]string{"default/pvc-1": {"app": "web", "team": "label-team"}},
+		annotations: map[string]map[string]string{"default/pvc-1": {"team": "storage", "other": "ignored"}},
+	}
+
+	_, err := cs.CreateVolume(ctx, newCreateVolumeRequest("pvc-1", GbToBytes))
+	require.NoError(t, err, "volume should be created")
+	metadata, err := diskManager.GetDiskMetadata("pvc-1")
+	require.NoError(t, err, "metadata of disk should be read")
+	assert.Equal(t, "storage", metadata["team"], "annotation of the PVC should be mirrored")
+	assert.Equal(t, "web", metadata["app"], "label of the PVC should be mirrored")
+	assert.NotContains(t, metadata, "cost-center", "key that the PVC does not have should be left out")
+	assert.NotContains(t, metadata, "other", "key that is not mirrored should be left out")
+	assert.Equal(t, "pvc-1", metadata[PVCNameMetadataKey], "disk should still be related to its PVC")
+
+	req := newCreateVolumeRequest("pvc-2", GbToBytes)
+	req.Parameters[PVCNameParameter] = "missing-pvc"
+	_, err = cs.CreateVolume(ctx, req)
+	require.NoError(t, err, "volume of a PVC that cannot be read should be created")
+	metadata, err = diskManager.GetDiskMetadata("pvc-2")
+	require.NoError(t, err, "metadata of disk should be read")
+	assert.NotContains(t, metadata, "team", "keys of a PVC that cannot be read should not be mirrored")
+}
+
+func TestControllerGetVolume(t *testing.T) {
+	cs, diskManager := newFakeControllerServer(t)
+	ctx := context.Background()
+
+	_, err := cs.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{VolumeId: "pvc-1"})
+	assert.Equal(t, codes.NotFound, status.Code(err), "volume that does not exist should not be found")
+
+	req := newCreateVolumeRequest("pvc-1", GbToBytes)
+	req.Parameters[StorageProfileParameter] = "gold"
+	_, err = cs.CreateVolume(ctx, req)
+	require.NoError(t, err, "volume should be created")
+	resp, err := cs.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{VolumeId: "pvc-1"})
+	require.NoError(t, err, "volume should be found")
+	assert.Equal(t, "pvc-1", resp.GetVolume().GetVolumeId(), "volume ID should be returned")
+	assert.Equal(t, GbToBytes, resp.GetVolume().GetCapacityBytes(), "size of the disk should be returned")
+	assert.Equal(t, "gold", resp.GetVolume().GetVolumeContext()[StorageProfileParameter],
+		"storage profile of the disk should be returned")
+	assert.Equal(t, "vdc", resp.GetVolume().GetAccessibleTopology()[0].GetSegments()[TopologyVDCKey],
+		"VDC of the disk should be its topology")
+	assert.Empty(t, resp.GetStatus().GetPublishedNodeIds(), "detached volume should not be published")
+
+	_, err = cs.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+		VolumeId:         "pvc-1",
+		NodeId:           "node-1",
+		VolumeCapability: req.GetVolumeCapabilities()[0],
+	})
+	require.NoError(t, err, "volume should be published")
+	resp, err = cs.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{VolumeId: "pvc-1"})
+	require.NoError(t, err, "volume should be found")
+	assert.Equal(t, []string{"node-1"}, resp.GetStatus().GetPublishedNodeIds(),
+		"node that the disk is attached to should be published")
+
+	diskManager.SetError(fake.OperationGetDisk, fmt.Errorf("VCD is down"))
+	_, err = cs.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{VolumeId: "pvc-1"})
+	assert.Equal(t, codes.Internal, status.Code(err), "failed lookup should be an internal error")
+}
+
+func TestListVolumes(t *testing.T) {
+	cs, _ := newFakeControllerServer(t)
+	ctx := context.Background()
+	for _, name := range []string{"pvc-2", "pvc-3", "pvc-1"} {
+		_, err := cs.CreateVolume(ctx, newCreateVolumeRequest(name, GbToBytes))
+		require.NoError(t, err, "volume [%s] should be created", name)
+	}
+	volumeIDs := func(resp *csi.ListVolumesResponse) []string {
+		var ids []string
+		for _, entry := range resp.GetEntries() {
+			ids = append(ids, entry.GetVolume().GetVolumeId())
+		}
+		return ids
+	}
+
+	resp, err := cs.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	require.NoError(t, err, "volumes should be listed")
+	assert.Equal(t, []string{"pvc-1", "pvc-2", "pvc-3"}, volumeIDs(resp), "all volumes should be listed in order")
+	assert.Empty(t, resp.GetNextToken(), "listing all volumes should have no next token")
+	assert.Equal(t, GbToBytes, resp.GetEntries()[0].GetVolume().GetCapacityBytes(), "size of the disk should be listed")
+	assert.Equal(t, "vdc", resp.GetEntries()[0].GetVolume().GetAccessibleTopology()[0].GetSegments()[TopologyVDCKey],
+		"VDC of the disk should be its topology")
+
+	resp, err = cs.ListVolumes(ctx, &csi.ListVolumesRequest{MaxEntries: 2})
+	require.NoError(t, err, "first page of volumes should be listed")
+	assert.Equal(t, []string{"pvc-1", "pvc-2"}, volumeIDs(resp), "first page should have max entries volumes")
+	require.NotEmpty(t, resp.GetNextToken(), "first page should have a next token")
+
+	resp, err = cs.ListVolumes(ctx, &csi.ListVolumesRequest{MaxEntries: 2, StartingToken: resp.GetNextToken()})
+	require.NoError(t, err, "second page of volumes should be listed")
+	assert.Equal(t, []string{"pvc-3"}, volumeIDs(resp), "second page should have the rest of the volumes")
+	assert.Empty(t, resp.GetNextToken(), "last page should have no next token")
+
+	_, err = cs.ListVolumes(ctx, &csi.ListVolumesRequest{StartingToken: "not-a-token"})
+	assert.Equal(t, codes.Aborted, status.Code(err), "invalid starting token should abort the listing")
+	_, err = cs.ListVolumes(ctx, &csi.ListVolumesRequest{MaxEntries: -1})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), "negative max entries should be invalid")
+}
+
+func TestGetCapacity(t *testing.T) {
+	cs, diskManager := newFakeControllerServer(t)
+	ctx := context.Background()
+	diskManager.Capacity = 10 * GbToBytes
+	diskManager.StorageProfileCapacities = map[string]int64{"gold": 2 * GbToBytes}
+
+	resp, err := cs.GetCapacity(ctx, &csi.GetCapacityRequest{})
+	require.NoError(t, err, "capacity of the default storage profile should be returned")
+	assert.Equal(t, 10*GbToBytes, resp.GetAvailableCapacity(), "capacity of the default storage profile should be used")
+
+	resp, err = cs.GetCapacity(ctx, &csi.GetCapacityRequest{
+		Parameters: map[string]string{StorageProfileParameter: "gold"},
+	})
+	require.NoError(t, err, "capacity of the storage profile should be returned")
+	assert.Equal(t, 2*GbToBytes, resp.GetAvailableCapacity(), "capacity of the storage profile should be used")
+
+	vdcDiskManager, err := diskManager.ForVDC("vdc-2")
+	require.NoError(t, err, "disk manager of the other VDC should be created")
+	vdcDiskManager.(*fake.DiskManager).Capacity = 5 * GbToBytes
+	resp, err = cs.GetCapacity(ctx, &csi.GetCapacityRequest{
+		AccessibleTopology: &csi.Topology{Segments: map[string]string{TopologyVDCKey: "vdc-2"}},
+	})
+	require.NoError(t, err, "capacity of the VDC of the topology should be returned")
+	assert.Equal(t, 5*GbToBytes, resp.GetAvailableCapacity(), "VDC of the topology should be used")
+	resp, err = cs.GetCapacity(ctx, &csi.GetCapacityRequest{
+		AccessibleTopology: &csi.Topology{Segments: map[string]string{TopologyVDCKey: "vdc"}},
+	})
+	require.NoError(t, err, "capacity of the VDC of the driver should be returned")
+	assert.Equal(t, 10*GbToBytes, resp.GetAvailableCapacity(), "VDC of the driver should be used for its topology")
+
+	diskManager.SetError(fake.OperationGetVDCCapacity, fmt.Errorf("VCD is down"))
+	_, err = cs.GetCapacity(ctx, &csi.GetCapacityRequest{})
+	assert.Equal(t, codes.Internal, status.Code(err), "failed capacity lookup should be an internal error")
+}
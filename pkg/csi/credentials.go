@@ -0,0 +1,151 @@
+/*
+   Copyright 2021 VMware, Inc.
+   SPDX-License-Identifier: Apache-2.0
+*/
+
+package csi
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"github.com/vmware/cloud-director-named-disk-csi-driver/pkg/config"
+	"io/ioutil"
+	"k8s.io/klog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// credentialsUpdater is the VCD client whose credentials a CredentialsWatcher updates
+type credentialsUpdater interface {
+	UpdateCredentials(ctx context.Context, userOrg string, user string, password string, refreshToken string) error
+}
+
+// credentials are the credentials of the VCD user that a CredentialsWatcher applied last
+type credentials struct {
+	userOrg      string
+	user         string
+	password     string
+	refreshToken string
+}
+
+// CredentialsWatcher updates the credentials of a VCD client when the secret mounted to a directory changes. The
+// kubelet updates a mounted secret in place once the secret is updated, so the password can be rotated without
+// restarting the driver.
+type CredentialsWatcher struct {
+	client credentialsUpdater
+	// cloudConfig is the cloud config of the client without its credentials, to which those of the secret are added
+	cloudConfig config.CloudConfig
+	dir         string
+	interval    time.Duration
+	// fingerprint is the hash of the files of the secret that were read last. A malformed secret or one with
+	// credentials that are rejected by VCD is not read again until it changes.
+	fingerprint [sha256.Size]byte
+	applied     credentials
+}
+
+// NewCredentialsWatcher creates a CredentialsWatcher that checks the secret mounted to dir every interval and updates
+// client once it changes. The credentials of cloudConfig, which were set from the secret, are those of client.
+func NewCredentialsWatcher(client credentialsUpdater, cloudConfig *config.CloudConfig, dir string,
+	interval time.Duration) (*CredentialsWatcher, error) {
+
+	if interval <= 0 {
+		return nil, fmt.Errorf("credentials watch interval [%v] should be positive", interval)
+	}
+
+	fingerprint, err := credentialsFingerprint(dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read credentials in [%s]: [%v]", dir, err)
+	}
+	watcher := &CredentialsWatcher{
+		client:      client,
+		cloudConfig: *cloudConfig,
+		dir:         dir,
+		interval:    interval,
+		fingerprint: fingerprint,
+		applied: credentials{
+			userOrg:      cloudConfig.VCD.UserOrg,
+			user:         cloudConfig.VCD.User,
+			password:     cloudConfig.VCD.Secret,
+			refreshToken: cloudConfig.VCD.RefreshToken,
+		},
+	}
+	// the user org is derived from the username or org rather than configured, hence it is derived again as well
+	vcdConfig := &watcher.cloudConfig.VCD
+	vcdConfig.UserOrg, vcdConfig.User, vcdConfig.Secret = "", "", ""
+	vcdConfig.RefreshToken, vcdConfig.RefreshTokenFile = "", ""
+
+	return watcher, nil
+}
+
+// Run checks the secret every interval until ctx is done
+func (watcher *CredentialsWatcher) Run(ctx context.Context) {
+	klog.Infof("Watching credentials in [%s] every [%v]", watcher.dir, watcher.interval)
+
+	ticker := time.NewTicker(watcher.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := watcher.check(ctx); err != nil {
+				klog.Errorf("unable to update credentials: [%v]", err)
+			}
+		}
+	}
+}
+
+// check updates the credentials of the client if the secret has changed since it was read last. The client keeps the
+// last good credentials if those of the secret are malformed or rejected.
+func (watcher *CredentialsWatcher) check(ctx context.Context) error {
+	fingerprint, err := credentialsFingerprint(watcher.dir)
+	if err != nil {
+		return fmt.Errorf("unable to read credentials in [%s]: [%v]", watcher.dir, err)
+	}
+	if fingerprint == watcher.fingerprint {
+		return nil
+	}
+	watcher.fingerprint = fingerprint
+
+	cloudConfig := watcher.cloudConfig
+	if err = config.SetAuthorizationFromDir(&cloudConfig, watcher.dir); err != nil {
+		return fmt.Errorf("malformed credentials in [%s]; keeping the last good credentials: [%v]", watcher.dir, err)
+	}
+	updated := credentials{
+		userOrg:      cloudConfig.VCD.UserOrg,
+		user:         cloudConfig.VCD.User,
+		password:     cloudConfig.VCD.Secret,
+		refreshToken: cloudConfig.VCD.RefreshToken,
+	}
+	if updated == watcher.applied {
+		return nil
+	}
+
+	klog.Infof("Credentials in [%s] have changed; updating VCD client of user [%s/%s]", watcher.dir,
+		updated.userOrg, updated.user)
+	if err = watcher.client.UpdateCredentials(ctx, updated.userOrg, updated.user, updated.password,
+		updated.refreshToken); err != nil {
+		return err
+	}
+	watcher.applied = updated
+
+	return nil
+}
+
+// credentialsFingerprint returns the hash of the credentials files in dir, of which the missing ones are empty
+func credentialsFingerprint(dir string) ([sha256.Size]byte, error) {
+	hash := sha256.New()
+	for _, file := range config.CredentialsFiles {
+		content, err := ioutil.ReadFile(filepath.Join(dir, file))
+		if err != nil && !os.IsNotExist(err) {
+			return [sha256.Size]byte{}, err
+		}
+		fmt.Fprintf(hash, "%s\x00%d\x00%s\x00", file, len(content), content)
+	}
+
+	var fingerprint [sha256.Size]byte
+	copy(fingerprint[:], hash.Sum(nil))
+	return fingerprint, nil
+}
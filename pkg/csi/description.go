@@ -0,0 +1,57 @@
+/*
+   Copyright 2021 VMware, Inc.
+   SPDX-License-Identifier: Apache-2.0
+*/
+
+package csi
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+)
+
+// DiskDescriptionData has the variables of the template of the description of the disks, which are set from the
+// CreateVolume request of the disk
+type DiskDescriptionData struct {
+	// ClusterID is the ID of the cluster that the driver runs in
+	ClusterID string
+	// DiskName is the name of the disk in VCD
+	DiskName string
+	// VolumeName is the name of the volume requested by the provisioner, which is the name of the PV
+	VolumeName string
+	// PVName, PVCName and Namespace are set if the provisioner runs with --extra-create-metadata
+	PVName    string
+	PVCName   string
+	Namespace string
+	// VDC is the VDC that the disk is created in
+	VDC string
+	// StorageProfile is the storage profile of the StorageClass, which is empty for the default profile of the VDC
+	StorageProfile string
+	// Parameters are the parameters of the StorageClass
+	Parameters map[string]string
+}
+
+// ParseDiskDescriptionTemplate parses text as a text/template of the descriptions of the disks, and checks that it
+// can be rendered from a DiskDescriptionData
+func ParseDiskDescriptionTemplate(text string) (*template.Template, error) {
+	descriptionTemplate, err := template.New("disk-description").Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse template [%s]: [%v]", text, err)
+	}
+	if _, err = renderDiskDescription(descriptionTemplate, &DiskDescriptionData{}); err != nil {
+		return nil, err
+	}
+
+	return descriptionTemplate, nil
+}
+
+// renderDiskDescription returns the description of the disk of data rendered from descriptionTemplate
+func renderDiskDescription(descriptionTemplate *template.Template, data *DiskDescriptionData) (string, error) {
+	description := &bytes.Buffer{}
+	if err := descriptionTemplate.Execute(description, data); err != nil {
+		return "", fmt.Errorf("unable to render template [%s]: [%v]", descriptionTemplate.Name(), err)
+	}
+
+	return description.String(), nil
+}
@@ -6,7 +6,6 @@
 package csi
 
 import (
-	"context"
 	"fmt"
 	"github.com/vmware/cloud-director-named-disk-csi-driver/pkg/util"
 	"github.com/vmware/cloud-director-named-disk-csi-driver/pkg/vcdcsiclient"
@@ -14,9 +13,13 @@ import (
 	"github.com/vmware/cloud-provider-for-cloud-director/pkg/vcdsdk"
 	"net"
 	"os"
+	"text/template"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"k8s.io/klog"
 )
 
@@ -33,6 +36,37 @@ type VCDDriver struct {
 
 	srv *grpc.Server
 
+	eventRecorder           *EventRecorder
+	diskDescriptionTemplate *template.Template
+	// nodeVMIDReader reads the VM IDs that the nodes report in their topology if it is set
+	nodeVMIDReader nodeVMIDReader
+	// pvcMetadataReader reads the PVCs whose mirroredPVCKeys are copied to the metadata of their disks if it is set
+	pvcMetadataReader pvcMetadataReader
+	mirroredPVCKeys   []string
+
+	minVolumeSizeBytes int64
+	maxVolumeSizeBytes int64
+	maxVolumesPerNode  int64
+
+	// attachDetachBusyRetries is how many times an attach or detach that fails because its VM is busy is retried,
+	// first after attachDetachRetryDelay
+	attachDetachBusyRetries int
+	attachDetachRetryDelay  time.Duration
+
+	// detachWaitTimeout is how long an unpublish waits for VCD to release a detached disk, checking it every
+	// detachPollInterval. It does not wait if detachWaitTimeout is 0.
+	detachWaitTimeout  time.Duration
+	detachPollInterval time.Duration
+
+	// maxConcurrentOperations bounds the mutating VCD operations of the controller in flight, which are not bounded
+	// if it is 0
+	maxConcurrentOperations int
+
+	// deviceReadyTimeout is how long a stage waits for the device of a just attached disk to appear on the node,
+	// looking it up every deviceReadyInterval
+	deviceReadyTimeout  time.Duration
+	deviceReadyInterval time.Duration
+
 	volumeCapabilityAccessModes   []*csi.VolumeCapability_AccessMode
 	controllerServiceCapabilities []*csi.ControllerServiceCapability
 	nodeServiceCapabilities       []*csi.NodeServiceCapability
@@ -61,6 +95,14 @@ func NewDriver(nodeID string, endpoint string) (*VCDDriver, error) {
 		nodeID:   nodeID,
 		version:  version.Version,
 		endpoint: endpoint,
+
+		maxVolumesPerNode:       defaultMaxVolumesPerNode,
+		attachDetachBusyRetries: defaultAttachDetachBusyRetries,
+		attachDetachRetryDelay:  defaultAttachDetachRetryDelay,
+		detachWaitTimeout:       defaultDetachWaitTimeout,
+		detachPollInterval:      defaultDetachPollInterval,
+		deviceReadyTimeout:      defaultDeviceReadyTimeout,
+		deviceReadyInterval:     defaultDeviceReadyInterval,
 	}
 
 	d.volumeCapabilityAccessModes = make([]*csi.VolumeCapability_AccessMode, len(VolumeCapabilityAccessModesList))
@@ -75,6 +117,7 @@ func NewDriver(nodeID string, endpoint string) (*VCDDriver, error) {
 	nodeServiceCapabilityList := []csi.NodeServiceCapability_RPC_Type{
 		csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
 		csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+		csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
 	}
 	d.nodeServiceCapabilities = make([]*csi.NodeServiceCapability, len(nodeServiceCapabilityList))
 	for idx, nodeServiceCapability := range nodeServiceCapabilityList {
@@ -92,6 +135,12 @@ func NewDriver(nodeID string, endpoint string) (*VCDDriver, error) {
 		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
 		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
 		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+		csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+		csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+		csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
+		csi.ControllerServiceCapability_RPC_GET_CAPACITY,
+		csi.ControllerServiceCapability_RPC_GET_VOLUME,
 	}
 	d.controllerServiceCapabilities = make([]*csi.ControllerServiceCapability, len(controllerServerCapabilitiesRPCList))
 	for idx, controllerServiceCapabilityRPC := range controllerServerCapabilitiesRPCList {
@@ -108,12 +157,115 @@ func NewDriver(nodeID string, endpoint string) (*VCDDriver, error) {
 	return d, nil
 }
 
+// SetEventRecorder sets the recorder of the events of the failures of the controller. Events are not recorded if
+// it is nil.
+func (d *VCDDriver) SetEventRecorder(eventRecorder *EventRecorder) {
+	d.eventRecorder = eventRecorder
+}
+
+// SetVMIDTopology makes the node report the ID of its VM in its topology, and the controller find the VMs of the nodes
+// by the IDs read with reader, instead of searching the VDC for their names. The VMs are found by name if it is nil.
+func (d *VCDDriver) SetVMIDTopology(reader *NodeVMIDReader) {
+	// a nil reader would otherwise be a non-nil nodeVMIDReader
+	if reader == nil {
+		d.nodeVMIDReader = nil
+		return
+	}
+
+	d.nodeVMIDReader = reader
+}
+
+// SetDiskDescriptionTemplate sets the template of the descriptions of the disks created by the controller. The
+// descriptions identify the disks of the cluster to the DiskReaper if it is nil.
+func (d *VCDDriver) SetDiskDescriptionTemplate(diskDescriptionTemplate *template.Template) {
+	d.diskDescriptionTemplate = diskDescriptionTemplate
+}
+
+// SetVolumeSizeLimits sets the bounds, in bytes, of the sizes of the volumes created by the controller. A bound of 0
+// does not bound the sizes.
+func (d *VCDDriver) SetVolumeSizeLimits(minBytes int64, maxBytes int64) error {
+	if minBytes < 0 || maxBytes < 0 {
+		return fmt.Errorf("volume size limits [%d] and [%d] should not be negative", minBytes, maxBytes)
+	}
+	if maxBytes > 0 && minBytes > maxBytes {
+		return fmt.Errorf("minimum volume size [%d] should not be larger than maximum volume size [%d]",
+			minBytes, maxBytes)
+	}
+
+	d.minVolumeSizeBytes = minBytes
+	d.maxVolumeSizeBytes = maxBytes
+	return nil
+}
+
+// SetMaxVolumesPerNode sets the most volumes that can be attached to a node, which the node reports so that the
+// scheduler does not place pods with more volumes on it
+func (d *VCDDriver) SetMaxVolumesPerNode(maxVolumes int64) error {
+	if maxVolumes < 1 || maxVolumes > maxSCSIVolumesPerNode {
+		return fmt.Errorf("max volumes per node [%d] should be between [1] and [%d]", maxVolumes,
+			maxSCSIVolumesPerNode)
+	}
+
+	d.maxVolumesPerNode = maxVolumes
+	return nil
+}
+
+// SetAttachDetachBusyRetries sets how many times the controller retries an attach or detach that VCD rejects because
+// the VM is busy with another task. Such attaches and detaches are not retried if retries is 0.
+func (d *VCDDriver) SetAttachDetachBusyRetries(retries int) error {
+	if retries < 0 {
+		return fmt.Errorf("attach and detach retries [%d] should not be negative", retries)
+	}
+
+	d.attachDetachBusyRetries = retries
+	return nil
+}
+
+// SetDetachWaitTimeout sets how long the controller waits for VCD to release a disk once it is detached, before
+// reporting the unpublish of its volume as done. The controller does not wait if timeout is 0.
+func (d *VCDDriver) SetDetachWaitTimeout(timeout time.Duration) error {
+	if timeout < 0 {
+		return fmt.Errorf("detach wait timeout [%v] should not be negative", timeout)
+	}
+
+	d.detachWaitTimeout = timeout
+	return nil
+}
+
+// SetMaxConcurrentOperations sets the most creations, deletions, resizes, attaches and detaches of disks that the
+// controller runs at a time, beyond which the requests wait. The operations are not bounded if maxOperations is 0.
+func (d *VCDDriver) SetMaxConcurrentOperations(maxOperations int) error {
+	if maxOperations < 0 {
+		return fmt.Errorf("max concurrent operations [%d] should not be negative", maxOperations)
+	}
+
+	d.maxConcurrentOperations = maxOperations
+	return nil
+}
+
+// SetDeviceReadyPolling sets how long the node waits for the device of a just attached disk to appear before the
+// stage of its volume fails, and the interval at which it looks for the device
+func (d *VCDDriver) SetDeviceReadyPolling(timeout time.Duration, interval time.Duration) error {
+	if timeout <= 0 || interval <= 0 {
+		return fmt.Errorf("device ready timeout [%v] and interval [%v] should be positive", timeout, interval)
+	}
+	if interval > timeout {
+		return fmt.Errorf("device ready interval [%v] should not be longer than timeout [%v]", interval, timeout)
+	}
+
+	d.deviceReadyTimeout = timeout
+	d.deviceReadyInterval = interval
+	return nil
+}
+
 // Setup will setup the driver and add controller, node and identity servers
 func (d *VCDDriver) Setup(diskManager *vcdcsiclient.DiskManager, VAppName string, nodeID string, upgradeRde bool) error {
 	klog.Infof("Driver setup called")
-	d.ns = NewNodeService(d, nodeID)
-	d.cs = NewControllerService(d, diskManager.VCDClient, diskManager.ClusterID, VAppName)
-	d.ids = NewIdentityServer(d)
+	d.ns = NewNodeService(d, nodeID, diskManager.VCDClient.ClusterOVDCName)
+	if d.nodeVMIDReader != nil {
+		d.ns.(*nodeService).VMID = findNodeVMID(diskManager, nodeID)
+	}
+	d.cs = NewControllerService(d, diskManager)
+	d.ids = NewIdentityServer(d, diskManager.VCDClient)
 	if !upgradeRde {
 		klog.Infof("Skipping RDE CSI section upgrade as upgradeRde flag is false")
 		return nil
@@ -162,22 +314,8 @@ func (d *VCDDriver) Run() error {
 		return err
 	}
 
-	logGRPC := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
-		handler grpc.UnaryHandler) (interface{}, error) {
-
-		klog.Infof("GRPC call: [%s]: [%#v]", info.FullMethod, req)
-
-		resp, err := handler(ctx, req)
-		if err != nil {
-			klog.Errorf("GRPC error: function [%s] req [%#v]: [%v]",
-				info.FullMethod, req, err)
-		}
-
-		return resp, err
-	}
-
 	opts := []grpc.ServerOption{
-		grpc.UnaryInterceptor(logGRPC),
+		grpc.UnaryInterceptor(logAndRecoverGRPC),
 	}
 	d.srv = grpc.NewServer(opts...)
 
@@ -195,6 +333,17 @@ func (d *VCDDriver) Run() error {
 	return d.srv.Serve(listener)
 }
 
+// toUnavailableIfHostUnreachable returns an Unavailable error for an internal error of a request that could not reach
+// VCD, which the sidecars re-drive as not final, by when the client may have failed over to another VCD host
+func toUnavailableIfHostUnreachable(err error) error {
+	st := status.Convert(err)
+	if (st.Code() != codes.Internal && st.Code() != codes.Unknown) || !vcdcsiclient.IsHostUnreachableError(err) {
+		return err
+	}
+
+	return status.Error(codes.Unavailable, st.Message())
+}
+
 // Stop will stop the grpc server
 func (d *VCDDriver) Stop() {
 	klog.Infof("Stopping server")
@@ -0,0 +1,312 @@
+/*
+   Copyright 2021 VMware, Inc.
+   SPDX-License-Identifier: Apache-2.0
+*/
+
+package csi
+
+import (
+	"context"
+	"fmt"
+	"k8s.io/klog"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// reasons of the events recorded on the PVCs and PVs whose disks fail to be modified in VCD
+	EventReasonDiskCreateFailed = "DiskCreateFailed"
+	EventReasonDiskDeleteFailed = "DiskDeleteFailed"
+	EventReasonDiskAttachFailed = "DiskAttachFailed"
+	EventReasonDiskDetachFailed = "DiskDetachFailed"
+	EventReasonDiskResizeFailed = "DiskResizeFailed"
+
+	eventTypeWarning = "Warning"
+	// eventTimeout bounds the time taken to record an event, including the lookup of the object of the event
+	eventTimeout = 30 * time.Second
+	// maxEventMessageLength is the length beyond which the Kubernetes API rejects the message of an event
+	maxEventMessageLength = 1024
+	// clusterScopedEventNamespace is the namespace of the events of cluster scoped objects such as PVs
+	clusterScopedEventNamespace = "default"
+
+	// eventCorrelationWindow is the time within which an event with the reason of an earlier one on the same object
+	// updates its count instead of creating another event, as the event correlator of client-go does
+	eventCorrelationWindow = 10 * time.Minute
+	// eventBurst is the number of events that are recorded on an object at once, after which one more event is
+	// recorded per eventRefillInterval, as the spam filter of client-go does
+	eventBurst          = 25
+	eventRefillInterval = 5 * time.Minute
+	// maxCorrelatedEvents bounds the events and objects that are remembered to correlate and rate limit the events
+	maxCorrelatedEvents = 4096
+)
+
+// EventRecorder records Kubernetes events on the PVCs and PVs of the volumes of the driver, so that the failures of
+// VCD are shown by `kubectl describe`. Events are recorded in the background and failures to record them are only
+// logged. Retried failures update the count of the event with their reason on the object, and the events of every
+// object are rate limited. A nil EventRecorder records nothing.
+type EventRecorder struct {
+	client   *kubeAPIClient
+	instance string
+
+	// lock serializes the events, so that an event is correlated with the ones recorded before
+	lock    sync.Mutex
+	events  map[string]*correlatedEvent
+	buckets map[string]*eventBucket
+}
+
+// correlatedEvent is an event that was recorded, which the events with its reason on its object update
+type correlatedEvent struct {
+	name           string
+	namespace      string
+	count          int32
+	lastTimestamp  time.Time
+	firstTimestamp string
+}
+
+// eventBucket has the tokens of the events that can be recorded on an object, which are refilled over time
+type eventBucket struct {
+	tokens     int
+	lastRefill time.Time
+}
+
+// NewEventRecorder creates an EventRecorder that records events with the service account of the pod
+func NewEventRecorder() (*EventRecorder, error) {
+	client, err := newKubeAPIClient()
+	if err != nil {
+		return nil, fmt.Errorf("unable to create client of Kubernetes API: [%v]", err)
+	}
+	instance, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get hostname: [%v]", err)
+	}
+
+	return newEventRecorder(client, instance), nil
+}
+
+func newEventRecorder(client *kubeAPIClient, instance string) *EventRecorder {
+	return &EventRecorder{
+		client:   client,
+		instance: instance,
+		events:   make(map[string]*correlatedEvent),
+		buckets:  make(map[string]*eventBucket),
+	}
+}
+
+// objectReference refers to the object that an event is about
+type objectReference struct {
+	APIVersion      string `json:"apiVersion"`
+	Kind            string `json:"kind"`
+	Namespace       string `json:"namespace,omitempty"`
+	Name            string `json:"name"`
+	UID             string `json:"uid,omitempty"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
+
+// objectMeta has the fields of the metadata of objects and events that are needed to record events
+type objectMeta struct {
+	Name            string `json:"name,omitempty"`
+	GenerateName    string `json:"generateName,omitempty"`
+	Namespace       string `json:"namespace,omitempty"`
+	UID             string `json:"uid,omitempty"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
+
+// event is a core/v1 Event
+type event struct {
+	APIVersion     string          `json:"apiVersion"`
+	Kind           string          `json:"kind"`
+	Metadata       objectMeta      `json:"metadata"`
+	InvolvedObject objectReference `json:"involvedObject"`
+	Reason         string          `json:"reason"`
+	Message        string          `json:"message"`
+	Type           string          `json:"type"`
+	Source         struct {
+		Component string `json:"component"`
+	} `json:"source"`
+	FirstTimestamp     string `json:"firstTimestamp"`
+	LastTimestamp      string `json:"lastTimestamp"`
+	Count              int32  `json:"count"`
+	ReportingComponent string `json:"reportingComponent"`
+	ReportingInstance  string `json:"reportingInstance"`
+}
+
+// RecordPVCWarning records a warning event with reason and message on the PVC name in namespace
+func (recorder *EventRecorder) RecordPVCWarning(namespace string, name string, reason string, message string) {
+	if recorder == nil || namespace == "" || name == "" {
+		return
+	}
+
+	go recorder.record(objectReference{
+		APIVersion: "v1",
+		Kind:       "PersistentVolumeClaim",
+		Namespace:  namespace,
+		Name:       name,
+	}, fmt.Sprintf("/api/v1/namespaces/%s/persistentvolumeclaims/%s", url.PathEscape(namespace),
+		url.PathEscape(name)), namespace, reason, message, time.Now())
+}
+
+// RecordPVWarning records a warning event with reason and message on the PV name
+func (recorder *EventRecorder) RecordPVWarning(name string, reason string, message string) {
+	if recorder == nil || name == "" {
+		return
+	}
+
+	go recorder.record(objectReference{
+		APIVersion: "v1",
+		Kind:       "PersistentVolume",
+		Name:       name,
+	}, fmt.Sprintf("/api/v1/persistentvolumes/%s", url.PathEscape(name)), clusterScopedEventNamespace, reason,
+		message, time.Now())
+}
+
+// allow takes a token of the events of the object objectKey at now, and returns false if it has none left
+func (recorder *EventRecorder) allow(objectKey string, now time.Time) bool {
+	bucket, ok := recorder.buckets[objectKey]
+	if !ok {
+		if len(recorder.buckets) >= maxCorrelatedEvents {
+			recorder.buckets = make(map[string]*eventBucket)
+		}
+		bucket = &eventBucket{
+			tokens:     eventBurst,
+			lastRefill: now,
+		}
+		recorder.buckets[objectKey] = bucket
+	}
+	if refills := int(now.Sub(bucket.lastRefill) / eventRefillInterval); refills > 0 {
+		bucket.tokens += refills
+		if bucket.tokens > eventBurst {
+			bucket.tokens = eventBurst
+		}
+		bucket.lastRefill = bucket.lastRefill.Add(time.Duration(refills) * eventRefillInterval)
+	}
+	if bucket.tokens == 0 {
+		return false
+	}
+	bucket.tokens--
+
+	return true
+}
+
+// correlated returns the event recorded with the key eventKey within the correlation window before now, or nil
+func (recorder *EventRecorder) correlated(eventKey string, now time.Time) *correlatedEvent {
+	correlated, ok := recorder.events[eventKey]
+	if !ok {
+		return nil
+	}
+	if now.Sub(correlated.lastTimestamp) > eventCorrelationWindow {
+		delete(recorder.events, eventKey)
+		return nil
+	}
+
+	return correlated
+}
+
+// remember keeps the event e with the key eventKey recorded at now, so that later events with its key update it
+func (recorder *EventRecorder) remember(eventKey string, e *event, now time.Time) {
+	if len(recorder.events) >= maxCorrelatedEvents {
+		for key, correlated := range recorder.events {
+			if now.Sub(correlated.lastTimestamp) > eventCorrelationWindow {
+				delete(recorder.events, key)
+			}
+		}
+		if len(recorder.events) >= maxCorrelatedEvents {
+			recorder.events = make(map[string]*correlatedEvent)
+		}
+	}
+	recorder.events[eventKey] = &correlatedEvent{
+		name:           e.Metadata.Name,
+		namespace:      e.Metadata.Namespace,
+		count:          e.Count,
+		lastTimestamp:  now,
+		firstTimestamp: e.FirstTimestamp,
+	}
+}
+
+// record creates an event on the object of ref, which is found at objectPath so that the event has its UID, or
+// updates the event with reason that was recorded on the object within the correlation window
+func (recorder *EventRecorder) record(ref objectReference, objectPath string, eventNamespace string,
+	reason string, message string, now time.Time) {
+
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+
+	objectKey := fmt.Sprintf("%s/%s/%s", ref.Kind, ref.Namespace, ref.Name)
+	if !recorder.allow(objectKey, now) {
+		klog.V(4).Infof("Dropped event [%s] on %s [%s] since too many events were recorded on it", reason,
+			ref.Kind, ref.Name)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), eventTimeout)
+	defer cancel()
+
+	if len(message) > maxEventMessageLength {
+		message = message[:maxEventMessageLength-3] + "..."
+	}
+	timestamp := now.UTC().Format(time.RFC3339)
+	eventKey := objectKey + "/" + reason
+	if correlated := recorder.correlated(eventKey, now); correlated != nil {
+		patch := map[string]interface{}{
+			"count":         correlated.count + 1,
+			"lastTimestamp": timestamp,
+			"message":       message,
+		}
+		err := recorder.client.do(ctx, http.MethodPatch, fmt.Sprintf("/api/v1/namespaces/%s/events/%s",
+			url.PathEscape(correlated.namespace), url.PathEscape(correlated.name)), patch, nil)
+		if err == nil {
+			correlated.count++
+			correlated.lastTimestamp = now
+			klog.V(4).Infof("Updated event [%s] on %s [%s] to count [%d]", reason, ref.Kind, ref.Name,
+				correlated.count)
+			return
+		}
+		// the event may have expired, hence another one is created
+		klog.V(4).Infof("unable to update event [%s] on %s [%s], hence creating another one: [%v]", reason,
+			ref.Kind, ref.Name, err)
+		delete(recorder.events, eventKey)
+	}
+
+	object := &struct {
+		Metadata objectMeta `json:"metadata"`
+	}{}
+	if err := recorder.client.do(ctx, http.MethodGet, objectPath, nil, object); err != nil {
+		klog.Errorf("unable to get %s [%s] to record event [%s]: [%v]", ref.Kind, ref.Name, reason, err)
+		return
+	}
+	ref.UID = object.Metadata.UID
+	ref.ResourceVersion = object.Metadata.ResourceVersion
+
+	e := &event{
+		APIVersion: "v1",
+		Kind:       "Event",
+		Metadata: objectMeta{
+			GenerateName: ref.Name + ".",
+			Namespace:    eventNamespace,
+		},
+		InvolvedObject:     ref,
+		Reason:             reason,
+		Message:            message,
+		Type:               eventTypeWarning,
+		FirstTimestamp:     timestamp,
+		LastTimestamp:      timestamp,
+		Count:              1,
+		ReportingComponent: Name,
+		ReportingInstance:  recorder.instance,
+	}
+	e.Source.Component = Name
+
+	created := &event{}
+	if err := recorder.client.do(ctx, http.MethodPost,
+		fmt.Sprintf("/api/v1/namespaces/%s/events", url.PathEscape(eventNamespace)), e, created); err != nil {
+		klog.Errorf("unable to record event [%s] on %s [%s]: [%v]", reason, ref.Kind, ref.Name, err)
+		return
+	}
+	if created.Metadata.Name != "" {
+		e.Metadata.Name = created.Metadata.Name
+		recorder.remember(eventKey, e, now)
+	}
+	klog.V(4).Infof("Recorded event [%s] on %s [%s]", reason, ref.Kind, ref.Name)
+}
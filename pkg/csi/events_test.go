@@ -0,0 +1,112 @@
+/*
+   Copyright 2021 VMware, Inc.
+   SPDX-License-Identifier: Apache-2.0
+*/
+
+package csi
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newFakeEventRecorder returns an EventRecorder that records events on the PVs of a fake Kubernetes API, and the
+// requests that the API received by method. The API fails to update events while patchStatus is not OK.
+func newFakeEventRecorder(t *testing.T, patchStatus *int) (*EventRecorder, map[string][]map[string]interface{}) {
+	requests := make(map[string][]map[string]interface{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := make(map[string]interface{})
+		if r.Method != http.MethodGet {
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&body), "event should be sent as JSON")
+		}
+		body["path"] = r.URL.Path
+		requests[r.Method] = append(requests[r.Method], body)
+		switch r.Method {
+		case http.MethodGet:
+			_, _ = w.Write([]byte(`{"metadata":{"uid":"uid-1"}}`))
+		case http.MethodPost:
+			_, _ = fmt.Fprintf(w, `{"metadata":{"name":"pv-1.%d"}}`, len(requests[r.Method]))
+		case http.MethodPatch:
+			assert.Equal(t, "application/merge-patch+json", r.Header.Get("Content-Type"),
+				"event should be updated with a merge patch")
+			w.WriteHeader(*patchStatus)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, ioutil.WriteFile(tokenFile, []byte("token"), 0600), "token should be written")
+	return newEventRecorder(&kubeAPIClient{
+		httpClient: server.Client(),
+		apiURL:     server.URL,
+		tokenFile:  tokenFile,
+	}, "controller-1"), requests
+}
+
+func TestEventRecorderCorrelatesEvents(t *testing.T) {
+	patchStatus := http.StatusOK
+	recorder, requests := newFakeEventRecorder(t, &patchStatus)
+	pv := objectReference{APIVersion: "v1", Kind: "PersistentVolume", Name: "pv-1"}
+	now := time.Now()
+	record := func(reason string, message string, at time.Duration) {
+		recorder.record(pv, "/api/v1/persistentvolumes/pv-1", clusterScopedEventNamespace, reason, message,
+			now.Add(at))
+	}
+
+	record(EventReasonDiskAttachFailed, "busy", 0)
+	require.Len(t, requests[http.MethodPost], 1, "first event should be created")
+	assert.Equal(t, "uid-1", requests[http.MethodPost][0]["involvedObject"].(map[string]interface{})["uid"],
+		"event should refer to the UID of the PV")
+
+	record(EventReasonDiskAttachFailed, "still busy", time.Minute)
+	assert.Len(t, requests[http.MethodPost], 1, "retried failure should not create another event")
+	require.Len(t, requests[http.MethodPatch], 1, "retried failure should update the event")
+	assert.Equal(t, "/api/v1/namespaces/default/events/pv-1.1", requests[http.MethodPatch][0]["path"],
+		"event that was created should be updated")
+	assert.Equal(t, float64(2), requests[http.MethodPatch][0]["count"], "count of the event should be increased")
+	assert.Equal(t, "still busy", requests[http.MethodPatch][0]["message"], "event should have the last message")
+
+	record(EventReasonDiskDetachFailed, "busy", time.Minute)
+	assert.Len(t, requests[http.MethodPost], 2, "event with another reason should be created")
+
+	record(EventReasonDiskAttachFailed, "busy", time.Minute+eventCorrelationWindow+time.Second)
+	assert.Len(t, requests[http.MethodPost], 3, "event after the correlation window should be created")
+
+	patchStatus = http.StatusNotFound
+	record(EventReasonDiskAttachFailed, "busy", eventCorrelationWindow+2*time.Minute)
+	assert.Len(t, requests[http.MethodPatch], 2, "retried failure should update the event")
+	assert.Len(t, requests[http.MethodPost], 4, "event that fails to be updated should be created again")
+}
+
+func TestEventRecorderRateLimitsEvents(t *testing.T) {
+	patchStatus := http.StatusOK
+	recorder, requests := newFakeEventRecorder(t, &patchStatus)
+	pv := objectReference{APIVersion: "v1", Kind: "PersistentVolume", Name: "pv-1"}
+	now := time.Now()
+	record := func(reason string, at time.Duration) {
+		recorder.record(pv, "/api/v1/persistentvolumes/pv-1", clusterScopedEventNamespace, reason, "failed",
+			now.Add(at))
+	}
+
+	for i := 0; i < eventBurst+5; i++ {
+		record(fmt.Sprintf("Reason%d", i), 0)
+	}
+	assert.Len(t, requests[http.MethodPost], eventBurst, "events beyond the burst should be dropped")
+
+	record(EventReasonDiskAttachFailed, eventRefillInterval)
+	record(EventReasonDiskDetachFailed, eventRefillInterval)
+	assert.Len(t, requests[http.MethodPost], eventBurst+1, "one event should be recorded per refill interval")
+
+	other := objectReference{APIVersion: "v1", Kind: "PersistentVolume", Name: "pv-2"}
+	recorder.record(other, "/api/v1/persistentvolumes/pv-2", clusterScopedEventNamespace,
+		EventReasonDiskAttachFailed, "failed", now)
+	assert.Len(t, requests[http.MethodPost], eventBurst+2, "events of another object should not be limited")
+}
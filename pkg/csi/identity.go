@@ -7,35 +7,75 @@ package csi
 
 import (
 	"context"
+	"github.com/vmware/cloud-director-named-disk-csi-driver/pkg/vcdcsiclient"
 	"github.com/vmware/cloud-director-named-disk-csi-driver/version"
+	"sync"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/protobuf/ptypes/wrappers"
 	"k8s.io/klog"
 )
 
 const (
 	// Name is the name of this CSI plugin.
 	Name = "named-disk.csi.cloud-director.vmware.com"
+
+	// probeCacheDuration is how long the result of a connectivity check to VCD answers probes
+	probeCacheDuration = 5 * time.Second
+	// probeTimeout bounds a connectivity check to VCD
+	probeTimeout = 10 * time.Second
 )
 
 type identityServer struct {
-	Driver *VCDDriver
+	Driver    *VCDDriver
+	VCDClient *vcdcsiclient.Client
+
+	// probeReady is the result of the connectivity check to VCD at probeCheckedAt
+	probeLock      sync.Mutex
+	probeReady     bool
+	probeCheckedAt time.Time
 }
 
-// NewIdentityServer will create a new csi.IdentityServer with driver
-func NewIdentityServer(driver *VCDDriver) csi.IdentityServer {
+// NewIdentityServer will create a new csi.IdentityServer with driver. The driver is ready when vcdClient can reach
+// VCD.
+func NewIdentityServer(driver *VCDDriver, vcdClient *vcdcsiclient.Client) csi.IdentityServer {
 	return &identityServer{
-		Driver: driver,
+		Driver:    driver,
+		VCDClient: vcdClient,
 	}
 }
 
+// Probe reports the driver ready if it can reach and authenticate to VCD. Probes are frequent, hence the result of
+// a check is reused for probeCacheDuration.
 func (ids *identityServer) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
-	klog.Infof("Probe: called with args [%+v]", *req)
-	return &csi.ProbeResponse{}, nil
+	klog.V(4).Infof("Probe: called with args [%v]", redactSecrets(req))
+
+	if ids.VCDClient == nil {
+		return &csi.ProbeResponse{Ready: &wrappers.BoolValue{Value: true}}, nil
+	}
+
+	// concurrent probes wait for a single check
+	ids.probeLock.Lock()
+	defer ids.probeLock.Unlock()
+
+	if time.Since(ids.probeCheckedAt) >= probeCacheDuration {
+		checkCtx, cancel := context.WithTimeout(ctx, probeTimeout)
+		err := ids.VCDClient.CheckConnectivity(checkCtx)
+		cancel()
+		if err != nil {
+			klog.Errorf("Probe: unable to reach VCD: [%v]", err)
+		} else if !ids.probeReady {
+			klog.Infof("Probe: VCD is reachable")
+		}
+		ids.probeReady, ids.probeCheckedAt = err == nil, time.Now()
+	}
+
+	return &csi.ProbeResponse{Ready: &wrappers.BoolValue{Value: ids.probeReady}}, nil
 }
 
 func (ids *identityServer) GetPluginInfo(ctx context.Context, req *csi.GetPluginInfoRequest) (*csi.GetPluginInfoResponse, error) {
-	klog.Infof("GetPluginInfo: called with args [%+v]", *req)
+	klog.Infof("GetPluginInfo: called with args [%v]", redactSecrets(req))
 	resp := &csi.GetPluginInfoResponse{
 		Name:          Name,
 		VendorVersion: version.Version,
@@ -45,7 +85,7 @@ func (ids *identityServer) GetPluginInfo(ctx context.Context, req *csi.GetPlugin
 }
 
 func (ids *identityServer) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
-	klog.Infof("GetPluginCapabilities: called with args [%+v]", *req)
+	klog.Infof("GetPluginCapabilities: called with args [%v]", redactSecrets(req))
 	resp := &csi.GetPluginCapabilitiesResponse{
 		Capabilities: []*csi.PluginCapability{
 			{
@@ -62,6 +102,13 @@ func (ids *identityServer) GetPluginCapabilities(ctx context.Context, req *csi.G
 					},
 				},
 			},
+			{
+				Type: &csi.PluginCapability_VolumeExpansion_{
+					VolumeExpansion: &csi.PluginCapability_VolumeExpansion{
+						Type: csi.PluginCapability_VolumeExpansion_ONLINE,
+					},
+				},
+			},
 		},
 	}
 
@@ -0,0 +1,165 @@
+/*
+   Copyright 2021 VMware, Inc.
+   SPDX-License-Identifier: Apache-2.0
+*/
+
+package csi
+
+import (
+	"context"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/protobuf/proto"
+	"github.com/vmware/cloud-director-named-disk-csi-driver/pkg/vcdcsiclient"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"k8s.io/klog"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// redactedValue replaces the values of the secrets of the requests that are logged
+const redactedValue = "***redacted***"
+
+// secretKeyFragments are the fragments of the keys of the entries of the maps of a request, such as the volume context,
+// whose values are redacted as secrets even though the CSI spec does not mark the map as secrets
+var secretKeyFragments = []string{"password", "token"}
+
+// logAndRecoverGRPC is the interceptor of the RPCs of the identity, controller and node services. It gives every RPC a
+// request ID, which the VCD calls of the RPC are logged with, and logs the method and request of the RPC, with its
+// secrets redacted, and the duration and code of its response. A panic of the handler of an RPC fails the RPC with an
+// Internal error instead of crashing the driver.
+func logAndRecoverGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (resp interface{}, err error) {
+
+	start := time.Now()
+	ctx = vcdcsiclient.NewRequestContext(ctx)
+	requestID := vcdcsiclient.RequestID(ctx)
+	klog.Infof("GRPC call: [%s] request ID [%s]: [%v]", info.FullMethod, requestID, redactSecrets(req))
+	defer func() {
+		if r := recover(); r != nil {
+			klog.Errorf("GRPC panic: function [%s] request ID [%s]: [%v]\n%s", info.FullMethod, requestID, r,
+				debug.Stack())
+			resp, err = nil, status.Errorf(codes.Internal, "unexpected panic in [%s]: [%v]", info.FullMethod, r)
+		}
+
+		code := status.Code(err)
+		if err != nil {
+			klog.Errorf("GRPC error: function [%s] request ID [%s] req [%v] took [%v] with code [%s]: [%v]",
+				info.FullMethod, requestID, redactSecrets(req), time.Since(start), code, err)
+			return
+		}
+		klog.Infof("GRPC response: function [%s] request ID [%s] took [%v] with code [%s]", info.FullMethod,
+			requestID, time.Since(start), code)
+	}()
+
+	resp, err = handler(ctx, req)
+	if err != nil {
+		err = toUnavailableIfHostUnreachable(err)
+	}
+
+	return resp, err
+}
+
+// redactSecrets returns a copy of the request req in which the values of the fields that the CSI spec marks as
+// secrets, and the values of the entries of maps whose keys contain a secretKeyFragments, are redacted, so that req can
+// be logged. A request that is not a protobuf message is returned as is.
+func redactSecrets(req interface{}) interface{} {
+	msg, ok := req.(proto.Message)
+	if !ok || msg == nil {
+		return req
+	}
+
+	redacted := proto.Clone(msg)
+	redactMessageSecrets(proto.MessageReflect(redacted))
+	return redacted
+}
+
+// redactMessageSecrets redacts the fields of msg and of its nested messages that the CSI spec marks as secrets
+func redactMessageSecrets(msg protoreflect.Message) {
+	// the secret fields are redacted once the fields are ranged over, since they cannot be changed meanwhile
+	var secretFields []protoreflect.FieldDescriptor
+	msg.Range(func(fd protoreflect.FieldDescriptor, value protoreflect.Value) bool {
+		switch {
+		case isSecretField(fd):
+			secretFields = append(secretFields, fd)
+		case fd.IsMap() && fd.MapValue().Kind() == protoreflect.StringKind:
+			entries := value.Map()
+			entries.Range(func(key protoreflect.MapKey, _ protoreflect.Value) bool {
+				if isSecretKey(key.String()) {
+					secretFields = append(secretFields, fd)
+					return false
+				}
+				return true
+			})
+		case fd.IsMap() && fd.MapValue().Kind() == protoreflect.MessageKind:
+			value.Map().Range(func(_ protoreflect.MapKey, mapValue protoreflect.Value) bool {
+				redactMessageSecrets(mapValue.Message())
+				return true
+			})
+		case fd.IsList() && fd.Kind() == protoreflect.MessageKind:
+			for i := 0; i < value.List().Len(); i++ {
+				redactMessageSecrets(value.List().Get(i).Message())
+			}
+		case !fd.IsMap() && !fd.IsList() && fd.Kind() == protoreflect.MessageKind:
+			redactMessageSecrets(value.Message())
+		}
+		return true
+	})
+	for _, fd := range secretFields {
+		redactField(msg, fd, isSecretField(fd))
+	}
+}
+
+// isSecretKey returns true if the key of an entry of a map contains a secretKeyFragments, ignoring case
+func isSecretKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, fragment := range secretKeyFragments {
+		if strings.Contains(key, fragment) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isSecretField returns true if the field fd has the csi_secret option of the CSI spec
+func isSecretField(fd protoreflect.FieldDescriptor) bool {
+	options, ok := fd.Options().(proto.Message)
+	if !ok || !proto.HasExtension(options, csi.E_CsiSecret) {
+		return false
+	}
+	secret, err := proto.GetExtension(options, csi.E_CsiSecret)
+	if err != nil {
+		return false
+	}
+	isSecret, ok := secret.(*bool)
+
+	return ok && isSecret != nil && *isSecret
+}
+
+// redactField replaces the value of the secret field fd of msg, or the values of its entries for a map, with
+// redactedValue. Only the entries whose keys are secret keys are redacted of a map that is not all secrets. The keys
+// of the entries of a map are kept, so that the secrets that a request has can be told.
+func redactField(msg protoreflect.Message, fd protoreflect.FieldDescriptor, allSecrets bool) {
+	switch {
+	case fd.IsMap() && fd.MapValue().Kind() == protoreflect.StringKind:
+		secrets := msg.Mutable(fd).Map()
+		var keys []protoreflect.MapKey
+		secrets.Range(func(key protoreflect.MapKey, _ protoreflect.Value) bool {
+			if allSecrets || isSecretKey(key.String()) {
+				keys = append(keys, key)
+			}
+			return true
+		})
+		for _, key := range keys {
+			secrets.Set(key, protoreflect.ValueOfString(redactedValue))
+		}
+	case !fd.IsList() && fd.Kind() == protoreflect.StringKind:
+		msg.Set(fd, protoreflect.ValueOfString(redactedValue))
+	default:
+		msg.Clear(fd)
+	}
+}
@@ -0,0 +1,128 @@
+/*
+   Copyright 2021 VMware, Inc.
+   SPDX-License-Identifier: Apache-2.0
+*/
+
+package csi
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// serviceAccountDir has the credentials of the service account of the pod of the driver
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	// listPageSize is the number of objects fetched from the Kubernetes API per request
+	listPageSize = 500
+)
+
+// kubeAPIClient sends requests to the Kubernetes API of the cluster that the pod runs in, with the service account
+// of the pod
+type kubeAPIClient struct {
+	httpClient *http.Client
+	apiURL     string
+	tokenFile  string
+}
+
+func newKubeAPIClient() (*kubeAPIClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT should be set in the pod")
+	}
+
+	caFile := filepath.Join(serviceAccountDir, "ca.crt")
+	caCert, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read CA certificate [%s]: [%v]", caFile, err)
+	}
+	rootCAs := x509.NewCertPool()
+	if !rootCAs.AppendCertsFromPEM(caCert) {
+		return nil, fmt.Errorf("no certificates found in [%s]", caFile)
+	}
+
+	return &kubeAPIClient{
+		httpClient: &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: rootCAs},
+			},
+		},
+		apiURL:    "https://" + net.JoinHostPort(host, port),
+		tokenFile: filepath.Join(serviceAccountDir, "token"),
+	}, nil
+}
+
+// listQuery returns the query of the page of a list of objects that continues at continueToken
+func listQuery(continueToken string) string {
+	query := url.Values{}
+	query.Set("limit", fmt.Sprintf("%d", listPageSize))
+	if continueToken != "" {
+		query.Set("continue", continueToken)
+	}
+
+	return query.Encode()
+}
+
+// do sends a request for path with the JSON of body, if not nil, and decodes the JSON of a successful response into
+// result, if not nil
+func (client *kubeAPIClient) do(ctx context.Context, method string, path string, body interface{},
+	result interface{}) error {
+
+	// the token of the service account is rotated, hence it is read for every request
+	token, err := ioutil.ReadFile(client.tokenFile)
+	if err != nil {
+		return fmt.Errorf("unable to read service account token [%s]: [%v]", client.tokenFile, err)
+	}
+
+	var reqBody io.Reader
+	if body != nil {
+		bodyJSON, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("unable to encode body of request [%s %s]: [%v]", method, path, err)
+		}
+		reqBody = bytes.NewReader(bodyJSON)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, client.apiURL+path, reqBody)
+	if err != nil {
+		return fmt.Errorf("unable to create request [%s %s]: [%v]", method, path, err)
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+	if method == http.MethodPatch {
+		req.Header.Set("Content-Type", "application/merge-patch+json")
+	} else if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := client.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("unexpected response status [%s]", resp.Status)
+	}
+
+	if result == nil {
+		return nil
+	}
+	if err = json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("unable to decode response of [%s %s]: [%v]", method, path, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,148 @@
+/*
+   Copyright 2021 VMware, Inc.
+   SPDX-License-Identifier: Apache-2.0
+*/
+
+package csi
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// MkfsOptionsParameter is the StorageClass parameter with the extra options of mkfs for the filesystem of a fresh
+// disk, e.g. "-b 4096 -E lazy_itable_init=0"
+const MkfsOptionsParameter = "mkfsOptions"
+
+var (
+	// extMkfsOptions are the options of mkfs.ext2, mkfs.ext3 and mkfs.ext4 that may be set, with the keys that the
+	// value of an option may list, or nil for an option whose value is a number
+	extMkfsOptions = map[string][]string{
+		"-b": nil, // block size
+		"-i": nil, // bytes per inode
+		"-I": nil, // inode size
+		"-m": nil, // reserved blocks percentage
+		"-N": nil, // number of inodes
+		"-E": {"discard", "lazy_itable_init", "lazy_journal_init", "nodiscard", "stride", "stripe_width"},
+	}
+	// xfsMkfsOptions are the options of mkfs.xfs that may be set, with the keys that the value of an option may list
+	xfsMkfsOptions = map[string][]string{
+		"-b": {"size"},
+		"-d": {"agcount", "su", "sunit", "sw", "swidth"},
+		"-i": {"maxpct", "size"},
+		"-l": {"size", "su", "sunit"},
+		"-m": {"crc", "finobt", "reflink"},
+	}
+	// allowedMkfsOptions are the mkfs options that may be set for each of the SupportedFileSystems. Other options are
+	// rejected, so that a StorageClass cannot make mkfs overwrite other devices or filesystems.
+	allowedMkfsOptions = map[string]map[string][]string{
+		"ext2": extMkfsOptions,
+		"ext3": extMkfsOptions,
+		"ext4": extMkfsOptions,
+		"xfs":  xfsMkfsOptions,
+	}
+
+	// mkfsNumberRegex matches the value of an option that is a number
+	mkfsNumberRegex = regexp.MustCompile(`^[0-9]+$`)
+	// mkfsKeyValueRegex matches a number with an optional unit, which is the value of a key such as su=64k
+	mkfsKeyValueRegex = regexp.MustCompile(`^[0-9]+[kmgKMG]?$`)
+)
+
+// parseMkfsOptions returns the arguments of mkfs for the mkfs options mkfsOptions of the filesystem fsType, which are
+// an option followed by its value, separated by spaces. The value of an option with keys is a comma-separated list of
+// keys with an optional number each, e.g. "-E lazy_itable_init=0,nodiscard". The error names the allowed options.
+func parseMkfsOptions(mkfsOptions string, fsType string) ([]string, error) {
+	args := strings.Fields(mkfsOptions)
+	if len(args) == 0 {
+		return nil, nil
+	}
+	allowedOptions, ok := allowedMkfsOptions[fsType]
+	if !ok {
+		return nil, fmt.Errorf("fs [%s] does not take mkfs options", fsType)
+	}
+
+	for i := 0; i < len(args); i += 2 {
+		keys, ok := allowedOptions[args[i]]
+		if !ok {
+			return nil, fmt.Errorf("mkfs option [%s] is not allowed for fs [%s]; allowed options are [%s]", args[i],
+				fsType, describeMkfsOptions(allowedOptions))
+		}
+		if i+1 == len(args) {
+			return nil, fmt.Errorf("mkfs option [%s] should have a value", args[i])
+		}
+		if err := checkMkfsOptionValue(args[i+1], keys); err != nil {
+			return nil, fmt.Errorf("invalid value [%s] of mkfs option [%s] for fs [%s]: [%v]; allowed options are [%s]",
+				args[i+1], args[i], fsType, err, describeMkfsOptions(allowedOptions))
+		}
+	}
+
+	return args, nil
+}
+
+// checkMkfsOptionValue returns an error if value is not a number for an option without keys, or not a list of the
+// keys keys with optional numbers otherwise
+func checkMkfsOptionValue(value string, keys []string) error {
+	if keys == nil {
+		if !mkfsNumberRegex.MatchString(value) {
+			return fmt.Errorf("value should be a number")
+		}
+		return nil
+	}
+
+	for _, item := range strings.Split(value, ",") {
+		key, keyValue, hasValue := item, "", false
+		if index := strings.Index(item, "="); index >= 0 {
+			key, keyValue, hasValue = item[:index], item[index+1:], true
+		}
+		allowed := false
+		for _, allowedKey := range keys {
+			allowed = allowed || key == allowedKey
+		}
+		if !allowed {
+			return fmt.Errorf("key [%s] is not allowed", key)
+		}
+		if hasValue && !mkfsKeyValueRegex.MatchString(keyValue) {
+			return fmt.Errorf("value of key [%s] should be a number with an optional unit k, m or g", key)
+		}
+	}
+
+	return nil
+}
+
+// describeMkfsOptions returns the allowed options with their keys, e.g. "-E discard|nodiscard, -b"
+func describeMkfsOptions(allowedOptions map[string][]string) string {
+	descriptions := make([]string, 0, len(allowedOptions))
+	for option, keys := range allowedOptions {
+		if keys == nil {
+			descriptions = append(descriptions, option)
+		} else {
+			descriptions = append(descriptions, fmt.Sprintf("%s %s", option, strings.Join(keys, "|")))
+		}
+	}
+	sort.Strings(descriptions)
+
+	return strings.Join(descriptions, ", ")
+}
+
+// formatDevice formats the unformatted device devicePath with the filesystem fsType and the arguments of mkfs
+// mkfsArgs, as returned by parseMkfsOptions
+func formatDevice(ctx context.Context, devicePath string, fsType string, mkfsArgs []string) error {
+	args := append([]string{}, mkfsArgs...)
+	if strings.HasPrefix(fsType, "ext") {
+		// mkfs.ext* asks for confirmation to format a whole disk instead of a partition
+		args = append(args, "-F")
+	}
+	args = append(args, devicePath)
+
+	output, err := exec.CommandContext(ctx, fmt.Sprintf("mkfs.%s", fsType), args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("unable to format device [%s] with mkfs.%s [%v]: [%v]: [%s]", devicePath, fsType,
+			args, err, strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
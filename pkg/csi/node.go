@@ -8,10 +8,12 @@ package csi
 import (
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/akutz/gofsutil"
 	"github.com/container-storage-interface/spec/lib/go/csi"
@@ -22,24 +24,55 @@ import (
 )
 
 const (
-	// The maximum number of volumes that a node can have attached.
+	// The default maximum number of volumes that a node can have attached.
 	// Since we're using bus 1 only, it allows up-to 16 disks of which one (#7)
 	// is pre-allocated for the HBA. Hence we have only 15 disks.
-	maxVolumesPerNode = 15
+	defaultMaxVolumesPerNode = 15
+	// maxSCSIVolumesPerNode is the most disks that the 4 SCSI buses of a VM can have, with 15 disks each
+	maxSCSIVolumesPerNode = 60
 
 	DevDiskPath = "/dev/disk/by-path"
+	// DevDiskByIDPath has links named after the WWN of the disks, which is their UUID in VCD
+	DevDiskByIDPath = "/dev/disk/by-id"
+
+	// SCSIHostPath has the SCSI hosts of the node, whose buses are rescanned for just attached disks
+	SCSIHostPath = "/sys/class/scsi_host"
+
+	// defaultDeviceReadyTimeout is how long to wait by default for the device of a just attached disk to appear on
+	// the node
+	defaultDeviceReadyTimeout = 2 * time.Minute
+	// defaultDeviceReadyInterval is the default interval at which the devices of the node are looked up for that of
+	// a disk
+	defaultDeviceReadyInterval = time.Second
+)
+
+var (
+	// driverMountFlags are managed by the driver and cannot be set through the mount options of a StorageClass
+	driverMountFlags = map[string]bool{
+		"bind":    true,
+		"rbind":   true,
+		"remount": true,
+	}
 )
 
 type nodeService struct {
 	Driver        *VCDDriver
 	NodeID        string
+	// VDCName is the VDC of the VM of the node, which is advertised as its topology
+	VDCName       string
+	// VMID is the UUID of the VM of the node, which is advertised in its topology if it is set
+	VMID          string
+	// diskByIDPath has the links named after the WWN of the disks, which is DevDiskByIDPath on a node
+	diskByIDPath  string
 }
 
 // NewNodeService creates and returns a NodeService struct.
-func NewNodeService(driver *VCDDriver, nodeID string) csi.NodeServer {
+func NewNodeService(driver *VCDDriver, nodeID string, vdcName string) csi.NodeServer {
 	return &nodeService{
-		Driver: driver,
-		NodeID: nodeID,
+		Driver:       driver,
+		NodeID:       nodeID,
+		VDCName:      vdcName,
+		diskByIDPath: DevDiskByIDPath,
 	}
 }
 
@@ -52,7 +85,11 @@ func (ns *nodeService) NodeStageVolume(ctx context.Context,
 		return nil, status.Errorf(codes.InvalidArgument, "NodeStageVolume: Request is empty")
 	}
 
-	klog.Infof("NodeStageVolume: called with args [%#v]", *req)
+	klog.Infof("NodeStageVolume: called with args [%v]", redactSecrets(req))
+	if encrypted, ok := req.GetVolumeContext()[EncryptedAttribute]; ok {
+		klog.Infof("NodeStageVolume: disk of volume [%s] is encrypted at rest by VCD: [%s]", req.GetVolumeId(),
+			encrypted)
+	}
 
 	// Check for block device and exit early if specified
 	volumeCapability := req.GetVolumeCapability()
@@ -70,12 +107,6 @@ func (ns *nodeService) NodeStageVolume(ctx context.Context,
 		return nil, status.Errorf(codes.InvalidArgument, "NodeStageVolume: Publish context not provided")
 	}
 
-	fsType, ok := publishContext[FileSystemParameter]
-	if !ok {
-		return nil, status.Errorf(codes.InvalidArgument,
-			"publish context does not have [%s] set", FileSystemParameter)
-	}
-
 	vmFullName, ok := publishContext[VMFullNameAttribute]
 	if !ok {
 		return nil, status.Errorf(codes.InvalidArgument,
@@ -83,7 +114,7 @@ func (ns *nodeService) NodeStageVolume(ctx context.Context,
 	}
 
 	mountMode := "rw"
-	if ns.isVolumeReadOnly(volumeCapability) {
+	if ns.isVolumeReadOnly(volumeCapability) || publishContext[ReadOnlyAttribute] == "true" {
 		mountMode = "ro"
 	}
 
@@ -91,17 +122,32 @@ func (ns *nodeService) NodeStageVolume(ctx context.Context,
 	if mnt == nil {
 		return nil, status.Errorf(codes.InvalidArgument, "volume capability must have mount details")
 	}
+	fsType := publishContext[FileSystemAttribute]
+	if fsType == "" {
+		fsType = req.GetVolumeContext()[FileSystemParameter]
+	}
 	if mnt.FsType != fsType {
-		if mnt.FsType != "" {
-			return nil, fmt.Errorf("fs type in mountpoint [%s] does not match specified fs type [%s]",
-				mnt.FsType, fsType)
+		if mnt.FsType != "" && fsType != "" {
+			return nil, status.Errorf(codes.InvalidArgument,
+				"fs type in mountpoint [%s] does not match specified fs type [%s]", mnt.FsType, fsType)
 		}
 
-		// allow fsType passed from the PV or other sources to go through
-		klog.Infof("Volume capability has empty FsType. Using FS [%s] from PV config.", fsType)
-		mnt.FsType = fsType
+		if fsType == "" {
+			fsType = mnt.FsType
+		} else {
+			// allow fsType passed from the PV or other sources to go through
+			klog.Infof("Volume capability has empty FsType. Using FS [%s] from PV config.", fsType)
+			mnt.FsType = fsType
+		}
+	}
+	if fsType != "" && !SupportedFileSystems[fsType] {
+		return nil, status.Errorf(codes.InvalidArgument, "fs type [%s] not supported", fsType)
+	}
+	mountFlags, err := getMountFlags(mnt.GetMountFlags(), mountMode)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid mount flags for volume [%s]: [%v]",
+			req.GetVolumeId(), err)
 	}
-	mountFlags := append(mnt.GetMountFlags(), mountMode)
 
 	diskUUID, ok := publishContext[DiskUUIDAttribute]
 	if !ok {
@@ -144,13 +190,46 @@ func (ns *nodeService) NodeStageVolume(ctx context.Context,
 		}
 	}
 
+	// A formatted device is mounted with its own filesystem, so it must be the requested one
+	existingFsType, err := gofsutil.GetDiskFormat(ctx, devicePath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "unable to get format of device [%s]: [%v]", devicePath, err)
+	}
+	if fsType == "" {
+		fsType = getStageFsType(existingFsType)
+		klog.Infof("No FS specified for volume [%s]. Hence using [%s] for device with FS [%s].",
+			volumeID, fsType, existingFsType)
+	}
+	if existingFsType != "" && existingFsType != fsType {
+		return nil, status.Errorf(codes.FailedPrecondition,
+			"device [%s] is already formatted with fs [%s] instead of the requested fs [%s]",
+			devicePath, existingFsType, fsType)
+	}
+
+	// the mkfs options only apply to a fresh device, and the filesystem of a formatted device is kept as it is
+	mkfsArgs, err := parseMkfsOptions(req.GetVolumeContext()[MkfsOptionsParameter], fsType)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid mkfs options of volume [%s]: [%v]", volumeID, err)
+	}
+	if len(mkfsArgs) > 0 {
+		if existingFsType == "" {
+			klog.Infof("Formatting device [%s] with fs [%s] and mkfs options [%v]", devicePath, fsType, mkfsArgs)
+			if err = formatDevice(ctx, devicePath, fsType, mkfsArgs); err != nil {
+				return nil, status.Errorf(codes.Internal, "%v", err)
+			}
+		} else {
+			klog.Infof("Device [%s] is already formatted with fs [%s], hence not applying mkfs options [%v]",
+				devicePath, existingFsType, mkfsArgs)
+		}
+	}
+
 	// Mounting as the device is not yet mounted
 	klog.Infof("Mounting device [%s] to folder [%s] of type [%s] with flags [%v]",
 		devicePath, mountDir, fsType, mountFlags)
 	if err = gofsutil.FormatAndMount(ctx, devicePath, mountDir, fsType, mountFlags...); err != nil {
 		return nil, status.Error(codes.Internal,
 			fmt.Sprintf("unable to format and mount device [%s] at path [%s] with fs [%s] and flags [%v]: [%v]",
-				devicePath, mountDir, mountFlags, err))
+				devicePath, mountDir, fsType, mountFlags, err))
 	}
 	klog.Infof("Mounted device [%s] at path [%s] with fs [%s] and options [%v]",
 		devicePath, mountDir, fsType, mountFlags)
@@ -159,7 +238,7 @@ func (ns *nodeService) NodeStageVolume(ctx context.Context,
 	return &csi.NodeStageVolumeResponse{}, nil
 }
 
-// NodeUnstageVolume unmounts disk from the host.
+// NodeUnstageVolume unmounts disk from the host once no pod target is bound to its staging directory.
 func (ns *nodeService) NodeUnstageVolume(ctx context.Context,
 	req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
 
@@ -189,6 +268,17 @@ func (ns *nodeService) NodeUnstageVolume(ctx context.Context,
 		return &csi.NodeUnstageVolumeResponse{}, nil
 	}
 
+	// unmounting the staging directory would leave the pods that still use the volume with a stale filesystem
+	boundTargets, err := ns.getBoundTargets(ctx, mountDir)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "unable to find targets bound to [%s]: [%v]", mountDir, err)
+	}
+	if len(boundTargets) > 0 {
+		return nil, status.Errorf(codes.FailedPrecondition,
+			"NodeUnstageVolume: volume [%s] staged at [%s] is still published at [%v]", deviceName, mountDir,
+			boundTargets)
+	}
+
 	// the directory exists and is mounted, so unmount
 	klog.Infof("Attempting to unmount path [%s].", mountDir)
 	if err = gofsutil.Unmount(ctx, mountDir); err != nil {
@@ -199,12 +289,23 @@ func (ns *nodeService) NodeUnstageVolume(ctx context.Context,
 	return &csi.NodeUnstageVolumeResponse{}, nil
 }
 
+// getStageFsType returns the fs with which a volume is staged if none was requested, where existingFsType is the fs
+// of its device. A device that is already formatted with a supported fs, such as a disk that was created outside the
+// driver and imported as a static PV, keeps its fs rather than being rejected for not having the default one.
+func getStageFsType(existingFsType string) string {
+	if existingFsType != "" && SupportedFileSystems[existingFsType] {
+		return existingFsType
+	}
+
+	return DefaultFileSystem
+}
+
 // NodePublishVolume bind-mounts the host mountDir onto a dir specific to each pod
 // requesting the pvc.
 func (ns *nodeService) NodePublishVolume(ctx context.Context,
 	req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
 
-	klog.Infof("NodePublishVolume: called with args %#v", *req)
+	klog.Infof("NodePublishVolume: called with args [%v]", redactSecrets(req))
 
 	if volumeContext := req.GetVolumeContext(); volumeContext != nil {
 		if ephemeralVolume, ok := volumeContext[EphemeralVolumeContext]; ok {
@@ -217,42 +318,51 @@ func (ns *nodeService) NodePublishVolume(ctx context.Context,
 
 	diskName := req.GetVolumeId()
 	if diskName == "" {
-		return nil, status.Errorf(codes.InvalidArgument, "NodeStageVolume: VolumeId not provided")
+		return nil, status.Errorf(codes.InvalidArgument, "NodePublishVolume: VolumeId not provided")
 	}
 
 	podMountDir := req.GetTargetPath()
 	if podMountDir == "" {
-		return nil, status.Errorf(codes.InvalidArgument, "NodeStageVolume: TargetPath not provided")
+		return nil, status.Errorf(codes.InvalidArgument, "NodePublishVolume: TargetPath not provided")
 	}
 
 	volumeCapability := req.GetVolumeCapability()
 	if volumeCapability == nil {
-		return nil, status.Errorf(codes.InvalidArgument, "NodeStageVolume: VolumeCapability not provided")
-	}
-
-	mountMode := "rw"
-	if ns.isVolumeReadOnly(volumeCapability) {
-		mountMode = "ro"
+		return nil, status.Errorf(codes.InvalidArgument, "NodePublishVolume: VolumeCapability not provided")
 	}
 
 	hostMountDir := req.GetStagingTargetPath()
 	if hostMountDir == "" {
-		return nil, status.Errorf(codes.InvalidArgument, "NodeStageVolume: StagingTargetPath not provided")
+		return nil, status.Errorf(codes.InvalidArgument, "NodePublishVolume: StagingTargetPath not provided")
 	}
 
 	publishContext := req.GetPublishContext()
 	if publishContext == nil {
-		return nil, status.Errorf(codes.InvalidArgument, "NodeStageVolume: PublishContext not provided")
+		return nil, status.Errorf(codes.InvalidArgument, "NodePublishVolume: PublishContext not provided")
+	}
+
+	mountMode := "rw"
+	if req.GetReadonly() || ns.isVolumeReadOnly(volumeCapability) || publishContext[ReadOnlyAttribute] == "true" {
+		mountMode = "ro"
+	}
+
+	// The device of a block volume is bind-mounted as is, without a filesystem
+	if blk := volumeCapability.GetBlock(); blk != nil {
+		return ns.nodePublishBlockVolume(ctx, diskName, podMountDir, publishContext, mountMode)
 	}
 
 	mnt := volumeCapability.GetMount()
 	if mnt == nil {
 		return nil, status.Errorf(codes.InvalidArgument, "volume capability must have mount details")
 	}
-	mountFlags := append(mnt.GetMountFlags(), mountMode)
+	mountFlags, err := getMountFlags(mnt.GetMountFlags(), mountMode)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid mount flags for volume [%s]: [%v]",
+			diskName, err)
+	}
 
 	// verify that host dir exists
-	hostMountDirExists, err := ns.checkIfDirExists(hostMountDir);
+	hostMountDirExists, err := ns.checkIfDirExists(hostMountDir)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "unable to check if host mount dir [%s] exists: [%v]",
 			hostMountDir, err)
@@ -261,6 +371,20 @@ func (ns *nodeService) NodePublishVolume(ctx context.Context,
 		return nil, status.Errorf(codes.Internal, "host mount dir [%s] does not exist", hostMountDir)
 	}
 
+	// a volume staged read-only for the read-only pods on the node cannot be written by another pod
+	if mountMode == "rw" {
+		stagingMount, err := ns.getMountedDevice(ctx, hostMountDir)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "unable to get mount of host dir [%s]: [%v]",
+				hostMountDir, err)
+		}
+		if stagingMount != nil && hasMountOption(stagingMount.Opts, "ro") {
+			return nil, status.Errorf(codes.FailedPrecondition,
+				"NodePublishVolume: volume [%s] is staged read-only at [%s] and cannot be published read-write",
+				diskName, hostMountDir)
+		}
+	}
+
 	// create target dir if not exists
 	if err := ns.mkdir(podMountDir); err != nil {
 		return nil, status.Errorf(codes.Internal, "unable to create dir [%s]: [%v]", podMountDir, err)
@@ -291,12 +415,65 @@ func (ns *nodeService) NodePublishVolume(ctx context.Context,
 		hostMountDir, podMountDir, mountFlags)
 	if err = gofsutil.BindMount(ctx, hostMountDir, podMountDir, mountFlags...); err != nil {
 		return nil, status.Error(codes.Internal,
-			fmt.Sprintf("unable to format and mount dir [%s] at path [%s] with fs [%s] and flags [%v]: [%v]",
+			fmt.Sprintf("unable to bind mount dir [%s] at path [%s] with flags [%v]: [%v]",
 				hostMountDir, podMountDir, mountFlags, err))
 	}
 	klog.Infof("Mounted dir [%s] at path [%s] with options [%v]", hostMountDir, podMountDir, mountFlags)
 
-	klog.Infof("NodeStageVolume successfully staged at [%s] for host dir [%s]", podMountDir, hostMountDir)
+	klog.Infof("NodePublishVolume successfully published at [%s] from host dir [%s]", podMountDir, hostMountDir)
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+// nodePublishBlockVolume bind-mounts the device of the disk in publishContext onto the file podMountPath
+func (ns *nodeService) nodePublishBlockVolume(ctx context.Context, diskName string, podMountPath string,
+	publishContext map[string]string, mountMode string) (*csi.NodePublishVolumeResponse, error) {
+
+	vmFullName, ok := publishContext[VMFullNameAttribute]
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"PublishContext did not contain full vm name in publish context")
+	}
+
+	diskUUID, ok := publishContext[DiskUUIDAttribute]
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"PublishContext did not contain disk UUID in publish context")
+	}
+
+	devicePath, err := ns.getDiskPath(ctx, vmFullName, diskUUID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "unable to obtain disk for vm [%s], disk [%s]: [%v]",
+			vmFullName, diskName, err)
+	}
+
+	// the target of a block volume is a file, unlike the target dir of a filesystem
+	if err = ns.mkdir(filepath.Dir(podMountPath)); err != nil {
+		return nil, status.Errorf(codes.Internal, "unable to create dir of [%s]: [%v]", podMountPath, err)
+	}
+	podMountFile, err := os.OpenFile(podMountPath, os.O_CREATE, 0660)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "unable to create file [%s]: [%v]", podMountPath, err)
+	}
+	if err = podMountFile.Close(); err != nil {
+		return nil, status.Errorf(codes.Internal, "unable to close file [%s]: [%v]", podMountPath, err)
+	}
+
+	isMounted, err := ns.checkIfDirMounted(ctx, podMountPath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "unable to check if [%s] is mounted: [%v]", podMountPath, err)
+	}
+	if isMounted {
+		klog.Infof("Device [%s] already mounted on [%s]", devicePath, podMountPath)
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	klog.Infof("Mounting device [%s] to file [%s] with flags [%v]", devicePath, podMountPath, mountMode)
+	if err = gofsutil.BindMount(ctx, devicePath, podMountPath, mountMode); err != nil {
+		return nil, status.Errorf(codes.Internal, "unable to bind mount device [%s] at path [%s]: [%v]",
+			devicePath, podMountPath, err)
+	}
+
+	klog.Infof("NodePublishVolume successfully published device [%s] at [%s]", devicePath, podMountPath)
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
@@ -314,101 +491,329 @@ func (ns *nodeService) NodeUnpublishVolume(ctx context.Context,
 		return nil, status.Errorf(codes.InvalidArgument, "NodeUnpublishVolume: Target Path must be provided")
 	}
 
-	podMountDirExists, err := ns.checkIfDirExists(podMountDir)
-	if err != nil {
+	// the pod mount path is a file for a block volume
+	podMountDirInfo, err := os.Stat(podMountDir)
+	if err != nil && !os.IsNotExist(err) {
 		return nil, status.Errorf(codes.Internal, "unable to check if pod mount dir [%s] exists: [%v]",
 			podMountDir, err)
 	}
-	if !podMountDirExists {
+	if os.IsNotExist(err) {
 		klog.Infof("Pod mount dir [%s] does not exist. Assuming already unmounted.", podMountDir)
 		return &csi.NodeUnpublishVolumeResponse{}, nil
 	}
+	isBlockVolume := !podMountDirInfo.IsDir()
 
 	isDirMounted, err := ns.checkIfDirMounted(ctx, podMountDir)
 	if err!= nil {
 		return nil, fmt.Errorf("unable to check if pod mount dir [%s] is mounted: [%v]", podMountDir, err)
 	}
-	if !isDirMounted {
+	if isDirMounted {
+		klog.Infof("Attempting to unmount pod mount dir [%s].", podMountDir)
+		if err = gofsutil.Unmount(ctx, podMountDir); err != nil {
+			return nil, fmt.Errorf("unable to unmount pod mount dir [%s]: [%v]", podMountDir, err)
+		}
+	} else {
 		klog.Infof("Pod mount dir [%s] is not mounted. Assuming already unmounted.", podMountDir)
-		return &csi.NodeUnpublishVolumeResponse{}, nil
 	}
 
-	klog.Infof("Attempting to unmount pod mount dir [%s].", podMountDir)
-	if err = gofsutil.Unmount(ctx, podMountDir); err != nil {
-		return nil, fmt.Errorf("unable to unmount pod mount dir [%s]: [%v]", podMountDir, err)
+	// remove the file that was created to publish the block volume
+	if isBlockVolume {
+		if err = os.Remove(podMountDir); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("unable to remove pod mount file [%s]: [%v]", podMountDir, err)
+		}
 	}
 
 	klog.Infof("NodeUnpublishVolume successful for disk [%s] at mount dir [%s]", diskName, podMountDir)
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
 
-func (ns *nodeService) NodeExpandVolume(context.Context, *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "not implemented...yet")
+// NodeExpandVolume grows the filesystem on the device mounted at the volume path to the size of the
+// device after the disk has been resized by ControllerExpandVolume
+func (ns *nodeService) NodeExpandVolume(ctx context.Context,
+	req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
+
+	if req == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "NodeExpandVolume: Request is empty")
+	}
+	klog.Infof("NodeExpandVolume: called with args [%v]", redactSecrets(req))
+
+	volumeID := req.GetVolumeId()
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "NodeExpandVolume: VolumeId not provided")
+	}
+
+	volumePath := req.GetVolumePath()
+	if volumePath == "" {
+		return nil, status.Error(codes.InvalidArgument, "NodeExpandVolume: VolumePath not provided")
+	}
+
+	capacityBytes := req.GetCapacityRange().GetRequiredBytes()
+
+	// No filesystem to grow for a block device. Must be handled by pod
+	if volumeCapability := req.GetVolumeCapability(); volumeCapability != nil && volumeCapability.GetBlock() != nil {
+		return &csi.NodeExpandVolumeResponse{CapacityBytes: capacityBytes}, nil
+	}
+
+	mountedDev, err := ns.getMountedDevice(ctx, volumePath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "unable to find device mounted at [%s]: [%v]", volumePath, err)
+	}
+	if mountedDev == nil {
+		return nil, status.Errorf(codes.NotFound, "volume [%s] is not mounted at [%s]", volumeID, volumePath)
+	}
+
+	// make the kernel pick up the new size of the disk before growing the filesystem
+	rescanPath := filepath.Join("/sys/class/block", filepath.Base(mountedDev.Device), "device/rescan")
+	if err = os.WriteFile(rescanPath, []byte("1"), 0200); err != nil {
+		return nil, status.Errorf(codes.Internal, "unable to rescan device [%s]: [%v]", mountedDev.Device, err)
+	}
+
+	var resizeCmd *exec.Cmd
+	switch mountedDev.Type {
+	case "ext2", "ext3", "ext4":
+		resizeCmd = exec.CommandContext(ctx, "resize2fs", mountedDev.Device)
+	case "xfs":
+		resizeCmd = exec.CommandContext(ctx, "xfs_growfs", volumePath)
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "unable to grow filesystem [%s] of device [%s]",
+			mountedDev.Type, mountedDev.Device)
+	}
+
+	klog.Infof("Growing filesystem [%s] of device [%s] mounted at [%s]", mountedDev.Type, mountedDev.Device,
+		volumePath)
+	if outBytes, err := resizeCmd.CombinedOutput(); err != nil {
+		return nil, status.Errorf(codes.Internal, "unable to grow filesystem of device [%s]: [%v]: [%s]",
+			mountedDev.Device, err, strings.TrimSpace(string(outBytes)))
+	}
+
+	klog.Infof("NodeExpandVolume successful for volume [%s] at [%s]", volumeID, volumePath)
+	return &csi.NodeExpandVolumeResponse{CapacityBytes: capacityBytes}, nil
 }
 
 func (ns *nodeService) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
-	klog.Infof("NodeGetCapabilities called with req: %#v", req)
+	klog.Infof("NodeGetCapabilities called with req: [%v]", redactSecrets(req))
 
 	return &csi.NodeGetCapabilitiesResponse{
 		Capabilities: ns.Driver.nodeServiceCapabilities,
 	}, nil
 }
 
+// NodeGetInfo reports the node ID, which is the name of the VM of the node that the controller looks the VM up by,
+// the most volumes that can be attached to the node and the VDC of the node as its topology, with the ID of the VM if
+// it is known.
 func (ns *nodeService) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+	// volumes are created in the VDC of the node that they are provisioned for
+	segments := make(map[string]string)
+	if ns.VDCName != "" {
+		segments[TopologyVDCKey] = ns.VDCName
+	}
+	// the controller finds the VM of the node by its ID instead of its name
+	if ns.VMID != "" {
+		segments[TopologyVMKey] = ns.VMID
+	}
+	var accessibleTopology *csi.Topology
+	if len(segments) > 0 {
+		accessibleTopology = &csi.Topology{
+			Segments: segments,
+		}
+	}
+
 	return &csi.NodeGetInfoResponse{
 		NodeId:             ns.NodeID,
-		AccessibleTopology: nil,
-		MaxVolumesPerNode:  maxVolumesPerNode,
+		AccessibleTopology: accessibleTopology,
+		MaxVolumesPerNode:  ns.Driver.maxVolumesPerNode,
 	}, nil
 
 }
 
+// NodeGetVolumeStats reports the usage of the filesystem mounted at the volume path, or the size of the device for a
+// raw block volume
 func (ns *nodeService) NodeGetVolumeStats(ctx context.Context,
 	req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
 
-	klog.Infof("NodeGetVolumeStats called with req: %#v", req)
+	if req == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "NodeGetVolumeStats: Request is empty")
+	}
+	klog.Infof("NodeGetVolumeStats called with req: [%v]", redactSecrets(req))
+
+	volumeID := req.GetVolumeId()
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "NodeGetVolumeStats: VolumeId not provided")
+	}
 
 	volumePath := req.GetVolumePath()
 	if volumePath == "" {
-		klog.Errorf("unable to get volume path from request")
-		return nil, fmt.Errorf("unable to get volume path from request")
+		return nil, status.Error(codes.InvalidArgument, "NodeGetVolumeStats: VolumePath not provided")
+	}
+
+	fi, err := os.Stat(volumePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound, "volume path [%s] of volume [%s] does not exist",
+				volumePath, volumeID)
+		}
+		return nil, status.Errorf(codes.Internal, "unable to get stat of [%s]: [%v]", volumePath, err)
+	}
+
+	if fi.Mode()&os.ModeDevice != 0 {
+		blockSize, err := ns.getBlockDeviceSize(volumePath)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "unable to get size of block device [%s]: [%v]",
+				volumePath, err)
+		}
+
+		return &csi.NodeGetVolumeStatsResponse{
+			Usage: []*csi.VolumeUsage{
+				{
+					Total: blockSize,
+					Unit:  csi.VolumeUsage_BYTES,
+				},
+			},
+		}, nil
+	}
+
+	isMounted, err := ns.checkIfDirMounted(ctx, volumePath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "unable to check if [%s] is mounted: [%v]", volumePath, err)
+	}
+	if !isMounted {
+		return nil, status.Errorf(codes.NotFound, "volume [%s] is not mounted at [%s]", volumeID, volumePath)
 	}
 
 	var statFS unix.Statfs_t
 	if err := unix.Statfs(volumePath, &statFS); err != nil {
-		klog.Errorf("unable to get stats of volume [%s]: [%v]", volumePath, err)
-		return nil, fmt.Errorf("unable to get stats of volume [%s]: [%v]", volumePath, err)
+		return nil, status.Errorf(codes.Internal, "unable to get stats of volume [%s]: [%v]", volumePath, err)
 	}
 
 	return &csi.NodeGetVolumeStatsResponse{
 		Usage: []*csi.VolumeUsage{
 			{
 				Available: int64(statFS.Bavail) * int64(statFS.Bsize),
-				Total: int64(statFS.Blocks) * int64(statFS.Bsize),
-				Used: (int64(statFS.Blocks) - int64(statFS.Bavail)) * int64(statFS.Bsize),
-				Unit: csi.VolumeUsage_BYTES,
+				Total:     int64(statFS.Blocks) * int64(statFS.Bsize),
+				Used:      (int64(statFS.Blocks) - int64(statFS.Bfree)) * int64(statFS.Bsize),
+				Unit:      csi.VolumeUsage_BYTES,
 			},
 			{
 				Available: int64(statFS.Ffree),
-				Total: int64(statFS.Files),
-				Used: int64(statFS.Files) - int64(statFS.Ffree),
-				Unit: csi.VolumeUsage_INODES,
+				Total:     int64(statFS.Files),
+				Used:      int64(statFS.Files) - int64(statFS.Ffree),
+				Unit:      csi.VolumeUsage_INODES,
 			},
 		},
 	}, nil
 }
 
-// getDiskPath looks for a device corresponding to vmName:diskName as stored in vSphere. It
-// enumerates devices in /dev/disk/by-path and returns a device with UUID matching the scsi UUID.
-// It needs disk.enableUUID to be set for the VM.
+// getBlockDeviceSize returns the size in bytes of the block device at devicePath
+func (ns *nodeService) getBlockDeviceSize(devicePath string) (int64, error) {
+	device, err := os.Open(devicePath)
+	if err != nil {
+		return 0, fmt.Errorf("unable to open [%s]: [%v]", devicePath, err)
+	}
+	defer device.Close()
+
+	size, err := device.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, fmt.Errorf("unable to seek to the end of [%s]: [%v]", devicePath, err)
+	}
+
+	return size, nil
+}
+
+// getDiskPath returns the device of the disk diskUUID of the VM vmFullName, waiting for up to the device ready timeout
+// of the driver for the device of a just attached disk to appear. The SCSI buses are rescanned if the device is not
+// there yet, since the kernel may not notice a hot-added disk. The device is found by the WWN of the disk, which is its
+// UUID in VCD, and needs disk.enableUUID to be set for the VM.
 func (ns *nodeService) getDiskPath(ctx context.Context, vmFullName string, diskUUID string) (string, error) {
 
 	if diskUUID == "" {
 		return "", fmt.Errorf("diskUUID should not be an empty string")
 	}
 
-	hexDiskUUID := strings.ReplaceAll(diskUUID, "-", "")
+	hexDiskUUID := strings.ToLower(strings.ReplaceAll(diskUUID, "-", ""))
+
+	ctx, cancel := context.WithTimeout(ctx, ns.Driver.deviceReadyTimeout)
+	defer cancel()
+	ticker := time.NewTicker(ns.Driver.deviceReadyInterval)
+	defer ticker.Stop()
+	for rescanned := false; ; rescanned = true {
+		guestDiskPath, err := ns.findDiskByID(hexDiskUUID)
+		if err != nil {
+			return "", err
+		}
+		// udev may not create the links of the WWN of the disks on every distribution
+		if guestDiskPath == "" {
+			if guestDiskPath, err = ns.findDiskBySCSIID(hexDiskUUID); err != nil {
+				return "", err
+			}
+		}
+		if guestDiskPath != "" {
+			klog.Infof("Obtained matching disk [%s] for disk [%s] of vm [%s]", guestDiskPath, diskUUID, vmFullName)
+			return guestDiskPath, nil
+		}
+		if !rescanned {
+			if err = rescanSCSIHosts(SCSIHostPath); err != nil {
+				klog.Infof("Unable to rescan SCSI hosts for disk [%s] of vm [%s]: [%v]", diskUUID, vmFullName, err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("timed out waiting for the device of disk with serial [%s] of vm [%s] "+
+				"to appear in [%s]: [%v]", hexDiskUUID, vmFullName, ns.diskByIDPath, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// rescanSCSIHosts asks every SCSI host in scsiHostPath to scan all of its channels, targets and LUNs, so that the
+// devices of hot-added disks are discovered
+func rescanSCSIHosts(scsiHostPath string) error {
+	scanPaths, err := filepath.Glob(filepath.Join(scsiHostPath, "*", "scan"))
+	if err != nil {
+		return fmt.Errorf("unable to find SCSI hosts in [%s]: [%v]", scsiHostPath, err)
+	}
 
+	for _, scanPath := range scanPaths {
+		if err = os.WriteFile(scanPath, []byte("- - -"), 0200); err != nil {
+			return fmt.Errorf("unable to rescan SCSI host [%s]: [%v]", filepath.Base(filepath.Dir(scanPath)), err)
+		}
+	}
+	klog.Infof("Rescanned [%d] SCSI hosts in [%s]", len(scanPaths), scsiHostPath)
+
+	return nil
+}
+
+// findDiskByID returns the device that a link of /dev/disk/by-id for the WWN hexDiskUUID points to, or an empty
+// string if there is none yet
+func (ns *nodeService) findDiskByID(hexDiskUUID string) (string, error) {
+	entries, err := os.ReadDir(ns.diskByIDPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", fmt.Errorf("unable to read [%s]: [%v]", ns.diskByIDPath, err)
+	}
+
+	// the links are named wwn-0x<uuid> and scsi-3<uuid> after the NAA identifier of the disk
+	for _, entry := range entries {
+		name := strings.ToLower(entry.Name())
+		if name != "wwn-0x"+hexDiskUUID && name != "scsi-3"+hexDiskUUID {
+			continue
+		}
+		devicePath, err := filepath.EvalSymlinks(filepath.Join(ns.diskByIDPath, entry.Name()))
+		if err != nil {
+			klog.Infof("Error accessing file [%s]: [%v]", entry.Name(), err)
+			continue
+		}
+		return devicePath, nil
+	}
+
+	return "", nil
+}
+
+// findDiskBySCSIID enumerates devices in /dev/disk/by-path and returns a device with UUID matching the scsi UUID
+// hexDiskUUID, or an empty string if there is none
+func (ns *nodeService) findDiskBySCSIID(hexDiskUUID string) (string, error) {
 	guestDiskPath := ""
 	err := filepath.Walk(DevDiskPath, func (path string, fi os.FileInfo, err error) error {
 		if err != nil {
@@ -453,7 +858,7 @@ func (ns *nodeService) getDiskPath(ctx context.Context, vmFullName string, diskU
 			return nil
 		}
 
-		if strings.ToLower(out) == strings.ToLower(hexDiskUUID) {
+		if strings.ToLower(out) == hexDiskUUID {
 			guestDiskPath = fileToProcess
 		}
 
@@ -463,7 +868,6 @@ func (ns *nodeService) getDiskPath(ctx context.Context, vmFullName string, diskU
 		return "", fmt.Errorf("could not create filepath.Walk for [%s]: [%v]", DevDiskPath, err)
 	}
 
-	klog.Infof("Obtained matching disk [%s]", guestDiskPath)
 	return guestDiskPath, nil
 }
 
@@ -474,6 +878,40 @@ func (ns *nodeService) isVolumeReadOnly(capability *csi.VolumeCapability) bool {
 		accessMode == csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY
 }
 
+// hasMountOption returns true if option is in the options of a mount
+func hasMountOption(options []string, option string) bool {
+	for _, mountOption := range options {
+		if mountOption == option {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getMountFlags validates the mount flags of a volume capability and returns them with mountMode added. The flags
+// are joined into the options of the mount command, hence they cannot contain separators.
+func getMountFlags(capabilityMountFlags []string, mountMode string) ([]string, error) {
+	mountFlags := make([]string, 0, len(capabilityMountFlags)+1)
+	for _, flag := range capabilityMountFlags {
+		if flag == "" || strings.ContainsAny(flag, ", \t\n") {
+			return nil, fmt.Errorf("mount flag [%s] is not a single mount option", flag)
+		}
+		if driverMountFlags[flag] {
+			return nil, fmt.Errorf("mount flag [%s] is set by the driver", flag)
+		}
+		if (flag == "ro" || flag == "rw") && flag != mountMode {
+			return nil, fmt.Errorf("mount flag [%s] conflicts with mount mode [%s] of the volume", flag, mountMode)
+		}
+		if flag == mountMode {
+			continue
+		}
+		mountFlags = append(mountFlags, flag)
+	}
+
+	return append(mountFlags, mountMode), nil
+}
+
 // returns isMounted, isMountedAsExpected, error in checking
 func (ns *nodeService) isVolumeMountedAsExpected(ctx context.Context, devicePath string, mountDir string,
 	mountMode string) (bool, bool, error) {
@@ -526,6 +964,47 @@ func (ns *nodeService) checkIfDirExists(path string) (bool, error) {
 	return true, nil
 }
 
+// getMountedDevice returns the mount at mountDir, or nil if nothing is mounted there
+func (ns *nodeService) getMountedDevice(ctx context.Context, mountDir string) (*gofsutil.Info, error) {
+	mountDevices, err := gofsutil.GetMounts(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get mounts of node: [%v]", err)
+	}
+
+	for _, mountDevice := range mountDevices {
+		if mountDevice.Path == mountDir {
+			return &mountDevice, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// getBoundTargets returns the other mounts of the device mounted at stagingDir, which are the pod targets that
+// NodePublishVolume bind-mounted from it
+func (ns *nodeService) getBoundTargets(ctx context.Context, stagingDir string) ([]string, error) {
+	stagingMount, err := ns.getMountedDevice(ctx, stagingDir)
+	if err != nil {
+		return nil, err
+	}
+	if stagingMount == nil {
+		return nil, nil
+	}
+
+	mountedDevs, err := gofsutil.GetDevMounts(ctx, stagingMount.Device)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get mounts of device [%s]: [%v]", stagingMount.Device, err)
+	}
+	var boundTargets []string
+	for _, mountedDev := range mountedDevs {
+		if mountedDev.Path != stagingDir {
+			boundTargets = append(boundTargets, mountedDev.Path)
+		}
+	}
+
+	return boundTargets, nil
+}
+
 func (ns *nodeService) checkIfDirMounted(ctx context.Context, mountDir string) (bool, error) {
 	mountDevices, err := gofsutil.GetMounts(ctx)
 	if err != nil {
@@ -0,0 +1,161 @@
+/*
+   Copyright 2021 VMware, Inc.
+   SPDX-License-Identifier: Apache-2.0
+*/
+
+package csi
+
+import (
+	"context"
+	"github.com/akutz/gofsutil"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestNodeService returns the node service of the node "node-1" in the VDC "vdc"
+func newTestNodeService(t *testing.T) *nodeService {
+	driver, err := NewDriver("node-1", "unix:///tmp/csi.sock")
+	require.NoError(t, err, "driver should be created")
+
+	return NewNodeService(driver, "node-1", "vdc").(*nodeService)
+}
+
+// newLoopDevice returns a loop device of sizeBytes backed by a file, which is detached once the test is done. The test
+// is skipped if loop devices cannot be set up, as they need root.
+func newLoopDevice(t *testing.T, sizeBytes int64) string {
+	if os.Geteuid() != 0 {
+		t.Skip("loop devices need root")
+	}
+	backingFile := filepath.Join(t.TempDir(), "disk.img")
+	require.NoError(t, os.WriteFile(backingFile, nil, 0600), "backing file should be created")
+	require.NoError(t, os.Truncate(backingFile, sizeBytes), "backing file should be sized")
+
+	out, err := exec.Command("losetup", "--find", "--show", backingFile).CombinedOutput()
+	if err != nil {
+		t.Skipf("unable to set up loop device: [%v]: [%s]", err, out)
+	}
+	devicePath := strings.TrimSpace(string(out))
+	t.Cleanup(func() {
+		if out, err := exec.Command("losetup", "--detach", devicePath).CombinedOutput(); err != nil {
+			t.Errorf("unable to detach loop device [%s]: [%v]: [%s]", devicePath, err, out)
+		}
+	})
+
+	return devicePath
+}
+
+func TestNodeGetVolumeStats(t *testing.T) {
+	ns := newTestNodeService(t)
+	ctx := context.Background()
+
+	_, err := ns.NodeGetVolumeStats(ctx, &csi.NodeGetVolumeStatsRequest{VolumePath: t.TempDir()})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), "volume ID should be required")
+	_, err = ns.NodeGetVolumeStats(ctx, &csi.NodeGetVolumeStatsRequest{VolumeId: "pvc-1"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), "volume path should be required")
+
+	_, err = ns.NodeGetVolumeStats(ctx, &csi.NodeGetVolumeStatsRequest{
+		VolumeId:   "pvc-1",
+		VolumePath: filepath.Join(t.TempDir(), "missing"),
+	})
+	assert.Equal(t, codes.NotFound, status.Code(err), "volume path that does not exist should not be found")
+
+	_, err = ns.NodeGetVolumeStats(ctx, &csi.NodeGetVolumeStatsRequest{
+		VolumeId:   "pvc-1",
+		VolumePath: t.TempDir(),
+	})
+	assert.Equal(t, codes.NotFound, status.Code(err), "volume that is not mounted at its path should not be found")
+}
+
+func TestNodeGetVolumeStatsOfBlockVolume(t *testing.T) {
+	ns := newTestNodeService(t)
+	devicePath := newLoopDevice(t, 4*MbToBytes)
+
+	resp, err := ns.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{
+		VolumeId:   "pvc-1",
+		VolumePath: devicePath,
+	})
+	require.NoError(t, err, "stats of the block volume should be returned")
+	require.Len(t, resp.GetUsage(), 1, "block volume should only report its bytes")
+	assert.Equal(t, csi.VolumeUsage_BYTES, resp.GetUsage()[0].GetUnit(), "usage of block volume should be in bytes")
+	assert.Equal(t, 4*MbToBytes, resp.GetUsage()[0].GetTotal(), "size of the device should be its total")
+}
+
+// countMounts returns how many mounts the node has at path
+func countMounts(t *testing.T, path string) int {
+	mounts, err := gofsutil.GetMounts(context.Background())
+	require.NoError(t, err, "mounts of the node should be read")
+	count := 0
+	for _, mount := range mounts {
+		if mount.Path == path {
+			count++
+		}
+	}
+
+	return count
+}
+
+func TestNodePublishBlockVolume(t *testing.T) {
+	ns := newTestNodeService(t)
+	ctx := context.Background()
+	devicePath := newLoopDevice(t, 4*MbToBytes)
+	ns.diskByIDPath = t.TempDir()
+	require.NoError(t, os.Symlink(devicePath, filepath.Join(ns.diskByIDPath, "wwn-0x6000c29a1b2c3d4e5f60718293a4b5c6")),
+		"link of the WWN of the disk should be created")
+
+	targetPath := filepath.Join(t.TempDir(), "pvc-1", "dev")
+	t.Cleanup(func() {
+		for countMounts(t, targetPath) > 0 {
+			require.NoError(t, gofsutil.Unmount(context.Background(), targetPath), "target should be unmounted")
+		}
+	})
+	req := &csi.NodePublishVolumeRequest{
+		VolumeId:          "pvc-1",
+		StagingTargetPath: t.TempDir(),
+		TargetPath:        targetPath,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Block{
+				Block: &csi.VolumeCapability_BlockVolume{},
+			},
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+		},
+		PublishContext: map[string]string{
+			VMFullNameAttribute: "node-1",
+			DiskUUIDAttribute:   "6000C29A-1B2C-3D4E-5F60-718293A4B5C6",
+		},
+	}
+
+	_, err := ns.NodePublishVolume(ctx, req)
+	require.NoError(t, err, "block volume should be published")
+	assert.Equal(t, 1, countMounts(t, targetPath), "device should be bind mounted at the target")
+	targetInfo, err := os.Stat(targetPath)
+	require.NoError(t, err, "target should exist")
+	assert.NotZero(t, targetInfo.Mode()&os.ModeDevice, "target should be the device of the disk")
+
+	_, err = ns.NodePublishVolume(ctx, req)
+	require.NoError(t, err, "retried publishing should succeed")
+	assert.Equal(t, 1, countMounts(t, targetPath), "retried publishing should not mount the device again")
+
+	unpublishReq := &csi.NodeUnpublishVolumeRequest{VolumeId: "pvc-1", TargetPath: targetPath}
+	_, err = ns.NodeUnpublishVolume(ctx, unpublishReq)
+	require.NoError(t, err, "block volume should be unpublished")
+	assert.Zero(t, countMounts(t, targetPath), "device should be unmounted from the target")
+	_, err = os.Stat(targetPath)
+	assert.True(t, os.IsNotExist(err), "file of the target should be removed")
+
+	_, err = ns.NodeUnpublishVolume(ctx, unpublishReq)
+	assert.NoError(t, err, "retried unpublishing should succeed")
+
+	delete(req.PublishContext, DiskUUIDAttribute)
+	_, err = ns.NodePublishVolume(ctx, req)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), "disk UUID should be required to find the device")
+}
@@ -0,0 +1,53 @@
+/*
+   Copyright 2021 VMware, Inc.
+   SPDX-License-Identifier: Apache-2.0
+*/
+
+package csi
+
+import (
+	"context"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+)
+
+// operationLimiter bounds the mutating VCD operations of the controller that are in flight at a time, i.e. the
+// creations, deletions, resizes, attaches and detaches of disks, so that a burst of volumes does not overwhelm VCD.
+// The operations beyond the limit wait for a slot until their request is canceled or times out.
+type operationLimiter struct {
+	// slots has an element for every operation in flight. The operations are not limited if it is nil.
+	slots chan struct{}
+}
+
+// newOperationLimiter creates an operationLimiter that allows maxOperations operations at a time, or any number of
+// them if maxOperations is 0
+func newOperationLimiter(maxOperations int) *operationLimiter {
+	limiter := &operationLimiter{}
+	if maxOperations > 0 {
+		limiter.slots = make(chan struct{}, maxOperations)
+	}
+
+	return limiter
+}
+
+// acquire waits until the operation described by description may run, or ctx is done. The returned func releases
+// the slot of the operation. The error is that of the context as a gRPC status.
+func (limiter *operationLimiter) acquire(ctx context.Context, description string) (func(), error) {
+	if limiter.slots == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case limiter.slots <- struct{}{}:
+		return func() { <-limiter.slots }, nil
+	default:
+	}
+
+	klog.Infof("Waiting to %s since [%d] VCD operations are in flight", description, cap(limiter.slots))
+	select {
+	case limiter.slots <- struct{}{}:
+		return func() { <-limiter.slots }, nil
+	case <-ctx.Done():
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+}
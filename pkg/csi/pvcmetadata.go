@@ -0,0 +1,133 @@
+/*
+   Copyright 2021 VMware, Inc.
+   SPDX-License-Identifier: Apache-2.0
+*/
+
+package csi
+
+import (
+	"context"
+	"fmt"
+	"k8s.io/klog"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// pvcMetadataReader reads the labels and annotations of PVCs
+type pvcMetadataReader interface {
+	// GetPVCMetadata returns the labels and the annotations of the PVC name in namespace
+	GetPVCMetadata(ctx context.Context, namespace string, name string) (map[string]string, map[string]string, error)
+}
+
+// PVCMetadataReader reads the labels and annotations of PVCs from the Kubernetes API of the cluster that the pod runs
+// in
+type PVCMetadataReader struct {
+	client *kubeAPIClient
+}
+
+// NewPVCMetadataReader creates a PVCMetadataReader that reads the PVCs with the service account of the pod
+func NewPVCMetadataReader() (*PVCMetadataReader, error) {
+	client, err := newKubeAPIClient()
+	if err != nil {
+		return nil, fmt.Errorf("unable to create client of Kubernetes API: [%v]", err)
+	}
+
+	return &PVCMetadataReader{
+		client: client,
+	}, nil
+}
+
+// pvc has the fields of a PVC that are mirrored to the metadata of its disk
+type pvc struct {
+	Metadata struct {
+		Labels      map[string]string `json:"labels"`
+		Annotations map[string]string `json:"annotations"`
+	} `json:"metadata"`
+}
+
+// GetPVCMetadata returns the labels and the annotations of the PVC name in namespace
+func (reader *PVCMetadataReader) GetPVCMetadata(ctx context.Context, namespace string,
+	name string) (map[string]string, map[string]string, error) {
+
+	kubePVC := &pvc{}
+	if err := reader.client.do(ctx, http.MethodGet, fmt.Sprintf("/api/v1/namespaces/%s/persistentvolumeclaims/%s",
+		url.PathEscape(namespace), url.PathEscape(name)), nil, kubePVC); err != nil {
+		return nil, nil, fmt.Errorf("unable to get PVC [%s/%s]: [%v]", namespace, name, err)
+	}
+
+	return kubePVC.Metadata.Labels, kubePVC.Metadata.Annotations, nil
+}
+
+// SetMirroredPVCKeys makes the controller copy the annotations, or else the labels, of the PVC of a volume that have
+// one of the keys mirroredKeys to the metadata of its disk, under the same keys. The PVCs are read with reader. The
+// keys of the metadata that relate a disk to its volume cannot be mirrored.
+func (d *VCDDriver) SetMirroredPVCKeys(reader *PVCMetadataReader, mirroredKeys []string) error {
+	if reader == nil {
+		return fmt.Errorf("reader of PVCs should not be nil")
+	}
+
+	reservedKeys := map[string]bool{
+		PVCNameMetadataKey:      true,
+		PVCNamespaceMetadataKey: true,
+		PVNameMetadataKey:       true,
+		ClusterIDMetadataKey:    true,
+		VolumeModeMetadataKey:   true,
+	}
+	keys := make([]string, 0, len(mirroredKeys))
+	for _, key := range mirroredKeys {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			return fmt.Errorf("mirrored PVC keys should not be empty")
+		}
+		if reservedKeys[key] {
+			return fmt.Errorf("PVC key [%s] cannot be mirrored since the driver sets the metadata of that key", key)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("at least one PVC key should be mirrored")
+	}
+
+	d.pvcMetadataReader = reader
+	d.mirroredPVCKeys = keys
+	return nil
+}
+
+// getMirroredPVCMetadata returns the annotations, or else the labels, of the PVC of the parameters of a CreateVolume
+// whose keys are mirrored to the metadata of its disk. The keys that the PVC does not have are left out. No metadata
+// is returned if the PVC of the volume is not known or cannot be read, so that its disk is created nonetheless.
+func (cs *controllerServer) getMirroredPVCMetadata(ctx context.Context,
+	parameters map[string]string) map[string]string {
+
+	if cs.Driver.pvcMetadataReader == nil {
+		return nil
+	}
+	namespace, name := parameters[PVCNamespaceParameter], parameters[PVCNameParameter]
+	if namespace == "" || name == "" {
+		klog.Infof("PVC of volume is not known; not mirroring keys [%s] of the PVC to the metadata of its disk",
+			strings.Join(cs.Driver.mirroredPVCKeys, ", "))
+		return nil
+	}
+
+	labels, annotations, err := cs.Driver.pvcMetadataReader.GetPVCMetadata(ctx, namespace, name)
+	if err != nil {
+		klog.Errorf("unable to read PVC [%s/%s]; not mirroring its keys to the metadata of its disk: [%v]",
+			namespace, name, err)
+		return nil
+	}
+
+	metadata := make(map[string]string)
+	for _, key := range cs.Driver.mirroredPVCKeys {
+		value, ok := annotations[key]
+		if !ok {
+			value = labels[key]
+		}
+		// VCD does not take metadata with empty values
+		if value != "" {
+			metadata[key] = value
+		}
+	}
+
+	return metadata
+}
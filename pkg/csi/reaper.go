@@ -0,0 +1,226 @@
+/*
+   Copyright 2021 VMware, Inc.
+   SPDX-License-Identifier: Apache-2.0
+*/
+
+package csi
+
+import (
+	"context"
+	"fmt"
+	"github.com/vmware/cloud-director-named-disk-csi-driver/pkg/vcdcsiclient"
+	"k8s.io/klog"
+	"net/http"
+	"time"
+)
+
+// getDiskDescription returns the description of the disks created by the driver for the cluster clusterID. The
+// description identifies the disks that the DiskReaper may delete.
+func getDiskDescription(clusterID string) string {
+	return fmt.Sprintf("Created by [%s] for cluster [%s]", Name, clusterID)
+}
+
+// volumeLister lists the IDs of the volumes of the driver that the cluster knows of
+type volumeLister interface {
+	ListVolumeIDs(ctx context.Context) (map[string]bool, error)
+}
+
+// DiskReaper deletes the disks created by the driver for the cluster that no PV refers to. This happens if the
+// provisioner fails to create the PV after CreateVolume succeeds.
+type DiskReaper struct {
+	diskManager  vcdcsiclient.VCDDiskManager
+	volumeLister volumeLister
+	interval     time.Duration
+	gracePeriod  time.Duration
+
+	// orphanedSince has the time at which each disk was first found without a PV. VCD does not report when a disk
+	// was created, hence a disk is only reaped after it has been orphaned for the grace period.
+	orphanedSince map[string]time.Time
+}
+
+// NewDiskReaper creates a DiskReaper that checks the disks every interval and deletes the disks orphaned for longer
+// than gracePeriod. It lists the PVs with the service account of the pod.
+func NewDiskReaper(diskManager vcdcsiclient.VCDDiskManager, interval time.Duration,
+	gracePeriod time.Duration) (*DiskReaper, error) {
+
+	if interval <= 0 {
+		return nil, fmt.Errorf("reaper interval [%v] should be positive", interval)
+	}
+	if gracePeriod <= 0 {
+		return nil, fmt.Errorf("reaper grace period [%v] should be positive", gracePeriod)
+	}
+	if diskManager.GetClusterID() == "" {
+		return nil, fmt.Errorf("disks cannot be reaped without a cluster ID to tell the disks of the cluster apart")
+	}
+
+	pvLister, err := newKubePVLister()
+	if err != nil {
+		return nil, fmt.Errorf("unable to create lister of PVs: [%v]", err)
+	}
+
+	return &DiskReaper{
+		diskManager:   diskManager,
+		volumeLister:  pvLister,
+		interval:      interval,
+		gracePeriod:   gracePeriod,
+		orphanedSince: make(map[string]time.Time),
+	}, nil
+}
+
+// Run reaps disks every interval until ctx is done
+func (reaper *DiskReaper) Run(ctx context.Context) {
+	klog.Infof("Reaping disks orphaned for [%v] every [%v]", reaper.gracePeriod, reaper.interval)
+
+	ticker := time.NewTicker(reaper.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := reaper.reap(ctx, time.Now()); err != nil {
+				klog.Errorf("unable to reap orphaned disks: [%v]", err)
+			}
+		}
+	}
+}
+
+// reap deletes the disks of the cluster that have had no PV for the grace period at time now
+func (reaper *DiskReaper) reap(ctx context.Context, now time.Time) error {
+	description := getDiskDescription(reaper.diskManager.GetClusterID())
+
+	// the disks are listed before the PVs, so that the PV of a disk created in between is not missed
+	var disks []string
+	// the volume handle of a static PV can be the URN of its disk instead of its name
+	diskIDs := make(map[string]string)
+	pageToken := ""
+	for {
+		diskPage, nextPageToken, err := reaper.diskManager.ListDisks(pageToken, 0)
+		if err != nil {
+			return fmt.Errorf("unable to list disks: [%v]", err)
+		}
+		for _, disk := range diskPage {
+			// disks created by earlier versions of the driver or for other clusters are never reaped
+			if disk.Description == description {
+				disks = append(disks, disk.Name)
+				diskIDs[disk.Name] = disk.ID
+			}
+		}
+		if nextPageToken == "" {
+			break
+		}
+		pageToken = nextPageToken
+	}
+
+	volumeIDs, err := reaper.volumeLister.ListVolumeIDs(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to list volumes of the cluster: [%v]", err)
+	}
+
+	orphanedSince := make(map[string]time.Time)
+	for _, diskName := range disks {
+		if volumeIDs[diskName] || (diskIDs[diskName] != "" && volumeIDs[diskIDs[diskName]]) {
+			continue
+		}
+
+		since, ok := reaper.orphanedSince[diskName]
+		if !ok {
+			klog.Infof("Found disk [%s] without a PV; it will be deleted if it still has none after [%v]",
+				diskName, reaper.gracePeriod)
+			since = now
+		}
+		if now.Sub(since) < reaper.gracePeriod {
+			orphanedSince[diskName] = since
+			continue
+		}
+
+		// DeleteDisk refuses to delete a disk that is attached to a VM
+		klog.Infof("Deleting disk [%s] that has had no PV since [%v]", diskName, since)
+		if err = reaper.diskManager.DeleteDiskWithContext(ctx, diskName); err != nil {
+			klog.Errorf("unable to delete orphaned disk [%s]: [%v]", diskName, err)
+			orphanedSince[diskName] = since
+		}
+	}
+	reaper.orphanedSince = orphanedSince
+
+	return nil
+}
+
+// kubePVLister lists the PVs of the driver from the Kubernetes API of the cluster that the pod runs in
+type kubePVLister struct {
+	client *kubeAPIClient
+}
+
+func newKubePVLister() (*kubePVLister, error) {
+	client, err := newKubeAPIClient()
+	if err != nil {
+		return nil, err
+	}
+
+	return &kubePVLister{
+		client: client,
+	}, nil
+}
+
+// pvList has the fields of a list of PVs that are needed to find the volumes of the driver
+type pvList struct {
+	Metadata struct {
+		Continue string `json:"continue"`
+	} `json:"metadata"`
+	Items []struct {
+		Metadata struct {
+			Name string `json:"name"`
+		} `json:"metadata"`
+		Spec struct {
+			CSI *struct {
+				Driver       string `json:"driver"`
+				VolumeHandle string `json:"volumeHandle"`
+			} `json:"csi"`
+		} `json:"spec"`
+	} `json:"items"`
+}
+
+// ListVolumeIDs returns the volume handles of the PVs of the driver
+func (lister *kubePVLister) ListVolumeIDs(ctx context.Context) (map[string]bool, error) {
+	volumeIDsByPV, err := lister.listVolumeIDsByPV(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	volumeIDs := make(map[string]bool, len(volumeIDsByPV))
+	for _, volumeID := range volumeIDsByPV {
+		volumeIDs[volumeID] = true
+	}
+	return volumeIDs, nil
+}
+
+// listVolumeIDsByPV returns the volume handles of the PVs of the driver by the names of the PVs
+func (lister *kubePVLister) listVolumeIDsByPV(ctx context.Context) (map[string]string, error) {
+	volumeIDsByPV := make(map[string]string)
+	continueToken := ""
+	for {
+		pvs, err := lister.listPVs(ctx, continueToken)
+		if err != nil {
+			return nil, err
+		}
+		for _, pv := range pvs.Items {
+			if pv.Spec.CSI != nil && pv.Spec.CSI.Driver == Name {
+				volumeIDsByPV[pv.Metadata.Name] = pv.Spec.CSI.VolumeHandle
+			}
+		}
+		if pvs.Metadata.Continue == "" {
+			return volumeIDsByPV, nil
+		}
+		continueToken = pvs.Metadata.Continue
+	}
+}
+
+func (lister *kubePVLister) listPVs(ctx context.Context, continueToken string) (*pvList, error) {
+	pvs := &pvList{}
+	if err := lister.client.do(ctx, http.MethodGet, "/api/v1/persistentvolumes?"+listQuery(continueToken), nil,
+		pvs); err != nil {
+		return nil, fmt.Errorf("unable to list PVs: [%v]", err)
+	}
+
+	return pvs, nil
+}
@@ -0,0 +1,168 @@
+/*
+   Copyright 2021 VMware, Inc.
+   SPDX-License-Identifier: Apache-2.0
+*/
+
+package csi
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware/cloud-director-named-disk-csi-driver/pkg/vcdcsiclient/fake"
+	"testing"
+	"time"
+)
+
+// fakeVolumeLister lists volumeIDs, or fails with err if it is set
+type fakeVolumeLister struct {
+	volumeIDs map[string]bool
+	err       error
+}
+
+func (lister *fakeVolumeLister) ListVolumeIDs(ctx context.Context) (map[string]bool, error) {
+	return lister.volumeIDs, lister.err
+}
+
+// newFakeDiskReaper returns a reaper of the disks of the cluster "cluster-1" in memory, with the VM of the node
+// "node-1", which finds the volumes of lister
+func newFakeDiskReaper(lister *fakeVolumeLister, gracePeriod time.Duration) (*DiskReaper, *fake.DiskManager) {
+	diskManager := fake.NewDiskManager("cluster-1", "vdc")
+	diskManager.AddVM("node-1")
+	return &DiskReaper{
+		diskManager:   diskManager,
+		volumeLister:  lister,
+		interval:      time.Minute,
+		gracePeriod:   gracePeriod,
+		orphanedSince: make(map[string]time.Time),
+	}, diskManager
+}
+
+func TestDiskReaper(t *testing.T) {
+	const gracePeriod = time.Hour
+	tests := []struct {
+		name        string
+		description string
+		// volumeHandle is "name" or "urn" for a PV with the name or the URN of the disk, or empty for no PV
+		volumeHandle string
+		attached     bool
+		reapAfter    time.Duration
+		deleted      bool
+	}{
+		{
+			name:        "orphaned disk is deleted after the grace period",
+			description: getDiskDescription("cluster-1"),
+			reapAfter:   gracePeriod,
+			deleted:     true,
+		},
+		{
+			name:        "orphaned disk is kept within the grace period",
+			description: getDiskDescription("cluster-1"),
+			reapAfter:   gracePeriod - time.Second,
+		},
+		{
+			name:         "disk with a PV is kept",
+			description:  getDiskDescription("cluster-1"),
+			volumeHandle: "name",
+			reapAfter:    2 * gracePeriod,
+		},
+		{
+			name:         "disk of a static PV with its URN is kept",
+			description:  getDiskDescription("cluster-1"),
+			volumeHandle: "urn",
+			reapAfter:    2 * gracePeriod,
+		},
+		{
+			name:        "attached orphaned disk is kept",
+			description: getDiskDescription("cluster-1"),
+			attached:    true,
+			reapAfter:   2 * gracePeriod,
+		},
+		{
+			name:        "disk of another cluster is kept",
+			description: getDiskDescription("cluster-2"),
+			reapAfter:   2 * gracePeriod,
+		},
+		{
+			name:      "disk without the description of the driver is kept",
+			reapAfter: 2 * gracePeriod,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lister := &fakeVolumeLister{volumeIDs: make(map[string]bool)}
+			reaper, diskManager := newFakeDiskReaper(lister, gracePeriod)
+			ctx := context.Background()
+
+			disk, err := diskManager.CreateDiskWithContext(ctx, "pvc-1", 1024, "", "", test.description, "", false,
+				"", "", 0)
+			require.NoError(t, err, "disk should be created")
+			switch test.volumeHandle {
+			case "name":
+				lister.volumeIDs[disk.Name] = true
+			case "urn":
+				lister.volumeIDs[disk.ID] = true
+			}
+			if test.attached {
+				vm, err := diskManager.FindVMByNodeID("node-1")
+				require.NoError(t, err, "VM of the node should be found")
+				require.NoError(t, diskManager.AttachVolumeAtWithContext(ctx, vm, disk, nil, nil),
+					"disk should be attached")
+			}
+
+			now := time.Now()
+			require.NoError(t, reaper.reap(ctx, now), "disks should be reaped")
+			require.NoError(t, reaper.reap(ctx, now.Add(test.reapAfter)), "disks should be reaped again")
+			foundDisk, err := diskManager.FindDiskByName(disk.Name)
+			require.NoError(t, err, "disk should be looked up")
+			assert.Equal(t, test.deleted, foundDisk == nil, "disk should be deleted only if it is orphaned")
+		})
+	}
+}
+
+func TestDiskReaperRestartsGracePeriod(t *testing.T) {
+	const gracePeriod = time.Hour
+	lister := &fakeVolumeLister{volumeIDs: make(map[string]bool)}
+	reaper, diskManager := newFakeDiskReaper(lister, gracePeriod)
+	ctx := context.Background()
+	_, err := diskManager.CreateDiskWithContext(ctx, "pvc-1", 1024, "", "", getDiskDescription("cluster-1"), "",
+		false, "", "", 0)
+	require.NoError(t, err, "disk should be created")
+
+	now := time.Now()
+	require.NoError(t, reaper.reap(ctx, now), "disks should be reaped")
+	lister.volumeIDs["pvc-1"] = true
+	require.NoError(t, reaper.reap(ctx, now.Add(gracePeriod/2)), "disks should be reaped")
+	delete(lister.volumeIDs, "pvc-1")
+	require.NoError(t, reaper.reap(ctx, now.Add(gracePeriod)), "disks should be reaped")
+	disk, err := diskManager.FindDiskByName("pvc-1")
+	require.NoError(t, err, "disk should be looked up")
+	assert.NotNil(t, disk, "disk that had a PV should get another grace period once it has none")
+
+	require.NoError(t, reaper.reap(ctx, now.Add(2*gracePeriod)), "disks should be reaped")
+	disk, err = diskManager.FindDiskByName("pvc-1")
+	require.NoError(t, err, "disk should be looked up")
+	assert.Nil(t, disk, "disk should be deleted once it has had no PV for the grace period")
+}
+
+func TestDiskReaperListErrors(t *testing.T) {
+	lister := &fakeVolumeLister{err: fmt.Errorf("forbidden")}
+	reaper, diskManager := newFakeDiskReaper(lister, time.Hour)
+	ctx := context.Background()
+	_, err := diskManager.CreateDiskWithContext(ctx, "pvc-1", 1024, "", "", getDiskDescription("cluster-1"), "",
+		false, "", "", 0)
+	require.NoError(t, err, "disk should be created")
+
+	now := time.Now()
+	assert.Error(t, reaper.reap(ctx, now), "disks should not be reaped without the volumes of the cluster")
+	assert.Error(t, reaper.reap(ctx, now.Add(2*time.Hour)), "disks should not be reaped without the volumes")
+	disk, err := diskManager.FindDiskByName("pvc-1")
+	require.NoError(t, err, "disk should be looked up")
+	assert.NotNil(t, disk, "disk should be kept while the volumes of the cluster cannot be listed")
+
+	diskManager.SetError(fake.OperationListDisks, fmt.Errorf("VCD is down"))
+	lister.err = nil
+	assert.Error(t, reaper.reap(ctx, now.Add(2*time.Hour)), "disks should not be reaped without listing them")
+}
@@ -0,0 +1,133 @@
+/*
+   Copyright 2021 VMware, Inc.
+   SPDX-License-Identifier: Apache-2.0
+*/
+
+package csi
+
+import (
+	"errors"
+	"fmt"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/vmware/cloud-director-named-disk-csi-driver/pkg/vcdcsiclient"
+	"google.golang.org/grpc/codes"
+	"k8s.io/klog"
+	"strings"
+)
+
+const (
+	// TopologyVDCKey is the topology segment of the VDC of a node, and of the volumes that it can attach
+	TopologyVDCKey = "topology.csi.vcd/vdc"
+
+	// volumeIDVDCSeparator separates the VDC from the disk name in the ID of a volume outside of the configured VDC.
+	// The names of the disks created by the driver have no separator.
+	volumeIDVDCSeparator = "/"
+)
+
+// getAccessibleTopology returns the topology of the VDC vdcName
+func getAccessibleTopology(vdcName string) []*csi.Topology {
+	if vdcName == "" {
+		return nil
+	}
+
+	return []*csi.Topology{
+		{
+			Segments: map[string]string{
+				TopologyVDCKey: vdcName,
+			},
+		},
+	}
+}
+
+// getRequestedVDC returns the VDC of the first preferred, and then requisite, topology of the accessibility
+// requirements that has a VDC, or an empty string if none does
+func getRequestedVDC(requirements *csi.TopologyRequirement) string {
+	for _, topologies := range [][]*csi.Topology{requirements.GetPreferred(), requirements.GetRequisite()} {
+		for _, topology := range topologies {
+			if vdcName := topology.GetSegments()[TopologyVDCKey]; vdcName != "" {
+				return vdcName
+			}
+		}
+	}
+
+	return ""
+}
+
+// isVDCAccessible returns true if a volume in the VDC vdcName satisfies the requisite topologies of the accessibility
+// requirements, which is the case if none of them has a VDC
+func isVDCAccessible(requirements *csi.TopologyRequirement, vdcName string) bool {
+	hasVDC := false
+	for _, topology := range requirements.GetRequisite() {
+		if requisiteVDC := topology.GetSegments()[TopologyVDCKey]; requisiteVDC != "" {
+			if requisiteVDC == vdcName {
+				return true
+			}
+			hasVDC = true
+		}
+	}
+
+	return !hasVDC
+}
+
+// getDiskManagerForVDC returns the disk manager of the VDC vdcName, creating a client for the VDC if needed. The
+// configured disk manager is returned for an empty VDC name.
+func (cs *controllerServer) getDiskManagerForVDC(vdcName string) (vcdcsiclient.VCDDiskManager, error) {
+	if vdcName == "" || vdcName == cs.DiskManager.GetVDCName() {
+		return cs.DiskManager, nil
+	}
+
+	cs.vdcDiskManagersLock.Lock()
+	defer cs.vdcDiskManagersLock.Unlock()
+
+	if diskManager, ok := cs.vdcDiskManagers[vdcName]; ok {
+		return diskManager, nil
+	}
+
+	klog.Infof("Creating VCD client for VDC [%s]", vdcName)
+	diskManager, err := cs.DiskManager.ForVDC(vdcName)
+	if err != nil {
+		return nil, err
+	}
+	cs.vdcDiskManagers[vdcName] = diskManager
+
+	return diskManager, nil
+}
+
+// vdcErrorCode returns the gRPC code of the error err of getDiskManagerForVDC. A VDC that does not exist is an invalid
+// argument of the request, whereas the other errors of the client, e.g. of the network or of VCD, are retried.
+func vdcErrorCode(err error) codes.Code {
+	if errors.Is(err, vcdcsiclient.ErrVDCNotFound) {
+		return codes.InvalidArgument
+	}
+
+	return diskErrorCode(err, codes.Unavailable)
+}
+
+// getVolumeID returns the ID of the volume of the disk diskName in the VDC of diskManager. The IDs of the volumes in
+// the configured VDC are the names of their disks, as they were before volumes could be created in other VDCs.
+func (cs *controllerServer) getVolumeID(diskManager vcdcsiclient.VCDDiskManager, diskName string) string {
+	if diskManager == cs.DiskManager {
+		return diskName
+	}
+
+	return diskManager.GetVDCName() + volumeIDVDCSeparator + diskName
+}
+
+// getVolumeDiskManager returns the disk manager of the VDC of the volume volumeID and the name of its disk
+func (cs *controllerServer) getVolumeDiskManager(volumeID string) (vcdcsiclient.VCDDiskManager, string, error) {
+	idx := strings.LastIndex(volumeID, volumeIDVDCSeparator)
+	if idx < 0 {
+		return cs.DiskManager, volumeID, nil
+	}
+
+	vdcName, diskName := volumeID[:idx], volumeID[idx+len(volumeIDVDCSeparator):]
+	if vdcName == "" || diskName == "" {
+		return nil, "", fmt.Errorf("volume ID [%s] should have a VDC and a disk name", volumeID)
+	}
+	diskManager, err := cs.getDiskManagerForVDC(vdcName)
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to get client for VDC [%s] of volume [%s]: [%v]", vdcName, volumeID, err)
+	}
+
+	return diskManager, diskName, nil
+}
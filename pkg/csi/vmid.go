@@ -0,0 +1,106 @@
+/*
+   Copyright 2021 VMware, Inc.
+   SPDX-License-Identifier: Apache-2.0
+*/
+
+package csi
+
+import (
+	"context"
+	"fmt"
+	"github.com/vmware/cloud-director-named-disk-csi-driver/pkg/vcdcsiclient"
+	"github.com/vmware/go-vcloud-director/v2/govcd"
+	"k8s.io/klog"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// TopologyVMKey is the topology segment with the UUID of the VM of a node, which kubelet sets as a label of the node
+// and which the controller finds the VM of the node by, instead of searching the VDC for the name of the VM. The URN
+// of the VM cannot be the value of a label.
+const TopologyVMKey = "topology.csi.vcd/vm"
+
+// nodeVMIDReader reads the VM ID that a node reports in its topology
+type nodeVMIDReader interface {
+	// GetNodeVMID returns the VM ID of the node nodeID, or an empty string if the node does not report it
+	GetNodeVMID(ctx context.Context, nodeID string) (string, error)
+}
+
+// NodeVMIDReader reads the VM IDs of the nodes from the labels of their topology in the Kubernetes API of the cluster
+// that the pod runs in
+type NodeVMIDReader struct {
+	client *kubeAPIClient
+}
+
+// NewNodeVMIDReader creates a NodeVMIDReader that reads the nodes with the service account of the pod
+func NewNodeVMIDReader() (*NodeVMIDReader, error) {
+	client, err := newKubeAPIClient()
+	if err != nil {
+		return nil, fmt.Errorf("unable to create client of Kubernetes API: [%v]", err)
+	}
+
+	return &NodeVMIDReader{
+		client: client,
+	}, nil
+}
+
+// node has the fields of a node that are needed to read its VM ID
+type node struct {
+	Metadata struct {
+		Labels map[string]string `json:"labels"`
+	} `json:"metadata"`
+}
+
+// GetNodeVMID returns the VM ID of the label of the node named nodeID, which is the name of its VM
+func (reader *NodeVMIDReader) GetNodeVMID(ctx context.Context, nodeID string) (string, error) {
+	kubeNode := &node{}
+	if err := reader.client.do(ctx, http.MethodGet, "/api/v1/nodes/"+url.PathEscape(nodeID), nil,
+		kubeNode); err != nil {
+		return "", fmt.Errorf("unable to get node [%s]: [%v]", nodeID, err)
+	}
+
+	return kubeNode.Metadata.Labels[TopologyVMKey], nil
+}
+
+// findNodeVMID returns the UUID of the VM of the node nodeID that the node reports in its topology, or an empty
+// string if the VM cannot be found, so that the controller finds the VM by its name
+func findNodeVMID(diskManager vcdcsiclient.VCDDiskManager, nodeID string) string {
+	vm, err := diskManager.FindVMByNodeID(nodeID)
+	if err != nil {
+		klog.Errorf("unable to find VM of node [%s] to report its ID: [%v]", nodeID, err)
+		return ""
+	}
+	vmID := strings.TrimPrefix(vm.VM.ID, vcdcsiclient.VMURNPrefix)
+	klog.Infof("Reporting ID [%s] of VM of node [%s] in topology [%s]", vmID, nodeID, TopologyVMKey)
+
+	return vmID
+}
+
+// findNodeVM finds the VM of the node nodeID by the VM ID that the node reports in its topology, if the nodes report
+// it, so that the VDC is not searched for the name of the VM. The VM is found by its name otherwise, and when the VM
+// of the ID is not named after the node, e.g. since the VM was replaced.
+func (cs *controllerServer) findNodeVM(ctx context.Context, diskManager vcdcsiclient.VCDDiskManager,
+	nodeID string) (*govcd.VM, error) {
+
+	if cs.Driver.nodeVMIDReader != nil {
+		vmID, err := cs.Driver.nodeVMIDReader.GetNodeVMID(ctx, nodeID)
+		switch {
+		case err != nil:
+			klog.Infof("Unable to get VM ID of node [%s]; finding its VM by name: [%v]", nodeID, err)
+		case vmID == "":
+			klog.Infof("Node [%s] does not report its VM ID; finding its VM by name", nodeID)
+		default:
+			vm, err := diskManager.FindVMByID(vmID)
+			if err == nil && vm.VM.Name == nodeID {
+				return vm, nil
+			}
+			if err == nil {
+				err = fmt.Errorf("VM is named [%s]", vm.VM.Name)
+			}
+			klog.Infof("Unable to find VM [%s] of node [%s]; finding its VM by name: [%v]", vmID, nodeID, err)
+		}
+	}
+
+	return diskManager.FindVMByNodeID(nodeID)
+}
@@ -0,0 +1,97 @@
+/*
+   Copyright 2021 VMware, Inc.
+   SPDX-License-Identifier: Apache-2.0
+*/
+
+package csi
+
+import (
+	"context"
+	"github.com/vmware/cloud-director-named-disk-csi-driver/pkg/vcdcsiclient"
+	"k8s.io/klog"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultAttachDetachBusyRetries is how many times an attach or detach whose VM is busy is retried by default
+	defaultAttachDetachBusyRetries = 3
+	// defaultAttachDetachRetryDelay is the delay before the first retry of an attach or detach whose VM is busy,
+	// which doubles with every retry
+	defaultAttachDetachRetryDelay = 2 * time.Second
+
+	// defaultDetachWaitTimeout is how long an unpublish waits by default for VCD to release a detached disk
+	defaultDetachWaitTimeout = time.Minute
+	// defaultDetachPollInterval is how often the attachment of a detached disk is checked
+	defaultDetachPollInterval = 2 * time.Second
+)
+
+// vmLocks serializes the attaches and detaches of the disks of each VM, since VCD rejects the reconfiguration of a
+// VM that is busy with another one
+type vmLocks struct {
+	lock  sync.Mutex
+	locks map[string]*vmLock
+}
+
+// vmLock is held by one attach or detach of a VM at a time, and is dropped once no operation awaits it
+type vmLock struct {
+	held  chan struct{}
+	users int
+}
+
+// acquire waits until the lock of the VM vmHref is held by the caller, or ctx is done. The returned func releases
+// the lock.
+func (locks *vmLocks) acquire(ctx context.Context, vmHref string) (func(), error) {
+	locks.lock.Lock()
+	if locks.locks == nil {
+		locks.locks = make(map[string]*vmLock)
+	}
+	lock, ok := locks.locks[vmHref]
+	if !ok {
+		lock = &vmLock{held: make(chan struct{}, 1)}
+		locks.locks[vmHref] = lock
+	}
+	lock.users++
+	locks.lock.Unlock()
+
+	drop := func() {
+		locks.lock.Lock()
+		defer locks.lock.Unlock()
+
+		lock.users--
+		if lock.users == 0 {
+			delete(locks.locks, vmHref)
+		}
+	}
+	select {
+	case lock.held <- struct{}{}:
+		return func() {
+			<-lock.held
+			drop()
+		}, nil
+	case <-ctx.Done():
+		drop()
+		return nil, ctx.Err()
+	}
+}
+
+// retryIfVMBusy calls operation until it succeeds or fails other than because its VM is busy, retrying it up to the
+// attach and detach retries of the driver with a doubling delay. It stops retrying once ctx is done.
+func (cs *controllerServer) retryIfVMBusy(ctx context.Context, description string, operation func() error) error {
+	delay := cs.Driver.attachDetachRetryDelay
+	for retry := 0; ; retry++ {
+		err := operation()
+		if err == nil || !vcdcsiclient.IsEntityBusyError(err) || retry >= cs.Driver.attachDetachBusyRetries {
+			return err
+		}
+
+		klog.Infof("Unable to %s since its VM is busy; retrying [%d/%d] in [%v]: [%v]", description, retry+1,
+			cs.Driver.attachDetachBusyRetries, delay, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
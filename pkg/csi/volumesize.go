@@ -0,0 +1,92 @@
+/*
+   Copyright 2021 VMware, Inc.
+   SPDX-License-Identifier: Apache-2.0
+*/
+
+package csi
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// volumeSizeSuffixes are the multipliers of the suffixes of the volume sizes, as in Kubernetes quantities
+var volumeSizeSuffixes = []struct {
+	suffix     string
+	multiplier int64
+}{
+	{"Ki", 1 << 10},
+	{"Mi", 1 << 20},
+	{"Gi", 1 << 30},
+	{"Ti", 1 << 40},
+	{"Pi", 1 << 50},
+	{"k", 1000},
+	{"M", 1000 * 1000},
+	{"G", 1000 * 1000 * 1000},
+	{"T", 1000 * 1000 * 1000 * 1000},
+	{"P", 1000 * 1000 * 1000 * 1000 * 1000},
+}
+
+// ParseVolumeSize returns the bytes of a volume size written as an integer with an optional binary (Ki, Mi, Gi, Ti,
+// Pi) or decimal (k, M, G, T, P) suffix, such as 10Ti. An empty size is 0, which does not bound the volumes.
+func ParseVolumeSize(size string) (int64, error) {
+	if size == "" {
+		return 0, nil
+	}
+
+	value, multiplier := size, int64(1)
+	for _, volumeSizeSuffix := range volumeSizeSuffixes {
+		if strings.HasSuffix(size, volumeSizeSuffix.suffix) {
+			value, multiplier = strings.TrimSuffix(size, volumeSizeSuffix.suffix), volumeSizeSuffix.multiplier
+			break
+		}
+	}
+	count, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || count < 0 {
+		return 0, fmt.Errorf("size [%s] should be a non-negative integer with an optional suffix", size)
+	}
+	if count > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("size [%s] is too large", size)
+	}
+
+	return count * multiplier, nil
+}
+
+// bytesToMB returns the size in MB, the granularity of the sizes of VCD disks, of a volume of at least required bytes
+func bytesToMB(required int64) int64 {
+	if required <= 0 {
+		return 0
+	}
+	return (required-1)/MbToBytes + 1
+}
+
+// checkCapacityLimit returns an error if a volume of sizeMB exceeds limitBytes, where a limit of 0 does not bound the
+// volume. A limit below the next MB cannot be met by a VCD disk.
+func checkCapacityLimit(sizeMB int64, limitBytes int64) error {
+	if limitBytes > 0 && sizeMB*MbToBytes > limitBytes {
+		return fmt.Errorf("size [%d]MB, rounded up to whole MB, exceeds limit bytes [%d]", sizeMB, limitBytes)
+	}
+
+	return nil
+}
+
+// checkVolumeSize returns an error if sizeBytes is out of the bounds set on the driver, where a bound of 0 does not
+// bound the size
+func (d *VCDDriver) checkVolumeSize(sizeBytes int64) error {
+	if (d.minVolumeSizeBytes > 0 && sizeBytes < d.minVolumeSizeBytes) ||
+		(d.maxVolumeSizeBytes > 0 && sizeBytes > d.maxVolumeSizeBytes) {
+		return fmt.Errorf("requested size [%d] bytes is out of the range of the driver: minimum [%s], maximum [%s]",
+			sizeBytes, formatVolumeSizeBound(d.minVolumeSizeBytes), formatVolumeSizeBound(d.maxVolumeSizeBytes))
+	}
+
+	return nil
+}
+
+func formatVolumeSizeBound(sizeBytes int64) string {
+	if sizeBytes == 0 {
+		return "none"
+	}
+	return fmt.Sprintf("%d bytes", sizeBytes)
+}
@@ -23,6 +23,7 @@ const (
 	DiskDeleteError         = "DiskDeleteError"
 	DiskAttachError         = "DiskAttachError"
 	DiskDetachError         = "DiskDetachError"
+	DiskResizeError         = "DiskResizeError"
 
 	// Events
 	RdeUpgradeEvent = "RdeUpgradeEvent"
@@ -30,6 +31,7 @@ const (
 	DiskDeleteEvent = "DiskDeleteEvent"
 	DiskAttachEvent = "DiskAttachEvent"
 	DiskDetachEvent = "DiskDetachEvent"
+	DiskResizeEvent = "DiskResizeEvent"
 )
 
 func GetPVsFromRDE(rde *swaggerClient.DefinedEntity) ([]string, error) {
@@ -119,7 +121,7 @@ func GetOldPVsFromRDE(statusMap map[string]interface{}, rdeId string) ([]string,
 	pvInterfaces, ok := statusMap[OldPersistentVolumeKey]
 
 	if !ok {
-		klog.Info("key [%s] not found in the status section of RDE [%s]", OldPersistentVolumeKey, rdeId)
+		klog.Infof("key [%s] not found in the status section of RDE [%s]", OldPersistentVolumeKey, rdeId)
 		return make([]string, 0), nil
 	}
 	if pvInterfaces == nil {
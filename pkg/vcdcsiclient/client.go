@@ -0,0 +1,1012 @@
+/*
+   Copyright 2021 VMware, Inc.
+   SPDX-License-Identifier: Apache-2.0
+*/
+
+package vcdcsiclient
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-logr/logr"
+	"github.com/vmware/cloud-provider-for-cloud-director/pkg/vcdsdk"
+	swaggerClient "github.com/vmware/cloud-provider-for-cloud-director/pkg/vcdswaggerclient"
+	"github.com/vmware/go-vcloud-director/v2/govcd"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+	"golang.org/x/sync/singleflight"
+	"golang.org/x/time/rate"
+	"io/ioutil"
+	"k8s.io/klog/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// tokenRefreshWindow is how long before its expiry the bearer token is proactively refreshed
+	tokenRefreshWindow = 60 * time.Second
+
+	// tokenFileReadAttempts and tokenFileRetryDelay bound the wait for a refresh token file that is briefly absent
+	// or empty while it is rotated
+	tokenFileReadAttempts = 5
+	tokenFileRetryDelay   = 200 * time.Millisecond
+
+	// defaultHTTPTimeout bounds every request to VCD, including reading the response body
+	defaultHTTPTimeout = 30 * time.Second
+	// defaultOrgVDCCacheTTL is how long the org and VDC of a client are reused by the refreshes of its bearer token
+	defaultOrgVDCCacheTTL = 5 * time.Minute
+	// dialTimeout, tlsHandshakeTimeout and responseHeaderTimeout make requests to an unreachable VCD fail fast
+	dialTimeout           = 10 * time.Second
+	tlsHandshakeTimeout   = 10 * time.Second
+	responseHeaderTimeout = 30 * time.Second
+
+	// vdcURNPrefix is the prefix of the URNs of VDCs, by which the VDC of a client can be configured instead of its
+	// name
+	vdcURNPrefix = "urn:vcloud:vdc:"
+)
+
+// Client wraps the vcdsdk client with the connection handling needed by the CSI driver
+type Client struct {
+	*vcdsdk.Client
+
+	cacheKey clientKey
+	// hosts are the scheme, host and port of the VCD host followed by its failover hosts, and hostIndex is the index
+	// of the host that the client authenticated with last
+	hosts     []*url.URL
+	hostIndex int32
+	// logger is the base logger of the operations of the client
+	logger logr.Logger
+
+	// apiVersion is the VCD API version used by the govcd client
+	apiVersion string
+	// caCert is a PEM encoded CA certificate used to verify VCD instead of the system roots
+	caCert []byte
+	// proxyURL is the proxy used to reach VCD. If it is nil, the proxy is obtained from the environment.
+	proxyURL *url.URL
+	// httpTimeout is the timeout of the http clients used by the govcd and swagger clients
+	httpTimeout time.Duration
+	// retryMaxAttempts and retryBaseDelay control how transient failures of the auth, org and VDC calls are retried
+	retryMaxAttempts int
+	retryBaseDelay   time.Duration
+	// transport is shared by the govcd and swagger clients
+	transport http.RoundTripper
+	// customTransport is used as the transport instead of the one built from the TLS and proxy settings, if it is set
+	customTransport http.RoundTripper
+	// limiter bounds the rate of requests of the govcd and swagger clients to VCD. If it is nil, the rate is not
+	// limited.
+	limiter *rate.Limiter
+	// debugLogMaxBodyBytes is the length that the bodies of the requests and responses logged at debugLogLevel are
+	// truncated to
+	debugLogMaxBodyBytes int
+	// refreshTokenFile is read for the refresh token every time the bearer token is obtained, if it is set
+	refreshTokenFile string
+	// tracer starts the spans of the operations of the client. If it is nil, the operations are not traced.
+	tracer Tracer
+	// operationOrg is the org that the disk operations of a system administrator run in instead of the system
+	// org, and tenantContext is its tenant context once it is resolved
+	operationOrg  string
+	tenantContext atomic.Value
+	// options are the options the client was created with, which are applied to its clients for other VDCs
+	options []ClientOption
+
+	// tokenIssuedAt and tokenExpiresAt are obtained from the bearer token. tokenExpiresAt is zero if the expiry is
+	// not known. refreshedAt is when the client last obtained a bearer token.
+	tokenIssuedAt  time.Time
+	tokenExpiresAt time.Time
+	refreshedAt    time.Time
+	// tokenRejected is set to 1 once VCD rejects the bearer token, and reauthToken is the token that the requests
+	// of the swagger client are retried with until the clients are refreshed
+	tokenRejected int32
+	reauthLock    sync.Mutex
+	reauthToken   string
+	// hostUnreachable is set to 1 once a request fails to reach the current host of a client with failover hosts,
+	// so that the next operation refreshes the clients, failing over to another host if the current one is down
+	hostUnreachable int32
+
+	// org is the org of the VDC of the client. The org and VDC are reused by the refreshes of the bearer token for
+	// orgVDCCacheTTL after orgVDCResolvedAt, unless orgVDCInvalid is set to 1 because either was not found.
+	org              *govcd.Org
+	orgVDCCacheTTL   time.Duration
+	orgVDCResolvedAt time.Time
+	orgVDCInvalid    int32
+}
+
+// clientKey identifies a cached client. Clients for different tenants, VDCs or users are cached separately so that
+// they do not overwrite each other.
+type clientKey struct {
+	host    string
+	orgName string
+	vdcName string
+	userOrg string
+	user    string
+}
+
+var (
+	clientCreatorLock sync.Mutex
+	clientCache       = make(map[clientKey]*Client)
+	// clientCreationGroup deduplicates concurrent creation of clients with the same parameters
+	clientCreationGroup singleflight.Group
+)
+
+// contextRoundTripper binds every request to ctx. govcd does not accept a context in its auth and query calls, so
+// this is used to make those calls cancellable.
+type contextRoundTripper struct {
+	ctx  context.Context
+	next http.RoundTripper
+}
+
+func (rt *contextRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	klog.FromContext(rt.ctx).V(4).Info("VCD call", "method", req.Method, "url", redactURL(req.URL))
+	return rt.next.RoundTrip(req.WithContext(rt.ctx))
+}
+
+// contextError adds the error of ctx to err if ctx is done, since govcd reports the failure of a request that ctx
+// abandoned as text
+func contextError(ctx context.Context, err error) error {
+	if err == nil || ctx.Err() == nil || errors.Is(err, ctx.Err()) {
+		return err
+	}
+
+	return fmt.Errorf("%v: [%w]", err, ctx.Err())
+}
+
+// bindToContext binds the requests of the govcd client to ctx until the returned func is called, so that they are
+// abandoned once ctx is done and logged with its request ID. The caller should hold client.RWLock for writing, since
+// the transport of the govcd client is swapped.
+func (client *Client) bindToContext(ctx context.Context) func() {
+	vcdClient := client.VCDClient
+	if vcdClient == nil {
+		return func() {}
+	}
+	ctx, _ = client.requestContext(ctx)
+
+	govcdTransport := vcdClient.Client.Http.Transport
+	if govcdTransport == nil {
+		govcdTransport = http.DefaultTransport
+	}
+	vcdClient.Client.Http.Transport = &contextRoundTripper{
+		ctx:  ctx,
+		next: govcdTransport,
+	}
+	return func() {
+		vcdClient.Client.Http.Transport = govcdTransport
+	}
+}
+
+// NewVCDClientFromSecrets returns the cached client for (host, org, vdc, user) if its credentials are unchanged.
+// Otherwise it authenticates to VCD with the given credentials and caches the new client. Concurrent callers with the
+// same parameters share a single authentication; the options of the caller that starts it are applied.
+func NewVCDClientFromSecrets(host string, orgName string, vdcName string, userOrg string,
+	user string, password string, refreshToken string, insecure bool, getVdcClient bool,
+	options ...ClientOption) (*Client, error) {
+
+	if err := validateClientParams(host, orgName, vdcName, user, password, refreshToken, getVdcClient); err != nil {
+		return nil, fmt.Errorf("invalid parameters for VCD client: [%v]", err)
+	}
+
+	key := clientKey{
+		host:    host,
+		orgName: orgName,
+		vdcName: vdcName,
+		userOrg: userOrg,
+		user:    user,
+	}
+	if client := getCachedClient(key, password, refreshToken, insecure, getVdcClient); client != nil {
+		return client, nil
+	}
+
+	// the credentials are hashed so that callers that changed them do not share the creation of a stale client
+	credentialsHash := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%s\x00%v\x00%v", password, refreshToken, insecure,
+		getVdcClient)))
+	flightKey := fmt.Sprintf("%#v/%x", key, credentialsHash)
+	result, err, shared := clientCreationGroup.Do(flightKey, func() (interface{}, error) {
+		client, err := newVCDClientFromSecrets(key, password, refreshToken, insecure, getVdcClient, options...)
+		if err != nil {
+			return nil, err
+		}
+
+		clientCreatorLock.Lock()
+		clientCache[key] = client
+		clientCreatorLock.Unlock()
+		return client, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if shared {
+		klog.V(3).InfoS("Shared creation of VCD client with concurrent callers", "host", host, "org", orgName,
+			"vdc", vdcName, "user", user)
+	}
+
+	return result.(*Client), nil
+}
+
+// NewVCDClientForVDC returns a client for the VDC vdcName of the org of client, which authenticates with the
+// credentials and options of client. The client itself is returned for its own VDC.
+func (client *Client) NewVCDClientForVDC(vdcName string) (*Client, error) {
+	if vdcName == "" {
+		return nil, fmt.Errorf("vdc name should not be empty")
+	}
+	if vdcName == client.ClusterOVDCName {
+		return client, nil
+	}
+
+	key, authConfig := client.cacheKey, client.VCDAuthConfig
+	vdcClient, err := NewVCDClientFromSecrets(key.host, key.orgName, vdcName, key.userOrg, key.user,
+		authConfig.Password, authConfig.RefreshToken, authConfig.Insecure, true, client.options...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create client for VDC [%s] of org [%s]: [%w]", vdcName, key.orgName, err)
+	}
+
+	return vdcClient, nil
+}
+
+// validateClientParams checks the parameters of NewVCDClientFromSecrets so that missing values are reported by name
+// instead of surfacing as authentication failures
+func validateClientParams(host string, orgName string, vdcName string, user string, password string,
+	refreshToken string, getVdcClient bool) error {
+
+	if _, err := parseHostURL(host); err != nil {
+		return err
+	}
+
+	if orgName == "" {
+		return fmt.Errorf("org name should not be empty")
+	}
+	if getVdcClient && vdcName == "" {
+		return fmt.Errorf("vdc name should not be empty")
+	}
+
+	if refreshToken == "" {
+		if user == "" {
+			return fmt.Errorf("user should not be empty if refresh token is not set")
+		}
+		if password == "" {
+			return fmt.Errorf("password should not be empty if refresh token is not set")
+		}
+	}
+
+	return nil
+}
+
+// parseHostURL parses the url of the VCD host, which has an http or https scheme, a host name or an IPv4 or
+// bracketed IPv6 address, and optionally a port. The paths of the APIs are added to it, hence it cannot have a path.
+func parseHostURL(host string) (*url.URL, error) {
+	if host == "" {
+		return nil, fmt.Errorf("host should not be empty")
+	}
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, fmt.Errorf("host [%s] is not a valid url: [%v]", host, err)
+	}
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Hostname() == "" {
+		return nil, fmt.Errorf("host [%s] should be an http or https url with a host name", host)
+	}
+	if strings.Contains(u.Hostname(), ":") && !strings.HasPrefix(u.Host, "[") {
+		return nil, fmt.Errorf("IPv6 address of host [%s] should be in brackets, e.g. https://[2001:db8::1]:443", host)
+	}
+	if (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return nil, fmt.Errorf("host [%s] should have no path, query, fragment or user, only a scheme, host and port",
+			host)
+	}
+
+	return &url.URL{
+		Scheme: u.Scheme,
+		Host:   u.Host,
+	}, nil
+}
+
+// apiURL returns the url of the path of the VCD host of the client, such as /api or /cloudapi
+func (client *Client) apiURL(path string) string {
+	hostURL := client.currentHost()
+	return (&url.URL{
+		Scheme: hostURL.Scheme,
+		Host:   hostURL.Host,
+		Path:   path,
+	}).String()
+}
+
+// getCachedClient returns the cached client for key if its credentials match. A client with different credentials
+// is evicted.
+func getCachedClient(key clientKey, password string, refreshToken string, insecure bool,
+	getVdcClient bool) *Client {
+
+	clientCreatorLock.Lock()
+	defer clientCreatorLock.Unlock()
+
+	client, ok := clientCache[key]
+	if !ok {
+		return nil
+	}
+
+	authConfig := client.VCDAuthConfig
+	if authConfig.Password == password && authConfig.RefreshToken == refreshToken &&
+		authConfig.Insecure == insecure && (!getVdcClient || client.GetVDC() != nil) {
+		return client
+	}
+
+	klog.InfoS("Credentials of cached client have changed; evicting it", "host", key.host, "org", key.orgName,
+		"vdc", key.vdcName, "user", key.user)
+	delete(clientCache, key)
+	return nil
+}
+
+// newVCDClientFromSecrets authenticates a new client for key with the given credentials
+func newVCDClientFromSecrets(key clientKey, password string, refreshToken string, insecure bool,
+	getVdcClient bool, options ...ClientOption) (*Client, error) {
+
+	host, orgName, vdcName, userOrg, user := key.host, key.orgName, key.vdcName, key.userOrg, key.user
+
+	// When getting the client from main.go, the user, orgName, userOrg would have correct values due to
+	// config.SetAuthorization(). If userOrg is already set, we want the fallback to userOrg first which could fall
+	// back to orgName if empty.
+	newUserOrg, newUsername, err := vcdsdk.GetUserAndOrg(user, orgName, userOrg)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing username before authenticating to VCD: [%v]", err)
+	}
+
+	hostURL, err := parseHostURL(host)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &Client{
+		Client: &vcdsdk.Client{
+			VCDAuthConfig: vcdsdk.NewVCDAuthConfigFromSecrets(host, newUsername, password, refreshToken,
+				newUserOrg, insecure),
+			ClusterOrgName:  orgName,
+			ClusterOVDCName: vdcName,
+		},
+		cacheKey:         key,
+		hosts:            []*url.URL{hostURL},
+		logger:           klog.Background(),
+		apiVersion:       vcdsdk.VCloudApiVersion,
+		httpTimeout:      defaultHTTPTimeout,
+		orgVDCCacheTTL:   defaultOrgVDCCacheTTL,
+		retryMaxAttempts: defaultRetryMaxAttempts,
+		retryBaseDelay:   defaultRetryBaseDelay,
+		options:          options,
+
+		debugLogMaxBodyBytes: defaultDebugLogMaxBodyBytes,
+	}
+	for _, option := range options {
+		if err = option(client); err != nil {
+			return nil, fmt.Errorf("unable to apply option to VCD client: [%v]", err)
+		}
+	}
+
+	if err = client.reloadRefreshToken(context.Background()); err != nil {
+		return nil, err
+	}
+
+	if client.customTransport != nil {
+		// the TLS and proxy settings are those of the custom transport
+		if len(client.caCert) > 0 || client.proxyURL != nil {
+			return nil, fmt.Errorf("a custom http transport cannot be used with a CA certificate or a proxy url")
+		}
+		client.transport = client.customTransport
+	} else if client.transport, err = client.newHTTPTransport(); err != nil {
+		return nil, fmt.Errorf("unable to create http transport for VCD client: [%v]", err)
+	}
+
+	ctx, logger := client.operationContext(context.Background(), operationAuthenticate)
+	err = observeVCDCall(operationAuthenticate, func() (err error) {
+		client.VCDClient, err = client.getBearerToken(ctx)
+		if err != nil && len(client.hosts) > 1 && IsHostUnreachableError(err) {
+			client.VCDClient, err = client.failover(ctx, err)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to get bearer token from secrets: [%v]", err)
+	}
+	client.APIClient = client.newSwaggerClient()
+	client.updateTokenLifetime(logger)
+	if err = client.resolveTenantContext(ctx); err != nil {
+		return nil, err
+	}
+
+	if getVdcClient {
+		var org *govcd.Org
+		err = client.retry(ctx, "get org", func() (err error) {
+			org, err = client.VCDClient.GetOrgByName(orgName)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to get org from name [%s]: [%v]", orgName, err)
+		}
+
+		if client.VDC, err = client.getVDC(ctx, org, vdcName); err != nil {
+			return nil, fmt.Errorf("unable to get VDC [%s] from org [%s]: [%w]", vdcName, orgName, err)
+		}
+		client.org = org
+		client.orgVDCResolvedAt = time.Now()
+	}
+
+	logger.Info("Created VCD client", "sysAdmin", client.VCDClient.Client.IsSysAdmin)
+
+	return client, nil
+}
+
+// newHTTPTransport creates the transport shared by the govcd and swagger clients
+func (client *Client) newHTTPTransport() (*http.Transport, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: client.VCDAuthConfig.Insecure,
+	}
+	if len(client.caCert) > 0 {
+		if client.VCDAuthConfig.Insecure {
+			return nil, fmt.Errorf("a CA certificate cannot be used with an insecure connection")
+		}
+
+		certPool := x509.NewCertPool()
+		if !certPool.AppendCertsFromPEM(client.caCert) {
+			return nil, fmt.Errorf("unable to parse PEM encoded CA certificate")
+		}
+		tlsConfig.RootCAs = certPool
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if client.proxyURL != nil {
+		proxy = http.ProxyURL(client.proxyURL)
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   dialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	return &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   tlsHandshakeTimeout,
+		ResponseHeaderTimeout: responseHeaderTimeout,
+	}, nil
+}
+
+// getBearerToken creates a govcd client that uses the client's transport and authenticates it with either the
+// refresh token or the username and password.
+func (client *Client) getBearerToken(ctx context.Context) (*govcd.VCDClient, error) {
+	logger := klog.FromContext(ctx)
+	config := client.VCDAuthConfig
+
+	href := client.apiURL("/api")
+	u, err := url.ParseRequestURI(href)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse url [%s]: %s", href, err)
+	}
+
+	vcdClient := govcd.NewVCDClient(*u, config.Insecure)
+	vcdClient.Client.Http.Transport = client.roundTripper()
+	vcdClient.Client.Http.Timeout = client.httpTimeout
+	vcdClient.Client.APIVersion = client.apiVersion
+	logger.Info("Using VCD API version", "apiVersion", vcdClient.Client.APIVersion)
+
+	if config.RefreshToken != "" {
+		// NOTE: for a system admin user using refresh token, the userOrg will still be tenant org.
+		// try setting authentication as a system org user
+		err = client.retry(ctx, "set token", func() error {
+			return vcdClient.SetToken("system", govcd.ApiTokenHeader, config.RefreshToken)
+		})
+		if err != nil {
+			logger.Error(err, "Failed to authenticate using refresh token as system org user; retrying as tenant org user",
+				"userOrg", config.UserOrg)
+			// failed to authenticate as system user. Retry as a tenant user
+			err = client.retry(ctx, "set token", func() error {
+				return vcdClient.SetToken(config.UserOrg, govcd.ApiTokenHeader, config.RefreshToken)
+			})
+			if err != nil {
+				return nil, fmt.Errorf("failed to set authorization header: [%v]", err)
+			}
+		} else {
+			// The persisted userorg should be changed to "system"
+			config.UserOrg = "system"
+		}
+		config.IsSysAdmin = vcdClient.Client.IsSysAdmin
+
+		logger.Info("Authenticated using refresh token", "sysAdmin", vcdClient.Client.IsSysAdmin)
+		return vcdClient, nil
+	}
+
+	var resp *http.Response
+	err = client.retry(ctx, "authenticate", func() (err error) {
+		resp, err = getAuthResponse(vcdClient, config.User, config.Password, config.UserOrg)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to authenticate [%s/%s] for url [%s]: [%+v] : [%v]",
+			config.UserOrg, config.User, href, resp, err)
+	}
+
+	return vcdClient, nil
+}
+
+// getAuthResponse authenticates vcdClient with the username and password. govcd does not map http status codes to
+// errors, so the status of the auth response is checked as well.
+func getAuthResponse(vcdClient *govcd.VCDClient, user string, password string, userOrg string) (*http.Response,
+	error) {
+
+	resp, err := vcdClient.GetAuthResponse(user, password, userOrg)
+	if err != nil {
+		return resp, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return resp, &httpStatusError{
+			statusCode: resp.StatusCode,
+			status:     resp.Status,
+		}
+	}
+
+	return resp, nil
+}
+
+// newSwaggerClient creates a swagger client that uses the current bearer token and the client's transport. The
+// generated APIs set the version in their own Accept header, so the API version is not applied here.
+func (client *Client) newSwaggerClient() *swaggerClient.APIClient {
+	swaggerConfig := swaggerClient.NewConfiguration()
+	swaggerConfig.BasePath = client.apiURL("/cloudapi")
+	swaggerConfig.AddDefaultHeader("Authorization", fmt.Sprintf("Bearer %s", client.VCDClient.Client.VCDToken))
+	swaggerConfig.HTTPClient = &http.Client{
+		Transport: &retryAfterRoundTripper{
+			next: &unauthorizedRetryRoundTripper{
+				client: client,
+				next:   client.roundTripper(),
+			},
+			maxAttempts: client.retryMaxAttempts,
+		},
+		Timeout: client.httpTimeout,
+	}
+
+	return swaggerClient.NewAPIClient(swaggerConfig)
+}
+
+// EvictClient removes client from the client cache if it is still the cached entry for its key. The next call to
+// NewVCDClientFromSecrets with the same parameters creates and authenticates a new client.
+func EvictClient(client *Client) {
+	clientCreatorLock.Lock()
+	defer clientCreatorLock.Unlock()
+
+	if cachedClient, ok := clientCache[client.cacheKey]; ok && cachedClient == client {
+		delete(clientCache, client.cacheKey)
+	}
+}
+
+// Close logs out the VCD session of the client, which invalidates its bearer token, removes the client from the
+// client cache and closes the idle connections of its transport. The client should not be used once it is closed.
+func (client *Client) Close() error {
+	EvictClient(client)
+
+	client.RWLock.Lock()
+	defer client.RWLock.Unlock()
+
+	ctx := context.Background()
+	var errs []string
+	if client.VCDClient != nil {
+		if err := client.logout(ctx, client.VCDClient.Client.VCDToken); err != nil {
+			errs = append(errs, err.Error())
+		}
+		client.VCDClient.Client.VCDToken = ""
+	}
+	// the token that rejected requests were retried with has a session of its own
+	client.reauthLock.Lock()
+	if err := client.logout(ctx, client.reauthToken); err != nil {
+		errs = append(errs, err.Error())
+	}
+	client.reauthToken = ""
+	client.reauthLock.Unlock()
+
+	(&http.Client{Transport: client.transport}).CloseIdleConnections()
+	if len(errs) > 0 {
+		return fmt.Errorf("unable to close VCD client: [%s]", strings.Join(errs, "; "))
+	}
+	klog.InfoS("Closed VCD client", "host", client.currentHost().Host, "org", client.ClusterOrgName,
+		"vdc", client.ClusterOVDCName)
+	return nil
+}
+
+// logout deletes the VCD session of token, if it is set
+func (client *Client) logout(ctx context.Context, token string) error {
+	if token == "" {
+		return nil
+	}
+
+	href := client.apiURL("/cloudapi/1.0.0/sessions/current")
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, href, nil)
+	if err != nil {
+		return fmt.Errorf("unable to create logout request [%s]: [%v]", href, err)
+	}
+	req.Header.Set("Accept", fmt.Sprintf("application/json;version=%s", client.apiVersion))
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+
+	resp, err := (&http.Client{Transport: client.roundTripper(), Timeout: client.httpTimeout}).Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to log out of VCD: [%v]", err)
+	}
+	defer resp.Body.Close()
+	// a session that has already expired needs no logout
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent &&
+		resp.StatusCode != http.StatusUnauthorized {
+		return fmt.Errorf("unable to log out of VCD: [%v]", &httpStatusError{
+			statusCode: resp.StatusCode,
+			status:     resp.Status,
+		})
+	}
+
+	return nil
+}
+
+// CloseClients closes every cached client, so that their VCD sessions do not outlive the driver
+func CloseClients() error {
+	clientCreatorLock.Lock()
+	clients := make([]*Client, 0, len(clientCache))
+	for _, client := range clientCache {
+		clients = append(clients, client)
+	}
+	clientCreatorLock.Unlock()
+
+	var errs []string
+	for _, client := range clients {
+		if err := client.Close(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("unable to close [%d] VCD clients: [%s]", len(errs), strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// RefreshBearerToken refreshes the bearer token of the client and resets the VDC and swagger clients
+func (client *Client) RefreshBearerToken() error {
+	return client.RefreshBearerTokenWithContext(context.Background())
+}
+
+// RefreshBearerTokenWithContext is the same as RefreshBearerToken but gives up on the VCD calls once ctx is done.
+// The logs of the refresh carry the request ID of ctx if it has one.
+func (client *Client) RefreshBearerTokenWithContext(ctx context.Context) error {
+	// the token of the govcd client is updated in place, so readers are excluded for the whole refresh
+	client.RWLock.Lock()
+	defer client.RWLock.Unlock()
+
+	return client.refreshBearerTokenLocked(ctx)
+}
+
+// refreshBearerTokenLocked is RefreshBearerTokenWithContext for callers that hold client.RWLock
+func (client *Client) refreshBearerTokenLocked(ctx context.Context) (err error) {
+	ctx, span := client.startSpan(ctx, operationRefresh, "")
+	defer func() { span.end(err) }()
+
+	ctx, _ = client.operationContext(ctx, operationRefresh)
+	return observeVCDCall(operationRefresh, func() error {
+		return client.refreshBearerToken(ctx)
+	})
+}
+
+func (client *Client) refreshBearerToken(ctx context.Context) error {
+	logger := klog.FromContext(ctx)
+	logger.Info("Refreshing VCD client")
+
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("unable to refresh vcd client: [%v]", err)
+	}
+	if err := client.reloadRefreshToken(ctx); err != nil {
+		return err
+	}
+
+	href := client.apiURL("/api")
+	client.VCDClient.Client.APIVersion = client.apiVersion
+
+	defer client.bindToContext(ctx)()
+
+	logger.V(3).Info("Refreshing bearer token", "sysAdmin", client.VCDAuthConfig.IsSysAdmin)
+	if err := client.authenticateLocked(ctx, href); err != nil {
+		if len(client.hosts) == 1 || !IsHostUnreachableError(err) {
+			return err
+		}
+		vcdClient, err := client.failover(ctx, err)
+		if err != nil {
+			return err
+		}
+		// the requests of the new govcd client are bound to ctx as well until the refresh is done, and the org
+		// and VDC of the old one are resolved again with it
+		client.VCDClient = vcdClient
+		defer client.bindToContext(ctx)()
+		client.invalidateOrgVDC()
+	}
+
+	if err := client.resolveTenantContext(ctx); err != nil {
+		return err
+	}
+
+	// reset legacy client, unless its org and VDC are still cached
+	if err := client.resolveOrgVDC(ctx); err != nil {
+		return err
+	}
+
+	// reset swagger client; swagger calls take their own context so the transport is not bound to ctx
+	client.APIClient = client.newSwaggerClient()
+	client.updateTokenLifetime(logger)
+
+	logger.Info("Successfully refreshed all clients")
+	return nil
+}
+
+// authenticateLocked authenticates the govcd client of the client again with its refresh token or its username and
+// password. The caller should hold client.RWLock.
+func (client *Client) authenticateLocked(ctx context.Context, href string) error {
+	if client.VCDAuthConfig.RefreshToken != "" {
+		userOrg := client.VCDAuthConfig.UserOrg
+		if client.VCDAuthConfig.IsSysAdmin {
+			userOrg = "system"
+		}
+		// Refresh vcd client using refresh token as system org user
+		err := client.retry(ctx, "set token", func() error {
+			return client.VCDClient.SetToken(userOrg, govcd.ApiTokenHeader, client.VCDAuthConfig.RefreshToken)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to refresh VCD client with the refresh token: [%v]", err)
+		}
+	} else if client.VCDAuthConfig.User != "" && client.VCDAuthConfig.Password != "" {
+		// Refresh vcd client using username and password
+		var resp *http.Response
+		err := client.retry(ctx, "authenticate", func() (err error) {
+			resp, err = getAuthResponse(client.VCDClient, client.VCDAuthConfig.User, client.VCDAuthConfig.Password,
+				client.VCDAuthConfig.UserOrg)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("unable to authenticate [%s/%s] for url [%s]: [%+v] : [%v]",
+				client.VCDAuthConfig.UserOrg, client.VCDAuthConfig.User, href, resp, err)
+		}
+	} else {
+		return fmt.Errorf(
+			"unable to find refresh token or secret to refresh vcd client for user [%s/%s] and url [%s]",
+			client.VCDAuthConfig.UserOrg, client.VCDAuthConfig.User, href)
+	}
+
+	return nil
+}
+
+// getVDC returns the VDC of org whose URN or name is vdcName. A name that matches no VDC exactly is matched
+// case-insensitively, and the error of a VDC that cannot be found lists the VDCs of org.
+func (client *Client) getVDC(ctx context.Context, org *govcd.Org, vdcName string) (*govcd.Vdc, error) {
+	var vdc *govcd.Vdc
+	err := client.retry(ctx, "get VDC", func() (err error) {
+		if strings.HasPrefix(vdcName, vdcURNPrefix) {
+			vdc, err = org.GetVDCById(vdcName, true)
+		} else {
+			vdc, err = org.GetVDCByName(vdcName, true)
+		}
+		return err
+	})
+	if err == nil {
+		return vdc, nil
+	}
+	if err != govcd.ErrorEntityNotFound {
+		return nil, err
+	}
+
+	var vdcRecords []*types.QueryResultOrgVdcRecordType
+	err = client.retry(ctx, "list VDCs", func() (err error) {
+		vdcRecords, err = org.QueryOrgVdcList()
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list VDCs to find VDC [%s]: [%v]", vdcName, err)
+	}
+
+	var matches []*types.QueryResultOrgVdcRecordType
+	vdcNames := make([]string, 0, len(vdcRecords))
+	for _, vdcRecord := range vdcRecords {
+		vdcNames = append(vdcNames, vdcRecord.Name)
+		if strings.EqualFold(vdcRecord.Name, vdcName) {
+			matches = append(matches, vdcRecord)
+		}
+	}
+	sort.Strings(vdcNames)
+	if len(matches) != 1 {
+		return nil, fmt.Errorf("found [%d] VDCs with a name or URN matching [%s] among VDCs [%s]: [%w]", len(matches),
+			vdcName, strings.Join(vdcNames, ", "), ErrVDCNotFound)
+	}
+
+	klog.FromContext(ctx).Info("Found VDC by a case-insensitive name", "vdc", vdcName, "name", matches[0].Name)
+	// the admin href returned to a system administrator is not the href of the VDC of an org
+	href := strings.Replace(matches[0].HREF, "/api/admin/", "/api/", 1)
+	err = client.retry(ctx, "get VDC", func() (err error) {
+		vdc, err = org.GetVDCByHref(href)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return vdc, nil
+}
+
+// reloadRefreshToken replaces the refresh token of the client with the content of its refresh token file, if it has
+// one. The caller should hold client.RWLock unless the client is being created.
+func (client *Client) reloadRefreshToken(ctx context.Context) error {
+	if client.refreshTokenFile == "" {
+		return nil
+	}
+
+	refreshToken, err := readRefreshTokenFile(ctx, client.refreshTokenFile)
+	if err != nil {
+		return fmt.Errorf("unable to read refresh token: [%v]", err)
+	}
+	if refreshToken != client.VCDAuthConfig.RefreshToken {
+		klog.FromContext(ctx).Info("Using refresh token read from file", "file", client.refreshTokenFile)
+		client.VCDAuthConfig.RefreshToken = refreshToken
+		// the org and VDC are resolved again with the permissions of the rotated refresh token
+		client.invalidateOrgVDC()
+	}
+
+	return nil
+}
+
+// readRefreshTokenFile returns the refresh token in tokenFile. Rotation replaces the file, hence a file that is
+// absent or empty is read again after a short delay.
+func readRefreshTokenFile(ctx context.Context, tokenFile string) (string, error) {
+	var err error
+	for attempt := 0; attempt < tokenFileReadAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return "", fmt.Errorf("gave up reading [%s]: [%v]: [%v]", tokenFile, ctx.Err(), err)
+			case <-time.After(tokenFileRetryDelay):
+			}
+		}
+
+		var content []byte
+		if content, err = ioutil.ReadFile(tokenFile); err != nil {
+			if !os.IsNotExist(err) {
+				return "", fmt.Errorf("unable to read [%s]: [%v]", tokenFile, err)
+			}
+			continue
+		}
+		if refreshToken := strings.TrimSpace(string(content)); refreshToken != "" {
+			return refreshToken, nil
+		}
+		err = fmt.Errorf("file [%s] is empty", tokenFile)
+	}
+
+	return "", fmt.Errorf("unable to read [%s] after [%d] attempts: [%v]", tokenFile, tokenFileReadAttempts, err)
+}
+
+// tokenLifetime returns the issue and expiry times from the claims of a JWT bearer token
+func tokenLifetime(token string) (time.Time, time.Time, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, time.Time{}, fmt.Errorf("bearer token is not a JWT")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("unable to decode bearer token payload: [%v]", err)
+	}
+
+	claims := struct {
+		IssuedAt  int64 `json:"iat"`
+		ExpiresAt int64 `json:"exp"`
+	}{}
+	if err = json.Unmarshal(payload, &claims); err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("unable to parse bearer token claims: [%v]", err)
+	}
+	if claims.ExpiresAt == 0 {
+		return time.Time{}, time.Time{}, fmt.Errorf("bearer token does not have an expiry claim")
+	}
+
+	return time.Unix(claims.IssuedAt, 0), time.Unix(claims.ExpiresAt, 0), nil
+}
+
+func (client *Client) updateTokenLifetime(logger logr.Logger) {
+	client.reauthLock.Lock()
+	client.reauthToken = ""
+	client.reauthLock.Unlock()
+	atomic.StoreInt32(&client.tokenRejected, 0)
+	atomic.StoreInt32(&client.hostUnreachable, 0)
+	client.refreshedAt = time.Now()
+
+	issuedAt, expiresAt, err := tokenLifetime(client.VCDClient.Client.VCDToken)
+	if err != nil {
+		logger.Info("Unable to get expiry of bearer token; it will not be refreshed proactively", "err", err)
+		client.tokenIssuedAt, client.tokenExpiresAt = time.Now(), time.Time{}
+		return
+	}
+
+	client.tokenIssuedAt, client.tokenExpiresAt = issuedAt, expiresAt
+	logger.Info("Obtained bearer token", "issuedAt", issuedAt, "expiresAt", expiresAt)
+}
+
+// TokenValid returns true if the client has a bearer token that does not expire within the refresh window. A token
+// whose expiry is not known is considered valid.
+func (client *Client) TokenValid() bool {
+	client.RWLock.RLock()
+	defer client.RWLock.RUnlock()
+
+	return client.tokenValid()
+}
+
+func (client *Client) tokenValid() bool {
+	if client.VCDClient == nil || client.VCDClient.Client.VCDToken == "" ||
+		atomic.LoadInt32(&client.tokenRejected) != 0 || atomic.LoadInt32(&client.hostUnreachable) != 0 {
+		return false
+	}
+	if client.tokenExpiresAt.IsZero() {
+		return true
+	}
+
+	return time.Now().Add(tokenRefreshWindow).Before(client.tokenExpiresAt)
+}
+
+// refreshBearerTokenIfExpiring refreshes the bearer token if it is missing or about to expire, so that long running
+// operations do not fail midway with an expired token. The org and VDC are resolved again with a valid token if
+// their cache has expired or was invalidated. The caller should hold client.RWLock.
+func (client *Client) refreshBearerTokenIfExpiring(ctx context.Context) error {
+	if client.tokenValid() {
+		if client.VDC == nil {
+			return nil
+		}
+		return client.resolveOrgVDC(ctx)
+	}
+
+	klog.FromContext(ctx).Info("Bearer token is about to expire; refreshing it", "expiresAt", client.tokenExpiresAt)
+	return client.refreshBearerTokenLocked(ctx)
+}
+
+// CheckConnectivity verifies that VCD is reachable and accepts the credentials of the client by fetching the VDC of
+// the cluster, refreshing the bearer token first if it is about to expire. It gives up once ctx is done.
+func (client *Client) CheckConnectivity(ctx context.Context) error {
+	// the transport of the govcd client is swapped to bind the request to ctx, so readers are excluded
+	client.RWLock.Lock()
+	defer client.RWLock.Unlock()
+
+	if err := client.refreshBearerTokenIfExpiring(ctx); err != nil {
+		return fmt.Errorf("unable to refresh bearer token: [%v]", err)
+	}
+	if client.VDC == nil {
+		return fmt.Errorf("client has no VDC to check connectivity with")
+	}
+
+	defer client.bindToContext(ctx)()
+
+	// the VDC is fetched into a new struct so that the cached VDC is left untouched
+	return observeVCDCall(operationCheckConnectivity, func() error {
+		_, err := client.VCDClient.Client.ExecuteRequest(client.VDC.Vdc.HREF, http.MethodGet, "",
+			"error retrieving VDC: %s", nil, &types.Vdc{})
+		if err = client.invalidateOrgVDCIfNotFound(err); err != nil {
+			return fmt.Errorf("unable to get VDC [%s]: [%v]", client.ClusterOVDCName, err)
+		}
+		return nil
+	})
+}
+
+// GetVDC returns the VDC of the cluster. The VDC is replaced when the bearer token is refreshed.
+func (client *Client) GetVDC() *govcd.Vdc {
+	client.RWLock.RLock()
+	defer client.RWLock.RUnlock()
+
+	return client.VDC
+}
+
+// GetAPIClient returns the swagger client of the cluster. The swagger client is replaced when the bearer token is
+// refreshed.
+func (client *Client) GetAPIClient() *swaggerClient.APIClient {
+	client.RWLock.RLock()
+	defer client.RWLock.RUnlock()
+
+	return client.APIClient
+}
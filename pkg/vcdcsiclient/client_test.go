@@ -0,0 +1,1054 @@
+/*
+   Copyright 2021 VMware, Inc.
+   SPDX-License-Identifier: Apache-2.0
+*/
+
+package vcdcsiclient
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware/cloud-director-named-disk-csi-driver/pkg/vcdtypes"
+	"github.com/vmware/cloud-provider-for-cloud-director/pkg/vcdsdk"
+	"github.com/vmware/go-vcloud-director/v2/govcd"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func getTestJWT(payload string) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	return fmt.Sprintf("%s.%s.signature", header, base64.RawURLEncoding.EncodeToString([]byte(payload)))
+}
+
+// fakeStorageProfiles are the storage profiles of the VDC served by newFakeVCDServer with their limits in MB, where 0
+// is unlimited, and the maximum IOPS of their disks, where 0 is a profile that does not support setting IOPS. The
+// last one has the name of another, which only its URN tells apart.
+var fakeStorageProfiles = []struct {
+	name             string
+	limitMB          int64
+	diskIopsMax      int64
+	diskIopsPerGbMax int64
+}{
+	{"*", 0, 0, 0},
+	{"gold", 10240, 0, 0},
+	{"iops", 0, 1000, 500},
+	{"gold", 0, 0, 0},
+}
+
+// fakeVMs are the VMs of the VDC served by newFakeVCDServer with the names of their vApps
+var fakeVMs = []struct {
+	name     string
+	vAppName string
+}{
+	{"node-1", "cluster"},
+	{"node-2", "moved"},
+	{"node-3", "cluster"},
+	{"node-3", "other-cluster"},
+}
+
+// fakeDetachingDeleteRejections is how many deletes the fake VCD server rejects for a disk that is being detached
+const fakeDetachingDeleteRejections = 1
+
+// fakeBusyCreateRejections is how many creates the fake VCD server rejects as busy for a disk named with the prefix
+// "busy-"
+const fakeBusyCreateRejections = 2
+
+// fakeEncryptionPolicies are the names of the encryption policies of the fake VCD server by their URNs
+var fakeEncryptionPolicies = map[string]string{
+	"urn:vcloud:encryptionPolicy:1": "gold-encryption",
+	"urn:vcloud:encryptionPolicy:2": "silver-encryption",
+}
+
+// newFakeVCDServer serves the VCD endpoints used to authenticate with a username and password and to look up the org
+// and VDC of the cluster. Every login returns a new bearer token and is counted in logins. The VDC contains disks,
+// which can be created, updated and deleted and have metadata set through the disk API, and attached to and detached from the
+// VMs of newFakeVM; changes are stored in disks and their tasks succeed immediately. The disks named with the prefix
+// "detaching-" are still being detached: they have a running task, and their first fakeDetachingDeleteRejections
+// deletes are rejected as busy. The deletes of the disks named with the prefix "stuck-" are always rejected as busy.
+// The first fakeBusyCreateRejections creates of a disk named with the prefix "busy-" are rejected as busy, and the
+// creates of the disks named with the prefix "always-busy-" always are. The disks created with one of the
+// fakeEncryptionPolicies are encrypted.
+func newFakeVCDServer(orgName string, vdcName string, disks ...*vcdtypes.Disk) (server *httptest.Server,
+	logins *int32) {
+
+	logins = new(int32)
+	disksLock := sync.Mutex{}
+	taskOwners := make(map[string]string)
+	var snapshots []*vcdtypes.DiskSnapshot
+	findSnapshot := func(matches func(snapshot *vcdtypes.DiskSnapshot) bool) (*vcdtypes.DiskSnapshot, int) {
+		for idx, snapshot := range snapshots {
+			if snapshot != nil && matches(snapshot) {
+				return snapshot, idx
+			}
+		}
+		return nil, -1
+	}
+	writeForbidden := func(w http.ResponseWriter, entity string) {
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, `<Error majorErrorCode="%d" minorErrorCode="ACCESS_TO_RESOURCE_IS_FORBIDDEN" `+
+			`message="[%s] does not exist"/>`, http.StatusForbidden, entity)
+	}
+	diskMetadata := make(map[string]map[string]string)
+	vmDiskSettings := make(map[string][]*types.DiskSettings)
+	deleteRejections := make(map[string]int)
+	createRejections := make(map[string]int)
+	mux := http.NewServeMux()
+	server = httptest.NewServer(mux)
+	writeXML := func(w http.ResponseWriter, body string) {
+		w.Header().Set("Content-Type", "application/xml")
+		fmt.Fprint(w, body)
+	}
+	// deleted disks leave gaps in the disks, hence their ids are counted separately
+	diskCount := 0
+	addDisk := func(disk *vcdtypes.Disk) {
+		disks = append(disks, disk)
+		diskCount++
+		disk.Id = fmt.Sprintf("urn:vcloud:disk:%d", diskCount)
+		disk.HREF = fmt.Sprintf("%s/api/disk/%d", server.URL, diskCount)
+		disk.Link = []*types.Link{
+			{HREF: disk.HREF, Rel: types.RelEdit, Type: types.MimeDisk},
+			{HREF: disk.HREF, Rel: types.RelRemove},
+			{HREF: disk.HREF + "/attachedVms", Rel: "down", Type: types.MimeVMs},
+			{HREF: server.URL + "/api/vdc/1", Rel: "up", Type: types.MimeVDC},
+		}
+		// VCD does not snapshot the legacy disks
+		if !strings.HasPrefix(disk.Name, "legacy-") {
+			disk.Link = append(disk.Link,
+				&types.Link{HREF: disk.HREF + "/snapshots", Rel: types.RelDown, Type: MimeDiskSnapshots},
+				&types.Link{HREF: disk.HREF + "/snapshots", Rel: types.RelSnapshotCreate,
+					Type: MimeDiskSnapshotCreateParams})
+		}
+	}
+	addTask := func(owner string) string {
+		taskHREF := fmt.Sprintf("%s/api/task/%d", server.URL, len(taskOwners)+1)
+		taskOwners[taskHREF] = owner
+		return taskHREF
+	}
+	initialDisks := disks
+	disks = nil
+	for _, disk := range initialDisks {
+		addDisk(disk)
+	}
+
+	mux.HandleFunc("/api/versions", func(w http.ResponseWriter, r *http.Request) {
+		writeXML(w, fmt.Sprintf(`<SupportedVersions><VersionInfo><Version>%s</Version>`+
+			`<LoginUrl>%s/api/sessions</LoginUrl></VersionInfo></SupportedVersions>`,
+			vcdsdk.VCloudApiVersion, server.URL))
+	})
+	login := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(govcd.BearerTokenHeader, fmt.Sprintf("token-%d", atomic.AddInt32(logins, 1)))
+		fmt.Fprint(w, "{}")
+	}
+	mux.HandleFunc("/cloudapi/1.0.0/sessions", login)
+	// system administrators log in to the provider
+	mux.HandleFunc("/cloudapi/1.0.0/sessions/provider", login)
+	mux.HandleFunc("/cloudapi/1.0.0/sessions/current", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/cloudapi/1.0.0/encryptionPolicies", func(w http.ResponseWriter, r *http.Request) {
+		var values []string
+		for id, name := range fakeEncryptionPolicies {
+			values = append(values, fmt.Sprintf(`{"id":"%s","name":"%s"}`, id, name))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"resultTotal":%d,"pageCount":1,"page":1,"pageSize":128,"values":[%s]}`, len(values),
+			strings.Join(values, ","))
+	})
+	mux.HandleFunc("/api/org", func(w http.ResponseWriter, r *http.Request) {
+		writeXML(w, fmt.Sprintf(`<OrgList><Org href="%s/api/org/1" name="%s"/></OrgList>`, server.URL, orgName))
+	})
+	mux.HandleFunc("/api/org/1", func(w http.ResponseWriter, r *http.Request) {
+		writeXML(w, fmt.Sprintf(`<Org href="%s/api/org/1" id="urn:vcloud:org:1" name="%s"></Org>`,
+			server.URL, orgName))
+	})
+	mux.HandleFunc("/api/query", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("type") == "disk" {
+			disksLock.Lock()
+			defer disksLock.Unlock()
+			writeXML(w, fakeDiskQuery(r.URL, server.URL+"/api/vdc/1", disks))
+			return
+		}
+		if r.URL.Query().Get("type") == types.QtVm {
+			writeXML(w, fakeVMQuery(r.URL, server.URL))
+			return
+		}
+		if !fakeVDCQueryMatches(r.URL, vdcName) {
+			writeXML(w, `<QueryResultRecords total="0" pageSize="25" page="1"></QueryResultRecords>`)
+			return
+		}
+		if r.URL.Query().Get("type") == types.QtAdminOrgVdc {
+			writeXML(w, fmt.Sprintf(`<QueryResultRecords total="1" pageSize="25" page="1">`+
+				`<AdminVdcRecord href="%s/api/admin/vdc/1" name="%s"/></QueryResultRecords>`, server.URL, vdcName))
+			return
+		}
+		writeXML(w, fmt.Sprintf(`<QueryResultRecords total="1" pageSize="25" page="1">`+
+			`<OrgVdcRecord href="%s/api/vdc/1" name="%s"/></QueryResultRecords>`, server.URL, vdcName))
+	})
+	mux.HandleFunc("/api/admin/vdc/1", func(w http.ResponseWriter, r *http.Request) {
+		writeXML(w, fmt.Sprintf(`<AdminVdc href="%s/api/admin/vdc/1" name="%s">`+
+			`<IsThinProvision>true</IsThinProvision></AdminVdc>`, server.URL, vdcName))
+	})
+	mux.HandleFunc("/api/vdc/1", func(w http.ResponseWriter, r *http.Request) {
+		disksLock.Lock()
+		defer disksLock.Unlock()
+		resourceEntities := ""
+		for _, disk := range disks {
+			resourceEntities += fmt.Sprintf(`<ResourceEntity href="%s" id="%s" name="%s" type="%s"/>`,
+				disk.HREF, disk.Id, disk.Name, types.MimeDisk)
+		}
+		storageProfiles := ""
+		for idx, storageProfile := range fakeStorageProfiles {
+			storageProfiles += fmt.Sprintf(`<VdcStorageProfile href="%s/api/vdcStorageProfile/%d" name="%s"/>`,
+				server.URL, idx+1, storageProfile.name)
+		}
+		writeXML(w, fmt.Sprintf(`<Vdc href="%s/api/vdc/1" id="urn:vcloud:vdc:1" name="%s">`+
+			`<Link rel="%s" type="%s" href="%s/api/vdc/1/disk"/><ResourceEntities>%s</ResourceEntities>`+
+			`<VdcStorageProfiles>%s</VdcStorageProfiles></Vdc>`, server.URL, vdcName, types.RelAdd,
+			types.MimeDiskCreateParams, server.URL, resourceEntities, storageProfiles))
+	})
+	mux.HandleFunc("/api/vdc/1/disk", func(w http.ResponseWriter, r *http.Request) {
+		disksLock.Lock()
+		defer disksLock.Unlock()
+		diskCreateParams := &vcdtypes.DiskCreateParams{}
+		if err := xml.NewDecoder(r.Body).Decode(diskCreateParams); err != nil || diskCreateParams.Disk == nil {
+			http.Error(w, fmt.Sprintf("invalid disk create params: [%v]", err), http.StatusBadRequest)
+			return
+		}
+
+		disk := diskCreateParams.Disk
+		if source := diskCreateParams.Source; source != nil {
+			sourceSizeMB := int64(-1)
+			if snapshot, _ := findSnapshot(func(snapshot *vcdtypes.DiskSnapshot) bool {
+				return snapshot.HREF == source.HREF
+			}); snapshot != nil {
+				sourceSizeMB = snapshot.SizeMb
+			}
+			for _, sourceDisk := range disks {
+				if sourceDisk.HREF == source.HREF && len(sourceDisk.AttachedVMs) == 0 {
+					sourceSizeMB = sourceDisk.SizeMb
+				}
+			}
+			if sourceSizeMB < 0 || disk.SizeMb < sourceSizeMB {
+				http.Error(w, fmt.Sprintf("invalid source [%s] of disk of [%d]MB", source.HREF, disk.SizeMb),
+					http.StatusBadRequest)
+				return
+			}
+		}
+		if strings.HasPrefix(disk.Name, "always-busy-") || (strings.HasPrefix(disk.Name, "busy-") &&
+			createRejections[disk.Name] < fakeBusyCreateRejections) {
+			createRejections[disk.Name]++
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `<Error majorErrorCode="%d" minorErrorCode="BUSY_ENTITY" `+
+				`message="The entity Vdc %s is busy completing an operation."/>`, http.StatusBadRequest, vdcName)
+			return
+		}
+		storageProfileHREF := fmt.Sprintf("%s/api/vdcStorageProfile/1", server.URL)
+		if disk.StorageProfile != nil {
+			storageProfileHREF = disk.StorageProfile.HREF
+		}
+		var storageProfileIdx int
+		if _, err := fmt.Sscanf(storageProfileHREF, server.URL+"/api/vdcStorageProfile/%d", &storageProfileIdx); err != nil ||
+			storageProfileIdx < 1 || storageProfileIdx > len(fakeStorageProfiles) {
+			http.Error(w, fmt.Sprintf("invalid storage profile [%s]", storageProfileHREF), http.StatusBadRequest)
+			return
+		}
+		disk.StorageProfile = &types.Reference{HREF: storageProfileHREF,
+			Name: fakeStorageProfiles[storageProfileIdx-1].name}
+		if disk.EncryptionPolicy != nil {
+			name, ok := fakeEncryptionPolicies[disk.EncryptionPolicy.ID]
+			if !ok {
+				http.Error(w, fmt.Sprintf("invalid encryption policy [%s]", disk.EncryptionPolicy.ID),
+					http.StatusBadRequest)
+				return
+			}
+			disk.EncryptionPolicy.Name = name
+			disk.Encrypted = true
+		}
+		addDisk(disk)
+
+		createdDisk := *disk
+		createdDisk.Tasks = &types.TasksInProgress{Task: []*types.Task{{HREF: addTask(disk.HREF), Status: "running"}}}
+		diskBytes, err := xml.Marshal(createdDisk)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		writeXML(w, string(diskBytes))
+	})
+	mux.HandleFunc("/api/vdcStorageProfile/", func(w http.ResponseWriter, r *http.Request) {
+		disksLock.Lock()
+		defer disksLock.Unlock()
+		var storageProfileIdx int
+		if _, err := fmt.Sscanf(r.URL.Path, "/api/vdcStorageProfile/%d", &storageProfileIdx); err != nil ||
+			storageProfileIdx < 1 || storageProfileIdx > len(fakeStorageProfiles) {
+			http.NotFound(w, r)
+			return
+		}
+
+		storageUsedMB := int64(0)
+		for _, disk := range disks {
+			if disk.StorageProfile != nil && disk.StorageProfile.HREF == server.URL+r.URL.Path {
+				storageUsedMB += disk.SizeMb
+			}
+		}
+		storageProfile := fakeStorageProfiles[storageProfileIdx-1]
+		iopsSettings := ""
+		if storageProfile.diskIopsMax > 0 {
+			iopsSettings = fmt.Sprintf(`<IopsSettings><Enabled>true</Enabled><DiskIopsMax>%d</DiskIopsMax>`+
+				`<DiskIopsPerGbMax>%d</DiskIopsPerGbMax></IopsSettings>`,
+				storageProfile.diskIopsMax, storageProfile.diskIopsPerGbMax)
+		}
+		writeXML(w, fmt.Sprintf(`<VdcStorageProfile name="%s"><Enabled>true</Enabled><Units>MB</Units>`+
+			`<Limit>%d</Limit>%s<StorageUsedMB>%d</StorageUsedMB></VdcStorageProfile>`,
+			storageProfile.name, storageProfile.limitMB, iopsSettings, storageUsedMB))
+	})
+	mux.HandleFunc("/api/disk/", func(w http.ResponseWriter, r *http.Request) {
+		disksLock.Lock()
+		defer disksLock.Unlock()
+		diskPath, metadataKey := r.URL.Path, ""
+		if idx := strings.Index(diskPath, "/metadata/"); idx >= 0 {
+			diskPath, metadataKey = diskPath[:idx], diskPath[idx+len("/metadata/"):]
+		}
+		diskPath = strings.TrimSuffix(diskPath, "/attachedVms")
+		diskPath = strings.TrimSuffix(diskPath, "/snapshots")
+		var disk *vcdtypes.Disk
+		for _, currDisk := range disks {
+			if currDisk.HREF == server.URL+diskPath {
+				disk = currDisk
+			}
+		}
+		if disk == nil {
+			// VCD forbids access to the disks that do not exist
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, `<Error majorErrorCode="%d" minorErrorCode="ACCESS_TO_RESOURCE_IS_FORBIDDEN" `+
+				`message="disk [%s] does not exist"/>`, http.StatusForbidden, diskPath)
+			return
+		}
+
+		if r.URL.Path == diskPath+"/attachedVms" {
+			vmReferences := ""
+			for _, vm := range disk.AttachedVMs {
+				vmReferences += fmt.Sprintf(`<VmReference href="%s" name="%s"/>`, vm.HREF, vm.Name)
+			}
+			writeXML(w, fmt.Sprintf(`<Vms>%s</Vms>`, vmReferences))
+			return
+		}
+		if r.URL.Path == diskPath+"/snapshots" {
+			switch r.Method {
+			case http.MethodGet:
+				diskSnapshots := vcdtypes.DiskSnapshots{}
+				for _, snapshot := range snapshots {
+					if snapshot != nil && snapshot.Disk.HREF == disk.HREF {
+						diskSnapshots.DiskSnapshot = append(diskSnapshots.DiskSnapshot, snapshot)
+					}
+				}
+				snapshotsBytes, err := xml.Marshal(diskSnapshots)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				writeXML(w, string(snapshotsBytes))
+			case http.MethodPost:
+				params := &vcdtypes.DiskSnapshotCreateParams{}
+				if err := xml.NewDecoder(r.Body).Decode(params); err != nil || params.Name == "" {
+					http.Error(w, fmt.Sprintf("invalid snapshot create params: [%v]", err), http.StatusBadRequest)
+					return
+				}
+				snapshot := &vcdtypes.DiskSnapshot{
+					HREF:    fmt.Sprintf("%s/api/diskSnapshot/%d", server.URL, len(snapshots)+1),
+					Id:      fmt.Sprintf("%s%d", DiskSnapshotURNPrefix, len(snapshots)+1),
+					Name:    params.Name,
+					SizeMb:  disk.SizeMb,
+					Created: time.Now().UTC().Format(time.RFC3339),
+					Disk:    &types.Reference{HREF: disk.HREF, ID: disk.Id, Name: disk.Name},
+				}
+				snapshot.Link = []*types.Link{{HREF: snapshot.HREF, Rel: types.RelRemove}}
+				snapshots = append(snapshots, snapshot)
+				w.WriteHeader(http.StatusAccepted)
+				writeXML(w, fmt.Sprintf(`<Task href="%s" status="running"/>`, addTask(disk.HREF)))
+			default:
+				w.WriteHeader(http.StatusMethodNotAllowed)
+			}
+			return
+		}
+		if diskPath != r.URL.Path {
+			switch {
+			case r.Method == http.MethodGet && metadataKey == "":
+				entries := ""
+				for key, value := range diskMetadata[disk.HREF] {
+					entries += fmt.Sprintf(`<MetadataEntry><Key>%s</Key><TypedValue><Value>%s</Value>`+
+						`</TypedValue></MetadataEntry>`, key, value)
+				}
+				writeXML(w, fmt.Sprintf(`<Metadata href="%s/metadata/">%s</Metadata>`, disk.HREF, entries))
+			case r.Method == http.MethodPut && metadataKey != "":
+				metadataValue := &types.MetadataValue{}
+				if err := xml.NewDecoder(r.Body).Decode(metadataValue); err != nil || metadataValue.TypedValue == nil {
+					http.Error(w, fmt.Sprintf("invalid metadata value: [%v]", err), http.StatusBadRequest)
+					return
+				}
+				if diskMetadata[disk.HREF] == nil {
+					diskMetadata[disk.HREF] = make(map[string]string)
+				}
+				diskMetadata[disk.HREF][metadataKey] = metadataValue.TypedValue.Value
+				w.WriteHeader(http.StatusAccepted)
+				writeXML(w, fmt.Sprintf(`<Task href="%s" status="running"/>`, addTask(disk.HREF)))
+			default:
+				w.WriteHeader(http.StatusMethodNotAllowed)
+			}
+			return
+		}
+
+		detaching := strings.HasPrefix(disk.Name, "detaching-") &&
+			deleteRejections[disk.HREF] < fakeDetachingDeleteRejections
+		switch r.Method {
+		case http.MethodGet:
+			returnedDisk := *disk
+			if detaching {
+				returnedDisk.Tasks = &types.TasksInProgress{Task: []*types.Task{{HREF: addTask(disk.HREF),
+					Operation: "Detaching Disk", Status: "running"}}}
+			}
+			diskBytes, err := xml.Marshal(returnedDisk)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			writeXML(w, string(diskBytes))
+		case http.MethodPut:
+			newDisk := &vcdtypes.Disk{}
+			if err := xml.NewDecoder(r.Body).Decode(newDisk); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			disk.SizeMb = newDisk.SizeMb
+			w.WriteHeader(http.StatusAccepted)
+			writeXML(w, fmt.Sprintf(`<Task href="%s" status="running"/>`, addTask(disk.HREF)))
+		case http.MethodDelete:
+			if detaching || strings.HasPrefix(disk.Name, "stuck-") {
+				deleteRejections[disk.HREF]++
+				w.Header().Set("Content-Type", "application/xml")
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, `<Error majorErrorCode="%d" minorErrorCode="BUSY_ENTITY" `+
+					`message="The entity Disk %s is busy completing an operation."/>`, http.StatusBadRequest,
+					disk.Name)
+				return
+			}
+			var remainingDisks []*vcdtypes.Disk
+			for _, currDisk := range disks {
+				if currDisk != disk {
+					remainingDisks = append(remainingDisks, currDisk)
+				}
+			}
+			disks = remainingDisks
+			w.WriteHeader(http.StatusAccepted)
+			writeXML(w, fmt.Sprintf(`<Task href="%s" status="running"/>`, addTask(disk.HREF)))
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/api/entity/", func(w http.ResponseWriter, r *http.Request) {
+		disksLock.Lock()
+		defer disksLock.Unlock()
+		urn := strings.TrimPrefix(r.URL.Path, "/api/entity/")
+		snapshot, _ := findSnapshot(func(snapshot *vcdtypes.DiskSnapshot) bool { return snapshot.Id == urn })
+		if snapshot == nil {
+			writeForbidden(w, urn)
+			return
+		}
+		writeXML(w, fmt.Sprintf(`<Entity href="%s" id="%s" name="%s"><Link rel="%s" type="%s" href="%s"/></Entity>`,
+			server.URL+r.URL.Path, urn, snapshot.Name, types.RelAlternate, MimeDiskSnapshot, snapshot.HREF))
+	})
+	mux.HandleFunc("/api/diskSnapshot/", func(w http.ResponseWriter, r *http.Request) {
+		disksLock.Lock()
+		defer disksLock.Unlock()
+		snapshot, idx := findSnapshot(func(snapshot *vcdtypes.DiskSnapshot) bool {
+			return snapshot.HREF == server.URL+r.URL.Path
+		})
+		if snapshot == nil {
+			writeForbidden(w, r.URL.Path)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			snapshotBytes, err := xml.Marshal(snapshot)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			writeXML(w, string(snapshotBytes))
+		case http.MethodDelete:
+			snapshots[idx] = nil
+			w.WriteHeader(http.StatusAccepted)
+			writeXML(w, fmt.Sprintf(`<Task href="%s" status="running"/>`, addTask(snapshot.HREF)))
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/api/vApp/", func(w http.ResponseWriter, r *http.Request) {
+		disksLock.Lock()
+		defer disksLock.Unlock()
+		// the VMs are named after the last element of their HREF
+		if vmName := strings.TrimPrefix(r.URL.Path, "/api/vApp/"); r.Method == http.MethodGet &&
+			!strings.Contains(vmName, "/") {
+			vm := newFakeVM(server, nil, vmName)
+			diskSection := ""
+			for _, diskSettings := range vmDiskSettings[vmName] {
+				diskSection += fmt.Sprintf(`<DiskSettings><UnitNumber>%d</UnitNumber><BusNumber>%d</BusNumber>`+
+					`<AdapterType>%s</AdapterType><Disk href="%s" name="%s"/></DiskSettings>`,
+					diskSettings.UnitNumber, diskSettings.BusNumber, diskSettings.AdapterType,
+					diskSettings.Disk.HREF, diskSettings.Disk.Name)
+			}
+			writeXML(w, fmt.Sprintf(`<Vm href="%s" name="%s"><Link rel="%s" type="%s" href="%s"/>`+
+				`<Link rel="%s" type="%s" href="%s"/><VmSpecSection><DiskSection>%s</DiskSection>`+
+				`</VmSpecSection></Vm>`, vm.VM.HREF, vmName,
+				vm.VM.Link[0].Rel, vm.VM.Link[0].Type, vm.VM.Link[0].HREF,
+				vm.VM.Link[1].Rel, vm.VM.Link[1].Type, vm.VM.Link[1].HREF, diskSection))
+			return
+		}
+		var vmName, action string
+		if _, err := fmt.Sscanf(strings.ReplaceAll(r.URL.Path, "/", " "), " api vApp %s disk action %s",
+			&vmName, &action); err != nil || r.Method != http.MethodPost {
+			http.NotFound(w, r)
+			return
+		}
+		params := &types.DiskAttachOrDetachParams{}
+		if err := xml.NewDecoder(r.Body).Decode(params); err != nil || params.Disk == nil {
+			http.Error(w, fmt.Sprintf("invalid disk attach or detach params: [%v]", err), http.StatusBadRequest)
+			return
+		}
+		var disk *vcdtypes.Disk
+		for _, currDisk := range disks {
+			if currDisk.HREF == params.Disk.HREF {
+				disk = currDisk
+			}
+		}
+		if disk == nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		vmHREF := fmt.Sprintf("%s/api/vApp/%s", server.URL, vmName)
+		var attachedVMs []*types.Reference
+		for _, vm := range disk.AttachedVMs {
+			if vm.HREF != vmHREF {
+				attachedVMs = append(attachedVMs, vm)
+			}
+		}
+		switch action {
+		case "attach":
+			if len(attachedVMs) != len(disk.AttachedVMs) {
+				http.Error(w, "disk is already attached to the VM", http.StatusBadRequest)
+				return
+			}
+			attachedVMs = append(attachedVMs, &types.Reference{HREF: vmHREF, Name: vmName})
+			if params.UnitNumber != nil {
+				diskSettings := &types.DiskSettings{
+					UnitNumber:  *params.UnitNumber,
+					AdapterType: SCSIAdapterTypes[disk.BusSubType],
+					Disk:        &types.Reference{HREF: disk.HREF, Name: disk.Name},
+				}
+				if params.BusNumber != nil {
+					diskSettings.BusNumber = *params.BusNumber
+				}
+				vmDiskSettings[vmName] = append(vmDiskSettings[vmName], diskSettings)
+			}
+		case "detach":
+			if len(attachedVMs) == len(disk.AttachedVMs) {
+				http.Error(w, "disk is not attached to the VM", http.StatusBadRequest)
+				return
+			}
+			var diskSettings []*types.DiskSettings
+			for _, currDiskSettings := range vmDiskSettings[vmName] {
+				if currDiskSettings.Disk.HREF != disk.HREF {
+					diskSettings = append(diskSettings, currDiskSettings)
+				}
+			}
+			vmDiskSettings[vmName] = diskSettings
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		disk.AttachedVMs = attachedVMs
+		w.WriteHeader(http.StatusAccepted)
+		writeXML(w, fmt.Sprintf(`<Task href="%s" status="running"/>`, addTask(disk.HREF)))
+	})
+	mux.HandleFunc("/api/task/", func(w http.ResponseWriter, r *http.Request) {
+		disksLock.Lock()
+		defer disksLock.Unlock()
+		taskHREF := server.URL + r.URL.Path
+		owner, ok := taskOwners[taskHREF]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		writeXML(w, fmt.Sprintf(`<Task href="%s" status="success"><Owner href="%s" type="%s"/></Task>`,
+			taskHREF, owner, types.MimeDisk))
+	})
+
+	return server, logins
+}
+
+// newFakeVM returns a VM named vmName that disks can be attached to and detached from in the fake VCD server. The VM
+// has no govcd client if client is nil.
+func newFakeVM(server *httptest.Server, client *Client, vmName string) *govcd.VM {
+	vm := govcd.NewVM(nil)
+	if client != nil {
+		vm = govcd.NewVM(&client.VCDClient.Client)
+	}
+	vm.VM.Name = vmName
+	vm.VM.HREF = fmt.Sprintf("%s/api/vApp/%s", server.URL, vmName)
+	vm.VM.Link = types.LinkList{
+		{HREF: vm.VM.HREF + "/disk/action/attach", Rel: types.RelDiskAttach, Type: types.MimeDiskAttachOrDetachParams},
+		{HREF: vm.VM.HREF + "/disk/action/detach", Rel: types.RelDiskDetach, Type: types.MimeDiskAttachOrDetachParams},
+	}
+	return vm
+}
+
+// fakeVMQuery returns the records of fakeVMs whose name is the one in the name filter of a VM query
+func fakeVMQuery(queryURL *url.URL, serverURL string) string {
+	filters := ""
+	for _, param := range strings.Split(queryURL.RawQuery, "&") {
+		if strings.HasPrefix(param, "filter=") {
+			filters, _ = url.QueryUnescape(strings.TrimPrefix(param, "filter="))
+		}
+	}
+	name := ""
+	for _, filter := range strings.Split(filters, ";") {
+		if strings.HasPrefix(filter, "name==") {
+			name, _ = url.QueryUnescape(strings.TrimPrefix(filter, "name=="))
+		}
+	}
+
+	records, total := "", 0
+	for _, vm := range fakeVMs {
+		if vm.name == name {
+			records += fmt.Sprintf(`<VMRecord href="%s/api/vApp/%s" name="%s" containerName="%s"/>`,
+				serverURL, vm.name, vm.name, vm.vAppName)
+			total++
+		}
+	}
+	return fmt.Sprintf(`<QueryResultRecords total="%d" pageSize="25" page="1">%s</QueryResultRecords>`,
+		total, records)
+}
+
+// fakeDiskQuery returns the records of the disks of the VDC vdcHREF that match the name prefix filter of a disk query,
+// sorted by name and paged as requested
+// fakeVDCQueryMatches returns true if the only VDC of the fake VCD, vdcName with the URN urn:vcloud:vdc:1, matches
+// the name and id filters of the VDC query queryURL
+func fakeVDCQueryMatches(queryURL *url.URL, vdcName string) bool {
+	for _, param := range strings.Split(queryURL.RawQuery, "&") {
+		if !strings.HasPrefix(param, "filter=") {
+			continue
+		}
+		filters, _ := url.QueryUnescape(strings.TrimPrefix(param, "filter="))
+		for _, filter := range strings.Split(filters, ";") {
+			idx := strings.Index(filter, "==")
+			if idx < 0 {
+				continue
+			}
+			value, _ := url.QueryUnescape(filter[idx+2:])
+			if (filter[:idx] == "name" && value != vdcName) || (filter[:idx] == "id" && value != "urn:vcloud:vdc:1") {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+func fakeDiskQuery(queryURL *url.URL, vdcHREF string, disks []*vcdtypes.Disk) string {
+	// url.ParseQuery drops the filter since it is separated by semicolons
+	query := queryURL.Query()
+	filters := ""
+	for _, param := range strings.Split(queryURL.RawQuery, "&") {
+		if strings.HasPrefix(param, "filter=") {
+			filters, _ = url.QueryUnescape(strings.TrimPrefix(param, "filter="))
+		}
+	}
+
+	namePrefix, vdcFilter := "", ""
+	for _, filter := range strings.Split(filters, ";") {
+		if strings.HasPrefix(filter, "name==") {
+			namePrefix = strings.TrimSuffix(strings.TrimPrefix(filter, "name=="), "*")
+		} else if strings.HasPrefix(filter, "vdc==") {
+			vdcFilter = strings.TrimPrefix(filter, "vdc==")
+		}
+	}
+
+	var matchingDisks []*vcdtypes.Disk
+	for _, disk := range disks {
+		if strings.HasPrefix(disk.Name, namePrefix) && vdcFilter == vdcHREF {
+			matchingDisks = append(matchingDisks, disk)
+		}
+	}
+	sort.Slice(matchingDisks, func(i, j int) bool { return matchingDisks[i].Name < matchingDisks[j].Name })
+
+	page, _ := strconv.Atoi(query.Get("page"))
+	pageSize, _ := strconv.Atoi(query.Get("pageSize"))
+	records := ""
+	for idx := (page - 1) * pageSize; idx < page*pageSize && idx < len(matchingDisks); idx++ {
+		records += fmt.Sprintf(`<DiskRecord href="%s" name="%s" sizeMb="%d"/>`, matchingDisks[idx].HREF,
+			matchingDisks[idx].Name, matchingDisks[idx].SizeMb)
+	}
+	return fmt.Sprintf(`<QueryResultRecords total="%d" pageSize="%d" page="%d">%s</QueryResultRecords>`,
+		len(matchingDisks), pageSize, page, records)
+}
+
+func TestTokenLifetime(t *testing.T) {
+	issuedAt, expiresAt, err := tokenLifetime(getTestJWT(`{"iat":1600000000,"exp":1600003600}`))
+	assert.NoError(t, err, "lifetime of a JWT with iat and exp claims should be parsed")
+	assert.Equal(t, time.Unix(1600000000, 0), issuedAt, "issue time should match iat claim")
+	assert.Equal(t, time.Unix(1600003600, 0), expiresAt, "expiry time should match exp claim")
+
+	_, _, err = tokenLifetime(getTestJWT(`{"iat":1600000000}`))
+	assert.Error(t, err, "a JWT without an exp claim should not be accepted")
+
+	_, _, err = tokenLifetime("opaque-token")
+	assert.Error(t, err, "a token that is not a JWT should not be accepted")
+}
+
+func TestTokenValid(t *testing.T) {
+	client := &Client{
+		Client: &vcdsdk.Client{
+			VCDClient: &govcd.VCDClient{},
+		},
+	}
+	assert.False(t, client.TokenValid(), "client without a token should not have a valid token")
+
+	client.VCDClient.Client.VCDToken = "opaque-token"
+	assert.True(t, client.TokenValid(), "token with unknown expiry should be considered valid")
+
+	client.tokenExpiresAt = time.Now().Add(tokenRefreshWindow / 2)
+	assert.False(t, client.TokenValid(), "token expiring within the refresh window should not be valid")
+
+	client.tokenExpiresAt = time.Now().Add(2 * tokenRefreshWindow)
+	assert.True(t, client.TokenValid(), "token expiring after the refresh window should be valid")
+}
+
+func TestNewHTTPTransport(t *testing.T) {
+	client := &Client{
+		Client: &vcdsdk.Client{
+			VCDAuthConfig: &vcdsdk.VCDAuthConfig{Insecure: true},
+		},
+	}
+	transport, err := client.newHTTPTransport()
+	assert.NoError(t, err, "transport without a CA certificate should be created")
+	assert.True(t, transport.TLSClientConfig.InsecureSkipVerify, "insecure transport should skip verification")
+
+	assert.NoError(t, WithProxyURL("http://proxy.example.com:3128")(client), "valid proxy url should be accepted")
+	transport, err = client.newHTTPTransport()
+	assert.NoError(t, err, "transport with a proxy should be created")
+	proxyURL, err := transport.Proxy(&http.Request{URL: &url.URL{Scheme: "https", Host: "vcd.example.com"}})
+	assert.NoError(t, err, "proxy of the transport should be obtained")
+	assert.Equal(t, "proxy.example.com:3128", proxyURL.Host, "explicit proxy url should be used")
+	assert.Error(t, WithProxyURL("proxy.example.com")(client), "proxy url without a scheme should not be accepted")
+
+	client.caCert = []byte("not a certificate")
+	_, err = client.newHTTPTransport()
+	assert.Error(t, err, "a CA certificate should not be accepted with an insecure connection")
+
+	client.VCDAuthConfig.Insecure = false
+	_, err = client.newHTTPTransport()
+	assert.Error(t, err, "a CA certificate that is not PEM encoded should not be accepted")
+}
+
+func TestValidateClientParams(t *testing.T) {
+	assert.NoError(t, validateClientParams("https://vcd.example.com", "org", "vdc", "user", "password", "", true),
+		"parameters with user and password should be valid")
+	assert.NoError(t, validateClientParams("https://vcd.example.com", "org", "", "", "", "token", false),
+		"parameters with refresh token and without vdc should be valid when the vdc is not needed")
+
+	for _, testCase := range []struct {
+		name         string
+		host         string
+		orgName      string
+		vdcName      string
+		user         string
+		password     string
+		refreshToken string
+		field        string
+	}{
+		{"empty host", "", "org", "vdc", "user", "password", "", "host"},
+		{"host without scheme", "vcd.example.com", "org", "vdc", "user", "password", "", "host"},
+		{"host with other scheme", "ftp://vcd.example.com", "org", "vdc", "user", "password", "", "host"},
+		{"host with path", "https://vcd.example.com/tenant/org", "org", "vdc", "user", "password", "", "host"},
+		{"host with query", "https://vcd.example.com?org=org", "org", "vdc", "user", "password", "", "host"},
+		{"unbracketed IPv6 host", "https://2001:db8::1", "org", "vdc", "user", "password", "", "host"},
+		{"empty org", "https://vcd.example.com", "", "vdc", "user", "password", "", "org"},
+		{"empty vdc", "https://vcd.example.com", "org", "", "user", "password", "", "vdc"},
+		{"no credentials", "https://vcd.example.com", "org", "vdc", "", "", "", "user"},
+		{"user without password", "https://vcd.example.com", "org", "vdc", "user", "", "", "password"},
+	} {
+		err := validateClientParams(testCase.host, testCase.orgName, testCase.vdcName, testCase.user,
+			testCase.password, testCase.refreshToken, true)
+		if assert.Error(t, err, "parameters with %s should be invalid", testCase.name) {
+			assert.Contains(t, err.Error(), testCase.field, "error for %s should name the field", testCase.name)
+		}
+	}
+}
+
+func TestParseHostURL(t *testing.T) {
+	for host, expectedAPIURL := range map[string]string{
+		"https://vcd.example.com":      "https://vcd.example.com/api",
+		"https://vcd.example.com/":     "https://vcd.example.com/api",
+		"https://vcd.example.com:8443": "https://vcd.example.com:8443/api",
+		"https://192.0.2.10:8443":      "https://192.0.2.10:8443/api",
+		"https://[2001:db8::1]":        "https://[2001:db8::1]/api",
+		"https://[2001:db8::1]:8443/":  "https://[2001:db8::1]:8443/api",
+		"http://[fe80::1%25eth0]:8080": "http://[fe80::1%25eth0]:8080/api",
+	} {
+		hostURL, err := parseHostURL(host)
+		require.NoError(t, err, "host [%s] should be parsed", host)
+		client := &Client{hosts: []*url.URL{hostURL}}
+		assert.Equal(t, expectedAPIURL, client.apiURL("/api"), "unexpected API url of host [%s]", host)
+		assert.Equal(t, strings.TrimSuffix(expectedAPIURL, "/api")+"/cloudapi", client.apiURL("/cloudapi"),
+			"unexpected cloud API url of host [%s]", host)
+	}
+}
+
+func TestRefreshBearerTokenConcurrentReaders(t *testing.T) {
+	server, _ := newFakeVCDServer("org", "vdc")
+	defer server.Close()
+
+	client, err := NewVCDClientFromSecrets(server.URL, "org", "vdc", "org", "user", "password", "",
+		true, true)
+	require.NoError(t, err, "client should be created against the fake VCD")
+	defer EvictClient(client)
+
+	stop := make(chan struct{})
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				assert.NotNil(t, client.GetVDC(), "VDC should not be nil during a refresh")
+				assert.NotNil(t, client.GetAPIClient(), "swagger client should not be nil during a refresh")
+				client.TokenValid()
+			}
+		}()
+	}
+
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, client.RefreshBearerToken(), "refresh should succeed against the fake VCD")
+	}
+	close(stop)
+	wg.Wait()
+
+	assert.Equal(t, "token-6", client.VCDClient.Client.VCDToken, "each refresh should obtain a new token")
+}
+
+func TestNewVCDClientFromSecretsConcurrentCallers(t *testing.T) {
+	server, logins := newFakeVCDServer("org", "vdc")
+	defer server.Close()
+
+	const callers = 10
+	clients := make([]*Client, callers)
+	errs := make([]error, callers)
+	wg := sync.WaitGroup{}
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			clients[i], errs[i] = NewVCDClientFromSecrets(server.URL, "org", "vdc", "org", "user", "password", "",
+				true, true)
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < callers; i++ {
+		require.NoError(t, errs[i], "client should be created against the fake VCD")
+		assert.Same(t, clients[0], clients[i], "concurrent callers should receive the same client")
+	}
+	defer EvictClient(clients[0])
+	assert.Equal(t, int32(1), atomic.LoadInt32(logins), "concurrent callers should authenticate once")
+
+	client, err := NewVCDClientFromSecrets(server.URL, "org", "vdc", "org", "user", "password", "", true, true)
+	require.NoError(t, err, "cached client should be returned")
+	assert.Same(t, clients[0], client, "later callers should receive the cached client")
+	assert.Equal(t, int32(1), atomic.LoadInt32(logins), "cached client should not authenticate again")
+}
+
+func TestNewVCDClientForVDC(t *testing.T) {
+	server, logins := newFakeVCDServer("org", "vdc")
+	defer server.Close()
+
+	client, err := NewVCDClientFromSecrets(server.URL, "org", "vdc", "org", "user", "password", "", true, true,
+		WithHTTPTimeout(5*time.Second))
+	require.NoError(t, err, "client should be created against the fake VCD")
+	defer EvictClient(client)
+
+	sameClient, err := client.NewVCDClientForVDC("vdc")
+	require.NoError(t, err, "client for its own VDC should be returned")
+	assert.Same(t, client, sameClient, "client should be returned for its own VDC")
+
+	// the fake VCD has a single VDC, which a name of another case finds as another VDC
+	vdcClient, err := client.NewVCDClientForVDC("VDC")
+	require.NoError(t, err, "client for another VDC should be created")
+	defer EvictClient(vdcClient)
+	assert.NotSame(t, client, vdcClient, "another VDC should have its own client")
+	assert.Equal(t, "VDC", vdcClient.ClusterOVDCName, "client should be for the requested VDC")
+	assert.Equal(t, 5*time.Second, vdcClient.httpTimeout, "options of the client should be applied")
+	assert.NotNil(t, vdcClient.GetVDC(), "client for another VDC should get its VDC")
+	assert.Equal(t, int32(2), atomic.LoadInt32(logins), "client for another VDC should authenticate")
+
+	cachedClient, err := client.NewVCDClientForVDC("VDC")
+	require.NoError(t, err, "cached client for another VDC should be returned")
+	assert.Same(t, vdcClient, cachedClient, "client for another VDC should be cached")
+
+	_, err = client.NewVCDClientForVDC("")
+	assert.Error(t, err, "empty VDC name should be refused")
+
+	_, err = client.NewVCDClientForVDC("missing-vdc")
+	assert.ErrorIs(t, err, ErrVDCNotFound, "VDC that does not exist should not be found")
+}
+
+func TestGetVDCByNameOrURN(t *testing.T) {
+	server, _ := newFakeVCDServer("org", "vdc")
+	defer server.Close()
+
+	for _, vdcName := range []string{"vdc", "VDC", "urn:vcloud:vdc:1"} {
+		client, err := NewVCDClientFromSecrets(server.URL, "org", vdcName, "org", "user", "password", "", true, true)
+		require.NoError(t, err, "client should find VDC [%s]", vdcName)
+		assert.Equal(t, "vdc", client.GetVDC().Vdc.Name, "VDC [%s] should be found", vdcName)
+		require.NoError(t, client.RefreshBearerToken(), "refresh should find VDC [%s]", vdcName)
+		assert.Equal(t, "vdc", client.GetVDC().Vdc.Name, "VDC [%s] should be found on refresh", vdcName)
+		EvictClient(client)
+	}
+
+	for _, vdcName := range []string{"other-vdc", "urn:vcloud:vdc:2"} {
+		_, err := NewVCDClientFromSecrets(server.URL, "org", vdcName, "org", "user", "password", "", true, true)
+		require.Error(t, err, "missing VDC [%s] should not be found", vdcName)
+		assert.Contains(t, err.Error(), "among VDCs [vdc]", "error should list the VDCs of the org")
+	}
+}
+
+// countingRoundTripper counts the requests that it sends through http.DefaultTransport
+type countingRoundTripper struct {
+	requests int32
+}
+
+func (rt *countingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&rt.requests, 1)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestWithHTTPTransport(t *testing.T) {
+	server, _ := newFakeVCDServer("org", "vdc")
+	defer server.Close()
+
+	transport := &countingRoundTripper{}
+	client, err := NewVCDClientFromSecrets(server.URL, "org", "vdc", "org", "user", "password", "", true, true,
+		WithHTTPTransport(transport))
+	require.NoError(t, err, "client with a custom transport should be created against the fake VCD")
+	defer EvictClient(client)
+	assert.Same(t, transport, client.transport, "custom transport should be used")
+
+	requests := atomic.LoadInt32(&transport.requests)
+	assert.Greater(t, requests, int32(0), "requests to authenticate should be sent through the custom transport")
+	assert.NoError(t, client.CheckConnectivity(context.Background()), "fake VCD should be reachable")
+	assert.Greater(t, atomic.LoadInt32(&transport.requests), requests,
+		"requests of the client should be sent through the custom transport")
+
+	assert.Error(t, WithHTTPTransport(nil)(&Client{}), "nil transport should not be accepted")
+	_, err = NewVCDClientFromSecrets(server.URL, "org", "other-vdc", "org", "user", "password", "", false, true,
+		WithHTTPTransport(transport), WithProxyURL("http://proxy.example.com:3128"))
+	assert.Error(t, err, "custom transport should not be accepted with a proxy url")
+}
+
+func TestCheckConnectivity(t *testing.T) {
+	server, _ := newFakeVCDServer("org", "vdc")
+
+	client, err := NewVCDClientFromSecrets(server.URL, "org", "vdc", "org", "user", "password", "", true, true,
+		WithHTTPTimeout(time.Second))
+	require.NoError(t, err, "client should be created against the fake VCD")
+	defer EvictClient(client)
+
+	assert.NoError(t, client.CheckConnectivity(context.Background()), "fake VCD should be reachable")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Error(t, client.CheckConnectivity(ctx), "check should give up once its context is done")
+
+	server.Close()
+	assert.Error(t, client.CheckConnectivity(context.Background()), "closed VCD should not be reachable")
+}
+
+func TestReadRefreshTokenFile(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "refreshToken")
+
+	require.NoError(t, ioutil.WriteFile(tokenFile, []byte("token-1\n"), 0600), "token file should be written")
+	refreshToken, err := readRefreshTokenFile(context.Background(), tokenFile)
+	require.NoError(t, err, "token file should be read")
+	assert.Equal(t, "token-1", refreshToken, "token should be read without its trailing newline")
+
+	// rotation removes the file before the new token is written
+	require.NoError(t, os.Remove(tokenFile), "token file should be removed")
+	go func() {
+		time.Sleep(tokenFileRetryDelay / 2)
+		ioutil.WriteFile(tokenFile, []byte("token-2"), 0600)
+	}()
+	refreshToken, err = readRefreshTokenFile(context.Background(), tokenFile)
+	require.NoError(t, err, "token file should be read once it is rotated")
+	assert.Equal(t, "token-2", refreshToken, "rotated token should be read")
+
+	require.NoError(t, ioutil.WriteFile(tokenFile, nil, 0600), "token file should be emptied")
+	_, err = readRefreshTokenFile(context.Background(), tokenFile)
+	assert.Error(t, err, "empty token file should not be read")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = readRefreshTokenFile(ctx, filepath.Join(t.TempDir(), "missing"))
+	assert.Error(t, err, "missing token file should not be read")
+}
+
+func TestClientClose(t *testing.T) {
+	server, _ := newFakeVCDServer("org", "vdc")
+	defer server.Close()
+
+	transport := &headerRecordingRoundTripper{tenantContexts: make(map[string]string)}
+	client, err := NewVCDClientFromSecrets(server.URL, "org", "vdc", "org", "user", "password", "", true, true,
+		WithHTTPTransport(transport))
+	require.NoError(t, err, "client should be created against the fake VCD")
+
+	require.NoError(t, client.Close(), "client should be closed")
+	_, ok := transport.tenantContext(http.MethodDelete + " /cloudapi/1.0.0/sessions/current")
+	assert.True(t, ok, "session of the client should be logged out")
+	assert.Empty(t, client.VCDClient.Client.VCDToken, "bearer token of a closed client should be cleared")
+	assert.NoError(t, client.Close(), "closing a closed client should succeed")
+
+	newClient, err := NewVCDClientFromSecrets(server.URL, "org", "vdc", "org", "user", "password", "", true, true)
+	require.NoError(t, err, "client should be created again")
+	defer EvictClient(newClient)
+	assert.NotSame(t, client, newClient, "closed client should be removed from the cache")
+	assert.NoError(t, CloseClients(), "cached clients should be closed")
+	assert.Empty(t, newClient.VCDClient.Client.VCDToken, "bearer tokens of the cached clients should be cleared")
+}
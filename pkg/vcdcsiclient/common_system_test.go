@@ -8,7 +8,6 @@ package vcdcsiclient
 import (
 	"fmt"
 	"github.com/vmware/cloud-director-named-disk-csi-driver/pkg/config"
-	"github.com/vmware/cloud-provider-for-cloud-director/pkg/vcdsdk"
 	"os"
 	"path/filepath"
 )
@@ -70,7 +69,7 @@ func getBoolValStrict(val interface{}, defaultVal bool) bool {
 	return defaultVal
 }
 
-func getTestVCDClient(config *config.CloudConfig, inputMap map[string]interface{}) (*vcdsdk.Client, error) {
+func getTestVCDClient(config *config.CloudConfig, inputMap map[string]interface{}) (*Client, error) {
 	cloudConfig := *config // Make a copy of cloudConfig so modified inputs don't carry over to next test
 	insecure := true
 	getVdcClient := false
@@ -99,7 +98,7 @@ func getTestVCDClient(config *config.CloudConfig, inputMap map[string]interface{
 		}
 	}
 
-	return vcdsdk.NewVCDClientFromSecrets(
+	return NewVCDClientFromSecrets(
 		cloudConfig.VCD.Host,
 		cloudConfig.VCD.Org,
 		cloudConfig.VCD.VDC,
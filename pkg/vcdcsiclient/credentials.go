@@ -0,0 +1,98 @@
+/*
+   Copyright 2021 VMware, Inc.
+   SPDX-License-Identifier: Apache-2.0
+*/
+
+package vcdcsiclient
+
+import (
+	"context"
+	"fmt"
+	"github.com/vmware/cloud-provider-for-cloud-director/pkg/vcdsdk"
+	"k8s.io/klog/v2"
+)
+
+// UpdateCredentials authenticates the client and the cached clients of the other VDCs of its org and user with new
+// credentials, e.g. once the secret that they were read from is rotated. The disk managers keep their clients, so the
+// clients are updated in place rather than created again, and the cache entries of the clients are moved to the new
+// user. A client keeps its last good credentials if it cannot authenticate with the new ones; the error of the client
+// itself is returned, and those of the clients of other VDCs are logged.
+func (client *Client) UpdateCredentials(ctx context.Context, userOrg string, user string, password string,
+	refreshToken string) error {
+
+	oldKey := client.cacheKey
+	if err := validateClientParams(oldKey.host, oldKey.orgName, oldKey.vdcName, user, password, refreshToken,
+		false); err != nil {
+		return fmt.Errorf("invalid credentials for VCD client: [%v]", err)
+	}
+	if err := client.updateCredentials(ctx, userOrg, user, password, refreshToken); err != nil {
+		return err
+	}
+
+	clientCreatorLock.Lock()
+	var vdcClients []*Client
+	for key, cachedClient := range clientCache {
+		if cachedClient != client && key.host == oldKey.host && key.orgName == oldKey.orgName &&
+			key.userOrg == oldKey.userOrg && key.user == oldKey.user {
+			vdcClients = append(vdcClients, cachedClient)
+		}
+	}
+	clientCreatorLock.Unlock()
+
+	logger := klog.FromContext(ctx)
+	for _, vdcClient := range vdcClients {
+		if err := vdcClient.updateCredentials(ctx, userOrg, user, password, refreshToken); err != nil {
+			logger.Error(err, "Unable to update credentials of VCD client of VDC", "vdc", vdcClient.ClusterOVDCName)
+		}
+	}
+
+	return nil
+}
+
+// updateCredentials authenticates the client with new credentials, restoring the old ones if it cannot, and moves
+// the cache entry of the client to the new user
+func (client *Client) updateCredentials(ctx context.Context, userOrg string, user string, password string,
+	refreshToken string) error {
+
+	key := client.cacheKey
+	newUserOrg, newUsername, err := vcdsdk.GetUserAndOrg(user, key.orgName, userOrg)
+	if err != nil {
+		return fmt.Errorf("error parsing username of new credentials: [%v]", err)
+	}
+
+	client.RWLock.Lock()
+	authConfig := client.VCDAuthConfig
+	oldAuthConfig := *authConfig
+	authConfig.UserOrg, authConfig.User = newUserOrg, newUsername
+	authConfig.Password, authConfig.RefreshToken = password, refreshToken
+	// the org and VDC are resolved again with the permissions of the new user
+	client.invalidateOrgVDC()
+	if err = client.refreshBearerTokenLocked(ctx); err != nil {
+		// the bearer token may be of the new user if only its org or VDC could not be resolved
+		*authConfig = oldAuthConfig
+		client.invalidateOrgVDC()
+		if restoreErr := client.refreshBearerTokenLocked(ctx); restoreErr != nil {
+			klog.FromContext(ctx).Error(restoreErr, "Unable to authenticate VCD client with its old credentials",
+				"org", key.orgName, "vdc", key.vdcName)
+		}
+		client.RWLock.Unlock()
+		return fmt.Errorf("unable to authenticate VCD client of org [%s], VDC [%s] with new credentials of user "+
+			"[%s/%s]; keeping credentials of user [%s/%s]: [%v]", key.orgName, key.vdcName, newUserOrg, newUsername,
+			oldAuthConfig.UserOrg, oldAuthConfig.User, err)
+	}
+	client.RWLock.Unlock()
+
+	clientCreatorLock.Lock()
+	defer clientCreatorLock.Unlock()
+
+	if cachedClient, ok := clientCache[key]; ok && cachedClient == client {
+		delete(clientCache, key)
+	}
+	key.userOrg, key.user = userOrg, user
+	client.cacheKey = key
+	clientCache[key] = client
+
+	klog.FromContext(ctx).Info("Updated credentials of VCD client", "host", key.host, "org", key.orgName,
+		"vdc", key.vdcName, "user", user)
+	return nil
+}
@@ -0,0 +1,66 @@
+/*
+   Copyright 2021 VMware, Inc.
+   SPDX-License-Identifier: Apache-2.0
+*/
+
+package vcdcsiclient
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// passwordRejectingRoundTripper rejects the logins with the password rejectedPassword and sends the other requests
+// through http.DefaultTransport
+type passwordRejectingRoundTripper struct {
+	rejectedPassword string
+}
+
+func (rt *passwordRejectingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if _, password, ok := req.BasicAuth(); ok && password == rt.rejectedPassword {
+		return &http.Response{
+			StatusCode: http.StatusUnauthorized,
+			Status:     "401 Unauthorized",
+			Body:       ioutil.NopCloser(strings.NewReader("")),
+			Header:     make(http.Header),
+			Request:    req,
+		}, nil
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestUpdateCredentials(t *testing.T) {
+	server, logins := newFakeVCDServer("org", "vdc")
+	defer server.Close()
+
+	client, err := NewVCDClientFromSecrets(server.URL, "org", "vdc", "org", "user", "password", "", true, true,
+		WithHTTPTransport(&passwordRejectingRoundTripper{rejectedPassword: "rejected"}))
+	require.NoError(t, err, "client should be created against the fake VCD")
+	defer EvictClient(client)
+	loginsBefore := *logins
+
+	ctx := context.Background()
+	require.NoError(t, client.UpdateCredentials(ctx, "org", "user-2", "password-2", ""),
+		"credentials should be updated")
+	assert.Equal(t, loginsBefore+1, *logins, "client should authenticate with the new credentials")
+	assert.Equal(t, "user-2", client.VCDAuthConfig.User, "client should use the new user")
+	assert.Equal(t, "password-2", client.VCDAuthConfig.Password, "client should use the new password")
+	cachedClient, err := NewVCDClientFromSecrets(server.URL, "org", "vdc", "org", "user-2", "password-2", "", true,
+		true)
+	require.NoError(t, err, "client should be returned for the new credentials")
+	assert.Same(t, client, cachedClient, "client should be cached for the new credentials")
+
+	assert.Error(t, client.UpdateCredentials(ctx, "org", "user-2", "rejected", ""),
+		"credentials rejected by VCD should not be used")
+	assert.Equal(t, "password-2", client.VCDAuthConfig.Password, "client should keep the last good password")
+	assert.NoError(t, client.CheckConnectivity(ctx), "client should keep working with the last good credentials")
+
+	assert.Error(t, client.UpdateCredentials(ctx, "org", "user-2", "", ""),
+		"credentials without a password or refresh token should not be used")
+	assert.Equal(t, "password-2", client.VCDAuthConfig.Password, "client should keep the last good password")
+}
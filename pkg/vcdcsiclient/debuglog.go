@@ -0,0 +1,148 @@
+/*
+   Copyright 2021 VMware, Inc.
+   SPDX-License-Identifier: Apache-2.0
+*/
+
+package vcdcsiclient
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"k8s.io/klog/v2"
+	"net/http"
+	"net/url"
+	"regexp"
+	"time"
+)
+
+const (
+	// debugLogLevel is the verbosity at which the requests to VCD and the responses of VCD are logged with their
+	// bodies
+	debugLogLevel = 6
+	// defaultDebugLogMaxBodyBytes is the length that the logged bodies are truncated to by default
+	defaultDebugLogMaxBodyBytes = 4096
+	// redactedCredential replaces the values of the credentials in the logged URLs and bodies
+	redactedCredential = "***redacted***"
+)
+
+// credentialFragment matches the names of the fields of the bodies and the parameters of the URLs whose values are
+// credentials, such as the refresh token of an OAuth request or the access token of its response
+const credentialFragment = `[\w.:-]*(?i:password|token|secret)[\w.:-]*`
+
+var (
+	// jsonCredentialRegex matches a JSON field that is a credential and the opening quote of its value
+	jsonCredentialRegex = regexp.MustCompile(`("` + credentialFragment + `"\s*:\s*)"(?:[^"\\]|\\.)*"`)
+	// formCredentialRegex matches a form or query parameter that is a credential
+	formCredentialRegex = regexp.MustCompile(`((?:^|&)` + credentialFragment + `=)[^&]*`)
+	// xmlAttributeCredentialRegex matches an XML attribute that is a credential
+	xmlAttributeCredentialRegex = regexp.MustCompile(`(\s` + credentialFragment + `\s*=\s*)"[^"]*"`)
+	// xmlElementCredentialRegex matches the text of an XML element that is a credential
+	xmlElementCredentialRegex = regexp.MustCompile(`(<` + credentialFragment + `(?:\s[^>]*)?>)[^<]*`)
+)
+
+// debugLogRoundTripper logs the requests to VCD with their bodies, and the responses of VCD with their status,
+// duration and bodies, when the verbosity of the log is at least debugLogLevel. The credentials in the URLs and the
+// bodies are redacted, the headers, which carry the bearer token, are not logged, and the bodies are truncated to
+// maxBodyBytes.
+type debugLogRoundTripper struct {
+	maxBodyBytes int
+	next         http.RoundTripper
+}
+
+func (rt *debugLogRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	logger := klog.FromContext(req.Context()).V(debugLogLevel)
+	if !logger.Enabled() {
+		return rt.next.RoundTrip(req)
+	}
+
+	peekedReq, requestBody, err := peekRequestBody(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read body of request [%s %s] to log it: [%v]", req.Method,
+			redactURL(req.URL), err)
+	}
+	req = peekedReq
+	logger.Info("VCD request", "method", req.Method, "url", redactURL(req.URL),
+		"body", rt.logBody(requestBody))
+
+	start := time.Now()
+	resp, err := rt.next.RoundTrip(req)
+	if err != nil {
+		logger.Info("VCD request failed", "method", req.Method, "url", redactURL(req.URL),
+			"duration", time.Since(start), "error", err.Error())
+		return resp, err
+	}
+
+	responseBody, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read body of response of [%s %s] to log it: [%v]", req.Method,
+			redactURL(req.URL), err)
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(responseBody))
+	logger.Info("VCD response", "method", req.Method, "url", redactURL(req.URL), "status", resp.Status,
+		"duration", time.Since(start), "body", rt.logBody(responseBody))
+
+	return resp, nil
+}
+
+// logBody returns body with its credentials redacted, truncated to maxBodyBytes
+func (rt *debugLogRoundTripper) logBody(body []byte) string {
+	redacted := redactCredentials(string(body))
+	if rt.maxBodyBytes > 0 && len(redacted) > rt.maxBodyBytes {
+		return fmt.Sprintf("%s... [%d more bytes]", redacted[:rt.maxBodyBytes], len(redacted)-rt.maxBodyBytes)
+	}
+
+	return redacted
+}
+
+// peekRequestBody returns the request to send instead of req and the body of req, without consuming the body. A body
+// that cannot be obtained again is read, and a copy of req with a copy of the body is returned. req is returned as is
+// with the error if the body cannot be read.
+func peekRequestBody(req *http.Request) (*http.Request, []byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req, nil, nil
+	}
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return req, nil, err
+		}
+		defer body.Close()
+		bodyBytes, err := ioutil.ReadAll(body)
+		return req, bodyBytes, err
+	}
+
+	bodyBytes, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return req, nil, err
+	}
+	req = req.Clone(req.Context())
+	req.Body = ioutil.NopCloser(bytes.NewReader(bodyBytes))
+
+	return req, bodyBytes, nil
+}
+
+// redactCredentials returns body with the values of its JSON fields, form parameters, XML attributes and XML elements
+// that are credentials replaced by redactedCredential
+func redactCredentials(body string) string {
+	body = jsonCredentialRegex.ReplaceAllString(body, `$1"`+redactedCredential+`"`)
+	body = formCredentialRegex.ReplaceAllString(body, `${1}`+redactedCredential)
+	body = xmlAttributeCredentialRegex.ReplaceAllString(body, `$1"`+redactedCredential+`"`)
+
+	return xmlElementCredentialRegex.ReplaceAllString(body, `${1}`+redactedCredential)
+}
+
+// redactURL returns u without its user info, and with the values of its query parameters that are credentials
+// redacted
+func redactURL(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+	redacted := *u
+	redacted.User = nil
+	redacted.RawQuery = formCredentialRegex.ReplaceAllString(redacted.RawQuery, `${1}`+redactedCredential)
+
+	return redacted.String()
+}
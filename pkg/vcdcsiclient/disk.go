@@ -0,0 +1,147 @@
+/*
+   Copyright 2021 VMware, Inc.
+   SPDX-License-Identifier: Apache-2.0
+*/
+
+package vcdcsiclient
+
+import (
+	"fmt"
+	"github.com/vmware/cloud-director-named-disk-csi-driver/pkg/vcdtypes"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+	"strings"
+)
+
+// Disk is a named disk of a VDC as returned by a VCDDiskManager. It is converted from the types that VCD returns,
+// so that the users of the disk manager do not depend on govcd or on the VCD API.
+type Disk struct {
+	// ID is the URN of the disk, e.g. urn:vcloud:disk:<uuid>
+	ID          string
+	HREF        string
+	UUID        string
+	Name        string
+	Description string
+	SizeMB      int64
+	BusType     string
+	BusSubType  string
+	IOPS        int64
+	Shareable   bool
+	// SharingType is how VCD shares the disk between VMs, e.g. DiskSharing, if VCD reports it
+	SharingType string
+	// StorageProfile is the name of the storage profile of the disk. The ID of the profile may be empty.
+	StorageProfile     string
+	StorageProfileID   string
+	StorageProfileHREF string
+	// Encrypted is true if VCD encrypts the disk at rest
+	Encrypted bool
+	// EncryptionPolicy is the name of the encryption policy of the disk, if VCD reports it. The ID of the policy may
+	// be empty.
+	EncryptionPolicy   string
+	EncryptionPolicyID string
+	// AttachedVMs are the names of the VMs that the disk is attached to, which are the node IDs of their nodes. They
+	// are only set by GetDisk and ListDisksForCluster.
+	AttachedVMs []string
+	// Metadata is the metadata of the disk. It is only set by GetDisk and ListDisksForCluster.
+	Metadata map[string]string
+
+	// vcdDisk is the disk that VCD returned, whose links are followed to attach the disk
+	vcdDisk *vcdtypes.Disk
+}
+
+// newDisk converts a disk returned by VCD
+func newDisk(vcdDisk *vcdtypes.Disk) *Disk {
+	disk := &Disk{
+		ID:          vcdDisk.Id,
+		HREF:        vcdDisk.HREF,
+		UUID:        vcdDisk.UUID,
+		Name:        vcdDisk.Name,
+		Description: vcdDisk.Description,
+		SizeMB:      vcdDisk.SizeMb,
+		BusType:     vcdDisk.BusType,
+		BusSubType:  vcdDisk.BusSubType,
+		IOPS:        vcdDisk.Iops,
+		Shareable:   isDiskShareable(vcdDisk),
+		SharingType: vcdDisk.SharingType,
+		Encrypted:   vcdDisk.Encrypted,
+		vcdDisk:     vcdDisk,
+	}
+	if vcdDisk.StorageProfile != nil {
+		disk.StorageProfile = vcdDisk.StorageProfile.Name
+		disk.StorageProfileID = vcdDisk.StorageProfile.ID
+		disk.StorageProfileHREF = vcdDisk.StorageProfile.HREF
+	}
+	if vcdDisk.EncryptionPolicy != nil {
+		disk.EncryptionPolicy = vcdDisk.EncryptionPolicy.Name
+		disk.EncryptionPolicyID = vcdDisk.EncryptionPolicy.ID
+	}
+	for _, vm := range vcdDisk.AttachedVMs {
+		if vm != nil {
+			disk.AttachedVMs = append(disk.AttachedVMs, vm.Name)
+		}
+	}
+
+	return disk
+}
+
+// The sharing types of disks in VCD
+const (
+	// DiskSharingTypeNone is the sharing type of the disks that VCD does not share between VMs
+	DiskSharingTypeNone = "None"
+	// DiskSharingTypeDisk shares the disk between VMs, which may run on other hosts
+	DiskSharingTypeDisk = "DiskSharing"
+	// DiskSharingTypeController shares the SCSI controller of the disk between VMs, e.g. for the quorum disks of
+	// clusters of VMs
+	DiskSharingTypeController = "ControllerSharing"
+
+	// sharingTypeMinAPIVersion is the first VCD API version that takes the sharing type of a disk
+	sharingTypeMinAPIVersion = "35.0"
+)
+
+// DiskSharingTypes are the sharing types that a disk may be created with
+var DiskSharingTypes = []string{DiskSharingTypeNone, DiskSharingTypeDisk, DiskSharingTypeController}
+
+// isDiskShareable returns true if vcdDisk can be attached to several VMs. Newer versions of VCD report the sharing
+// type of a disk instead of whether it is shareable.
+func isDiskShareable(vcdDisk *vcdtypes.Disk) bool {
+	return vcdDisk.Shareable || (vcdDisk.SharingType != "" && vcdDisk.SharingType != DiskSharingTypeNone)
+}
+
+// HasEncryptionPolicy returns true if the disk is encrypted with encryptionPolicy, which is the name or the URN of a
+// policy. An encrypted disk whose policy VCD does not report is taken to have it.
+func (disk *Disk) HasEncryptionPolicy(encryptionPolicy string) bool {
+	if !disk.Encrypted {
+		return false
+	}
+	if disk.EncryptionPolicy == "" && disk.EncryptionPolicyID == "" {
+		return true
+	}
+
+	return disk.EncryptionPolicy == encryptionPolicy || strings.EqualFold(disk.EncryptionPolicyID, encryptionPolicy)
+}
+
+// HasStorageProfile returns true if the storage profile of the disk is storageProfile, which is the name or the URN
+// of a profile
+func (disk *Disk) HasStorageProfile(storageProfile string) bool {
+	return StorageProfileMatches(&types.Reference{
+		ID:   disk.StorageProfileID,
+		HREF: disk.StorageProfileHREF,
+		Name: disk.StorageProfile,
+	}, storageProfile)
+}
+
+// getVCDDisk returns the disk that VCD returned for disk, reading it again if disk was not returned by the disk
+// manager. The caller should hold diskManager.VCDClient.RWLock.
+func (diskManager *DiskManager) getVCDDisk(disk *Disk) (*vcdtypes.Disk, error) {
+	if disk.vcdDisk != nil {
+		return disk.vcdDisk, nil
+	}
+	if disk.HREF != "" {
+		vcdDisk, err := diskManager.govcdGetDiskByHref(disk.HREF)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get disk [%s] with href [%s]: [%v]", disk.Name, disk.HREF, err)
+		}
+		return vcdDisk, nil
+	}
+
+	return diskManager.getDiskByName(disk.Name)
+}
@@ -8,6 +8,7 @@ package vcdcsiclient
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/vmware/cloud-director-named-disk-csi-driver/pkg/util"
 	"github.com/vmware/cloud-director-named-disk-csi-driver/pkg/vcdtypes"
@@ -18,19 +19,97 @@ import (
 	"github.com/vmware/go-vcloud-director/v2/types/v56"
 	"k8s.io/klog"
 	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
+// SCSIAdapterTypes are the adapter types of the disk settings of a VM by the SCSI bus sub types of disks
+var SCSIAdapterTypes = map[string]string{
+	VCDBusSubTypeBusLogic:    "2",
+	VCDBusSubTypeLsiLogic:    "3",
+	VCDBusSubTypeLsiLogicSAS: "4",
+	VCDBusSubTypeVirtualSCSI: "5",
+}
+
+// volumeNamePrefixRegexp matches the volume name prefixes that are valid in disk names
+var volumeNamePrefixRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+
 type DiskManager struct {
-	VCDClient *vcdsdk.Client
+	VCDClient *Client
 	ClusterID string
+	// VAppName is the vApp of the VMs of the nodes of the cluster
+	VAppName string
+	// DryRun makes the disk manager log the disk operations that modify VCD instead of running them, and report
+	// their success. Disks and VMs are still looked up.
+	DryRun bool
+	// VolumeNamePrefix is prepended to the names of the volumes to get the names of their disks, so that clusters
+	// sharing a VDC do not use the same disk names
+	VolumeNamePrefix string
+	// VAppScopedVMSearch makes FindVMByNodeID find the VMs of the nodes only in VAppName, instead of searching the
+	// whole VDC for the VMs that are not in VAppName, such as standalone VMs
+	VAppScopedVMSearch bool
+	// AllowOfflineAttach allows the disks to be attached to VMs that are powered off, which VCD adds offline
+	// instead of hot-adding them. An attach to a powered off VM fails otherwise, since its node cannot use the disk.
+	AllowOfflineAttach bool
+	// DeleteTransitionTimeout bounds the wait for a disk that VCD reports as in use or in transition, e.g. while it is
+	// still being detached, to become deletable. It is DefaultDeleteTransitionTimeout if 0.
+	DeleteTransitionTimeout time.Duration
+
+	vmCacheLock sync.Mutex
+	vmCache     map[string]cachedVM
+}
+
+// cachedVM is a VM found by FindVMByNodeID, which is used until expiry
+type cachedVM struct {
+	vm     *govcd.VM
+	expiry time.Time
 }
 
 const (
 	VCDBusTypeSCSI           = "6"
 	VCDBusSubTypeVirtualSCSI = "VirtualSCSI"
+	VCDBusSubTypeLsiLogicSAS = "lsilogicsas"
+	VCDBusSubTypeLsiLogic    = "lsilogic"
+	VCDBusSubTypeBusLogic    = "buslogic"
 	NoRdePrefix              = `NO_RDE_`
+
+	// VCDBusTypeIDE is the bus type of IDE disks, which cannot be hot-added to a VM that is powered on
+	VCDBusTypeIDE = "5"
+
+	mbToBytes = int64(1024 * 1024)
+
+	// ProvisionedDiskNamePrefix is the prefix of the names of the disks created for PVCs by the external-provisioner
+	// with its default volume name prefix
+	ProvisionedDiskNamePrefix = "pvc-"
+	// DiskURNPrefix is the prefix of the URNs of disks, which a volume handle can be instead of the name of the disk
+	DiskURNPrefix = "urn:vcloud:disk:"
+	// StorageProfileURNPrefix is the prefix of the URNs of storage profiles, by which the storage profile of a disk can
+	// be selected instead of its name, which providers may give to several storage profiles
+	StorageProfileURNPrefix = "urn:vcloud:vdcstorageProfile:"
+	// ClusterIDMetadataKey is the metadata key of the disks that relates them to the cluster they were created for
+	ClusterIDMetadataKey = "k8s-cluster-id"
+	// maxDiskQueryPageSize is the default maximum page size of the VCD query API
+	maxDiskQueryPageSize = 128
+	// maxVolumeNamePrefixLength leaves room in the names of disks for the volume names of the external-provisioner
+	maxVolumeNamePrefixLength = 32
+
+	// vmCacheTTL is the duration for which FindVMByNodeID reuses a VM it found
+	vmCacheTTL = 30 * time.Second
+	// VMURNPrefix prefixes the UUID of a VM in its ID
+	VMURNPrefix = "urn:vcloud:vm:"
+
+	// createDiskBusyRetries is how many times the create of a disk that VCD rejects as busy is retried
+	createDiskBusyRetries = 3
+	// deleteDiskRetries is how many times the delete of a disk that VCD reports as in use or in transition is retried
+	deleteDiskRetries = 4
+	// DefaultDeleteTransitionTimeout bounds the wait for a disk in use or in transition to become deletable by
+	// default
+	DefaultDeleteTransitionTimeout = 2 * time.Minute
 )
 
 // Returns a Disk structure as JSON
@@ -104,23 +183,61 @@ func (diskManager *DiskManager) createDisk(diskCreateParams *vcdtypes.DiskCreate
 
 // CreateDisk will create a new independent disk with params specified
 func (diskManager *DiskManager) CreateDisk(diskName string, sizeMB int64, busType string, busSubType string,
-	description string, storageProfile string, shareable bool) (*vcdtypes.Disk, error) {
+	description string, storageProfile string, shareable bool, iops int64) (*Disk, error) {
+	return diskManager.CreateDiskWithContext(context.Background(), diskName, sizeMB, busType, busSubType, description,
+		storageProfile, shareable, "", "", iops)
+}
+
+// CreateDiskWithContext is the same as CreateDisk but traces the creation in a child span of the span of ctx. A
+// shareable disk is created with the sharingType of DiskSharingTypes if it is not empty, which VCD API version 35.0
+// and later take. The disk is encrypted at rest with encryptionPolicy, the name or the URN of an encryption policy,
+// if it is not empty, which VCD API version 37.0 and later take.
+func (diskManager *DiskManager) CreateDiskWithContext(ctx context.Context, diskName string, sizeMB int64,
+	busType string, busSubType string, description string, storageProfile string, shareable bool,
+	sharingType string, encryptionPolicy string, iops int64) (_ *Disk, err error) {
+	ctx, span := diskManager.VCDClient.startSpan(ctx, operationCreateDisk, diskName)
+	defer func() { span.end(err) }()
+
 	diskManager.VCDClient.RWLock.Lock()
 	defer diskManager.VCDClient.RWLock.Unlock()
+	// the requests to VCD are abandoned once the caller gives up on the operation
+	defer diskManager.VCDClient.bindToContext(ctx)()
+	defer func() { err = contextError(ctx, err) }()
+	defer func() { err = diskOperationError(diskName, err) }()
 
-	klog.Infof("Entered CreateDisk with name [%s] size [%d]MB, storageProfile [%s] shareable[%v]\n",
-		diskName, sizeMB, storageProfile, shareable)
+	klog.Infof("Entered CreateDisk with name [%s] size [%d]MB, storageProfile [%s] shareable[%v] "+
+		"sharingType [%s] encryptionPolicy [%s] iops [%d]\n", diskName, sizeMB, storageProfile, shareable, sharingType,
+		encryptionPolicy, iops)
 
-	disk, err := diskManager.GetDiskByName(diskName)
-	if err != nil && err != govcd.ErrorEntityNotFound {
-		if rdeErr := diskManager.AddToErrorSet(util.DiskQueryError, "", diskName, map[string]interface{}{"Detailed Error": fmt.Errorf("unable to query disk [%s]: [%v]",
+	if iops < 0 {
+		return nil, fmt.Errorf("IOPS [%d] of disk [%s] should not be negative", iops, diskName)
+	}
+	// VCD picks the default storage profile of the VDC otherwise, whose IOPS settings are not known
+	if iops > 0 && storageProfile == "" {
+		return nil, fmt.Errorf("a storage profile is required to set the IOPS of disk [%s]", diskName)
+	}
+
+	if err := diskManager.checkSharingType(diskName, shareable, sharingType); err != nil {
+		return nil, err
+	}
+	if err := diskManager.checkEncryptionPolicy(diskName, encryptionPolicy); err != nil {
+		return nil, err
+	}
+
+	if err := diskManager.VCDClient.refreshBearerTokenIfExpiring(ctx); err != nil {
+		return nil, fmt.Errorf("unable to refresh bearer token to create disk [%s]: [%v]", diskName, err)
+	}
+
+	disk, err := diskManager.getDiskByName(diskName)
+	if err != nil && !errors.Is(err, ErrDiskNotFound) {
+		if rdeErr := diskManager.addToErrorSet(util.DiskQueryError, "", diskName, map[string]interface{}{"Detailed Error": fmt.Errorf("unable to query disk [%s]: [%v]",
 			diskName, err)}); rdeErr != nil {
 			klog.Errorf("unable to add error [%s] into [CSI.Errors] in RDE [%s], %v", util.DiskQueryError, diskManager.ClusterID, rdeErr)
 		}
 		return nil, fmt.Errorf("unable to check if disk [%s] already exists: [%v]",
 			diskName, err)
 	}
-	if removeErrorRdeErr := diskManager.RemoveFromErrorSet(util.DiskQueryError, "", diskName); removeErrorRdeErr != nil {
+	if removeErrorRdeErr := diskManager.removeFromErrorSet(util.DiskQueryError, "", diskName); removeErrorRdeErr != nil {
 		klog.Errorf("unable to remove error [%s] from [CSI.Errors] in RDE [%s]", "DiskCreateError", diskManager.ClusterID)
 	}
 
@@ -128,14 +245,17 @@ func (diskManager *DiskManager) CreateDisk(diskName string, sizeMB int64, busTyp
 		if disk.SizeMb != sizeMB ||
 			disk.BusType != busType ||
 			disk.BusSubType != busSubType ||
-			(storageProfile != "") && (disk.StorageProfile.Name != storageProfile) ||
-			disk.Shareable != shareable {
-			return nil, fmt.Errorf("disk [%s] already exists but with different properties: [%v]",
-				diskName, disk)
+			(storageProfile != "") && !StorageProfileMatches(disk.StorageProfile, storageProfile) ||
+			isDiskShareable(disk) != shareable ||
+			(sharingType != "" && disk.SharingType != "" && disk.SharingType != sharingType) ||
+			(encryptionPolicy != "" && !newDisk(disk).HasEncryptionPolicy(encryptionPolicy)) ||
+			(iops > 0 && disk.Iops != iops) {
+			return nil, NewDiskError(ErrDiskExists, diskName, fmt.Errorf(
+				"disk [%s] already exists but with different properties: [%v]", diskName, disk))
 		}
 
 		klog.Infof("Disk with name [%s] already exists", diskName)
-		return disk, nil
+		return newDisk(disk), nil
 	}
 
 	d := &vcdtypes.Disk{
@@ -145,6 +265,8 @@ func (diskManager *DiskManager) CreateDisk(diskName string, sizeMB int64, busTyp
 		BusSubType:  busSubType,
 		Description: description,
 		Shareable:   shareable,
+		SharingType: sharingType,
+		Iops:        iops,
 	}
 
 	diskParams := &vcdtypes.DiskCreateParams{
@@ -152,42 +274,72 @@ func (diskManager *DiskManager) CreateDisk(diskName string, sizeMB int64, busTyp
 		Disk:  d,
 	}
 	if storageProfile != "" {
-		storageReference, err := diskManager.VCDClient.VDC.FindStorageProfileReference(storageProfile)
+		storageReference, err := diskManager.findStorageProfileReference(storageProfile)
 		if err != nil {
-			return nil, fmt.Errorf("unable to find storage profile [%s] for disk [%s]",
-				storageProfile, diskName)
+			return nil, fmt.Errorf("unable to find storage profile [%s] for disk [%s]: [%v]",
+				storageProfile, diskName, err)
 		}
 
 		diskParams.Disk.StorageProfile = &types.Reference{
 			HREF: storageReference.HREF,
 		}
+
+		if iops > 0 {
+			if err = diskManager.validateDiskIops(storageReference.HREF, sizeMB, iops); err != nil {
+				return nil, fmt.Errorf("unable to set IOPS of disk [%s]: [%v]", diskName, err)
+			}
+		}
+	}
+	if encryptionPolicy != "" {
+		if diskParams.Disk.EncryptionPolicy, err = diskManager.findEncryptionPolicyReference(diskName,
+			encryptionPolicy); err != nil {
+			return nil, fmt.Errorf("unable to find encryption policy [%s] for disk [%s]: [%w]", encryptionPolicy,
+				diskName, err)
+		}
+	}
+
+	if diskManager.DryRun {
+		klog.Infof("Dry run: not creating disk [%s] with params [%#v]", diskName, diskParams.Disk)
+		return newDisk(d), nil
 	}
 
-	task, err := diskManager.createDisk(diskParams)
+	task, err := diskManager.createDiskWhenNotBusy(ctx, diskParams, sizeMB)
 	if err != nil {
-		return nil,
-			fmt.Errorf("unable to create disk with name [%s] size [%d]MB: [%v]",
-				diskName, sizeMB, err)
+		return nil, err
 	}
 
-	klog.Infof("START: Waiting for creation of disk [%s] size [%d]MB", diskName, sizeMB)
-	err = task.WaitTaskCompletion()
+	disk, err = diskManager.addCreatedDisk(ctx, diskName, sizeMB, task)
 	if err != nil {
-		return nil, fmt.Errorf("error waiting to finish creation of independent disk: [%v]", err)
+		return nil, err
+	}
+	if encryptionPolicy != "" && !disk.Encrypted {
+		klog.Warningf("VCD reports disk [%s] created with encryption policy [%s] as not encrypted", diskName,
+			encryptionPolicy)
 	}
-	klog.Infof("END  : Waiting for creation of disk [%s] size [%d]MB", diskName, sizeMB)
 
+	return newDisk(disk), nil
+}
+
+// addCreatedDisk returns the disk diskName of sizeMB created by task, once it is added to the events and to the RDE
+// of the cluster. The caller should hold diskManager.VCDClient.RWLock.
+func (diskManager *DiskManager) addCreatedDisk(ctx context.Context, diskName string, sizeMB int64,
+	task govcd.Task) (*vcdtypes.Disk, error) {
 	diskHref := task.Task.Owner.HREF
-	disk, err = diskManager.govcdGetDiskByHref(diskHref)
+	disk, err := diskManager.govcdGetDiskByHref(diskHref)
 	if err != nil {
 		return nil, fmt.Errorf("unable to find disk with href [%s]: [%v]", diskHref, err)
 	}
-	if addEventRdeErr := diskManager.AddToEventSet(util.DiskCreateEvent, "", diskName, map[string]interface{}{"Detailed Info": fmt.Sprintf("Successfully created disk [%s] of size [%d]MB", diskName, sizeMB)}); addEventRdeErr != nil {
+	if addEventRdeErr := diskManager.addToEventSet(util.DiskCreateEvent, "", diskName, map[string]interface{}{"Detailed Info": fmt.Sprintf("Successfully created disk [%s] of size [%d]MB", diskName, sizeMB)}); addEventRdeErr != nil {
 		klog.Errorf("unable to add event [%s] into [CSI.Events] in RDE [%s]", util.DiskCreateEvent, diskManager.ClusterID)
 	}
 	klog.Infof("Disk created: [%#v]", disk)
 
-	rdeManager := vcdsdk.NewRDEManager(diskManager.VCDClient, diskManager.ClusterID, util.CSIName, version.Version)
+	// the create task may have taken long enough for the token to be close to expiry
+	if err = diskManager.VCDClient.refreshBearerTokenIfExpiring(ctx); err != nil {
+		return nil, fmt.Errorf("unable to refresh bearer token to add disk [%s] to RDE: [%v]", diskName, err)
+	}
+
+	rdeManager := vcdsdk.NewRDEManager(diskManager.VCDClient.Client, diskManager.ClusterID, util.CSIName, version.Version)
 	if diskManager.ClusterID != "" && !strings.HasPrefix(diskManager.ClusterID, NoRdePrefix) {
 		if err = diskManager.addPvToRDE(disk.Id, disk.Name, rdeManager); err != nil {
 			return nil, vcdsdk.NewNoRDEError(fmt.Sprintf("Unable to add PV Id [%s] to RDE; RDE ID is generated", disk.Id))
@@ -197,6 +349,312 @@ func (diskManager *DiskManager) CreateDisk(diskName string, sizeMB int64, busTyp
 	return disk, nil
 }
 
+// createDiskFromSource creates the disk diskName of sizeMB in storageProfile with the data of source, a snapshot or
+// a disk, and with the bus, the sharing and the description of sourceDisk, or returns the disk diskName if it exists
+// with these properties. The caller should hold diskManager.VCDClient.RWLock.
+func (diskManager *DiskManager) createDiskFromSource(ctx context.Context, diskName string, source *types.Reference,
+	sourceDisk *vcdtypes.Disk, storageProfile string, sizeMB int64) (*Disk, error) {
+	disk, err := diskManager.getDiskByName(diskName)
+	if err != nil && !errors.Is(err, ErrDiskNotFound) {
+		return nil, fmt.Errorf("unable to check if disk [%s] already exists: [%v]", diskName, err)
+	}
+	if disk != nil {
+		if disk.SizeMb != sizeMB ||
+			disk.BusType != sourceDisk.BusType ||
+			disk.BusSubType != sourceDisk.BusSubType ||
+			(storageProfile != "") && !StorageProfileMatches(disk.StorageProfile, storageProfile) ||
+			isDiskShareable(disk) != isDiskShareable(sourceDisk) {
+			return nil, NewDiskError(ErrDiskExists, diskName, fmt.Errorf(
+				"disk [%s] already exists but with different properties: [%v]", diskName, disk))
+		}
+
+		klog.Infof("Disk with name [%s] already exists", diskName)
+		return newDisk(disk), nil
+	}
+
+	diskParams := &vcdtypes.DiskCreateParams{
+		Xmlns: types.XMLNamespaceVCloud,
+		Disk: &vcdtypes.Disk{
+			Name:        diskName,
+			SizeMb:      sizeMB,
+			BusType:     sourceDisk.BusType,
+			BusSubType:  sourceDisk.BusSubType,
+			Description: sourceDisk.Description,
+			Shareable:   sourceDisk.Shareable,
+			SharingType: sourceDisk.SharingType,
+		},
+		Source: source,
+	}
+	if storageProfile != "" {
+		storageReference, err := diskManager.findStorageProfileReference(storageProfile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to find storage profile [%s] for disk [%s]: [%v]",
+				storageProfile, diskName, err)
+		}
+		diskParams.Disk.StorageProfile = &types.Reference{
+			HREF: storageReference.HREF,
+		}
+	}
+
+	if diskManager.DryRun {
+		klog.Infof("Dry run: not creating disk [%s] from [%s] with params [%#v]", diskName, source.HREF,
+			diskParams.Disk)
+		return newDisk(diskParams.Disk), nil
+	}
+
+	task, err := diskManager.createDiskWhenNotBusy(ctx, diskParams, sizeMB)
+	if err != nil {
+		return nil, err
+	}
+	if disk, err = diskManager.addCreatedDisk(ctx, diskName, sizeMB, task); err != nil {
+		return nil, err
+	}
+
+	return newDisk(disk), nil
+}
+
+// CloneDisk creates the disk newDiskName in storageProfile as a copy by VCD of the disk sourceDiskName, with its bus
+// and its sharing. The copy has sizeBytes, rounded up to MB, or the size of the source disk if it is larger, and is
+// independent of the source disk. VCD only copies a detached disk, hence a source disk that is attached to VMs fails
+// with ErrDiskAttached.
+func (diskManager *DiskManager) CloneDisk(sourceDiskName string, newDiskName string, storageProfile string,
+	sizeBytes int64) (*Disk, error) {
+	return diskManager.CloneDiskWithContext(context.Background(), sourceDiskName, newDiskName, storageProfile,
+		sizeBytes)
+}
+
+// CloneDiskWithContext is the same as CloneDisk but traces the copy in a child span of the span of ctx
+func (diskManager *DiskManager) CloneDiskWithContext(ctx context.Context, sourceDiskName string, newDiskName string,
+	storageProfile string, sizeBytes int64) (_ *Disk, err error) {
+	ctx, span := diskManager.VCDClient.startSpan(ctx, operationCreateDisk, newDiskName)
+	defer func() { span.end(err) }()
+
+	diskManager.VCDClient.RWLock.Lock()
+	defer diskManager.VCDClient.RWLock.Unlock()
+	defer diskManager.VCDClient.bindToContext(ctx)()
+	defer func() { err = contextError(ctx, err) }()
+	defer func() { err = diskOperationError(newDiskName, err) }()
+
+	klog.Infof("Entered CloneDisk with source [%s] name [%s] storageProfile [%s] size [%d]B", sourceDiskName,
+		newDiskName, storageProfile, sizeBytes)
+
+	if sizeBytes < 0 {
+		return nil, fmt.Errorf("size [%d] of disk [%s] should not be negative", sizeBytes, newDiskName)
+	}
+	if err := diskManager.VCDClient.refreshBearerTokenIfExpiring(ctx); err != nil {
+		return nil, fmt.Errorf("unable to refresh bearer token to create disk [%s]: [%v]", newDiskName, err)
+	}
+
+	sourceDisk, err := diskManager.getDiskByName(sourceDiskName)
+	if err != nil {
+		if errors.Is(err, ErrDiskNotFound) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("unable to find disk with name [%s]: [%v]", sourceDiskName, err)
+	}
+	// a retried clone returns the copy even if the source disk has been attached since
+	if _, err = diskManager.getDiskByName(newDiskName); errors.Is(err, ErrDiskNotFound) {
+		attachedVMs, err := diskManager.govcdAttachedVM(sourceDisk)
+		if err != nil {
+			return nil, fmt.Errorf("unable to find VMs that disk [%s] is attached to: [%v]", sourceDiskName, err)
+		}
+		var vmNames []string
+		for _, attachedVM := range attachedVMs {
+			if attachedVM != nil {
+				vmNames = append(vmNames, attachedVM.Name)
+			}
+		}
+		if len(vmNames) > 0 {
+			sort.Strings(vmNames)
+			return nil, NewDiskError(ErrDiskAttached, sourceDiskName, fmt.Errorf(
+				"disk [%s] cannot be copied while it is attached to VMs [%s]", sourceDiskName,
+				strings.Join(vmNames, ", ")))
+		}
+	}
+
+	sizeMB := (sizeBytes + mbToBytes - 1) / mbToBytes
+	if sizeMB < sourceDisk.SizeMb {
+		sizeMB = sourceDisk.SizeMb
+	}
+
+	return diskManager.createDiskFromSource(ctx, newDiskName, &types.Reference{
+		HREF: sourceDisk.HREF,
+		ID:   sourceDisk.Id,
+		Type: types.MimeDisk,
+	}, sourceDisk, storageProfile, sizeMB)
+}
+
+// IsStorageProfileURN returns true if storageProfile is the URN of a storage profile rather than its name
+func IsStorageProfileURN(storageProfile string) bool {
+	return len(storageProfile) > len(StorageProfileURNPrefix) &&
+		strings.EqualFold(storageProfile[:len(StorageProfileURNPrefix)], StorageProfileURNPrefix)
+}
+
+// StorageProfileMatches returns true if reference is the storage profile storageProfile, which is the name or the
+// URN of the storage profile. The references of VCD may only have the href of the storage profile, whose last
+// segment is the UUID of its URN.
+func StorageProfileMatches(reference *types.Reference, storageProfile string) bool {
+	if reference == nil {
+		return false
+	}
+	if !IsStorageProfileURN(storageProfile) {
+		return reference.Name == storageProfile
+	}
+	if reference.ID != "" {
+		return strings.EqualFold(reference.ID, storageProfile)
+	}
+
+	uuid := storageProfile[len(StorageProfileURNPrefix):]
+	return strings.HasSuffix(strings.ToLower(reference.HREF), "/vdcstorageprofile/"+strings.ToLower(uuid))
+}
+
+// findStorageProfileReference returns the reference to the storage profile in the VDC whose name or URN is
+// storageProfile. A URN selects the exact storage profile even when others share its name.
+func (diskManager *DiskManager) findStorageProfileReference(storageProfile string) (*types.Reference, error) {
+	vdc := diskManager.VCDClient.VDC
+	if err := diskManager.VCDClient.invalidateOrgVDCIfNotFound(vdc.Refresh()); err != nil {
+		return nil, fmt.Errorf("unable to refresh vdc [%s]: [%v]", vdc.Vdc.Name, err)
+	}
+
+	var storageProfileNames []string
+	if vdc.Vdc.VdcStorageProfiles != nil {
+		for _, storageProfileReference := range vdc.Vdc.VdcStorageProfiles.VdcStorageProfile {
+			if StorageProfileMatches(storageProfileReference, storageProfile) {
+				return storageProfileReference, nil
+			}
+			storageProfileNames = append(storageProfileNames, storageProfileReference.Name)
+		}
+	}
+
+	return nil, fmt.Errorf("storage profile [%s] does not exist in vdc [%s] with storage profiles [%s]",
+		storageProfile, vdc.Vdc.Name, strings.Join(storageProfileNames, ", "))
+}
+
+// govcdGetStorageProfile reads the storage profile of the VDC at storageProfileHref
+func (diskManager *DiskManager) govcdGetStorageProfile(storageProfileHref string) (*vcdtypes.VdcStorageProfile, error) {
+	storageProfile := &vcdtypes.VdcStorageProfile{}
+	_, err := diskManager.VCDClient.VCDClient.Client.ExecuteRequestWithApiVersion(storageProfileHref, http.MethodGet,
+		"", "error retrieving storage profile: %s", nil, storageProfile,
+		diskManager.VCDClient.VCDClient.Client.APIVersion)
+	if err != nil {
+		return nil, err
+	}
+	return storageProfile, nil
+}
+
+// validateDiskIops checks that disks of sizeMB in the storage profile at storageProfileHref can have iops IOPS
+func (diskManager *DiskManager) validateDiskIops(storageProfileHref string, sizeMB int64, iops int64) error {
+	storageProfile, err := diskManager.govcdGetStorageProfile(storageProfileHref)
+	if err != nil {
+		return fmt.Errorf("unable to get storage profile [%s]: [%v]", storageProfileHref, err)
+	}
+
+	iopsSettings := storageProfile.IopsSettings
+	if iopsSettings == nil || !iopsSettings.Enabled {
+		return fmt.Errorf("storage profile [%s] does not support setting the IOPS of disks", storageProfile.Name)
+	}
+	if iopsSettings.DiskIopsMax > 0 && iops > iopsSettings.DiskIopsMax {
+		return fmt.Errorf("IOPS [%d] exceed the maximum [%d] of disks in storage profile [%s]",
+			iops, iopsSettings.DiskIopsMax, storageProfile.Name)
+	}
+	// the IOPS of a disk may also be limited by its size
+	if iopsSettings.DiskIopsPerGbMax > 0 {
+		sizeGB := (sizeMB + 1023) / 1024
+		if maxIops := iopsSettings.DiskIopsPerGbMax * sizeGB; iops > maxIops {
+			return fmt.Errorf("IOPS [%d] exceed the maximum [%d] of a disk of [%d]MB in storage profile [%s]",
+				iops, maxIops, sizeMB, storageProfile.Name)
+		}
+	}
+
+	return nil
+}
+
+// getStorageProfileAvailableBytes returns the bytes left in the storage profile at storageProfileHref, or 0 if the
+// storage profile has no limit
+func (diskManager *DiskManager) getStorageProfileAvailableBytes(storageProfileHref string) (int64, error) {
+	storageProfile, err := diskManager.govcdGetStorageProfile(storageProfileHref)
+	if err != nil {
+		return 0, err
+	}
+
+	if storageProfile.Limit == 0 {
+		klog.Infof("Storage profile [%s] has no limit", storageProfile.Name)
+		return 0, nil
+	}
+	if storageProfile.Units != "MB" {
+		return 0, fmt.Errorf("unknown units [%s] of storage profile [%s]", storageProfile.Units,
+			storageProfile.Name)
+	}
+	if storageProfile.StorageUsedMB >= storageProfile.Limit {
+		return 0, nil
+	}
+	return (storageProfile.Limit - storageProfile.StorageUsedMB) * mbToBytes, nil
+}
+
+// GetVDCCapacity returns the bytes left in the storage profile storageProfile of the VDC, or in all its storage
+// profiles if storageProfile is empty. Storage profiles without a limit add no capacity.
+func (diskManager *DiskManager) GetVDCCapacity(storageProfile string) (int64, error) {
+	diskManager.VCDClient.RWLock.Lock()
+	defer diskManager.VCDClient.RWLock.Unlock()
+
+	klog.Infof("Entered GetVDCCapacity for storage profile [%s]", storageProfile)
+
+	if err := diskManager.VCDClient.refreshBearerTokenIfExpiring(context.Background()); err != nil {
+		return 0, fmt.Errorf("unable to refresh bearer token to get capacity: [%v]", err)
+	}
+
+	var storageProfileReferences []*types.Reference
+	if storageProfile != "" {
+		storageProfileReference, err := diskManager.findStorageProfileReference(storageProfile)
+		if err != nil {
+			return 0, err
+		}
+		storageProfileReferences = append(storageProfileReferences, storageProfileReference)
+	} else {
+		vdc := diskManager.VCDClient.VDC
+		if err := diskManager.VCDClient.invalidateOrgVDCIfNotFound(vdc.Refresh()); err != nil {
+			return 0, fmt.Errorf("unable to refresh vdc [%s]: [%v]", vdc.Vdc.Name, err)
+		}
+		if vdc.Vdc.VdcStorageProfiles != nil {
+			storageProfileReferences = vdc.Vdc.VdcStorageProfiles.VdcStorageProfile
+		}
+	}
+
+	capacity := int64(0)
+	for _, storageProfileReference := range storageProfileReferences {
+		availableBytes, err := diskManager.getStorageProfileAvailableBytes(storageProfileReference.HREF)
+		if err != nil {
+			return 0, fmt.Errorf("unable to get capacity of storage profile [%s]: [%v]",
+				storageProfileReference.Name, err)
+		}
+		capacity += availableBytes
+	}
+
+	return capacity, nil
+}
+
+// GetVDCThinProvisioned returns true if the VDC provisions its disks thin, which VCD applies to the named disks of
+// every storage profile of the VDC. The setting is only in the admin view of the VDC.
+func (diskManager *DiskManager) GetVDCThinProvisioned() (bool, error) {
+	diskManager.VCDClient.RWLock.Lock()
+	defer diskManager.VCDClient.RWLock.Unlock()
+
+	if err := diskManager.VCDClient.refreshBearerTokenIfExpiring(context.Background()); err != nil {
+		return false, fmt.Errorf("unable to refresh bearer token to get provisioning of VDC: [%v]", err)
+	}
+
+	vdc := diskManager.VCDClient.VDC
+	adminVdcHref := strings.Replace(vdc.Vdc.HREF, "/api/vdc/", "/api/admin/vdc/", 1)
+	adminVdc := &types.AdminVdc{}
+	_, err := diskManager.VCDClient.VCDClient.Client.ExecuteRequest(adminVdcHref, http.MethodGet,
+		"", "error retrieving admin VDC: %s", nil, adminVdc)
+	if err = diskManager.VCDClient.invalidateOrgVDCIfNotFound(err); err != nil {
+		return false, fmt.Errorf("unable to get provisioning of VDC [%s]: [%v]", vdc.Vdc.Name, err)
+	}
+
+	return adminVdc.IsThinProvision != nil && *adminVdc.IsThinProvision, nil
+}
+
 // GetDiskByHref finds a Disk by HREF
 // On success, returns a pointer to the Disk structure and a nil error
 // On failure, returns a nil pointer and an error
@@ -219,7 +677,7 @@ func (diskManager *DiskManager) govcdGetDiskByHref(diskHref string) (*vcdtypes.D
 func (diskManager *DiskManager) govcdGetDiskById(diskId string, refresh bool) (*vcdtypes.Disk, error) {
 	klog.Infof("Get Disk By Id: %s\n", diskId)
 	if refresh {
-		err := diskManager.VCDClient.VDC.Refresh()
+		err := diskManager.VCDClient.invalidateOrgVDCIfNotFound(diskManager.VCDClient.VDC.Refresh())
 		if err != nil {
 			return nil, fmt.Errorf("error when refreshing by disk id %s, [%v]", diskId, err)
 		}
@@ -245,7 +703,7 @@ func (diskManager *DiskManager) govcdGetDisksByName(diskName string, refresh boo
 	klog.Infof("Get Disk By Name: %s\n", diskName)
 	var diskList []vcdtypes.Disk
 	if refresh {
-		err := diskManager.VCDClient.VDC.Refresh()
+		err := diskManager.VCDClient.invalidateOrgVDCIfNotFound(diskManager.VCDClient.VDC.Refresh())
 		if err != nil {
 			return nil, fmt.Errorf("disk name should not be empty")
 		}
@@ -267,13 +725,210 @@ func (diskManager *DiskManager) govcdGetDisksByName(diskName string, refresh boo
 	return &diskList, nil
 }
 
-// GetDiskByName will get disk by name
-func (diskManager *DiskManager) GetDiskByName(name string) (*vcdtypes.Disk, error) {
+// GetDiskName returns the name of the disk of the volume volumeName
+func (diskManager *DiskManager) GetDiskName(volumeName string) string {
+	return diskManager.VolumeNamePrefix + volumeName
+}
+
+// ValidateVolumeNamePrefix checks that prefix can start the name of a disk, and cannot be mistaken for the VDC of a
+// volume ID
+func ValidateVolumeNamePrefix(prefix string) error {
+	if prefix == "" {
+		return nil
+	}
+	if !volumeNamePrefixRegexp.MatchString(prefix) {
+		return fmt.Errorf("volume name prefix [%s] should have only letters, digits, '.', '_' and '-', "+
+			"and start with a letter or digit", prefix)
+	}
+	if len(prefix) > maxVolumeNamePrefixLength {
+		return fmt.Errorf("volume name prefix [%s] should have at most [%d] characters", prefix,
+			maxVolumeNamePrefixLength)
+	}
+
+	return nil
+}
+
+// queryDisks returns the page of the records of the disks of the VDC whose name starts with the volume name prefix
+// and ProvisionedDiskNamePrefix, sorted by name, and the total number of such disks
+func (diskManager *DiskManager) queryDisks(page int, pageSize int) ([]*types.DiskRecordType, int, error) {
+	client := &diskManager.VCDClient.VCDClient.Client
+	queryType := "disk"
+	if client.IsSysAdmin {
+		queryType = "adminDisk"
+	}
+
+	results, err := client.QueryWithNotEncodedParams(map[string]string{
+		"type":     queryType,
+		"page":     strconv.Itoa(page),
+		"pageSize": strconv.Itoa(pageSize),
+		"sortAsc":  "name",
+	}, map[string]string{
+		"filter": fmt.Sprintf("name==%s*;vdc==%s", url.QueryEscape(diskManager.GetDiskName(ProvisionedDiskNamePrefix)),
+			url.QueryEscape(diskManager.VCDClient.VDC.Vdc.HREF)),
+		"filterEncoded": "true",
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to query page [%d] of disks: [%v]", page, err)
+	}
+
+	diskRecords := results.Results.DiskRecord
+	if client.IsSysAdmin {
+		diskRecords = results.Results.AdminDiskRecord
+	}
+	return diskRecords, int(results.Results.Total), nil
+}
+
+// ListDisks returns up to maxEntries disks of the VDC that were created by the driver, sorted by name and starting at
+// the offset pageToken, and the token of the next page, which is empty after the last disk. If maxEntries is 0, all
+// the remaining disks are returned.
+func (diskManager *DiskManager) ListDisks(pageToken string, maxEntries int) ([]Disk, string, error) {
+	diskManager.VCDClient.RWLock.Lock()
+	defer diskManager.VCDClient.RWLock.Unlock()
+
+	klog.Infof("Entered ListDisks with page token [%s] and max entries [%d]", pageToken, maxEntries)
+
+	offset := 0
+	if pageToken != "" {
+		var err error
+		if offset, err = strconv.Atoi(pageToken); err != nil || offset < 0 {
+			return nil, "", fmt.Errorf("invalid page token [%s]", pageToken)
+		}
+	}
+	if maxEntries < 0 {
+		return nil, "", fmt.Errorf("max entries [%d] should not be negative", maxEntries)
+	}
+
+	if err := diskManager.VCDClient.refreshBearerTokenIfExpiring(context.Background()); err != nil {
+		return nil, "", fmt.Errorf("unable to refresh bearer token to list disks: [%v]", err)
+	}
+
+	pageSize := maxEntries
+	if pageSize == 0 || pageSize > maxDiskQueryPageSize {
+		pageSize = maxDiskQueryPageSize
+	}
+	// the offset need not be a multiple of the page size, since the caller may change maxEntries between pages
+	page, skip := offset/pageSize+1, offset%pageSize
+
+	var disks []Disk
+	total := 0
+	for {
+		diskRecords, currTotal, err := diskManager.queryDisks(page, pageSize)
+		if err != nil {
+			return nil, "", err
+		}
+		total = currTotal
+
+		for idx := skip; idx < len(diskRecords); idx++ {
+			if maxEntries > 0 && len(disks) == maxEntries {
+				break
+			}
+			diskRecord := diskRecords[idx]
+			disks = append(disks, Disk{
+				HREF:               diskRecord.HREF,
+				ID:                 diskRecord.Id,
+				Name:               diskRecord.Name,
+				SizeMB:             diskRecord.SizeMb,
+				BusType:            diskRecord.BusType,
+				BusSubType:         diskRecord.BusSubType,
+				Description:        diskRecord.Description,
+				StorageProfile:     diskRecord.StorageProfileName,
+				StorageProfileHREF: diskRecord.StorageProfile,
+			})
+		}
+		skip = 0
+
+		if (maxEntries > 0 && len(disks) == maxEntries) || len(diskRecords) < pageSize || page*pageSize >= total {
+			break
+		}
+		page++
+	}
+
+	nextPageToken := ""
+	if next := offset + len(disks); next < total {
+		nextPageToken = strconv.Itoa(next)
+	}
+	return disks, nextPageToken, nil
+}
+
+// GetDisk returns the disk with the URN diskID along with the VMs it is attached to and its metadata
+func (diskManager *DiskManager) GetDisk(diskID string) (*Disk, error) {
+	// the VDC is refreshed while looking for the disk, so this cannot share the lock with readers
+	diskManager.VCDClient.RWLock.Lock()
+	defer diskManager.VCDClient.RWLock.Unlock()
+
+	klog.Infof("Entered GetDisk for id [%s]", diskID)
+
+	if diskID == "" {
+		return nil, fmt.Errorf("disk id should not be empty")
+	}
+
+	if err := diskManager.VCDClient.refreshBearerTokenIfExpiring(context.Background()); err != nil {
+		return nil, fmt.Errorf("unable to refresh bearer token to get disk [%s]: [%v]", diskID, err)
+	}
+
+	disk, err := diskManager.govcdGetDiskById(diskID, true)
+	if err != nil {
+		if err == govcd.ErrorEntityNotFound {
+			return nil, NewDiskError(ErrDiskNotFound, diskID, nil)
+		}
+		return nil, fmt.Errorf("unable to get disk with id [%s]: [%v]", diskID, err)
+	}
+
+	if disk.AttachedVMs, err = diskManager.govcdAttachedVM(disk); err != nil {
+		return nil, fmt.Errorf("unable to find VMs that disk [%s] is attached to: [%v]", diskID, err)
+	}
+	result := newDisk(disk)
+	if result.Metadata, err = diskManager.govcdGetMetadata(disk.HREF); err != nil {
+		return nil, fmt.Errorf("unable to get metadata of disk [%s]: [%v]", diskID, err)
+	}
+
+	return result, nil
+}
+
+// FindDiskByName returns the disk with the given name, or nil if there is no such disk. Unlike GetDiskByName, not
+// finding the disk is not an error.
+func (diskManager *DiskManager) FindDiskByName(name string) (*Disk, error) {
+	diskManager.VCDClient.RWLock.Lock()
+	defer diskManager.VCDClient.RWLock.Unlock()
+
+	disk, err := diskManager.getDiskByName(name)
+	if errors.Is(err, ErrDiskNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return newDisk(disk), nil
+}
+
+// GetDiskByName will get disk by name, along with the VMs it is attached to
+func (diskManager *DiskManager) GetDiskByName(name string) (*Disk, error) {
+	// the VDC is refreshed while looking for the disk, so this cannot share the lock with readers
+	diskManager.VCDClient.RWLock.Lock()
+	defer diskManager.VCDClient.RWLock.Unlock()
+
+	disk, err := diskManager.getDiskByName(name)
+	if err != nil {
+		return nil, err
+	}
+	if disk.AttachedVMs, err = diskManager.govcdAttachedVM(disk); err != nil {
+		return nil, fmt.Errorf("unable to find VMs that disk [%s] is attached to: [%v]", name, err)
+	}
+
+	return newDisk(disk), nil
+}
+
+// getDiskByName is GetDiskByName for callers that hold the lock of the VCD client
+func (diskManager *DiskManager) getDiskByName(name string) (*vcdtypes.Disk, error) {
 	klog.Infof("Entered GetDiskByName for name [%s]", name)
 
 	if name == "" {
 		return nil, fmt.Errorf("disk name should not be empty")
 	}
+	// the disk of a URN is read directly instead of refreshing the VDC
+	if IsDiskURN(name) {
+		return diskManager.getDiskByURN(name)
+	}
 
 	disks, err := diskManager.govcdGetDisksByName(name, true)
 	if err != nil && err != govcd.ErrorEntityNotFound {
@@ -281,7 +936,7 @@ func (diskManager *DiskManager) GetDiskByName(name string) (*vcdtypes.Disk, erro
 	}
 	if err == govcd.ErrorEntityNotFound || disks == nil || len(*disks) == 0 {
 		// disk not found is a useful error code in some scenarios
-		return nil, govcd.ErrorEntityNotFound
+		return nil, NewDiskError(ErrDiskNotFound, name, nil)
 	}
 	if len(*disks) > 1 {
 		return nil, fmt.Errorf("found [%d] > 1 disks with name [%s]", len(*disks), name)
@@ -290,6 +945,61 @@ func (diskManager *DiskManager) GetDiskByName(name string) (*vcdtypes.Disk, erro
 	return &(*disks)[0], nil
 }
 
+// IsDiskURN returns true if volumeHandle is the URN of a disk rather than its name
+func IsDiskURN(volumeHandle string) bool {
+	return strings.HasPrefix(volumeHandle, DiskURNPrefix)
+}
+
+// GetDiskByURN returns the disk of the VDC with the URN urn, or ErrDiskNotFound if there is none. The disk
+// is read directly, which is cheaper than finding it by name.
+func (diskManager *DiskManager) GetDiskByURN(urn string) (*Disk, error) {
+	diskManager.VCDClient.RWLock.Lock()
+	defer diskManager.VCDClient.RWLock.Unlock()
+
+	if err := diskManager.VCDClient.refreshBearerTokenIfExpiring(context.Background()); err != nil {
+		return nil, fmt.Errorf("unable to refresh bearer token to get disk [%s]: [%v]", urn, err)
+	}
+
+	disk, err := diskManager.getDiskByURN(urn)
+	if err != nil {
+		return nil, err
+	}
+
+	return newDisk(disk), nil
+}
+
+func (diskManager *DiskManager) getDiskByURN(urn string) (*vcdtypes.Disk, error) {
+	klog.Infof("Entered GetDiskByURN for urn [%s]", urn)
+
+	diskUUID := strings.TrimPrefix(urn, DiskURNPrefix)
+	if !IsDiskURN(urn) || diskUUID == "" || strings.Contains(diskUUID, "/") {
+		return nil, fmt.Errorf("[%s] is not the URN of a disk", urn)
+	}
+
+	diskHref := fmt.Sprintf("%s/disk/%s", diskManager.VCDClient.VCDClient.Client.VCDHREF.String(), diskUUID)
+	disk, err := diskManager.govcdGetDiskByHref(diskHref)
+	if err != nil {
+		// VCD forbids access to the disks that do not exist
+		if govcd.ContainsNotFound(err) || strings.Contains(err.Error(), fmt.Sprintf("API Error: %d:",
+			http.StatusNotFound)) || strings.Contains(err.Error(), fmt.Sprintf("API Error: %d:",
+			http.StatusForbidden)) {
+			return nil, NewDiskError(ErrDiskNotFound, urn, nil)
+		}
+		return nil, fmt.Errorf("unable to get disk with urn [%s]: [%v]", urn, err)
+	}
+
+	// a disk of another VDC of the org is not a disk of the VDC of the disk manager
+	for _, link := range disk.Link {
+		if link.Rel == "up" && link.Type == types.MimeVDC && link.HREF != diskManager.VCDClient.VDC.Vdc.HREF {
+			klog.Infof("Disk with urn [%s] is in VDC [%s] instead of [%s]", urn, link.HREF,
+				diskManager.VCDClient.VDC.Vdc.HREF)
+			return nil, NewDiskError(ErrDiskNotFound, urn, nil)
+		}
+	}
+
+	return disk, nil
+}
+
 func (diskManager *DiskManager) govcdAttachedVM(disk *vcdtypes.Disk) ([]*types.Reference, error) {
 	klog.Infof("[TRACE] Disk attached VM, HREF: %s\n", disk.HREF)
 
@@ -350,116 +1060,660 @@ func (diskManager *DiskManager) govcdDelete(disk *vcdtypes.Disk) (govcd.Task, er
 		return govcd.Task{}, fmt.Errorf("error disk is attached")
 	}
 
-	var deleteDiskLink *types.Link
+	var deleteDiskLink *types.Link
+
+	// Find the proper link for request
+	for _, diskLink := range disk.Link {
+		if diskLink.Rel == types.RelRemove {
+			klog.Infof("[TRACE] Delete disk - found the proper link for request, HREF: %s, name: %s, type: %s,id: %s, rel: %s \n",
+				diskLink.HREF,
+				diskLink.Name,
+				diskLink.Type,
+				diskLink.ID,
+				diskLink.Rel)
+			deleteDiskLink = diskLink
+			break
+		}
+	}
+
+	if deleteDiskLink == nil {
+		return govcd.Task{}, fmt.Errorf("could not find request URL for delete disk in disk Link")
+	}
+
+	// Return the task
+	return diskManager.VCDClient.VCDClient.Client.ExecuteTaskRequestWithApiVersion(deleteDiskLink.HREF, http.MethodDelete,
+		"", "error delete disk: %s", nil,
+		diskManager.VCDClient.VCDClient.Client.APIVersion)
+}
+
+// DeleteDisk will delete independent disk by its name
+func (diskManager *DiskManager) DeleteDisk(name string) error {
+	return diskManager.DeleteDiskWithContext(context.Background(), name)
+}
+
+// DeleteDiskWithContext is the same as DeleteDisk but traces the deletion in a child span of the span of ctx
+func (diskManager *DiskManager) DeleteDiskWithContext(ctx context.Context, name string) (err error) {
+	ctx, span := diskManager.VCDClient.startSpan(ctx, operationDeleteDisk, name)
+	defer func() { span.end(err) }()
+
+	diskManager.VCDClient.RWLock.Lock()
+	defer diskManager.VCDClient.RWLock.Unlock()
+	// the requests to VCD are abandoned once the caller gives up on the operation
+	defer diskManager.VCDClient.bindToContext(ctx)()
+	defer func() { err = contextError(ctx, err) }()
+	defer func() { err = diskOperationError(name, err) }()
+
+	klog.Infof("Entered DeleteDisk for disk [%s]\n", name)
+
+	if err := diskManager.VCDClient.refreshBearerTokenIfExpiring(ctx); err != nil {
+		return fmt.Errorf("unable to refresh bearer token to delete disk [%s]: [%v]", name, err)
+	}
+
+	disk, err := diskManager.getDiskByName(name)
+	if err != nil {
+		if errors.Is(err, ErrDiskNotFound) {
+			// ignore deletes for non-existent entities
+			klog.Infof("Unable to find disk with name [%s]: [%v]", name, err)
+			return nil
+		}
+
+		return fmt.Errorf("unable to find disk with name [%s]: [%v]", name, err)
+	}
+
+	attachedVMs, err := diskManager.govcdAttachedVM(disk)
+	if err != nil {
+		return fmt.Errorf("unable to find if disk [%s] is attached to a VM: [%v]", name, err)
+	}
+	if attachedVMs != nil && len(attachedVMs) > 0 {
+		return NewDiskError(ErrDiskAttached, name, fmt.Errorf("unable to delete disk [%s] that is attached to VMs [%#v]",
+			name, attachedVMs))
+	}
+
+	if diskManager.DryRun {
+		klog.Infof("Dry run: not deleting disk [%s] with href [%s]", name, disk.HREF)
+		return nil
+	}
+
+	err = observeVCDCall(operationDeleteDisk, func() error {
+		return diskManager.deleteDiskWhenDeletable(ctx, disk)
+	})
+	if err != nil {
+		return err
+	}
+
+	if addEventRdeErr := diskManager.addToEventSet(util.DiskDeleteEvent, "", disk.Name, map[string]interface{}{"Detailed Info": fmt.Sprintf("Volume %s deleted successfully", name)}); addEventRdeErr != nil {
+		klog.Errorf("unable to add event [%s] into [CSI.Events] in RDE [%s]", util.DiskDeleteEvent, diskManager.ClusterID)
+	}
+	rdeManager := vcdsdk.NewRDEManager(diskManager.VCDClient.Client, diskManager.ClusterID, util.CSIName, version.Version)
+	// update RDE
+	if diskManager.ClusterID != "" && !strings.HasPrefix(diskManager.ClusterID, NoRdePrefix) {
+		if err = diskManager.removePvFromRDE(disk.Id, disk.Name, rdeManager); err != nil {
+			return vcdsdk.NewNoRDEError(fmt.Sprintf("unable to remove PV Id [%s] from RDE; RDE ID is generated", disk.Id))
+		}
+	}
+
+	return nil
+}
+
+// checkSharingType returns an ErrInvalidDisk error naming the attribute of the disk diskName that the sharing type
+// sharingType, if any, is not valid for, or that VCD does not support
+func (diskManager *DiskManager) checkSharingType(diskName string, shareable bool, sharingType string) error {
+	if sharingType == "" {
+		return nil
+	}
+
+	valid := false
+	for _, diskSharingType := range DiskSharingTypes {
+		valid = valid || sharingType == diskSharingType
+	}
+	if !valid {
+		return NewDiskError(ErrInvalidDisk, diskName, fmt.Errorf(
+			"attribute [sharingType] of disk [%s] should be one of [%s], obtained [%s]", diskName,
+			strings.Join(DiskSharingTypes, ", "), sharingType))
+	}
+	if (sharingType != DiskSharingTypeNone) != shareable {
+		return NewDiskError(ErrInvalidDisk, diskName, fmt.Errorf(
+			"attribute [sharingType] [%s] of disk [%s] does not match attribute [shareable] [%v]", sharingType,
+			diskName, shareable))
+	}
+	client := &diskManager.VCDClient.VCDClient.Client
+	if !client.APIClientVersionIs(">= " + sharingTypeMinAPIVersion) {
+		return NewDiskError(ErrInvalidDisk, diskName, fmt.Errorf(
+			"attribute [sharingType] of disk [%s] is not supported by VCD API version [%s]; it needs version [%s] "+
+				"or later", diskName, client.APIVersion, sharingTypeMinAPIVersion))
+	}
+
+	return nil
+}
+
+// createDiskWhenNotBusy creates the disk of diskParams and waits for its creation. A create that VCD rejects since an
+// entity that it involves, e.g. the VDC or the storage profile, is busy with another operation is retried up to
+// createDiskBusyRetries times with the backoff of the retries of the client. Other failures, e.g. of the quota or the
+// rights of the user, are not retried. The caller should hold diskManager.VCDClient.RWLock.
+func (diskManager *DiskManager) createDiskWhenNotBusy(ctx context.Context, diskParams *vcdtypes.DiskCreateParams,
+	sizeMB int64) (govcd.Task, error) {
+
+	diskName := diskParams.Disk.Name
+	for retry := 0; ; retry++ {
+		var task govcd.Task
+		err := observeVCDCall(operationCreateDisk, func() error {
+			var err error
+			task, err = diskManager.createDisk(diskParams)
+			if err != nil {
+				return fmt.Errorf("unable to create disk with name [%s] size [%d]MB: [%v]",
+					diskName, sizeMB, err)
+			}
+
+			klog.Infof("START: Waiting for creation of disk [%s] size [%d]MB", diskName, sizeMB)
+			if err = waitForTask(ctx, &task); err != nil {
+				return fmt.Errorf("error waiting to finish creation of independent disk: [%v]", err)
+			}
+			klog.Infof("END  : Waiting for creation of disk [%s] size [%d]MB", diskName, sizeMB)
+			return nil
+		})
+		if err == nil || !isCreateDiskBusyError(err) {
+			return task, err
+		}
+		if retry >= createDiskBusyRetries {
+			return govcd.Task{}, fmt.Errorf("unable to create disk [%s] after [%d] retries while VCD reported it "+
+				"busy: [%v]", diskName, retry, err)
+		}
+
+		delay := backoffDelay(diskManager.VCDClient.retryBaseDelay, retry)
+		klog.Infof("VCD is busy creating disk [%s]; retrying create [%d/%d] in [%v]: [%v]", diskName, retry+1,
+			createDiskBusyRetries, delay, err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return govcd.Task{}, err
+		case <-timer.C:
+		}
+
+		// a create whose task failed should not have left a disk behind, but a retry must not duplicate one
+		if _, getErr := diskManager.getDiskByName(diskName); !errors.Is(getErr, ErrDiskNotFound) {
+			return govcd.Task{}, fmt.Errorf("disk [%s] cannot be created again after [%d] retries while VCD "+
+				"reported it busy since it could not be checked to be missing: [%v]: [%v]", diskName, retry+1,
+				getErr, err)
+		}
+	}
+}
+
+// isCreateDiskBusyError returns true if the create of a disk failed with err only since an entity was busy. Errors of
+// the quota or the rights of the user may mention a busy entity too, and are not retried.
+func isCreateDiskBusyError(err error) bool {
+	if !IsEntityBusyError(err) {
+		return false
+	}
+	switch classifyVCDError(err) {
+	case errorClassQuota, errorClassAuth:
+		return false
+	}
+
+	return true
+}
+
+// deleteDiskWhenDeletable deletes disk once the tasks in progress on it are done. A delete that VCD rejects since the
+// disk is in use or in transition, e.g. while it is still being detached, is retried up to deleteDiskRetries times
+// with the backoff of the polls of tasks. It returns an ErrDiskInTransition error if the disk does not become deletable
+// within the delete transition timeout. The caller should hold diskManager.VCDClient.RWLock.
+func (diskManager *DiskManager) deleteDiskWhenDeletable(ctx context.Context, disk *vcdtypes.Disk) error {
+	transitionTimeout := diskManager.DeleteTransitionTimeout
+	if transitionTimeout == 0 {
+		transitionTimeout = DefaultDeleteTransitionTimeout
+	}
+	transitionCtx, cancel := context.WithTimeout(ctx, transitionTimeout)
+	defer cancel()
+
+	for retry := 0; ; retry++ {
+		if err := diskManager.waitForDiskTasks(transitionCtx, disk); err != nil {
+			// the caller that gives up gets the error of its context instead
+			if ctx.Err() != nil {
+				return err
+			}
+			return NewDiskError(ErrDiskInTransition, disk.Name, fmt.Errorf(
+				"disk [%s] did not become deletable: [%v]", disk.Name, err))
+		}
+
+		task, err := diskManager.govcdDelete(disk)
+		if err != nil {
+			err = fmt.Errorf("unable to issue delete disk call for [%s]: [%v]", disk.Name, err)
+		} else if err = waitForTask(ctx, &task); err != nil {
+			err = fmt.Errorf("failed to wait for deletion task of disk [%s]: [%v]", disk.Name, err)
+		}
+		if err == nil || !isDiskInTransitionError(err) {
+			return err
+		}
+		if retry >= deleteDiskRetries {
+			return NewDiskError(ErrDiskInTransition, disk.Name, fmt.Errorf(
+				"disk [%s] is still in use or in transition after [%d] retries of its delete: [%v]", disk.Name,
+				retry, err))
+		}
+
+		delay := taskPollDelay(retry)
+		klog.Infof("Disk [%s] is in use or in transition; retrying delete [%d/%d] in [%v]: [%v]", disk.Name,
+			retry+1, deleteDiskRetries, delay, err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-transitionCtx.Done():
+			timer.Stop()
+			if ctx.Err() != nil {
+				return err
+			}
+			return NewDiskError(ErrDiskInTransition, disk.Name, fmt.Errorf(
+				"gave up waiting for disk [%s] to become deletable: [%v]: [%v]", disk.Name, transitionCtx.Err(), err))
+		case <-timer.C:
+		}
+		if err = diskManager.govcdRefresh(disk); err != nil {
+			return fmt.Errorf("unable to refresh disk [%s] to retry its delete: [%v]", disk.Name, err)
+		}
+	}
+}
+
+// waitForDiskTasks waits for the tasks in progress on disk, such as a detach, to complete. A task that fails leaves
+// the disk as it was, hence only the failure to wait for it is returned.
+func (diskManager *DiskManager) waitForDiskTasks(ctx context.Context, disk *vcdtypes.Disk) error {
+	if disk.Tasks == nil {
+		return nil
+	}
+
+	for _, diskTask := range disk.Tasks.Task {
+		if diskTask == nil || !taskPendingStatuses[diskTask.Status] {
+			continue
+		}
+		klog.Infof("Waiting for task [%s] of operation [%s] on disk [%s]", diskTask.HREF, diskTask.Operation,
+			disk.Name)
+		task := govcd.NewTask(&diskManager.VCDClient.VCDClient.Client)
+		task.Task = diskTask
+		if err := waitForTask(ctx, task); err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			klog.Infof("Task [%s] on disk [%s] did not succeed: [%v]", diskTask.HREF, disk.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// Refresh the disk information by disk href
+func (diskManager *DiskManager) govcdRefresh(disk *vcdtypes.Disk) error {
+	klog.Infof("[TRACE] Disk refresh, HREF: %s\n", disk.HREF)
+
+	if disk == nil || disk.HREF == "" {
+		return fmt.Errorf("cannot refresh, Object is empty")
+	}
+
+	unmarshalledDisk := &vcdtypes.Disk{}
+
+	_, err := diskManager.VCDClient.VCDClient.Client.ExecuteRequestWithApiVersion(disk.HREF, http.MethodGet,
+		"", "error refreshing independent disk: %s", nil, unmarshalledDisk,
+		diskManager.VCDClient.VCDClient.Client.APIVersion)
+	if err != nil {
+		return err
+	}
+
+	// shallow-copy content from unmarshalledDisk to Disk
+	*disk = *unmarshalledDisk
+
+	// The request was successful
+	return nil
+}
+
+// Update the independent disk with the properties of newDisk
+// Make a PUT request to the URL in the rel="edit" link in the Disk and return the task of the update
+// Reference: vCloud API Programming Guide for Service Providers vCloud API 35.0 PDF Page 108,
+// https://vdc-download.vmware.com/vmwb-repository/dcr-public/715b0387-34d7-4568-b2d8-d11454c52d51/944f905e-fa4e-4005-be7d-19c3cea70ffd/vmware_cloud_director_sp_api_guide_35_0.pdf
+func (diskManager *DiskManager) govcdUpdate(disk *vcdtypes.Disk, newDisk *vcdtypes.Disk) (govcd.Task, error) {
+	klog.Infof("[TRACE] Update disk, name: %s, size: %dMB, HREF: %s\n", newDisk.Name, newDisk.SizeMb, disk.HREF)
+
+	if newDisk.Name == "" {
+		return govcd.Task{}, fmt.Errorf("disk name is required")
+	}
+
+	var updateDiskLink *types.Link
+
+	// Find the proper link for request
+	for _, diskLink := range disk.Link {
+		if diskLink.Rel == types.RelEdit && diskLink.Type == types.MimeDisk {
+			klog.Infof("[TRACE] Update disk - found the proper link for request, HREF: %s, name: %s, type: %s,id: %s, rel: %s \n",
+				diskLink.HREF,
+				diskLink.Name,
+				diskLink.Type,
+				diskLink.ID,
+				diskLink.Rel)
+			updateDiskLink = diskLink
+			break
+		}
+	}
+
+	if updateDiskLink == nil {
+		return govcd.Task{}, fmt.Errorf("could not find request URL for update disk in disk Link")
+	}
+
+	newDisk.Xmlns = types.XMLNamespaceVCloud
+	return diskManager.VCDClient.VCDClient.Client.ExecuteTaskRequestWithApiVersion(updateDiskLink.HREF, http.MethodPut,
+		updateDiskLink.Type, "error updating disk: %s", newDisk,
+		diskManager.VCDClient.VCDClient.Client.APIVersion)
+}
+
+// ResizeDisk grows the independent disk diskName to newSizeBytes rounded up to a MB. A disk that is already at least
+// as large is left unchanged, so that retried expansions succeed.
+func (diskManager *DiskManager) ResizeDisk(diskName string, newSizeBytes int64) error {
+	return diskManager.ResizeDiskWithContext(context.Background(), diskName, newSizeBytes)
+}
+
+// ResizeDiskWithContext is the same as ResizeDisk but abandons the requests to VCD once ctx is done
+func (diskManager *DiskManager) ResizeDiskWithContext(ctx context.Context, diskName string,
+	newSizeBytes int64) (err error) {
+
+	diskManager.VCDClient.RWLock.Lock()
+	defer diskManager.VCDClient.RWLock.Unlock()
+	defer diskManager.VCDClient.bindToContext(ctx)()
+	defer func() { err = contextError(ctx, err) }()
+	defer func() { err = diskOperationError(diskName, err) }()
+
+	klog.Infof("Entered ResizeDisk for disk [%s] with size [%d] bytes\n", diskName, newSizeBytes)
+
+	if newSizeBytes <= 0 {
+		return fmt.Errorf("new size [%d] of disk [%s] should be positive", newSizeBytes, diskName)
+	}
+	newSizeMB := (newSizeBytes + mbToBytes - 1) / mbToBytes
+
+	if err := diskManager.VCDClient.refreshBearerTokenIfExpiring(ctx); err != nil {
+		return fmt.Errorf("unable to refresh bearer token to resize disk [%s]: [%v]", diskName, err)
+	}
+
+	disk, err := diskManager.getDiskByName(diskName)
+	if err != nil {
+		if errors.Is(err, ErrDiskNotFound) {
+			return err
+		}
+		return fmt.Errorf("unable to find disk with name [%s]: [%v]", diskName, err)
+	}
+
+	if disk.SizeMb >= newSizeMB {
+		klog.Infof("Disk [%s] of size [%d]MB is already at least [%d]MB, so nothing to do.",
+			diskName, disk.SizeMb, newSizeMB)
+		return nil
+	}
+
+	newDisk := &vcdtypes.Disk{
+		Name:           disk.Name,
+		SizeMb:         newSizeMB,
+		Iops:           disk.Iops,
+		BusType:        disk.BusType,
+		BusSubType:     disk.BusSubType,
+		Shareable:      disk.Shareable,
+		SharingType:    disk.SharingType,
+		Description:    disk.Description,
+		Owner:          disk.Owner,
+		StorageProfile: disk.StorageProfile,
+	}
+	if diskManager.DryRun {
+		klog.Infof("Dry run: not resizing disk [%s] from [%d]MB to [%d]MB", diskName, disk.SizeMb, newSizeMB)
+		return nil
+	}
+
+	err = observeVCDCall(operationResizeDisk, func() error {
+		task, err := diskManager.govcdUpdate(disk, newDisk)
+		if err != nil {
+			return fmt.Errorf("unable to issue resize call for disk [%s] from [%d]MB to [%d]MB: [%v]",
+				diskName, disk.SizeMb, newSizeMB, err)
+		}
+
+		klog.Infof("START: Waiting for resize of disk [%s] to [%d]MB", diskName, newSizeMB)
+		if err = waitForTask(ctx, &task); err != nil {
+			return fmt.Errorf("failed to wait for resize task of disk [%s]: [%v]", diskName, err)
+		}
+		klog.Infof("END  : Waiting for resize of disk [%s] to [%d]MB", diskName, newSizeMB)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if addEventRdeErr := diskManager.addToEventSet(util.DiskResizeEvent, "", diskName, map[string]interface{}{"Detailed Info": fmt.Sprintf("Successfully resized disk [%s] from [%d]MB to [%d]MB", diskName, disk.SizeMb, newSizeMB)}); addEventRdeErr != nil {
+		klog.Errorf("unable to add event [%s] into [CSI.Events] in RDE [%s]", util.DiskResizeEvent, diskManager.ClusterID)
+	}
+
+	return nil
+}
+
+// SetDiskMetadata sets the metadata entries kv on the independent disk diskName. Entries that the disk already has
+// with other keys are kept.
+func (diskManager *DiskManager) SetDiskMetadata(ctx context.Context, diskName string,
+	kv map[string]string) (err error) {
+
+	diskManager.VCDClient.RWLock.Lock()
+	defer diskManager.VCDClient.RWLock.Unlock()
+	defer diskManager.VCDClient.bindToContext(ctx)()
+	defer func() { err = contextError(ctx, err) }()
+
+	klog.Infof("Entered SetDiskMetadata for disk [%s] with metadata [%v]\n", diskName, kv)
+
+	// the disk is not looked up since it may have been created in the dry run
+	if diskManager.DryRun {
+		klog.Infof("Dry run: not setting metadata [%v] of disk [%s]", kv, diskName)
+		return nil
+	}
+
+	if err := diskManager.VCDClient.refreshBearerTokenIfExpiring(ctx); err != nil {
+		return fmt.Errorf("unable to refresh bearer token to set metadata of disk [%s]: [%v]", diskName, err)
+	}
 
-	// Find the proper link for request
-	for _, diskLink := range disk.Link {
-		if diskLink.Rel == types.RelRemove {
-			klog.Infof("[TRACE] Delete disk - found the proper link for request, HREF: %s, name: %s, type: %s,id: %s, rel: %s \n",
-				diskLink.HREF,
-				diskLink.Name,
-				diskLink.Type,
-				diskLink.ID,
-				diskLink.Rel)
-			deleteDiskLink = diskLink
-			break
+	disk, err := diskManager.getDiskByName(diskName)
+	if err != nil {
+		if errors.Is(err, ErrDiskNotFound) {
+			return err
 		}
+		return fmt.Errorf("unable to find disk with name [%s]: [%v]", diskName, err)
 	}
 
-	if deleteDiskLink == nil {
-		return govcd.Task{}, fmt.Errorf("could not find request URL for delete disk in disk Link")
+	// sort the keys so that the entries are always set in the same order
+	keys := make([]string, 0, len(kv))
+	for key := range kv {
+		keys = append(keys, key)
 	}
+	sort.Strings(keys)
 
-	// Return the task
-	return diskManager.VCDClient.VCDClient.Client.ExecuteTaskRequestWithApiVersion(deleteDiskLink.HREF, http.MethodDelete,
-		"", "error delete disk: %s", nil,
-		diskManager.VCDClient.VCDClient.Client.APIVersion)
+	return observeVCDCall(operationSetDiskMetadata, func() error {
+		for _, key := range keys {
+			metadataValue := &types.MetadataValue{
+				Xmlns: types.XMLNamespaceVCloud,
+				Xsi:   types.XMLNamespaceXSI,
+				TypedValue: &types.TypedValue{
+					XsiType: "MetadataStringValue",
+					Value:   kv[key],
+				},
+			}
+			task, err := diskManager.VCDClient.VCDClient.Client.ExecuteTaskRequestWithApiVersion(
+				disk.HREF+"/metadata/"+url.PathEscape(key), http.MethodPut, types.MimeMetaDataValue,
+				"error setting disk metadata: %s", metadataValue, diskManager.VCDClient.VCDClient.Client.APIVersion)
+			if err != nil {
+				return fmt.Errorf("unable to set metadata [%s] of disk [%s]: [%v]", key, diskName, err)
+			}
+			if err = waitForTask(ctx, &task); err != nil {
+				return fmt.Errorf("failed to wait for task setting metadata [%s] of disk [%s]: [%v]",
+					key, diskName, err)
+			}
+		}
+		return nil
+	})
 }
 
-// DeleteDisk will delete independent disk by its name
-func (diskManager *DiskManager) DeleteDisk(name string) error {
+// GetDiskMetadata returns the metadata entries of the independent disk diskName. A disk without metadata, such as one
+// created by an earlier version of the driver, has no entries.
+func (diskManager *DiskManager) GetDiskMetadata(diskName string) (map[string]string, error) {
 	diskManager.VCDClient.RWLock.Lock()
 	defer diskManager.VCDClient.RWLock.Unlock()
 
-	klog.Infof("Entered DeleteDisk for disk [%s]\n", name)
+	if err := diskManager.VCDClient.refreshBearerTokenIfExpiring(context.Background()); err != nil {
+		return nil, fmt.Errorf("unable to refresh bearer token to get metadata of disk [%s]: [%v]", diskName, err)
+	}
 
-	disk, err := diskManager.GetDiskByName(name)
+	disk, err := diskManager.getDiskByName(diskName)
 	if err != nil {
-		if err == govcd.ErrorEntityNotFound {
-			// ignore deletes for non-existent entities
-			klog.Infof("Unable to find disk with name [%s]: [%v]", name, err)
-			return nil
+		if errors.Is(err, ErrDiskNotFound) {
+			return nil, err
 		}
-
-		return fmt.Errorf("unable to find disk with name [%s]: [%v]", name, err)
+		return nil, fmt.Errorf("unable to find disk with name [%s]: [%v]", diskName, err)
 	}
 
-	attachedVMs, err := diskManager.govcdAttachedVM(disk)
+	kv, err := diskManager.govcdGetMetadata(disk.HREF)
 	if err != nil {
-		return fmt.Errorf("unable to find if disk [%s] is attached to a VM: [%v]", name, err)
+		return nil, fmt.Errorf("unable to get metadata of disk [%s]: [%v]", diskName, err)
 	}
-	if attachedVMs != nil && len(attachedVMs) > 0 {
-		return fmt.Errorf("unable to delete disk [%s] that is attached to VMs [%#v]", name, attachedVMs)
+	return kv, nil
+}
+
+// govcdGetMetadata returns the metadata entries of the disk diskHref
+func (diskManager *DiskManager) govcdGetMetadata(diskHref string) (map[string]string, error) {
+	metadata := &types.Metadata{}
+	if _, err := diskManager.VCDClient.VCDClient.Client.ExecuteRequestWithApiVersion(diskHref+"/metadata/",
+		http.MethodGet, types.MimeMetaData, "error getting disk metadata: %s", nil, metadata,
+		diskManager.VCDClient.VCDClient.Client.APIVersion); err != nil {
+		return nil, err
 	}
 
-	task, err := diskManager.govcdDelete(disk)
-	if err != nil {
-		return fmt.Errorf("unable to issue delete disk call for [%s]: [%v]", name, err)
+	kv := make(map[string]string)
+	for _, entry := range metadata.MetadataEntry {
+		if entry != nil && entry.TypedValue != nil {
+			kv[entry.Key] = entry.TypedValue.Value
+		}
 	}
+	return kv, nil
+}
 
-	err = task.WaitTaskCompletion()
-	if err != nil {
-		return fmt.Errorf("failed to wait for deletion task of disk [%s]: [%v]", name, err)
+// ListDisksForCluster returns the disks of the VDC created by the driver whose cluster ID metadata is clusterID, with
+// the VMs that they are attached to, e.g. so that the volumes of a decommissioned cluster can be deleted once they
+// are detached. Disks without the metadata, such as those created by earlier versions of the driver, are skipped.
+func (diskManager *DiskManager) ListDisksForCluster(clusterID string) ([]Disk, error) {
+	if clusterID == "" {
+		return nil, fmt.Errorf("cluster ID should not be empty")
 	}
 
-	if addEventRdeErr := diskManager.AddToEventSet(util.DiskDeleteEvent, "", disk.Name, map[string]interface{}{"Detailed Info": fmt.Sprintf("Volume %s deleted successfully", name)}); addEventRdeErr != nil {
-		klog.Errorf("unable to add event [%s] into [CSI.Events] in RDE [%s]", util.DiskDeleteEvent, diskManager.ClusterID)
+	disks, _, err := diskManager.ListDisks("", 0)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list disks of cluster [%s]: [%v]", clusterID, err)
 	}
-	rdeManager := vcdsdk.NewRDEManager(diskManager.VCDClient, diskManager.ClusterID, util.CSIName, version.Version)
-	// update RDE
-	if diskManager.ClusterID != "" && !strings.HasPrefix(diskManager.ClusterID, NoRdePrefix) {
-		if err = diskManager.removePvFromRDE(disk.Id, disk.Name, rdeManager); err != nil {
-			return vcdsdk.NewNoRDEError(fmt.Sprintf("unable to remove PV Id [%s] from RDE; RDE ID is generated", disk.Id))
+
+	diskManager.VCDClient.RWLock.Lock()
+	defer diskManager.VCDClient.RWLock.Unlock()
+
+	var clusterDisks []Disk
+	for _, listedDisk := range disks {
+		// a disk deleted since it was listed is skipped
+		metadata, err := diskManager.govcdGetMetadata(listedDisk.HREF)
+		if err != nil {
+			if govcd.ContainsNotFound(err) {
+				continue
+			}
+			return nil, fmt.Errorf("unable to get metadata of disk [%s]: [%v]", listedDisk.Name, err)
+		}
+		if metadata[ClusterIDMetadataKey] != clusterID {
+			continue
 		}
+
+		disk, err := diskManager.govcdGetDiskByHref(listedDisk.HREF)
+		if err != nil {
+			if err == govcd.ErrorEntityNotFound || govcd.ContainsNotFound(err) {
+				continue
+			}
+			return nil, fmt.Errorf("unable to get disk [%s]: [%v]", listedDisk.Name, err)
+		}
+		if disk.AttachedVMs, err = diskManager.govcdAttachedVM(disk); err != nil {
+			return nil, fmt.Errorf("unable to find VMs that disk [%s] is attached to: [%v]", listedDisk.Name, err)
+		}
+		clusterDisk := newDisk(disk)
+		clusterDisk.Metadata = metadata
+		clusterDisks = append(clusterDisks, *clusterDisk)
 	}
 
-	return nil
+	klog.Infof("Found [%d] disks of cluster [%s]", len(clusterDisks), clusterID)
+	return clusterDisks, nil
 }
 
-// Refresh the disk information by disk href
-func (diskManager *DiskManager) govcdRefresh(disk *vcdtypes.Disk) error {
-	klog.Infof("[TRACE] Disk refresh, HREF: %s\n", disk.HREF)
+// AttachmentState returns the names of the VMs that the disk diskName is attached to, in order, which are the node IDs
+// of the nodes of the VMs. A disk that is not shareable is attached to one VM at most, and a detached disk to none.
+func (diskManager *DiskManager) AttachmentState(diskName string) ([]string, error) {
+	diskManager.VCDClient.RWLock.Lock()
+	defer diskManager.VCDClient.RWLock.Unlock()
 
-	if disk == nil || disk.HREF == "" {
-		return fmt.Errorf("cannot refresh, Object is empty")
+	if err := diskManager.VCDClient.refreshBearerTokenIfExpiring(context.Background()); err != nil {
+		return nil, fmt.Errorf("unable to refresh bearer token to get attachment of disk [%s]: [%v]",
+			diskName, err)
 	}
 
-	unmarshalledDisk := &vcdtypes.Disk{}
-
-	_, err := diskManager.VCDClient.VCDClient.Client.ExecuteRequestWithApiVersion(disk.HREF, http.MethodGet,
-		"", "error refreshing independent disk: %s", nil, unmarshalledDisk,
-		diskManager.VCDClient.VCDClient.Client.APIVersion)
+	disk, err := diskManager.getDiskByName(diskName)
 	if err != nil {
-		return err
+		if errors.Is(err, ErrDiskNotFound) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("unable to find disk with name [%s]: [%v]", diskName, err)
 	}
 
-	// shallow-copy content from unmarshalledDisk to Disk
-	*disk = *unmarshalledDisk
+	attachedVMs, err := diskManager.govcdAttachedVM(disk)
+	if err != nil {
+		return nil, fmt.Errorf("unable to find VMs that disk [%s] is attached to: [%v]", diskName, err)
+	}
+	var vmNames []string
+	for _, attachedVM := range attachedVMs {
+		if attachedVM != nil {
+			vmNames = append(vmNames, attachedVM.Name)
+		}
+	}
+	sort.Strings(vmNames)
 
-	// The request was successful
-	return nil
+	return vmNames, nil
 }
 
 // AttachVolume will attach diskName to vm
-func (diskManager *DiskManager) AttachVolume(vm *govcd.VM, disk *vcdtypes.Disk) error {
-	diskManager.VCDClient.RWLock.Lock()
-	defer diskManager.VCDClient.RWLock.Unlock()
+func (diskManager *DiskManager) AttachVolume(vm *govcd.VM, disk *Disk) error {
+	return diskManager.AttachVolumeAt(vm, disk, nil, nil)
+}
+
+// AttachVolumeAt attaches disk to vm as the unit unitNumber of the bus busNumber of its adapter, so that the disk
+// appears in the same place in the guest. VCD picks the bus and unit if they are nil, and the bus defaults to 0 if
+// only the unit is set.
+func (diskManager *DiskManager) AttachVolumeAt(vm *govcd.VM, disk *Disk, busNumber *int,
+	unitNumber *int) error {
+	return diskManager.AttachVolumeAtWithContext(context.Background(), vm, disk, busNumber, unitNumber)
+}
 
-	if disk == nil {
+// AttachVolumeAtWithContext is the same as AttachVolumeAt but traces the attachment in a child span of the span of
+// ctx
+func (diskManager *DiskManager) AttachVolumeAtWithContext(ctx context.Context, vm *govcd.VM, attachedDisk *Disk,
+	busNumber *int, unitNumber *int) (err error) {
+	if attachedDisk == nil {
 		return fmt.Errorf("disk passed shoulf not be nil")
 	}
+	ctx, span := diskManager.VCDClient.startSpan(ctx, operationAttachDisk, attachedDisk.Name)
+	defer func() { span.end(err) }()
+
+	diskManager.VCDClient.RWLock.Lock()
+	defer diskManager.VCDClient.RWLock.Unlock()
+	// the requests to VCD are abandoned once the caller gives up on the operation
+	defer diskManager.VCDClient.bindToContext(ctx)()
+	defer func() { err = contextError(ctx, err) }()
+	defer func() { err = diskOperationError(attachedDisk.Name, err) }()
+	if busNumber != nil && unitNumber == nil {
+		return fmt.Errorf("a unit number is required to attach disk [%s] to bus [%d]", attachedDisk.Name,
+			*busNumber)
+	}
+	if unitNumber != nil && busNumber == nil {
+		busNumber = new(int)
+	}
 
-	klog.Infof("Entered AttachVolume for vm [%v], disk [%s]\n", vm, disk.Name)
+	klog.Infof("Entered AttachVolume for vm [%v], disk [%s]\n", vm, attachedDisk.Name)
+
+	if err := diskManager.VCDClient.refreshBearerTokenIfExpiring(ctx); err != nil {
+		return fmt.Errorf("unable to refresh bearer token to attach disk [%s]: [%v]", attachedDisk.Name, err)
+	}
+	disk, err := diskManager.getVCDDisk(attachedDisk)
+	if err != nil {
+		return fmt.Errorf("unable to get disk [%s] to attach: [%v]", attachedDisk.Name, err)
+	}
 
 	attachedVMs, err := diskManager.govcdAttachedVM(disk)
 	if err != nil {
@@ -477,48 +1731,307 @@ func (diskManager *DiskManager) AttachVolume(vm *govcd.VM, disk *vcdtypes.Disk)
 		}
 
 		// if disk is not shareable and there are other attached VMs, fail
-		if !disk.Shareable {
-			return fmt.Errorf("cannot attach disk since disk is not shareable and [%#v] VMs are attached",
-				attachedVMs)
+		if !isDiskShareable(disk) {
+			return NewDiskError(ErrDiskAttached, disk.Name, fmt.Errorf(
+				"cannot attach disk since disk is not shareable and [%#v] VMs are attached", attachedVMs))
+		}
+	}
+
+	vmStatus, err := diskManager.getVMStatus(vm)
+	if err != nil {
+		return fmt.Errorf("unable to get power state of VM [%s] to attach disk [%s]: [%v]", vm.VM.Name, disk.Name,
+			err)
+	}
+	if err = CheckAttachPowerState(vm.VM.Name, vmStatus, disk.Name, disk.BusType,
+		diskManager.AllowOfflineAttach); err != nil {
+		return err
+	}
+
+	if unitNumber != nil {
+		if err = diskManager.checkDiskUnitIsFree(vm, disk, *busNumber, *unitNumber); err != nil {
+			return err
 		}
 	}
 
 	params := &types.DiskAttachOrDetachParams{
-		Disk: &types.Reference{HREF: disk.HREF},
+		Disk:       &types.Reference{HREF: disk.HREF},
+		BusNumber:  busNumber,
+		UnitNumber: unitNumber,
 	}
 
-	klog.Infof("Attaching disk with params [%v]", params)
-	task, err := vm.AttachDisk(params)
-	if err != nil {
-		return fmt.Errorf("failed to run AttachDisk with params [%v]: [%v]", params, err)
+	if diskManager.DryRun {
+		klog.Infof("Dry run: not attaching disk [%s] to VM [%s]", disk.Name, vm.VM.Name)
+		return nil
 	}
-	klog.Infof("AttachDisk returned task: [%#v]", task.Task)
 
-	err = task.WaitTaskCompletion()
+	klog.Infof("Attaching disk with params [%v]", params)
+	err = observeVCDCall(operationAttachDisk, func() error {
+		task, err := vm.AttachDisk(params)
+		if err != nil {
+			return fmt.Errorf("failed to run AttachDisk with params [%v]: [%v]", params, err)
+		}
+		klog.Infof("AttachDisk returned task: [%#v]", task.Task)
+
+		if err = waitForTask(ctx, &task); err != nil {
+			return fmt.Errorf("failed waiting for disk [%s] to attach to vm [%s]: [%v]",
+				disk.Name, vm.VM.Name, err)
+		}
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("failed waiting for disk [%s] to attach to vm [%s]",
-			disk.Name, vm.VM.Name)
+		return err
 	}
 
 	if err = diskManager.govcdRefresh(disk); err != nil {
 		return fmt.Errorf("unable to refresh disk [%s] for verification: [%v]", disk.Name, err)
 	}
-	if addEventRdeErr := diskManager.AddToEventSet(util.DiskAttachEvent, "", disk.Name, map[string]interface{}{"Detailed Info": fmt.Sprintf("Successfully attached volume %s to node %s ", disk.Name, vm.VM.Name)}); addEventRdeErr != nil {
+	if addEventRdeErr := diskManager.addToEventSet(util.DiskAttachEvent, "", disk.Name, map[string]interface{}{"Detailed Info": fmt.Sprintf("Successfully attached volume %s to node %s ", disk.Name, vm.VM.Name)}); addEventRdeErr != nil {
 		klog.Errorf("unable to add event [%s] into [CSI.Events] in RDE [%s]", util.DiskAttachEvent, diskManager.ClusterID)
 	}
 
 	return nil
 }
 
+// checkDiskUnitIsFree returns an error if another disk of vm is the unit unitNumber of the bus busNumber of the
+// adapter that disk would be attached to. The VM is read again since the disks of a cached VM may be stale.
+func (diskManager *DiskManager) checkDiskUnitIsFree(vm *govcd.VM, disk *vcdtypes.Disk, busNumber int,
+	unitNumber int) error {
+
+	adapterType, ok := SCSIAdapterTypes[disk.BusSubType]
+	if !ok {
+		return fmt.Errorf("unable to find the adapter of bus sub type [%s] of disk [%s]", disk.BusSubType, disk.Name)
+	}
+
+	currVM := &types.Vm{}
+	if _, err := diskManager.VCDClient.VCDClient.Client.ExecuteRequest(vm.VM.HREF, http.MethodGet, "",
+		"error getting VM: %s", nil, currVM); err != nil {
+		return fmt.Errorf("unable to get disks of VM [%s]: [%v]", vm.VM.Name, err)
+	}
+	if currVM.VmSpecSection == nil || currVM.VmSpecSection.DiskSection == nil {
+		return nil
+	}
+	for _, diskSettings := range currVM.VmSpecSection.DiskSection.DiskSettings {
+		if diskSettings.AdapterType != adapterType || diskSettings.BusNumber != busNumber ||
+			diskSettings.UnitNumber != unitNumber {
+			continue
+		}
+		if diskSettings.Disk != nil && diskSettings.Disk.HREF == disk.HREF {
+			continue
+		}
+		usedBy := diskSettings.DiskId
+		if diskSettings.Disk != nil {
+			usedBy = diskSettings.Disk.Name
+		}
+		return fmt.Errorf("unit [%d] of bus [%d] of VM [%s] is already used by disk [%s]", unitNumber, busNumber,
+			vm.VM.Name, usedBy)
+	}
+
+	return nil
+}
+
+// getVMStatus returns the current status of vm, which is read again since the VMs of the nodes are cached. vm itself
+// is not refreshed, since it may be used by other operations.
+func (diskManager *DiskManager) getVMStatus(vm *govcd.VM) (int, error) {
+	currVM := &types.Vm{}
+	if _, err := diskManager.VCDClient.VCDClient.Client.ExecuteRequest(vm.VM.HREF, http.MethodGet, "",
+		"error getting VM: %s", nil, currVM); err != nil {
+		return 0, err
+	}
+
+	return currVM.Status, nil
+}
+
+// CheckAttachPowerState returns an ErrAttachUnsupported error if the disk diskName with the bus type busType cannot
+// be attached to the VM vmName with the status vmStatus. VCD attaches a disk with the same action whatever the power
+// state of the VM: the disk is hot-added to a VM that is powered on, which the IDE bus does not support, and added
+// offline to a VM that is powered off, which is only done if allowOfflineAttach is set.
+func CheckAttachPowerState(vmName string, vmStatus int, diskName string, busType string,
+	allowOfflineAttach bool) error {
+
+	switch types.VAppStatuses[vmStatus] {
+	case "POWERED_ON":
+		if busType == VCDBusTypeIDE {
+			return NewDiskError(ErrAttachUnsupported, diskName, fmt.Errorf(
+				"disk [%s] on an IDE bus cannot be hot-added to VM [%s] that is powered on", diskName, vmName))
+		}
+	case "POWERED_OFF":
+		if !allowOfflineAttach {
+			return NewDiskError(ErrAttachUnsupported, diskName, fmt.Errorf(
+				"VM [%s] is powered off, and disk [%s] is only attached offline if offline attaches are allowed",
+				vmName, diskName))
+		}
+		klog.Infof("VM [%s] is powered off, hence disk [%s] is attached offline", vmName, diskName)
+	}
+
+	return nil
+}
+
+// FindVMByName finds the VM vmName in the vApp vAppName of the cluster VDC
+func (diskManager *DiskManager) FindVMByName(vAppName string, vmName string) (*govcd.VM, error) {
+	diskManager.VCDClient.RWLock.RLock()
+	defer diskManager.VCDClient.RWLock.RUnlock()
+
+	vdcManager, err := vcdsdk.NewVDCManager(diskManager.VCDClient.Client, diskManager.VCDClient.ClusterOrgName,
+		diskManager.VCDClient.ClusterOVDCName)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get vdcManager: [%v]", err)
+	}
+
+	return vdcManager.FindVMByName(vAppName, vmName)
+}
+
+// FindVMByNodeID finds the VM of the node nodeID, which is the name of the VM. The VM is looked up in the vApp of the
+// cluster first, if there is one, and then in the whole VDC, so that standalone VMs and VMs moved to other vApps are
+// still found. Only the vApp is searched if VAppScopedVMSearch is set. The VM found is reused for vmCacheTTL.
+func (diskManager *DiskManager) FindVMByNodeID(nodeID string) (*govcd.VM, error) {
+	if nodeID == "" {
+		return nil, fmt.Errorf("node ID should not be empty")
+	}
+
+	diskManager.vmCacheLock.Lock()
+	cached, ok := diskManager.vmCache[nodeID]
+	diskManager.vmCacheLock.Unlock()
+	if ok && time.Now().Before(cached.expiry) {
+		return cached.vm, nil
+	}
+
+	var vm *govcd.VM
+	var err error
+	if diskManager.VAppScopedVMSearch {
+		if diskManager.VAppName == "" {
+			return nil, fmt.Errorf("unable to find vm [%s]: vApp scoped search needs the vApp of the cluster", nodeID)
+		}
+		if vm, err = diskManager.FindVMByName(diskManager.VAppName, nodeID); err != nil {
+			return nil, fmt.Errorf("unable to find vm [%s] in vApp [%s]: [%v]", nodeID, diskManager.VAppName, err)
+		}
+	} else if diskManager.VAppName != "" {
+		vm, err = diskManager.FindVMByName(diskManager.VAppName, nodeID)
+		if err != nil {
+			klog.Infof("Unable to find vm [%s] in vApp [%s]; searching the VDC: [%v]",
+				nodeID, diskManager.VAppName, err)
+		}
+	}
+	if vm == nil {
+		if vm, err = diskManager.queryVMByName(nodeID); err != nil {
+			return nil, err
+		}
+	}
+
+	diskManager.vmCacheLock.Lock()
+	if diskManager.vmCache == nil {
+		diskManager.vmCache = make(map[string]cachedVM)
+	}
+	diskManager.vmCache[nodeID] = cachedVM{
+		vm:     vm,
+		expiry: time.Now().Add(vmCacheTTL),
+	}
+	diskManager.vmCacheLock.Unlock()
+
+	return vm, nil
+}
+
+// FindVMByID finds the VM whose ID is vmID, which is the URN of the VM or its UUID, with a single request instead of
+// searching the VDC for the name of the VM. The VM need not be in the VDC of the cluster.
+func (diskManager *DiskManager) FindVMByID(vmID string) (*govcd.VM, error) {
+	vmUUID := strings.TrimPrefix(vmID, VMURNPrefix)
+	if vmUUID == "" || strings.ContainsAny(vmUUID, "/?#") {
+		return nil, fmt.Errorf("vm ID [%s] should be the URN or the UUID of a vm", vmID)
+	}
+
+	diskManager.VCDClient.RWLock.RLock()
+	defer diskManager.VCDClient.RWLock.RUnlock()
+
+	client := &diskManager.VCDClient.VCDClient.Client
+	vmHREF := fmt.Sprintf("%s/vApp/vm-%s", client.VCDHREF.String(), vmUUID)
+	vm, err := client.GetVMByHref(vmHREF)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get vm [%s] by href [%s]: [%v]", vmID, vmHREF, err)
+	}
+
+	return vm, nil
+}
+
+// queryVMByName finds the only VM named vmName in the VDC of the cluster, in any vApp
+func (diskManager *DiskManager) queryVMByName(vmName string) (*govcd.VM, error) {
+	diskManager.VCDClient.RWLock.RLock()
+	defer diskManager.VCDClient.RWLock.RUnlock()
+
+	client := &diskManager.VCDClient.VCDClient.Client
+	queryType := types.QtVm
+	if client.IsSysAdmin {
+		queryType = types.QtAdminVm
+	}
+
+	results, err := client.QueryWithNotEncodedParams(map[string]string{
+		"type": queryType,
+	}, map[string]string{
+		"filter": fmt.Sprintf("name==%s;vdc==%s", url.QueryEscape(vmName),
+			url.QueryEscape(diskManager.VCDClient.VDC.Vdc.HREF)),
+		"filterEncoded": "true",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to query vms named [%s]: [%v]", vmName, err)
+	}
+
+	vmRecords := results.Results.VMRecord
+	if client.IsSysAdmin {
+		vmRecords = results.Results.AdminVMRecord
+	}
+	var matches []*types.QueryResultVMRecordType
+	for _, vmRecord := range vmRecords {
+		// the VMs of vApp templates in catalogs cannot be nodes of the cluster
+		if vmRecord.VAppTemplate || vmRecord.Deleted {
+			continue
+		}
+		matches = append(matches, vmRecord)
+	}
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("unable to find vm [%s] in VDC [%s]: [%v]", vmName,
+			diskManager.VCDClient.ClusterOVDCName, govcd.ErrorEntityNotFound)
+	case 1:
+	default:
+		vApps := make([]string, len(matches))
+		for i, match := range matches {
+			vApps[i] = match.ContainerName
+		}
+		return nil, fmt.Errorf("found [%d] vms named [%s] in VDC [%s], in vApps [%v]", len(matches), vmName,
+			diskManager.VCDClient.ClusterOVDCName, vApps)
+	}
+
+	vm, err := client.GetVMByHref(matches[0].HREF)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get vm [%s] by href [%s]: [%v]", vmName, matches[0].HREF, err)
+	}
+	return vm, nil
+}
+
 // DetachVolume will detach diskName from vm
 func (diskManager *DiskManager) DetachVolume(vm *govcd.VM, diskName string) error {
+	return diskManager.DetachVolumeWithContext(context.Background(), vm, diskName)
+}
+
+// DetachVolumeWithContext is the same as DetachVolume but traces the detachment in a child span of the span of ctx
+func (diskManager *DiskManager) DetachVolumeWithContext(ctx context.Context, vm *govcd.VM,
+	diskName string) (err error) {
+	ctx, span := diskManager.VCDClient.startSpan(ctx, operationDetachDisk, diskName)
+	defer func() { span.end(err) }()
+
 	diskManager.VCDClient.RWLock.Lock()
 	defer diskManager.VCDClient.RWLock.Unlock()
+	// the requests to VCD are abandoned once the caller gives up on the operation
+	defer diskManager.VCDClient.bindToContext(ctx)()
+	defer func() { err = contextError(ctx, err) }()
+	defer func() { err = diskOperationError(diskName, err) }()
 
 	klog.Infof("Entered DetachVolume for vm [%v], disk [%s]\n", vm, diskName)
 
-	disk, err := diskManager.GetDiskByName(diskName)
-	if err == govcd.ErrorEntityNotFound {
+	if err := diskManager.VCDClient.refreshBearerTokenIfExpiring(ctx); err != nil {
+		return fmt.Errorf("unable to refresh bearer token to detach disk [%s]: [%v]", diskName, err)
+	}
+
+	disk, err := diskManager.getDiskByName(diskName)
+	if errors.Is(err, ErrDiskNotFound) {
 		klog.Warningf("Unable to find disk [%s]. It is probably already deleted.", diskName)
 		return nil
 	} else if err != nil {
@@ -550,16 +2063,26 @@ func (diskManager *DiskManager) DetachVolume(vm *govcd.VM, diskName string) erro
 	params := &types.DiskAttachOrDetachParams{
 		Disk: &types.Reference{HREF: disk.HREF},
 	}
-	task, err := vm.DetachDisk(params)
-	if err != nil {
-		return fmt.Errorf("unable to detach disk [%s] from VM [%s]: [%v]", disk.Name, vm.VM.Name, err)
+	if diskManager.DryRun {
+		klog.Infof("Dry run: not detaching disk [%s] from VM [%s]", disk.Name, vm.VM.Name)
+		return nil
 	}
-	err = task.WaitTaskCompletion()
+
+	err = observeVCDCall(operationDetachDisk, func() error {
+		task, err := vm.DetachDisk(params)
+		if err != nil {
+			return fmt.Errorf("unable to detach disk [%s] from VM [%s]: [%v]", disk.Name, vm.VM.Name, err)
+		}
+		if err = waitForTask(ctx, &task); err != nil {
+			return fmt.Errorf("error while waiting for detach task for disk [%s] from VM [%s]: [%v]",
+				diskName, vm.VM.Name, err)
+		}
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("error while waiting for detach task for disk [%s] from VM [%s]",
-			diskName, vm.VM.Name)
+		return err
 	}
-	if addEventRdeErr := diskManager.AddToEventSet(util.DiskDetachEvent, "", disk.Name, map[string]interface{}{"Detailed Info": fmt.Sprintf("Successfully detached volume %s from node %s ", disk.Name, vm.VM.Name)}); addEventRdeErr != nil {
+	if addEventRdeErr := diskManager.addToEventSet(util.DiskDetachEvent, "", disk.Name, map[string]interface{}{"Detailed Info": fmt.Sprintf("Successfully detached volume %s from node %s ", disk.Name, vm.VM.Name)}); addEventRdeErr != nil {
 		klog.Errorf("unable to add event [%s] into [CSI.Events] in RDE [%s]", util.DiskDetachEvent, diskManager.ClusterID)
 	}
 	klog.Infof("Successfully detached disk [%s] from VM [%s]", disk.Name, vm.VM.Name)
@@ -567,6 +2090,67 @@ func (diskManager *DiskManager) DetachVolume(vm *govcd.VM, diskName string) erro
 	return nil
 }
 
+// WaitForDiskDetached checks every pollInterval whether the disk diskName is attached to vm, until it is not. The
+// detach task may complete before VCD releases the disk, and until then the disk cannot be attached to another VM.
+// A deleted disk is detached. It gives up once ctx is done.
+func (diskManager *DiskManager) WaitForDiskDetached(ctx context.Context, vm *govcd.VM, diskName string,
+	pollInterval time.Duration) error {
+
+	if diskManager.DryRun {
+		return nil
+	}
+	for {
+		attached, err := diskManager.diskAttachedToVM(ctx, vm, diskName)
+		if err != nil {
+			return err
+		}
+		if !attached {
+			klog.Infof("Disk [%s] is detached from VM [%s]", diskName, vm.VM.Name)
+			return nil
+		}
+
+		klog.Infof("Disk [%s] is still attached to VM [%s]; checking again in [%v]", diskName, vm.VM.Name,
+			pollInterval)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("disk [%s] is still attached to VM [%s]: [%v]", diskName, vm.VM.Name, ctx.Err())
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// diskAttachedToVM returns true if VCD reports the disk diskName as attached to vm
+func (diskManager *DiskManager) diskAttachedToVM(ctx context.Context, vm *govcd.VM, diskName string) (bool, error) {
+	diskManager.VCDClient.RWLock.Lock()
+	defer diskManager.VCDClient.RWLock.Unlock()
+	defer diskManager.VCDClient.bindToContext(ctx)()
+
+	if err := diskManager.VCDClient.refreshBearerTokenIfExpiring(ctx); err != nil {
+		return false, fmt.Errorf("unable to refresh bearer token to get attachment of disk [%s]: [%v]",
+			diskName, err)
+	}
+
+	disk, err := diskManager.getDiskByName(diskName)
+	if errors.Is(err, ErrDiskNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("unable to get disk details for [%s]: [%v]", diskName, contextError(ctx, err))
+	}
+
+	attachedVMs, err := diskManager.govcdAttachedVM(disk)
+	if err != nil {
+		return false, fmt.Errorf("unable to find VMs that disk [%s] is attached to: [%v]", diskName,
+			contextError(ctx, err))
+	}
+	for _, attachedVM := range attachedVMs {
+		if attachedVM != nil && attachedVM.HREF == vm.VM.HREF {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
 func (diskManager *DiskManager) GetRDEPersistentVolumes(rde *swaggerClient.DefinedEntity) ([]string, error) {
 	pvStrs, err := util.GetPVsFromRDE(rde)
 	if err != nil {
@@ -702,13 +2286,16 @@ func (diskManager *DiskManager) removePvFromRDE(removePvId string, removePvName
 
 // UpgradeRDEPersistentVolumes This function will only upgrade RDE CSI section for CAPVCD cluster
 func (diskManager *DiskManager) UpgradeRDEPersistentVolumes() error {
+	diskManager.VCDClient.RWLock.Lock()
+	defer diskManager.VCDClient.RWLock.Unlock()
+
 	for i := 0; i < vcdsdk.MaxRDEUpdateRetries; i++ {
 		rde, _, etag, err := diskManager.VCDClient.APIClient.DefinedEntityApi.GetDefinedEntity(context.TODO(),
 			diskManager.ClusterID)
 		if err != nil {
 			return fmt.Errorf("error when getting defined entity from VCD: [%v]", err)
 		}
-		rdeManager := vcdsdk.NewRDEManager(diskManager.VCDClient, diskManager.ClusterID, util.CSIName, version.Version)
+		rdeManager := vcdsdk.NewRDEManager(diskManager.VCDClient.Client, diskManager.ClusterID, util.CSIName, version.Version)
 		statusEntry, ok := rde.Entity["status"]
 		if !ok {
 			klog.Infof("key 'Status' is missing in the RDE [%s]; skipping upgrade of CSI section in RDE status", diskManager.ClusterID)
@@ -829,8 +2416,16 @@ func (diskManager *DiskManager) UpgradeRDEPersistentVolumes() error {
 	return fmt.Errorf("unable to update rde due to incorrect etag after %d tries", vcdsdk.MaxRDEUpdateRetries)
 }
 
+// AddToErrorSet adds an error to the CSI section of the RDE of the cluster
 func (diskManager *DiskManager) AddToErrorSet(errorType string, vcdResourceId string, vcdResourceName string, detailMap map[string]interface{}) error {
-	rdeManager := vcdsdk.NewRDEManager(diskManager.VCDClient, diskManager.ClusterID, util.CSIName, version.Version)
+	diskManager.VCDClient.RWLock.RLock()
+	defer diskManager.VCDClient.RWLock.RUnlock()
+
+	return diskManager.addToErrorSet(errorType, vcdResourceId, vcdResourceName, detailMap)
+}
+
+func (diskManager *DiskManager) addToErrorSet(errorType string, vcdResourceId string, vcdResourceName string, detailMap map[string]interface{}) error {
+	rdeManager := vcdsdk.NewRDEManager(diskManager.VCDClient.Client, diskManager.ClusterID, util.CSIName, version.Version)
 	newError := vcdsdk.BackendError{
 		Name:              errorType,
 		OccurredAt:        time.Now(),
@@ -841,13 +2436,29 @@ func (diskManager *DiskManager) AddToErrorSet(errorType string, vcdResourceId st
 	return rdeManager.AddToErrorSet(context.Background(), vcdsdk.ComponentCSI, newError, util.DefaultWindowSize)
 }
 
+// RemoveFromErrorSet removes the errors of errorType from the CSI section of the RDE of the cluster
 func (diskManager *DiskManager) RemoveFromErrorSet(errorType string, vcdResourceId string, vcdResourceName string) error {
-	rdeManager := vcdsdk.NewRDEManager(diskManager.VCDClient, diskManager.ClusterID, util.CSIName, version.Version)
+	diskManager.VCDClient.RWLock.RLock()
+	defer diskManager.VCDClient.RWLock.RUnlock()
+
+	return diskManager.removeFromErrorSet(errorType, vcdResourceId, vcdResourceName)
+}
+
+func (diskManager *DiskManager) removeFromErrorSet(errorType string, vcdResourceId string, vcdResourceName string) error {
+	rdeManager := vcdsdk.NewRDEManager(diskManager.VCDClient.Client, diskManager.ClusterID, util.CSIName, version.Version)
 	return rdeManager.RemoveErrorByNameOrIdFromErrorSet(context.Background(), vcdsdk.ComponentCSI, errorType, vcdResourceId, vcdResourceName)
 }
 
+// AddToEventSet adds an event to the CSI section of the RDE of the cluster
 func (diskManager *DiskManager) AddToEventSet(eventType string, vcdResourceId string, vcdResourceName string, detailMap map[string]interface{}) error {
-	rdeManager := vcdsdk.NewRDEManager(diskManager.VCDClient, diskManager.ClusterID, util.CSIName, version.Version)
+	diskManager.VCDClient.RWLock.RLock()
+	defer diskManager.VCDClient.RWLock.RUnlock()
+
+	return diskManager.addToEventSet(eventType, vcdResourceId, vcdResourceName, detailMap)
+}
+
+func (diskManager *DiskManager) addToEventSet(eventType string, vcdResourceId string, vcdResourceName string, detailMap map[string]interface{}) error {
+	rdeManager := vcdsdk.NewRDEManager(diskManager.VCDClient.Client, diskManager.ClusterID, util.CSIName, version.Version)
 	newEvent := vcdsdk.BackendEvent{
 		Name:              eventType,
 		OccurredAt:        time.Now(),
@@ -111,7 +111,7 @@ func TestDiskCreateAttach(t *testing.T) {
 	// create disk with bad storage profile: should not succeed
 	diskName := fmt.Sprintf("test-pvc-%s", uuid.New().String())
 	disk, err := diskManager.CreateDisk(diskName, 100, VCDBusTypeSCSI, VCDBusSubTypeVirtualSCSI,
-		"", "dev", true)
+		"", "dev", true, 0)
 	assert.Errorf(t, err, "should not be able to create disk with storage profile [dev]")
 	assert.Nil(t, disk, "disk created should be nil")
 
@@ -119,14 +119,14 @@ func TestDiskCreateAttach(t *testing.T) {
 	diskName = fmt.Sprintf("test-pvc-%s", uuid.New().String())
 	// diskName = "test-pvc-29830aa7-377e-4496-b87d-41f2e50a5491"
 	disk, err = diskManager.CreateDisk(diskName, 100, VCDBusTypeSCSI, VCDBusSubTypeVirtualSCSI,
-		"", "*", true)
+		"", "*", true, 0)
 	assert.NoErrorf(t, err, "unable to create disk with name [%s]", diskName)
 	require.NotNil(t, disk, "disk created should not be nil")
 	assert.NotNil(t, disk.UUID, "disk UUID should not be nil")
 
 	// try to create same disk with same parameters: should succeed
 	disk, err = diskManager.CreateDisk(diskName, 100, VCDBusTypeSCSI, VCDBusSubTypeVirtualSCSI,
-		"", "*", true)
+		"", "*", true, 0)
 	assert.NoError(t, err, "unable to create disk again with name [%s]", diskName)
 	require.NotNil(t, disk, "disk created should not be nil")
 
@@ -141,14 +141,14 @@ func TestDiskCreateAttach(t *testing.T) {
 
 	// try to create same disk with different parameters; should not succeed
 	disk1, err := diskManager.CreateDisk(diskName, 1000, VCDBusTypeSCSI, VCDBusSubTypeVirtualSCSI,
-		"", "", true)
+		"", "", true, 0)
 	assert.Error(t, err, "should not be able to create same disk with different parameters")
 	assert.Nil(t, disk1, "disk should not be created")
 
 	// get VM nodeID should be the existing VM name
 	nodeID := "capi-cluster-2-md0-85c8585c96-8bqj2"
 
-	vdcManager, err := vcdsdk.NewVDCManager(diskManager.VCDClient, diskManager.VCDClient.ClusterOrgName, diskManager.VCDClient.ClusterOVDCName)
+	vdcManager, err := vcdsdk.NewVDCManager(diskManager.VCDClient.Client, diskManager.VCDClient.ClusterOrgName, diskManager.VCDClient.ClusterOVDCName)
 	assert.NoError(t, err, "unable to get vdcManager")
 	// Todo find a suitable way to handle cluster
 	vm, err := vdcManager.FindVMByName(vAppName, nodeID)
@@ -159,7 +159,7 @@ func TestDiskCreateAttach(t *testing.T) {
 	err = diskManager.AttachVolume(vm, disk)
 	assert.NoError(t, err, "unable to attach disk [%s] to vm [%#v]", disk.Name, vm)
 
-	attachedVMs, err := diskManager.govcdAttachedVM(disk)
+	attachedVMs, err := diskManager.govcdAttachedVM(disk.vcdDisk)
 	assert.NoError(t, err, "unable to get VMs attached to disk [%#v]", disk)
 	assert.NotNil(t, attachedVMs, "VM [%s] should be returned", nodeID)
 	assert.EqualValues(t, len(attachedVMs), 1, "[%d] VM(s) should be returned", 1)
@@ -168,7 +168,7 @@ func TestDiskCreateAttach(t *testing.T) {
 	err = diskManager.DetachVolume(vm, disk.Name)
 	assert.NoError(t, err, "unable to detach disk [%s] from vm [%#v]", disk.Name, vm)
 
-	attachedVMs, err = diskManager.govcdAttachedVM(disk)
+	attachedVMs, err = diskManager.govcdAttachedVM(disk.vcdDisk)
 	assert.NoError(t, err, "unable to get VMs attached to disk [%#v]", disk)
 	assert.Nil(t, attachedVMs, "no VM should be returned", nodeID)
 
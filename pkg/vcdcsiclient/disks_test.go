@@ -0,0 +1,946 @@
+/*
+   Copyright 2021 VMware, Inc.
+   SPDX-License-Identifier: Apache-2.0
+*/
+
+package vcdcsiclient
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware/cloud-director-named-disk-csi-driver/pkg/vcdtypes"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResizeDisk(t *testing.T) {
+	disk := &vcdtypes.Disk{
+		Name:       "test-pvc",
+		SizeMb:     100,
+		BusType:    VCDBusTypeSCSI,
+		BusSubType: VCDBusSubTypeVirtualSCSI,
+	}
+	server, _ := newFakeVCDServer("org", "vdc", disk)
+	defer server.Close()
+
+	client, err := NewVCDClientFromSecrets(server.URL, "org", "vdc", "org", "user", "password", "",
+		true, true)
+	require.NoError(t, err, "client should be created against the fake VCD")
+	defer EvictClient(client)
+	diskManager := &DiskManager{VCDClient: client}
+
+	assert.NoError(t, diskManager.ResizeDisk(disk.Name, 200*mbToBytes), "disk should be grown")
+	resizedDisk, err := diskManager.GetDiskByName(disk.Name)
+	require.NoError(t, err, "resized disk should be found")
+	assert.EqualValues(t, 200, resizedDisk.SizeMB, "disk should have the requested size")
+	assert.Equal(t, VCDBusSubTypeVirtualSCSI, resizedDisk.BusSubType, "resize should keep the bus of the disk")
+
+	assert.NoError(t, diskManager.ResizeDisk(disk.Name, 150*mbToBytes+1),
+		"resizing to a size that the disk already has should succeed")
+	resizedDisk, err = diskManager.GetDiskByName(disk.Name)
+	require.NoError(t, err, "resized disk should be found")
+	assert.EqualValues(t, 200, resizedDisk.SizeMB, "disk that is large enough should not be resized")
+
+	assert.Error(t, diskManager.ResizeDisk(disk.Name, 0), "resizing to a size that is not positive should fail")
+	assert.ErrorIs(t, diskManager.ResizeDisk("missing-pvc", 200*mbToBytes), ErrDiskNotFound,
+		"resizing a missing disk should fail with not found")
+}
+
+func TestCloneDisk(t *testing.T) {
+	newDisk := func(name string) *vcdtypes.Disk {
+		return &vcdtypes.Disk{Name: name, SizeMb: 100, BusType: VCDBusTypeSCSI, BusSubType: VCDBusSubTypeLsiLogicSAS}
+	}
+	attachedDisk := newDisk("attached-pvc")
+	attachedDisk.AttachedVMs = []*types.Reference{{HREF: "https://vcd/api/vApp/vm-1", Name: "node-1"}}
+	server, _ := newFakeVCDServer("org", "vdc", newDisk("source-pvc"), attachedDisk)
+	defer server.Close()
+
+	client, err := NewVCDClientFromSecrets(server.URL, "org", "vdc", "org", "user", "password", "",
+		true, true)
+	require.NoError(t, err, "client should be created against the fake VCD")
+	defer EvictClient(client)
+	diskManager := &DiskManager{VCDClient: client}
+
+	clonedDisk, err := diskManager.CloneDisk("source-pvc", "clone-pvc", "", 50*mbToBytes)
+	require.NoError(t, err, "disk should be cloned")
+	assert.EqualValues(t, 100, clonedDisk.SizeMB, "clone smaller than the source disk should have its size")
+	assert.Equal(t, VCDBusSubTypeLsiLogicSAS, clonedDisk.BusSubType, "clone should have the bus of the source disk")
+	sameDisk, err := diskManager.CloneDisk("source-pvc", "clone-pvc", "", 50*mbToBytes)
+	require.NoError(t, err, "clone that exists should be returned")
+	assert.Equal(t, clonedDisk.ID, sameDisk.ID, "disk should not be cloned again")
+	largerDisk, err := diskManager.CloneDisk("source-pvc", "larger-pvc", "", 200*mbToBytes)
+	require.NoError(t, err, "larger disk should be cloned")
+	assert.EqualValues(t, 200, largerDisk.SizeMB, "clone should have the requested size larger than the source")
+	require.NoError(t, diskManager.DeleteDisk("source-pvc"), "source disk should be deleted")
+	_, err = diskManager.GetDiskByName("clone-pvc")
+	assert.NoError(t, err, "clone should be kept when its source is deleted")
+	assert.NoError(t, diskManager.DeleteDisk("clone-pvc"), "clone should be deleted on its own")
+
+	_, err = diskManager.CloneDisk("attached-pvc", "attached-clone-pvc", "", 0)
+	assert.ErrorIs(t, err, ErrDiskAttached, "disk attached to a VM should not be cloned")
+	_, err = diskManager.CloneDisk("missing-pvc", "missing-clone-pvc", "", 0)
+	assert.ErrorIs(t, err, ErrDiskNotFound, "cloning a missing disk should fail with not found")
+}
+
+func TestDeleteDiskInTransition(t *testing.T) {
+	newDisk := func(name string) *vcdtypes.Disk {
+		return &vcdtypes.Disk{Name: name, SizeMb: 100, BusType: VCDBusTypeSCSI, BusSubType: VCDBusSubTypeVirtualSCSI}
+	}
+	server, _ := newFakeVCDServer("org", "vdc", newDisk("detaching-pvc"), newDisk("stuck-pvc"))
+	defer server.Close()
+
+	client, err := NewVCDClientFromSecrets(server.URL, "org", "vdc", "org", "user", "password", "",
+		true, true)
+	require.NoError(t, err, "client should be created against the fake VCD")
+	defer EvictClient(client)
+	diskManager := &DiskManager{VCDClient: client, DeleteTransitionTimeout: time.Second}
+
+	require.NoError(t, diskManager.DeleteDisk("detaching-pvc"),
+		"disk being detached should be deleted once it is deletable")
+	_, err = diskManager.GetDiskByName("detaching-pvc")
+	assert.ErrorIs(t, err, ErrDiskNotFound, "disk should be deleted")
+
+	assert.ErrorIs(t, diskManager.DeleteDisk("stuck-pvc"), ErrDiskInTransition,
+		"disk that stays in transition should not be deleted")
+	_, err = diskManager.GetDiskByName("stuck-pvc")
+	assert.NoError(t, err, "disk in transition should be kept")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = diskManager.DeleteDiskWithContext(ctx, "stuck-pvc")
+	assert.ErrorIs(t, err, context.DeadlineExceeded, "delete should be abandoned with the error of the caller")
+}
+
+func TestCreateDiskWhenBusy(t *testing.T) {
+	server, _ := newFakeVCDServer("org", "vdc")
+	defer server.Close()
+
+	client, err := NewVCDClientFromSecrets(server.URL, "org", "vdc", "org", "user", "password", "",
+		true, true, WithRetry(1, time.Millisecond))
+	require.NoError(t, err, "client should be created against the fake VCD")
+	defer EvictClient(client)
+	diskManager := &DiskManager{VCDClient: client}
+
+	disk, err := diskManager.CreateDisk("busy-pvc", 100, VCDBusTypeSCSI, VCDBusSubTypeVirtualSCSI, "", "",
+		false, 0)
+	require.NoError(t, err, "disk should be created once VCD is no longer busy")
+	assert.Equal(t, "busy-pvc", disk.Name, "created disk should be returned")
+
+	_, err = diskManager.CreateDisk("always-busy-pvc", 100, VCDBusTypeSCSI, VCDBusSubTypeVirtualSCSI, "", "",
+		false, 0)
+	require.Error(t, err, "create should fail while VCD stays busy")
+	assert.True(t, IsEntityBusyError(err), "error should report that VCD is busy")
+	assert.Contains(t, err.Error(), fmt.Sprintf("after [%d] retries", createDiskBusyRetries),
+		"error should report the retries")
+	_, err = diskManager.GetDiskByName("always-busy-pvc")
+	assert.ErrorIs(t, err, ErrDiskNotFound, "disk should not be created")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = diskManager.CreateDiskWithContext(ctx, "always-busy-pvc", 100, VCDBusTypeSCSI,
+		VCDBusSubTypeVirtualSCSI, "", "", false, "", "", 0)
+	assert.ErrorIs(t, err, context.Canceled, "create should be abandoned with the error of the caller")
+}
+
+func TestIsCreateDiskBusyError(t *testing.T) {
+	assert.True(t, isCreateDiskBusyError(fmt.Errorf("unable to create disk: [%w]",
+		&types.Error{MajorErrorCode: 400, MinorErrorCode: "BUSY_ENTITY", Message: "the entity Vdc is busy"})),
+		"busy error should be retried")
+	assert.False(t, isCreateDiskBusyError(fmt.Errorf("the entity is busy and the storage quota is exceeded")),
+		"quota error should not be retried")
+	assert.False(t, isCreateDiskBusyError(fmt.Errorf("entity is busy: [403 Forbidden] access denied")),
+		"permission error should not be retried")
+	assert.False(t, isCreateDiskBusyError(fmt.Errorf("unable to create disk: [500 Internal Server Error]")),
+		"other error should not be retried")
+}
+
+func TestDiskOperationsWithCanceledContext(t *testing.T) {
+	disk := &vcdtypes.Disk{
+		Name:       "test-pvc",
+		SizeMb:     100,
+		BusType:    VCDBusTypeSCSI,
+		BusSubType: VCDBusSubTypeVirtualSCSI,
+	}
+	server, _ := newFakeVCDServer("org", "vdc", disk)
+	defer server.Close()
+
+	client, err := NewVCDClientFromSecrets(server.URL, "org", "vdc", "org", "user", "password", "",
+		true, true)
+	require.NoError(t, err, "client should be created against the fake VCD")
+	defer EvictClient(client)
+	diskManager := &DiskManager{VCDClient: client}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err = diskManager.ResizeDiskWithContext(ctx, disk.Name, 200*mbToBytes)
+	assert.ErrorIs(t, err, context.Canceled, "resize should be abandoned with the error of the caller")
+	assert.Error(t, diskManager.DeleteDiskWithContext(ctx, disk.Name),
+		"deletion should be abandoned once the caller gives up")
+
+	existingDisk, err := diskManager.GetDiskByName(disk.Name)
+	require.NoError(t, err, "disk should still exist")
+	assert.EqualValues(t, 100, existingDisk.SizeMB, "disk should not be resized")
+	assert.NoError(t, diskManager.ResizeDiskWithContext(context.Background(), disk.Name, 200*mbToBytes),
+		"requests should not stay bound to the context of an abandoned operation")
+}
+
+func TestCreateDiskWithStorageProfile(t *testing.T) {
+	server, _ := newFakeVCDServer("org", "vdc")
+	defer server.Close()
+
+	client, err := NewVCDClientFromSecrets(server.URL, "org", "vdc", "org", "user", "password", "",
+		true, true)
+	require.NoError(t, err, "client should be created against the fake VCD")
+	defer EvictClient(client)
+	diskManager := &DiskManager{VCDClient: client}
+
+	disk, err := diskManager.CreateDisk("test-pvc-gold", 100, VCDBusTypeSCSI, VCDBusSubTypeVirtualSCSI,
+		"", "gold", false, 0)
+	require.NoError(t, err, "disk should be created with an existing storage profile")
+	assert.Equal(t, "gold", disk.StorageProfile, "disk should be created with the requested storage profile")
+
+	disk, err = diskManager.CreateDisk("test-pvc-gold", 100, VCDBusTypeSCSI, VCDBusSubTypeVirtualSCSI,
+		"", "gold", false, 0)
+	assert.NoError(t, err, "creating the same disk again should succeed")
+	assert.NotNil(t, disk, "existing disk should be returned")
+
+	_, err = diskManager.CreateDisk("test-pvc-gold", 100, VCDBusTypeSCSI, VCDBusSubTypeVirtualSCSI,
+		"", "*", false, 0)
+	assert.ErrorIs(t, err, ErrDiskExists, "creating the same disk with another storage profile should fail")
+
+	disk, err = diskManager.CreateDisk("test-pvc-silver", 100, VCDBusTypeSCSI, VCDBusSubTypeVirtualSCSI,
+		"", "silver", false, 0)
+	if assert.Error(t, err, "disk should not be created with a missing storage profile") {
+		assert.Contains(t, err.Error(), "storage profile [silver] does not exist in vdc [vdc]",
+			"error should name the missing storage profile and the vdc")
+	}
+	assert.Nil(t, disk, "no disk should be returned for a missing storage profile")
+	_, err = diskManager.GetDiskByName("test-pvc-silver")
+	assert.ErrorIs(t, err, ErrDiskNotFound, "no disk should be created for a missing storage profile")
+}
+
+func TestCreateDiskWithStorageProfileURN(t *testing.T) {
+	server, _ := newFakeVCDServer("org", "vdc")
+	defer server.Close()
+
+	client, err := NewVCDClientFromSecrets(server.URL, "org", "vdc", "org", "user", "password", "",
+		true, true)
+	require.NoError(t, err, "client should be created against the fake VCD")
+	defer EvictClient(client)
+	diskManager := &DiskManager{VCDClient: client}
+
+	// the fake VDC has two storage profiles named gold, the second of which has the UUID 4
+	disk, err := diskManager.CreateDisk("test-pvc-gold", 100, VCDBusTypeSCSI, VCDBusSubTypeVirtualSCSI,
+		"", "urn:vcloud:vdcstorageProfile:4", false, 0)
+	require.NoError(t, err, "disk should be created with the URN of an existing storage profile")
+	assert.Equal(t, server.URL+"/api/vdcStorageProfile/4", disk.StorageProfileHREF,
+		"disk should be created on the exact storage profile of the URN, not the first one of the name")
+
+	_, err = diskManager.CreateDisk("test-pvc-gold", 100, VCDBusTypeSCSI, VCDBusSubTypeVirtualSCSI,
+		"", "urn:vcloud:vdcstorageProfile:4", false, 0)
+	assert.NoError(t, err, "creating the same disk again with the URN should succeed")
+	_, err = diskManager.CreateDisk("test-pvc-gold", 100, VCDBusTypeSCSI, VCDBusSubTypeVirtualSCSI,
+		"", "urn:vcloud:vdcstorageProfile:2", false, 0)
+	assert.Error(t, err, "creating the same disk with the URN of another storage profile should fail")
+
+	_, err = diskManager.CreateDisk("test-pvc-missing", 100, VCDBusTypeSCSI, VCDBusSubTypeVirtualSCSI,
+		"", "urn:vcloud:vdcstorageProfile:5", false, 0)
+	assert.Error(t, err, "disk should not be created with the URN of a missing storage profile")
+}
+
+func TestStorageProfileMatches(t *testing.T) {
+	reference := &types.Reference{HREF: "https://vcd.example.com/api/vdcStorageProfile/1a-2b", Name: "gold"}
+	assert.True(t, StorageProfileMatches(reference, "gold"), "storage profile should match its name")
+	assert.True(t, StorageProfileMatches(reference, "urn:vcloud:vdcstorageProfile:1a-2b"),
+		"storage profile should match the URN of its href")
+	assert.True(t, StorageProfileMatches(reference, "URN:VCLOUD:VDCSTORAGEPROFILE:1A-2B"),
+		"URNs should be matched case-insensitively")
+	assert.False(t, StorageProfileMatches(reference, "urn:vcloud:vdcstorageProfile:2b"),
+		"storage profile should not match another URN")
+	assert.False(t, StorageProfileMatches(reference, "silver"), "storage profile should not match another name")
+	assert.False(t, StorageProfileMatches(nil, "gold"), "missing storage profile should not match")
+
+	reference.ID = "urn:vcloud:vdcstorageProfile:3c"
+	assert.True(t, StorageProfileMatches(reference, "urn:vcloud:vdcstorageProfile:3c"),
+		"storage profile should match the URN of its ID")
+}
+
+func TestListDisks(t *testing.T) {
+	var fakeDisks []*vcdtypes.Disk
+	for _, name := range []string{"pvc-c", "other-disk", "pvc-a", "pvc-e", "pvc-b", "pvc-d"} {
+		fakeDisks = append(fakeDisks, &vcdtypes.Disk{Name: name, SizeMb: 100})
+	}
+	server, _ := newFakeVCDServer("org", "vdc", fakeDisks...)
+	defer server.Close()
+
+	client, err := NewVCDClientFromSecrets(server.URL, "org", "vdc", "org", "user", "password", "",
+		true, true)
+	require.NoError(t, err, "client should be created against the fake VCD")
+	defer EvictClient(client)
+	diskManager := &DiskManager{VCDClient: client}
+
+	getNames := func(disks []Disk) []string {
+		names := make([]string, len(disks))
+		for idx, disk := range disks {
+			names[idx] = disk.Name
+		}
+		return names
+	}
+
+	disks, nextToken, err := diskManager.ListDisks("", 0)
+	require.NoError(t, err, "all disks should be listed")
+	assert.Equal(t, []string{"pvc-a", "pvc-b", "pvc-c", "pvc-d", "pvc-e"}, getNames(disks),
+		"only disks created by the driver should be listed, sorted by name")
+	assert.EqualValues(t, 100, disks[0].SizeMB, "listed disks should have their size")
+	assert.Empty(t, nextToken, "there should be no next page after all disks")
+
+	disks, nextToken, err = diskManager.ListDisks("", 2)
+	require.NoError(t, err, "first page of disks should be listed")
+	assert.Equal(t, []string{"pvc-a", "pvc-b"}, getNames(disks), "first page should have the first disks")
+	assert.Equal(t, "2", nextToken, "next page should start after the first page")
+
+	disks, nextToken, err = diskManager.ListDisks(nextToken, 2)
+	require.NoError(t, err, "second page of disks should be listed")
+	assert.Equal(t, []string{"pvc-c", "pvc-d"}, getNames(disks), "second page should follow the first page")
+
+	disks, nextToken, err = diskManager.ListDisks(nextToken, 2)
+	require.NoError(t, err, "last page of disks should be listed")
+	assert.Equal(t, []string{"pvc-e"}, getNames(disks), "last page should have the remaining disks")
+	assert.Empty(t, nextToken, "there should be no next page after the last page")
+
+	disks, nextToken, err = diskManager.ListDisks("1", 3)
+	require.NoError(t, err, "disks should be listed from an offset that is not a multiple of the page size")
+	assert.Equal(t, []string{"pvc-b", "pvc-c", "pvc-d"}, getNames(disks), "listing should start at the offset")
+	assert.Equal(t, "4", nextToken, "next page should start after the listed disks")
+
+	_, _, err = diskManager.ListDisks("not-a-token", 2)
+	assert.Error(t, err, "an invalid page token should not be accepted")
+}
+
+func TestListDisksWithVolumeNamePrefix(t *testing.T) {
+	var fakeDisks []*vcdtypes.Disk
+	for _, name := range []string{"pvc-a", "cluster-1-pvc-b", "cluster-1-pvc-a", "cluster-2-pvc-c", "cluster-1-disk"} {
+		fakeDisks = append(fakeDisks, &vcdtypes.Disk{Name: name, SizeMb: 100})
+	}
+	server, _ := newFakeVCDServer("org", "vdc", fakeDisks...)
+	defer server.Close()
+
+	client, err := NewVCDClientFromSecrets(server.URL, "org", "vdc", "org", "user", "password", "",
+		true, true)
+	require.NoError(t, err, "client should be created against the fake VCD")
+	defer EvictClient(client)
+	diskManager := &DiskManager{VCDClient: client, VolumeNamePrefix: "cluster-1-"}
+
+	assert.Equal(t, "cluster-1-pvc-d", diskManager.GetDiskName("pvc-d"),
+		"disk name should be the volume name with the prefix")
+
+	disks, nextToken, err := diskManager.ListDisks("", 0)
+	require.NoError(t, err, "all disks should be listed")
+	names := make([]string, len(disks))
+	for idx, disk := range disks {
+		names[idx] = disk.Name
+	}
+	assert.Equal(t, []string{"cluster-1-pvc-a", "cluster-1-pvc-b"}, names,
+		"only disks created by the driver with the prefix should be listed")
+	assert.Empty(t, nextToken, "there should be no next page after all disks")
+}
+
+func TestListDisksForCluster(t *testing.T) {
+	fakeDisks := []*vcdtypes.Disk{
+		{Name: "pvc-a", SizeMb: 100, AttachedVMs: []*types.Reference{{HREF: "https://vcd/api/vApp/vm-1", Name: "node-1"}}},
+		{Name: "pvc-b", SizeMb: 100},
+		{Name: "pvc-c", SizeMb: 100},
+		{Name: "pvc-d", SizeMb: 100},
+		{Name: "other-disk", SizeMb: 100},
+	}
+	server, _ := newFakeVCDServer("org", "vdc", fakeDisks...)
+	defer server.Close()
+
+	client, err := NewVCDClientFromSecrets(server.URL, "org", "vdc", "org", "user", "password", "",
+		true, true)
+	require.NoError(t, err, "client should be created against the fake VCD")
+	defer EvictClient(client)
+	diskManager := &DiskManager{VCDClient: client}
+
+	for diskName, clusterID := range map[string]string{
+		"pvc-a":      "cluster-1",
+		"pvc-b":      "cluster-1",
+		"pvc-c":      "cluster-2",
+		"other-disk": "cluster-1",
+	} {
+		require.NoError(t, diskManager.SetDiskMetadata(context.Background(), diskName,
+			map[string]string{ClusterIDMetadataKey: clusterID}), "cluster of disk [%s] should be set", diskName)
+	}
+
+	disks, err := diskManager.ListDisksForCluster("cluster-1")
+	require.NoError(t, err, "disks of the cluster should be listed")
+	require.Len(t, disks, 2, "only disks created by the driver for the cluster should be listed")
+	assert.Equal(t, "pvc-a", disks[0].Name, "disks should be sorted by name")
+	require.Len(t, disks[0].AttachedVMs, 1, "attached disk should have its VM")
+	assert.Equal(t, "node-1", disks[0].AttachedVMs[0], "attached disk should have the VM of its node")
+	assert.Equal(t, "pvc-b", disks[1].Name, "disks should be sorted by name")
+	assert.Empty(t, disks[1].AttachedVMs, "detached disk should have no VMs")
+
+	disks, err = diskManager.ListDisksForCluster("cluster-3")
+	require.NoError(t, err, "disks of a cluster without disks should be listed")
+	assert.Empty(t, disks, "cluster without disks should have none")
+
+	_, err = diskManager.ListDisksForCluster("")
+	assert.Error(t, err, "empty cluster ID should not be accepted")
+}
+
+func TestValidateVolumeNamePrefix(t *testing.T) {
+	for _, prefix := range []string{"", "cluster-1-", "c1.", "C_1"} {
+		assert.NoError(t, ValidateVolumeNamePrefix(prefix), "prefix [%s] should be valid", prefix)
+	}
+	for _, prefix := range []string{"-cluster", "vdc/", "cluster 1", "prefix" + strings.Repeat("x", 32)} {
+		assert.Error(t, ValidateVolumeNamePrefix(prefix), "prefix [%s] should be invalid", prefix)
+	}
+}
+
+func TestGetVDCCapacity(t *testing.T) {
+	server, _ := newFakeVCDServer("org", "vdc")
+	defer server.Close()
+
+	client, err := NewVCDClientFromSecrets(server.URL, "org", "vdc", "org", "user", "password", "",
+		true, true)
+	require.NoError(t, err, "client should be created against the fake VCD")
+	defer EvictClient(client)
+	diskManager := &DiskManager{VCDClient: client}
+
+	_, err = diskManager.CreateDisk("test-pvc-gold", 1024, VCDBusTypeSCSI, VCDBusSubTypeVirtualSCSI,
+		"", "gold", false, 0)
+	require.NoError(t, err, "disk should be created in the gold storage profile")
+
+	capacity, err := diskManager.GetVDCCapacity("gold")
+	assert.NoError(t, err, "capacity of the gold storage profile should be obtained")
+	assert.Equal(t, (10240-1024)*mbToBytes, capacity, "capacity should be the limit less the used storage")
+
+	capacity, err = diskManager.GetVDCCapacity("*")
+	assert.NoError(t, err, "capacity of a storage profile without a limit should be obtained")
+	assert.Zero(t, capacity, "storage profile without a limit should have no capacity")
+
+	capacity, err = diskManager.GetVDCCapacity("")
+	assert.NoError(t, err, "capacity of the vdc should be obtained")
+	assert.Equal(t, (10240-1024)*mbToBytes, capacity, "capacity of the vdc should add up its storage profiles")
+
+	_, err = diskManager.GetVDCCapacity("silver")
+	assert.Error(t, err, "capacity of a missing storage profile should not be obtained")
+}
+
+func TestGetVDCThinProvisioned(t *testing.T) {
+	server, _ := newFakeVCDServer("org", "vdc")
+	defer server.Close()
+
+	client, err := NewVCDClientFromSecrets(server.URL, "org", "vdc", "org", "user", "password", "",
+		true, true)
+	require.NoError(t, err, "client should be created against the fake VCD")
+	defer EvictClient(client)
+	diskManager := &DiskManager{VCDClient: client}
+
+	thinProvisioned, err := diskManager.GetVDCThinProvisioned()
+	require.NoError(t, err, "provisioning of the VDC should be obtained")
+	assert.True(t, thinProvisioned, "VDC should be thin provisioned")
+}
+
+func TestFindDiskByName(t *testing.T) {
+	disk := &vcdtypes.Disk{
+		Name:       "test-pvc",
+		SizeMb:     100,
+		BusType:    VCDBusTypeSCSI,
+		BusSubType: VCDBusSubTypeVirtualSCSI,
+	}
+	server, _ := newFakeVCDServer("org", "vdc", disk)
+	defer server.Close()
+
+	client, err := NewVCDClientFromSecrets(server.URL, "org", "vdc", "org", "user", "password", "",
+		true, true)
+	require.NoError(t, err, "client should be created against the fake VCD")
+	defer EvictClient(client)
+	diskManager := &DiskManager{VCDClient: client}
+
+	foundDisk, err := diskManager.FindDiskByName(disk.Name)
+	require.NoError(t, err, "existing disk should be found")
+	require.NotNil(t, foundDisk, "existing disk should be returned")
+	assert.EqualValues(t, 100, foundDisk.SizeMB, "found disk should have the size of the existing disk")
+
+	foundDisk, err = diskManager.FindDiskByName("missing-pvc")
+	assert.NoError(t, err, "looking for a missing disk should not fail")
+	assert.Nil(t, foundDisk, "no disk should be returned for a missing disk")
+}
+
+func TestSetDiskMetadata(t *testing.T) {
+	disk := &vcdtypes.Disk{
+		Name:       "test-pvc",
+		SizeMb:     100,
+		BusType:    VCDBusTypeSCSI,
+		BusSubType: VCDBusSubTypeVirtualSCSI,
+	}
+	server, _ := newFakeVCDServer("org", "vdc", disk)
+	defer server.Close()
+
+	client, err := NewVCDClientFromSecrets(server.URL, "org", "vdc", "org", "user", "password", "",
+		true, true)
+	require.NoError(t, err, "client should be created against the fake VCD")
+	defer EvictClient(client)
+	diskManager := &DiskManager{VCDClient: client}
+
+	metadata, err := diskManager.GetDiskMetadata(disk.Name)
+	require.NoError(t, err, "metadata of a disk without metadata should be returned")
+	assert.Empty(t, metadata, "disk without metadata should have no entries")
+
+	require.NoError(t, diskManager.SetDiskMetadata(context.Background(), disk.Name, map[string]string{
+		"k8s-pvc-name":  "my-pvc",
+		"k8s-namespace": "default",
+	}), "metadata should be set")
+	require.NoError(t, diskManager.SetDiskMetadata(context.Background(), disk.Name, map[string]string{
+		"k8s-namespace": "other",
+	}), "metadata should be updated")
+
+	metadata, err = diskManager.GetDiskMetadata(disk.Name)
+	require.NoError(t, err, "metadata of the disk should be returned")
+	assert.Equal(t, map[string]string{"k8s-pvc-name": "my-pvc", "k8s-namespace": "other"}, metadata,
+		"updating metadata should keep the entries with other keys")
+
+	assert.ErrorIs(t, diskManager.SetDiskMetadata(context.Background(), "missing-pvc", map[string]string{"a": "b"}),
+		ErrDiskNotFound, "setting metadata of a missing disk should fail with not found")
+}
+
+func TestGetDisk(t *testing.T) {
+	disk := &vcdtypes.Disk{
+		Name:        "test-pvc",
+		SizeMb:      100,
+		BusType:     VCDBusTypeSCSI,
+		BusSubType:  VCDBusSubTypeVirtualSCSI,
+		AttachedVMs: []*types.Reference{{HREF: "https://vcd/api/vApp/vm-1", Name: "node-1"}},
+	}
+	server, _ := newFakeVCDServer("org", "vdc", disk)
+	defer server.Close()
+
+	client, err := NewVCDClientFromSecrets(server.URL, "org", "vdc", "org", "user", "password", "",
+		true, true)
+	require.NoError(t, err, "client should be created against the fake VCD")
+	defer EvictClient(client)
+	diskManager := &DiskManager{VCDClient: client}
+	require.NoError(t, diskManager.SetDiskMetadata(context.Background(), disk.Name, map[string]string{"a": "b"}),
+		"metadata of the disk should be set")
+
+	foundDisk, err := diskManager.GetDisk(disk.Id)
+	require.NoError(t, err, "disk should be found by its id")
+	assert.Equal(t, disk.Name, foundDisk.Name, "disk with the id should be returned")
+	assert.EqualValues(t, 100, foundDisk.SizeMB, "disk should have its size")
+	if assert.Len(t, foundDisk.AttachedVMs, 1, "disk should report the VM it is attached to") {
+		assert.Equal(t, "node-1", foundDisk.AttachedVMs[0], "disk should report the name of the VM")
+	}
+	assert.Equal(t, map[string]string{"a": "b"}, foundDisk.Metadata, "disk should report its metadata")
+
+	_, err = diskManager.GetDisk("urn:vcloud:disk:missing")
+	assert.ErrorIs(t, err, ErrDiskNotFound, "getting a missing disk should fail with not found")
+}
+
+func TestGetDiskByURN(t *testing.T) {
+	disk := &vcdtypes.Disk{
+		Name:       "test-pvc",
+		SizeMb:     100,
+		BusType:    VCDBusTypeSCSI,
+		BusSubType: VCDBusSubTypeVirtualSCSI,
+	}
+	server, _ := newFakeVCDServer("org", "vdc", disk)
+	defer server.Close()
+
+	client, err := NewVCDClientFromSecrets(server.URL, "org", "vdc", "org", "user", "password", "",
+		true, true)
+	require.NoError(t, err, "client should be created against the fake VCD")
+	defer EvictClient(client)
+	diskManager := &DiskManager{VCDClient: client}
+
+	assert.True(t, IsDiskURN(disk.Id), "id of the disk should be a URN")
+	assert.False(t, IsDiskURN(disk.Name), "name of the disk should not be a URN")
+
+	foundDisk, err := diskManager.GetDiskByURN(disk.Id)
+	require.NoError(t, err, "disk should be found by its URN")
+	assert.Equal(t, disk.Name, foundDisk.Name, "disk with the URN should be returned")
+	foundDisk, err = diskManager.GetDiskByName(disk.Id)
+	require.NoError(t, err, "disk should be found by name with its URN")
+	assert.Equal(t, disk.Name, foundDisk.Name, "disk with the URN should be returned for its name")
+
+	assert.NoError(t, diskManager.ResizeDisk(disk.Id, 200*mbToBytes), "disk should be resized by its URN")
+	foundDisk, err = diskManager.GetDiskByName(disk.Name)
+	require.NoError(t, err, "disk should be found by its name")
+	assert.EqualValues(t, 200, foundDisk.SizeMB, "disk of the URN should be resized")
+
+	_, err = diskManager.GetDiskByURN(DiskURNPrefix + "missing")
+	assert.ErrorIs(t, err, ErrDiskNotFound, "getting the URN of a missing disk should fail with not found")
+	_, err = diskManager.GetDiskByURN(DiskURNPrefix + "1/metadata")
+	assert.Error(t, err, "a URN with a path should not be accepted")
+
+	require.NoError(t, diskManager.DeleteDisk(disk.Id), "disk should be deleted by its URN")
+	_, err = diskManager.GetDiskByURN(disk.Id)
+	assert.ErrorIs(t, err, ErrDiskNotFound, "deleted disk should not be found by its URN")
+}
+
+func TestCreateDiskWithSharingType(t *testing.T) {
+	server, _ := newFakeVCDServer("org", "vdc")
+	defer server.Close()
+
+	client, err := NewVCDClientFromSecrets(server.URL, "org", "vdc", "org", "user", "password", "",
+		true, true)
+	require.NoError(t, err, "client should be created against the fake VCD")
+	defer EvictClient(client)
+	diskManager := &DiskManager{VCDClient: client}
+	ctx := context.Background()
+
+	disk, err := diskManager.CreateDiskWithContext(ctx, "test-pvc-shared", 100, VCDBusTypeSCSI,
+		VCDBusSubTypeVirtualSCSI, "", "", true, DiskSharingTypeDisk, "", 0)
+	require.NoError(t, err, "disk should be created with a sharing type")
+	assert.Equal(t, DiskSharingTypeDisk, disk.SharingType, "disk should have the requested sharing type")
+	assert.True(t, disk.Shareable, "disk with a sharing type should be shareable")
+
+	_, err = diskManager.CreateDiskWithContext(ctx, "test-pvc-shared", 100, VCDBusTypeSCSI,
+		VCDBusSubTypeVirtualSCSI, "", "", true, DiskSharingTypeController, "", 0)
+	assert.ErrorIs(t, err, ErrDiskExists, "creating the same disk with another sharing type should fail")
+
+	_, err = diskManager.CreateDiskWithContext(ctx, "test-pvc-invalid", 100, VCDBusTypeSCSI,
+		VCDBusSubTypeVirtualSCSI, "", "", true, "CrossVAppSharing", "", 0)
+	assert.ErrorIs(t, err, ErrInvalidDisk, "disk should not be created with an unknown sharing type")
+	_, err = diskManager.CreateDiskWithContext(ctx, "test-pvc-invalid", 100, VCDBusTypeSCSI,
+		VCDBusSubTypeVirtualSCSI, "", "", false, DiskSharingTypeDisk, "", 0)
+	assert.ErrorIs(t, err, ErrInvalidDisk, "disk that is not shareable should not be created with a sharing type")
+
+	// the fake VCD only logs in with the latest API version
+	client.VCDClient.Client.APIVersion = "34.0"
+	_, err = diskManager.CreateDiskWithContext(ctx, "test-pvc-old", 100, VCDBusTypeSCSI,
+		VCDBusSubTypeVirtualSCSI, "", "", true, DiskSharingTypeDisk, "", 0)
+	if assert.ErrorIs(t, err, ErrInvalidDisk, "disk should not be created with a sharing type that VCD does not take") {
+		assert.Contains(t, err.Error(), "sharingType", "error should name the unsupported attribute")
+	}
+	_, err = diskManager.CreateDiskWithContext(ctx, "test-pvc-old", 100, VCDBusTypeSCSI,
+		VCDBusSubTypeVirtualSCSI, "", "", true, "", "", 0)
+	assert.NoError(t, err, "shareable disk without a sharing type should be created with an older API version")
+}
+
+func TestCreateDiskWithIops(t *testing.T) {
+	server, _ := newFakeVCDServer("org", "vdc")
+	defer server.Close()
+
+	client, err := NewVCDClientFromSecrets(server.URL, "org", "vdc", "org", "user", "password", "",
+		true, true)
+	require.NoError(t, err, "client should be created against the fake VCD")
+	defer EvictClient(client)
+	diskManager := &DiskManager{VCDClient: client}
+
+	disk, err := diskManager.CreateDisk("test-pvc-iops", 1024, VCDBusTypeSCSI, VCDBusSubTypeVirtualSCSI,
+		"", "iops", false, 400)
+	require.NoError(t, err, "disk should be created with IOPS in the range of the storage profile")
+	assert.EqualValues(t, 400, disk.IOPS, "disk should be created with the requested IOPS")
+
+	_, err = diskManager.CreateDisk("test-pvc-iops", 1024, VCDBusTypeSCSI, VCDBusSubTypeVirtualSCSI,
+		"", "iops", false, 300)
+	assert.Error(t, err, "creating the same disk with other IOPS should fail")
+
+	_, err = diskManager.CreateDisk("test-pvc-iops-max", 4096, VCDBusTypeSCSI, VCDBusSubTypeVirtualSCSI,
+		"", "iops", false, 2000)
+	assert.Error(t, err, "disk should not be created with more IOPS than the maximum of the storage profile")
+
+	_, err = diskManager.CreateDisk("test-pvc-iops-per-gb", 1024, VCDBusTypeSCSI, VCDBusSubTypeVirtualSCSI,
+		"", "iops", false, 600)
+	assert.Error(t, err, "disk should not be created with more IOPS than the maximum for its size")
+
+	_, err = diskManager.CreateDisk("test-pvc-gold", 1024, VCDBusTypeSCSI, VCDBusSubTypeVirtualSCSI,
+		"", "gold", false, 100)
+	if assert.Error(t, err, "disk should not be created with IOPS in a storage profile without IOPS settings") {
+		assert.Contains(t, err.Error(), "storage profile [gold] does not support setting the IOPS of disks",
+			"error should name the storage profile that does not support IOPS")
+	}
+
+	_, err = diskManager.CreateDisk("test-pvc-default", 1024, VCDBusTypeSCSI, VCDBusSubTypeVirtualSCSI,
+		"", "", false, 100)
+	assert.Error(t, err, "disk should not be created with IOPS without a storage profile")
+}
+
+func TestAttachmentState(t *testing.T) {
+	attachedDisk := &vcdtypes.Disk{
+		Name:        "test-pvc-attached",
+		SizeMb:      100,
+		BusType:     VCDBusTypeSCSI,
+		BusSubType:  VCDBusSubTypeVirtualSCSI,
+		AttachedVMs: []*types.Reference{{HREF: "https://vcd/api/vApp/vm-1", Name: "node-1"}},
+	}
+	sharedDisk := &vcdtypes.Disk{
+		Name:       "test-pvc-shared",
+		SizeMb:     100,
+		BusType:    VCDBusTypeSCSI,
+		BusSubType: VCDBusSubTypeVirtualSCSI,
+		Shareable:  true,
+		AttachedVMs: []*types.Reference{{HREF: "https://vcd/api/vApp/vm-2", Name: "node-2"},
+			{HREF: "https://vcd/api/vApp/vm-1", Name: "node-1"}},
+	}
+	detachedDisk := &vcdtypes.Disk{
+		Name:       "test-pvc-detached",
+		SizeMb:     100,
+		BusType:    VCDBusTypeSCSI,
+		BusSubType: VCDBusSubTypeVirtualSCSI,
+	}
+	server, _ := newFakeVCDServer("org", "vdc", attachedDisk, sharedDisk, detachedDisk)
+	defer server.Close()
+
+	client, err := NewVCDClientFromSecrets(server.URL, "org", "vdc", "org", "user", "password", "",
+		true, true)
+	require.NoError(t, err, "client should be created against the fake VCD")
+	defer EvictClient(client)
+	diskManager := &DiskManager{VCDClient: client}
+
+	vmNames, err := diskManager.AttachmentState(attachedDisk.Name)
+	require.NoError(t, err, "attachment of an attached disk should be found")
+	assert.Equal(t, []string{"node-1"}, vmNames, "attached disk should report the node of its VM")
+
+	vmNames, err = diskManager.AttachmentState(sharedDisk.Name)
+	require.NoError(t, err, "attachment of a shared disk should be found")
+	assert.Equal(t, []string{"node-1", "node-2"}, vmNames, "shared disk should report all the nodes of its VMs")
+
+	vmNames, err = diskManager.AttachmentState(detachedDisk.Name)
+	require.NoError(t, err, "attachment of a detached disk should be found")
+	assert.Empty(t, vmNames, "detached disk should report no node")
+
+	_, err = diskManager.AttachmentState("missing-pvc")
+	assert.ErrorIs(t, err, ErrDiskNotFound, "attachment of a missing disk should fail with not found")
+}
+
+func TestDetachVolumeRetry(t *testing.T) {
+	disk := &vcdtypes.Disk{
+		Name:       "test-pvc",
+		SizeMb:     100,
+		BusType:    VCDBusTypeSCSI,
+		BusSubType: VCDBusSubTypeVirtualSCSI,
+	}
+	server, _ := newFakeVCDServer("org", "vdc", disk)
+	defer server.Close()
+
+	client, err := NewVCDClientFromSecrets(server.URL, "org", "vdc", "org", "user", "password", "",
+		true, true)
+	require.NoError(t, err, "client should be created against the fake VCD")
+	defer EvictClient(client)
+	diskManager := &DiskManager{VCDClient: client}
+	vm := newFakeVM(server, client, "node-1")
+
+	attachedDisk, err := diskManager.GetDiskByName(disk.Name)
+	require.NoError(t, err, "disk should be found")
+	require.NoError(t, diskManager.AttachVolume(vm, attachedDisk), "disk should be attached")
+	vmNames, err := diskManager.AttachmentState(disk.Name)
+	require.NoError(t, err, "attachment of the disk should be found")
+	require.NotEmpty(t, vmNames, "disk should be attached to the VM")
+
+	assert.NoError(t, diskManager.DetachVolume(vm, disk.Name), "disk should be detached")
+	vmNames, err = diskManager.AttachmentState(disk.Name)
+	require.NoError(t, err, "attachment of the disk should be found")
+	assert.Empty(t, vmNames, "disk should be detached from the VM")
+
+	assert.NoError(t, diskManager.DetachVolume(vm, disk.Name), "detaching a detached disk again should succeed")
+	assert.NoError(t, diskManager.DetachVolume(vm, "missing-pvc"), "detaching a missing disk should succeed")
+}
+
+func TestWaitForDiskDetached(t *testing.T) {
+	disk := &vcdtypes.Disk{
+		Name:       "test-pvc",
+		SizeMb:     100,
+		BusType:    VCDBusTypeSCSI,
+		BusSubType: VCDBusSubTypeVirtualSCSI,
+	}
+	server, _ := newFakeVCDServer("org", "vdc", disk)
+	defer server.Close()
+
+	client, err := NewVCDClientFromSecrets(server.URL, "org", "vdc", "org", "user", "password", "",
+		true, true)
+	require.NoError(t, err, "client should be created against the fake VCD")
+	defer EvictClient(client)
+	diskManager := &DiskManager{VCDClient: client}
+	vm := newFakeVM(server, client, "node-1")
+
+	attachedDisk, err := diskManager.GetDiskByName(disk.Name)
+	require.NoError(t, err, "disk should be found")
+	require.NoError(t, diskManager.AttachVolume(vm, attachedDisk), "disk should be attached")
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = diskManager.WaitForDiskDetached(ctx, vm, disk.Name, 10*time.Millisecond)
+	assert.Error(t, err, "waiting for an attached disk should time out")
+	assert.Contains(t, err.Error(), context.DeadlineExceeded.Error(), "error should report that the wait timed out")
+
+	require.NoError(t, diskManager.DetachVolume(vm, disk.Name), "disk should be detached")
+	assert.NoError(t, diskManager.WaitForDiskDetached(context.Background(), vm, disk.Name, time.Millisecond),
+		"detached disk should be released")
+	assert.NoError(t, diskManager.WaitForDiskDetached(context.Background(), vm, "missing-pvc", time.Millisecond),
+		"missing disk should be released")
+}
+
+func TestAttachVolumeAt(t *testing.T) {
+	var fakeDisks []*vcdtypes.Disk
+	for _, name := range []string{"test-pvc-1", "test-pvc-2", "test-pvc-3"} {
+		fakeDisks = append(fakeDisks, &vcdtypes.Disk{
+			Name:       name,
+			SizeMb:     100,
+			BusType:    VCDBusTypeSCSI,
+			BusSubType: VCDBusSubTypeVirtualSCSI,
+		})
+	}
+	fakeDisks[2].BusSubType = VCDBusSubTypeLsiLogicSAS
+	server, _ := newFakeVCDServer("org", "vdc", fakeDisks...)
+	defer server.Close()
+
+	client, err := NewVCDClientFromSecrets(server.URL, "org", "vdc", "org", "user", "password", "",
+		true, true)
+	require.NoError(t, err, "client should be created against the fake VCD")
+	defer EvictClient(client)
+	diskManager := &DiskManager{VCDClient: client}
+	vm := newFakeVM(server, client, "node-1")
+	var disks []*Disk
+	for _, fakeDisk := range fakeDisks[:2] {
+		disk, err := diskManager.GetDiskByName(fakeDisk.Name)
+		require.NoError(t, err, "disk should be found")
+		disks = append(disks, disk)
+	}
+	// a disk that was not returned by the disk manager is read again by its href
+	disks = append(disks, &Disk{Name: fakeDisks[2].Name, HREF: fakeDisks[2].HREF})
+	unitNumber := 1
+
+	require.NoError(t, diskManager.AttachVolumeAt(vm, disks[0], nil, &unitNumber),
+		"disk should be attached at a free unit")
+	vmNames, err := diskManager.AttachmentState(disks[0].Name)
+	require.NoError(t, err, "attachment of the disk should be found")
+	assert.NotEmpty(t, vmNames, "disk should be attached to the VM")
+	assert.NoError(t, diskManager.AttachVolumeAt(vm, disks[0], nil, &unitNumber),
+		"attaching a disk again at its unit should succeed")
+
+	assert.Error(t, diskManager.AttachVolumeAt(vm, disks[1], nil, &unitNumber),
+		"disk should not be attached at a unit used by another disk")
+	vmNames, err = diskManager.AttachmentState(disks[1].Name)
+	require.NoError(t, err, "attachment of the disk should be found")
+	assert.Empty(t, vmNames, "disk should not be attached at a used unit")
+
+	busNumber := 1
+	assert.NoError(t, diskManager.AttachVolumeAt(vm, disks[1], &busNumber, &unitNumber),
+		"disk should be attached at the same unit of another bus")
+	assert.NoError(t, diskManager.AttachVolumeAt(vm, disks[2], nil, &unitNumber),
+		"disk should be attached at the same unit of the bus of another adapter")
+	assert.Error(t, diskManager.AttachVolumeAt(vm, disks[2], &busNumber, nil),
+		"a bus number without a unit number should not be accepted")
+
+	require.NoError(t, diskManager.DetachVolume(vm, disks[0].Name), "disk should be detached")
+	assert.NoError(t, diskManager.AttachVolumeAt(vm, disks[0], nil, &unitNumber),
+		"disk should be attached at the unit freed by the detach")
+}
+
+func TestDryRun(t *testing.T) {
+	disk := &vcdtypes.Disk{
+		Name:       "test-pvc",
+		SizeMb:     100,
+		BusType:    VCDBusTypeSCSI,
+		BusSubType: VCDBusSubTypeVirtualSCSI,
+	}
+	server, _ := newFakeVCDServer("org", "vdc", disk)
+	defer server.Close()
+
+	client, err := NewVCDClientFromSecrets(server.URL, "org", "vdc", "org", "user", "password", "",
+		true, true)
+	require.NoError(t, err, "client should be created against the fake VCD")
+	defer EvictClient(client)
+	diskManager := &DiskManager{VCDClient: client, DryRun: true}
+	vm := newFakeVM(server, client, "node-1")
+
+	createdDisk, err := diskManager.CreateDisk("test-pvc-new", 100, VCDBusTypeSCSI, VCDBusSubTypeVirtualSCSI,
+		"", "", false, 0)
+	require.NoError(t, err, "disk creation should be simulated")
+	assert.Equal(t, "test-pvc-new", createdDisk.Name, "simulated disk should have the requested name")
+	assert.EqualValues(t, 100, createdDisk.SizeMB, "simulated disk should have the requested size")
+	_, err = diskManager.GetDiskByName("test-pvc-new")
+	assert.ErrorIs(t, err, ErrDiskNotFound, "no disk should be created in a dry run")
+	assert.NoError(t, diskManager.SetDiskMetadata(context.Background(), "test-pvc-new",
+		map[string]string{"key": "value"}), "setting the metadata of a simulated disk should be simulated")
+
+	existingDisk, err := diskManager.CreateDisk(disk.Name, 200, VCDBusTypeSCSI, VCDBusSubTypeVirtualSCSI,
+		"", "", false, 0)
+	assert.Error(t, err, "a disk that exists with other properties should still be looked up in a dry run")
+	assert.Nil(t, existingDisk, "no disk should be returned for a conflicting disk")
+
+	assert.NoError(t, diskManager.ResizeDisk(disk.Name, 200*mbToBytes), "resize should be simulated")
+	foundDisk, err := diskManager.GetDiskByName(disk.Name)
+	require.NoError(t, err, "disk should be found")
+	assert.EqualValues(t, 100, foundDisk.SizeMB, "disk should not be resized in a dry run")
+
+	require.NoError(t, diskManager.AttachVolume(vm, foundDisk), "attach should be simulated")
+	vmNames, err := diskManager.AttachmentState(disk.Name)
+	require.NoError(t, err, "attachment of the disk should be found")
+	assert.Empty(t, vmNames, "disk should not be attached in a dry run")
+
+	snapshot, err := diskManager.CreateDiskSnapshot(disk.Name, "snap-1")
+	require.NoError(t, err, "snapshot should be simulated")
+	assert.True(t, IsDiskSnapshotURN(snapshot.ID), "simulated snapshot should have a snapshot URN")
+	sameSnapshot, err := diskManager.CreateDiskSnapshot(disk.Name, "snap-1")
+	require.NoError(t, err, "snapshot should be simulated again")
+	assert.Equal(t, snapshot.ID, sameSnapshot.ID, "simulated snapshot with the same name should have the same ID")
+	snapshots, err := diskManager.ListDiskSnapshots(disk.Name)
+	require.NoError(t, err, "snapshots of the disk should be listed")
+	assert.Empty(t, snapshots, "no snapshot should be created in a dry run")
+	assert.NoError(t, diskManager.DeleteDiskSnapshot(snapshot.ID), "delete of a simulated snapshot should succeed")
+
+	assert.NoError(t, diskManager.DeleteDisk(disk.Name), "delete should be simulated")
+	_, err = diskManager.GetDiskByName(disk.Name)
+	assert.NoError(t, err, "disk should not be deleted in a dry run")
+}
+
+func TestFindVMByNodeID(t *testing.T) {
+	server, _ := newFakeVCDServer("org", "vdc")
+	defer server.Close()
+
+	client, err := NewVCDClientFromSecrets(server.URL, "org", "vdc", "org", "user", "password", "",
+		true, true)
+	require.NoError(t, err, "client should be created against the fake VCD")
+	defer EvictClient(client)
+	// the fake VDC has no vApps, hence every VM is looked up in the VDC
+	diskManager := &DiskManager{VCDClient: client, VAppName: "cluster"}
+
+	vm, err := diskManager.FindVMByNodeID("node-2")
+	require.NoError(t, err, "vm outside of the vApp of the cluster should be found")
+	assert.Equal(t, "node-2", vm.VM.Name, "vm of the node should be found")
+	assert.Equal(t, server.URL+"/api/vApp/node-2", vm.VM.HREF, "vm should be fetched by its href")
+
+	cachedVM, err := diskManager.FindVMByNodeID("node-2")
+	require.NoError(t, err, "vm should be found again")
+	assert.Same(t, vm, cachedVM, "vm found recently should be reused")
+
+	_, err = diskManager.FindVMByNodeID("node-3")
+	assert.Error(t, err, "node with vms in two vApps should not be resolved")
+
+	_, err = diskManager.FindVMByNodeID("missing-node")
+	assert.Error(t, err, "missing vm should not be found")
+
+	_, err = diskManager.FindVMByNodeID("")
+	assert.Error(t, err, "empty node ID should be refused")
+
+	vm, err = (&DiskManager{VCDClient: client}).FindVMByNodeID("node-2")
+	require.NoError(t, err, "vm should be found in the VDC of a cluster without a vApp")
+	assert.Equal(t, "node-2", vm.VM.Name, "vm of the node should be found")
+
+	_, err = (&DiskManager{VCDClient: client, VAppName: "cluster", VAppScopedVMSearch: true}).FindVMByNodeID("node-2")
+	assert.Error(t, err, "vm outside of the vApp of the cluster should not be found by a vApp scoped search")
+	_, err = (&DiskManager{VCDClient: client, VAppScopedVMSearch: true}).FindVMByNodeID("node-2")
+	assert.Error(t, err, "vApp scoped search should need the vApp of the cluster")
+}
+
+func TestCheckAttachPowerState(t *testing.T) {
+	poweredOn, poweredOff, suspended := 4, 8, 3
+
+	assert.NoError(t, CheckAttachPowerState("vm", poweredOn, "disk", VCDBusTypeSCSI, false),
+		"SCSI disk should be hot-added to a powered on VM")
+	assert.ErrorIs(t, CheckAttachPowerState("vm", poweredOn, "disk", VCDBusTypeIDE, true), ErrAttachUnsupported,
+		"IDE disk should not be hot-added to a powered on VM")
+	assert.ErrorIs(t, CheckAttachPowerState("vm", poweredOff, "disk", VCDBusTypeSCSI, false), ErrAttachUnsupported,
+		"disk should not be attached to a powered off VM unless offline attaches are allowed")
+	assert.NoError(t, CheckAttachPowerState("vm", poweredOff, "disk", VCDBusTypeIDE, true),
+		"IDE disk should be attached offline to a powered off VM")
+	assert.NoError(t, CheckAttachPowerState("vm", suspended, "disk", VCDBusTypeSCSI, false),
+		"disk should be attached to a VM in another state, which VCD checks itself")
+}
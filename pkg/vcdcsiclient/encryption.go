@@ -0,0 +1,74 @@
+/*
+   Copyright 2021 VMware, Inc.
+   SPDX-License-Identifier: Apache-2.0
+*/
+
+package vcdcsiclient
+
+import (
+	"fmt"
+	"github.com/vmware/cloud-director-named-disk-csi-driver/pkg/vcdtypes"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+	"strings"
+)
+
+const (
+	// encryptionPolicyMinAPIVersion is the first VCD API version, of VCD 10.4, that takes the encryption policy of a
+	// disk
+	encryptionPolicyMinAPIVersion = "37.0"
+	// encryptionPoliciesEndpoint is the OpenAPI endpoint of the encryption policies of VCD
+	encryptionPoliciesEndpoint = "1.0.0/encryptionPolicies"
+)
+
+// checkEncryptionPolicy returns an ErrInvalidDisk error if the disk diskName cannot be created with the encryption
+// policy encryptionPolicy, if any, since the API version of the client does not take encryption policies
+func (diskManager *DiskManager) checkEncryptionPolicy(diskName string, encryptionPolicy string) error {
+	if encryptionPolicy == "" {
+		return nil
+	}
+
+	client := &diskManager.VCDClient.VCDClient.Client
+	if !client.APIClientVersionIs(">= " + encryptionPolicyMinAPIVersion) {
+		return NewDiskError(ErrInvalidDisk, diskName, fmt.Errorf(
+			"attribute [encryptionPolicy] of disk [%s] is not supported by VCD API version [%s]; it needs VCD 10.4 "+
+				"and version [%s] or later, which is set by apiVersion of the vcd section of the cloud config",
+			diskName, client.APIVersion, encryptionPolicyMinAPIVersion))
+	}
+
+	return nil
+}
+
+// findEncryptionPolicyReference returns the reference of the encryption policy encryptionPolicy, which is the name or
+// the URN of the policy, to create the disk diskName with. An ErrInvalidDisk error is returned if VCD has no such
+// policy.
+func (diskManager *DiskManager) findEncryptionPolicyReference(diskName string,
+	encryptionPolicy string) (*types.Reference, error) {
+
+	client := &diskManager.VCDClient.VCDClient.Client
+	endpoint, err := client.OpenApiBuildEndpoint(encryptionPoliciesEndpoint)
+	if err != nil {
+		return nil, fmt.Errorf("unable to build endpoint of encryption policies: [%v]", err)
+	}
+	var encryptionPolicies []*vcdtypes.EncryptionPolicy
+	if err = client.OpenApiGetAllItems(client.APIVersion, endpoint, nil, &encryptionPolicies, nil); err != nil {
+		return nil, fmt.Errorf("unable to list encryption policies: [%v]", err)
+	}
+
+	var encryptionPolicyNames []string
+	for _, policy := range encryptionPolicies {
+		if policy == nil {
+			continue
+		}
+		if policy.Name == encryptionPolicy || strings.EqualFold(policy.ID, encryptionPolicy) {
+			return &types.Reference{
+				ID:   policy.ID,
+				Name: policy.Name,
+			}, nil
+		}
+		encryptionPolicyNames = append(encryptionPolicyNames, policy.Name)
+	}
+
+	return nil, NewDiskError(ErrInvalidDisk, diskName, fmt.Errorf(
+		"encryption policy [%s] of disk [%s] does not exist in VCD with encryption policies [%s]", encryptionPolicy,
+		diskName, strings.Join(encryptionPolicyNames, ", ")))
+}
@@ -0,0 +1,66 @@
+/*
+   Copyright 2021 VMware, Inc.
+   SPDX-License-Identifier: Apache-2.0
+*/
+
+package vcdcsiclient
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestCreateDiskWithEncryptionPolicy(t *testing.T) {
+	server, _ := newFakeVCDServer("org", "vdc")
+	defer server.Close()
+
+	client, err := NewVCDClientFromSecrets(server.URL, "org", "vdc", "org", "user", "password", "",
+		true, true)
+	require.NoError(t, err, "client should be created against the fake VCD")
+	defer EvictClient(client)
+	diskManager := &DiskManager{VCDClient: client}
+	ctx := context.Background()
+
+	// the fake VCD only logs in with the API version of the SDK, which predates encryption policies
+	_, err = diskManager.CreateDiskWithContext(ctx, "test-pvc-old", 100, VCDBusTypeSCSI,
+		VCDBusSubTypeVirtualSCSI, "", "", false, "", "gold-encryption", 0)
+	if assert.ErrorIs(t, err, ErrInvalidDisk, "disk should not be created with an encryption policy that VCD "+
+		"does not take") {
+		assert.Contains(t, err.Error(), encryptionPolicyMinAPIVersion, "error should name the API version needed")
+	}
+	_, err = diskManager.GetDiskByName("test-pvc-old")
+	assert.ErrorIs(t, err, ErrDiskNotFound, "disk should not be created")
+
+	client.VCDClient.Client.APIVersion = encryptionPolicyMinAPIVersion
+	disk, err := diskManager.CreateDiskWithContext(ctx, "test-pvc-encrypted", 100, VCDBusTypeSCSI,
+		VCDBusSubTypeVirtualSCSI, "", "", false, "", "gold-encryption", 0)
+	require.NoError(t, err, "disk should be created with an encryption policy")
+	assert.True(t, disk.Encrypted, "disk with an encryption policy should be encrypted")
+	assert.Equal(t, "urn:vcloud:encryptionPolicy:1", disk.EncryptionPolicyID,
+		"disk should have the URN of the encryption policy")
+	assert.True(t, disk.HasEncryptionPolicy("gold-encryption"), "disk should have the policy by its name")
+
+	disk, err = diskManager.CreateDiskWithContext(ctx, "test-pvc-encrypted", 100, VCDBusTypeSCSI,
+		VCDBusSubTypeVirtualSCSI, "", "", false, "", "URN:vcloud:encryptionPolicy:1", 0)
+	require.NoError(t, err, "creating the same disk with the URN of its policy should return it")
+	assert.True(t, disk.Encrypted, "existing disk should be reported encrypted")
+	_, err = diskManager.CreateDiskWithContext(ctx, "test-pvc-encrypted", 100, VCDBusTypeSCSI,
+		VCDBusSubTypeVirtualSCSI, "", "", false, "", "silver-encryption", 0)
+	assert.ErrorIs(t, err, ErrDiskExists, "creating the same disk with another encryption policy should fail")
+
+	_, err = diskManager.CreateDiskWithContext(ctx, "test-pvc-missing", 100, VCDBusTypeSCSI,
+		VCDBusSubTypeVirtualSCSI, "", "", false, "", "platinum-encryption", 0)
+	if assert.ErrorIs(t, err, ErrInvalidDisk, "disk should not be created with an unknown encryption policy") {
+		assert.Contains(t, err.Error(), "gold-encryption", "error should list the encryption policies")
+	}
+
+	disk, err = diskManager.CreateDiskWithContext(ctx, "test-pvc-plain", 100, VCDBusTypeSCSI,
+		VCDBusSubTypeVirtualSCSI, "", "", false, "", "", 0)
+	require.NoError(t, err, "disk should be created without an encryption policy")
+	assert.False(t, disk.Encrypted, "disk without an encryption policy should not be encrypted")
+	_, err = diskManager.CreateDiskWithContext(ctx, "test-pvc-plain", 100, VCDBusTypeSCSI,
+		VCDBusSubTypeVirtualSCSI, "", "", false, "", "gold-encryption", 0)
+	assert.ErrorIs(t, err, ErrDiskExists, "creating an unencrypted disk with an encryption policy should fail")
+}
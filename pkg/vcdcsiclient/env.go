@@ -0,0 +1,115 @@
+/*
+   Copyright 2021 VMware, Inc.
+   SPDX-License-Identifier: Apache-2.0
+*/
+
+package vcdcsiclient
+
+import (
+	"fmt"
+	"github.com/vmware/cloud-provider-for-cloud-director/pkg/vcdsdk"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The environment variables that ReadEnvConfig reads the VCD of the cluster and its credentials from, which are set
+// instead of mounting the secret of the credentials when the driver or its client runs outside of Kubernetes
+const (
+	EnvVCDHost = "VCD_HOST"
+	EnvVCDOrg  = "VCD_ORG"
+	EnvVCDVDC  = "VCD_VDC"
+	// EnvVCDVApp is the vApp of the VMs of the nodes of the cluster, which is optional
+	EnvVCDVApp = "VCD_VAPP"
+	// EnvVCDUser is the user, or org/user for a user of another org than VCD_ORG
+	EnvVCDUser     = "VCD_USER"
+	EnvVCDPassword = "VCD_PASSWORD"
+	// EnvVCDRefreshToken is used instead of VCD_USER and VCD_PASSWORD if it is set
+	EnvVCDRefreshToken = "VCD_REFRESH_TOKEN"
+	// EnvVCDInsecure skips the verification of the certificate of VCD if it is true. It is false if not set.
+	EnvVCDInsecure = "VCD_INSECURE"
+)
+
+// EnvConfig is the VCD of the cluster and its credentials as read from the environment
+type EnvConfig struct {
+	Host         string
+	Org          string
+	VDC          string
+	VApp         string
+	UserOrg      string
+	User         string
+	Password     string
+	RefreshToken string
+	Insecure     bool
+}
+
+// ReadEnvConfig reads the VCD of the cluster and its credentials from the environment. It returns an error naming all
+// the variables that are missing, of which the credentials are either VCD_REFRESH_TOKEN or VCD_USER and VCD_PASSWORD.
+func ReadEnvConfig() (*EnvConfig, error) {
+	envConfig := &EnvConfig{
+		Host:         os.Getenv(EnvVCDHost),
+		Org:          os.Getenv(EnvVCDOrg),
+		VDC:          os.Getenv(EnvVCDVDC),
+		VApp:         os.Getenv(EnvVCDVApp),
+		User:         os.Getenv(EnvVCDUser),
+		Password:     os.Getenv(EnvVCDPassword),
+		RefreshToken: os.Getenv(EnvVCDRefreshToken),
+	}
+
+	var missing []string
+	for _, env := range []struct {
+		name  string
+		value string
+	}{
+		{EnvVCDHost, envConfig.Host},
+		{EnvVCDOrg, envConfig.Org},
+		{EnvVCDVDC, envConfig.VDC},
+	} {
+		if env.value == "" {
+			missing = append(missing, env.name)
+		}
+	}
+	if envConfig.RefreshToken == "" {
+		if envConfig.User == "" {
+			missing = append(missing, EnvVCDUser)
+		}
+		if envConfig.Password == "" {
+			missing = append(missing, EnvVCDPassword)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("environment variables [%s] should be set; the credentials are either [%s] or [%s] "+
+			"and [%s]", strings.Join(missing, ", "), EnvVCDRefreshToken, EnvVCDUser, EnvVCDPassword)
+	}
+
+	if insecure := os.Getenv(EnvVCDInsecure); insecure != "" {
+		var err error
+		if envConfig.Insecure, err = strconv.ParseBool(insecure); err != nil {
+			return nil, fmt.Errorf("environment variable [%s] should be true or false, obtained [%s]",
+				EnvVCDInsecure, insecure)
+		}
+	}
+
+	envConfig.UserOrg = envConfig.Org
+	if envConfig.User != "" {
+		var err error
+		if envConfig.UserOrg, envConfig.User, err = vcdsdk.GetUserAndOrg(envConfig.User, envConfig.Org,
+			""); err != nil {
+			return nil, fmt.Errorf("invalid environment variable [%s]: [%v]", EnvVCDUser, err)
+		}
+	}
+
+	return envConfig, nil
+}
+
+// NewVCDClientFromEnv creates the client of the VDC of the cluster with the credentials of the environment, as read
+// by ReadEnvConfig. The vApp of the cluster is not used by the client and is set in the DiskManager.
+func NewVCDClientFromEnv(options ...ClientOption) (*Client, error) {
+	envConfig, err := ReadEnvConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return NewVCDClientFromSecrets(envConfig.Host, envConfig.Org, envConfig.VDC, envConfig.UserOrg, envConfig.User,
+		envConfig.Password, envConfig.RefreshToken, envConfig.Insecure, true, options...)
+}
@@ -0,0 +1,95 @@
+/*
+   Copyright 2021 VMware, Inc.
+   SPDX-License-Identifier: Apache-2.0
+*/
+
+package vcdcsiclient
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// setEnv sets the environment variables of env for the duration of the test
+func setEnv(t *testing.T, env map[string]string) {
+	for _, name := range []string{EnvVCDHost, EnvVCDOrg, EnvVCDVDC, EnvVCDVApp, EnvVCDUser, EnvVCDPassword,
+		EnvVCDRefreshToken, EnvVCDInsecure} {
+		t.Setenv(name, env[name])
+	}
+}
+
+func TestReadEnvConfig(t *testing.T) {
+	setEnv(t, map[string]string{
+		EnvVCDHost:     "https://vcd.example.com",
+		EnvVCDOrg:      "org",
+		EnvVCDVDC:      "vdc",
+		EnvVCDVApp:     "cluster",
+		EnvVCDUser:     "system/admin",
+		EnvVCDPassword: "password",
+		EnvVCDInsecure: "true",
+	})
+	envConfig, err := ReadEnvConfig()
+	require.NoError(t, err, "config should be read from the environment")
+	assert.Equal(t, &EnvConfig{
+		Host:     "https://vcd.example.com",
+		Org:      "org",
+		VDC:      "vdc",
+		VApp:     "cluster",
+		UserOrg:  "system",
+		User:     "admin",
+		Password: "password",
+		Insecure: true,
+	}, envConfig, "config should have the variables of the environment")
+
+	setEnv(t, map[string]string{
+		EnvVCDHost:         "https://vcd.example.com",
+		EnvVCDOrg:          "org",
+		EnvVCDVDC:          "vdc",
+		EnvVCDRefreshToken: "token",
+	})
+	envConfig, err = ReadEnvConfig()
+	require.NoError(t, err, "config with a refresh token should be read from the environment")
+	assert.Equal(t, "org", envConfig.UserOrg, "user org should default to the org")
+	assert.False(t, envConfig.Insecure, "certificate of VCD should be verified by default")
+
+	setEnv(t, map[string]string{EnvVCDOrg: "org", EnvVCDUser: "user"})
+	_, err = ReadEnvConfig()
+	if assert.Error(t, err, "config without host, vdc and password should not be read") {
+		assert.Contains(t, err.Error(), "[VCD_HOST, VCD_VDC, VCD_PASSWORD]", "error should name the missing variables")
+	}
+
+	setEnv(t, map[string]string{
+		EnvVCDHost:         "https://vcd.example.com",
+		EnvVCDOrg:          "org",
+		EnvVCDVDC:          "vdc",
+		EnvVCDRefreshToken: "token",
+		EnvVCDInsecure:     "sometimes",
+	})
+	_, err = ReadEnvConfig()
+	if assert.Error(t, err, "config with an invalid insecure flag should not be read") {
+		assert.Contains(t, err.Error(), EnvVCDInsecure, "error should name the invalid variable")
+	}
+}
+
+func TestNewVCDClientFromEnv(t *testing.T) {
+	server, _ := newFakeVCDServer("org", "vdc")
+	defer server.Close()
+
+	setEnv(t, map[string]string{
+		EnvVCDHost:     server.URL,
+		EnvVCDOrg:      "org",
+		EnvVCDVDC:      "vdc",
+		EnvVCDUser:     "user",
+		EnvVCDPassword: "password",
+		EnvVCDInsecure: "true",
+	})
+	client, err := NewVCDClientFromEnv()
+	require.NoError(t, err, "client should be created from the environment")
+	defer EvictClient(client)
+	assert.Equal(t, "vdc", client.ClusterOVDCName, "client should be for the VDC of the environment")
+
+	setEnv(t, map[string]string{EnvVCDHost: server.URL})
+	_, err = NewVCDClientFromEnv()
+	assert.Error(t, err, "client should not be created without the org, vdc and credentials")
+}
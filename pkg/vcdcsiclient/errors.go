@@ -0,0 +1,101 @@
+/*
+   Copyright 2021 VMware, Inc.
+   SPDX-License-Identifier: Apache-2.0
+*/
+
+package vcdcsiclient
+
+import (
+	"errors"
+	"fmt"
+	"github.com/vmware/go-vcloud-director/v2/govcd"
+)
+
+// The kinds of the errors of the disk manager, which errors.Is matches against the errors that it returns, so that
+// callers need not match the messages of VCD, which differ across its versions
+var (
+	// ErrDiskNotFound is returned for a disk that does not exist. It also matches govcd.ErrorEntityNotFound, which the
+	// disk manager returned for a missing disk before.
+	ErrDiskNotFound = errors.New("disk not found")
+	// ErrDiskAttached is returned for an operation that VCD rejects since the disk is attached to a VM
+	ErrDiskAttached = errors.New("disk is attached")
+	// ErrDiskExists is returned for the creation of a disk that already exists with other properties, or whose name VCD
+	// rejects as a duplicate
+	ErrDiskExists = errors.New("disk already exists")
+	// ErrAttachUnsupported is returned for the attach of a disk that VCD cannot do in the power state of the VM
+	ErrAttachUnsupported = errors.New("disk cannot be attached to the VM in its power state")
+	// ErrDiskInTransition is returned for the delete of a disk that VCD still reports as in use or in transition, e.g.
+	// while it is being detached, after the delete has been retried
+	ErrDiskInTransition = errors.New("disk is in use or in transition")
+	// ErrVCDThrottled is returned for an operation that VCD throttled beyond the retries of the client
+	ErrVCDThrottled = errors.New("VCD throttled the request")
+	// ErrVDCNotFound is returned for a VDC that does not exist in the org of the client, or whose name matches several
+	// VDCs of the org
+	ErrVDCNotFound = errors.New("VDC not found")
+	// ErrSnapshotNotFound is returned for a snapshot of a disk that does not exist
+	ErrSnapshotNotFound = errors.New("snapshot not found")
+	// ErrSnapshotsUnsupported is returned for a snapshot operation on a disk that VCD offers no snapshots of
+	ErrSnapshotsUnsupported = errors.New("VCD does not snapshot the disk")
+	// ErrQuotaExceeded is returned for an operation that VCD rejected since it exceeds the storage quota of the VDC or
+	// of the storage profile
+	ErrQuotaExceeded = errors.New("storage quota exceeded")
+	// ErrAccessDenied is returned for an operation that VCD rejected since the user lacks the rights for it
+	ErrAccessDenied = errors.New("access denied")
+	// ErrInvalidDisk is returned for an operation that VCD rejected as invalid, e.g. for the size of the disk
+	ErrInvalidDisk = errors.New("invalid disk request")
+)
+
+// diskErrorKindsByClass are the kinds of the errors of the disk manager for the classes of the errors of VCD that
+// callers can act on
+var diskErrorKindsByClass = map[string]error{
+	errorClassThrottle:  ErrVCDThrottled,
+	errorClassQuota:     ErrQuotaExceeded,
+	errorClassAuth:      ErrAccessDenied,
+	errorClassDuplicate: ErrDiskExists,
+	errorClassInvalid:   ErrInvalidDisk,
+}
+
+// DiskError is an error of the disk manager for the disk Disk, of which Kind is one of the error kinds above. Err is
+// the error that the operation failed with, if any.
+type DiskError struct {
+	Kind error
+	Disk string
+	Err  error
+}
+
+// NewDiskError returns an error of the kind kind for the disk disk, which failed with err if it is not nil
+func NewDiskError(kind error, disk string, err error) *DiskError {
+	return &DiskError{Kind: kind, Disk: disk, Err: err}
+}
+
+func (err *DiskError) Error() string {
+	if err.Err != nil {
+		return err.Err.Error()
+	}
+
+	return fmt.Sprintf("%v: [%s]", err.Kind, err.Disk)
+}
+
+// Is returns true if target is the kind of the error
+func (err *DiskError) Is(target error) bool {
+	return target == err.Kind || (err.Kind == ErrDiskNotFound && target == govcd.ErrorEntityNotFound)
+}
+
+func (err *DiskError) Unwrap() error {
+	return err.Err
+}
+
+// diskOperationError returns err as an error of the kind of its class if VCD rejected the operation on the disk
+// diskName for a reason that callers can act on, e.g. since it throttled the operation or the quota is exceeded, which
+// is mostly only recognized from the message of err after govcd has reported the response as text
+func diskOperationError(diskName string, err error) error {
+	var diskErr *DiskError
+	if err == nil || errors.As(err, &diskErr) {
+		return err
+	}
+	if kind, ok := diskErrorKindsByClass[classifyVCDError(err)]; ok {
+		return NewDiskError(kind, diskName, err)
+	}
+
+	return err
+}
@@ -0,0 +1,52 @@
+/*
+   Copyright 2021 VMware, Inc.
+   SPDX-License-Identifier: Apache-2.0
+*/
+
+package vcdcsiclient
+
+import (
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/vmware/go-vcloud-director/v2/govcd"
+	"net/http"
+	"testing"
+)
+
+func TestDiskErrors(t *testing.T) {
+	notFoundErr := fmt.Errorf("unable to resize disk: %w", NewDiskError(ErrDiskNotFound, "pvc-1", nil))
+	assert.ErrorIs(t, notFoundErr, ErrDiskNotFound, "wrapped error should be of its kind")
+	assert.ErrorIs(t, notFoundErr, govcd.ErrorEntityNotFound, "missing disk should be a missing entity of govcd")
+	assert.NotErrorIs(t, notFoundErr, ErrDiskAttached, "error should not be of another kind")
+	assert.Contains(t, notFoundErr.Error(), "pvc-1", "error without a cause should name the disk")
+
+	cause := errors.New("unable to delete disk [pvc-1] that is attached to VMs")
+	attachedErr := NewDiskError(ErrDiskAttached, "pvc-1", cause)
+	assert.ErrorIs(t, attachedErr, cause, "error should wrap its cause")
+	assert.Equal(t, cause.Error(), attachedErr.Error(), "error should have the message of its cause")
+	assert.NotErrorIs(t, attachedErr, govcd.ErrorEntityNotFound, "attached disk should not be a missing entity")
+
+	throttledErr := diskOperationError("pvc-1", fmt.Errorf("unable to attach disk: [%v]",
+		&httpStatusError{statusCode: http.StatusTooManyRequests, status: "429 Too Many Requests"}))
+	assert.ErrorIs(t, throttledErr, ErrVCDThrottled, "throttled operation should be of its kind")
+	assert.ErrorIs(t, diskOperationError("pvc-1", errors.New("API Error: 429: too many requests")),
+		ErrVCDThrottled, "operation that govcd reported as throttled should be of its kind")
+	for _, testCase := range []struct {
+		err  error
+		kind error
+	}{
+		{errors.New("API Error: 400: The requested operation will exceed the VDC's storage quota"),
+			ErrQuotaExceeded},
+		{&httpStatusError{statusCode: http.StatusForbidden, status: "403 Forbidden"}, ErrAccessDenied},
+		{errors.New("API Error: 400: disk with name [pvc-1] already exists"), ErrDiskExists},
+		{errors.New("API Error: 400: size of the disk should be positive"), ErrInvalidDisk},
+	} {
+		assert.ErrorIs(t, diskOperationError("pvc-1", testCase.err), testCase.kind,
+			"operation failing with [%v] should be of its kind", testCase.err)
+	}
+	assert.Same(t, attachedErr, diskOperationError("pvc-1", attachedErr), "typed error should keep its kind")
+	otherErr := errors.New("unable to reconfigure VM")
+	assert.Same(t, otherErr, diskOperationError("pvc-1", otherErr), "other errors should be returned as is")
+	assert.NoError(t, diskOperationError("pvc-1", nil), "no error should be returned for a success")
+}
@@ -0,0 +1,101 @@
+/*
+   Copyright 2021 VMware, Inc.
+   SPDX-License-Identifier: Apache-2.0
+*/
+
+package vcdcsiclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/vmware/go-vcloud-director/v2/govcd"
+	"k8s.io/klog/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+)
+
+// unreachableMessages are the fragments of the errors of requests that did not reach the host, which govcd reports
+// as text instead of wrapping the network errors
+var unreachableMessages = []string{
+	"connection refused",
+	"no such host",
+	"no route to host",
+	"network is unreachable",
+	"i/o timeout",
+	"TLS handshake timeout",
+}
+
+// IsHostUnreachableError returns true if err is the error of a request that could not reach the VCD host. Such an
+// operation can be retried against a failover host.
+func IsHostUnreachableError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	for _, message := range unreachableMessages {
+		if strings.Contains(err.Error(), message) {
+			return true
+		}
+	}
+	return false
+}
+
+// currentHost returns the host that the client authenticated with last
+func (client *Client) currentHost() *url.URL {
+	return client.hosts[atomic.LoadInt32(&client.hostIndex)]
+}
+
+// failover authenticates with the hosts other than the current one in turn, once the current host is unreachable
+// with the error cause, and returns the govcd client of the first host that it authenticates with. That host becomes
+// the current one. The current host is kept if no host can be authenticated with.
+func (client *Client) failover(ctx context.Context, cause error) (*govcd.VCDClient, error) {
+	logger := klog.FromContext(ctx)
+
+	failedIndex := atomic.LoadInt32(&client.hostIndex)
+	errs := []string{fmt.Sprintf("%s: %v", client.hosts[failedIndex].Host, cause)}
+	for i := 1; i < len(client.hosts); i++ {
+		hostIndex := (failedIndex + int32(i)) % int32(len(client.hosts))
+		host := client.hosts[hostIndex]
+		logger.Info("VCD host is unreachable; failing over to another host", "failedHost",
+			client.hosts[failedIndex].Host, "host", host.Host)
+
+		atomic.StoreInt32(&client.hostIndex, hostIndex)
+		vcdClient, err := client.getBearerToken(ctx)
+		if err == nil {
+			client.VCDAuthConfig.Host = host.String()
+			logger.Info("Failed over to VCD host", "host", host.Host)
+			return vcdClient, nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", host.Host, err))
+	}
+
+	atomic.StoreInt32(&client.hostIndex, failedIndex)
+	return nil, fmt.Errorf("unable to authenticate with any VCD host: [%s]", strings.Join(errs, "; "))
+}
+
+// failoverRoundTripper marks the clients of a client with failover hosts for a refresh once one of their requests
+// cannot reach the current host, so that the next operation fails over. The request itself fails with the network
+// error, which upper layers retry.
+type failoverRoundTripper struct {
+	client *Client
+	next   http.RoundTripper
+}
+
+func (rt *failoverRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := rt.next.RoundTrip(req)
+	if err != nil && IsHostUnreachableError(err) &&
+		atomic.CompareAndSwapInt32(&rt.client.hostUnreachable, 0, 1) {
+		klog.FromContext(req.Context()).Error(err, "Request could not reach VCD host; failing over on next operation",
+			"host", req.URL.Host)
+	}
+
+	return resp, err
+}
@@ -0,0 +1,71 @@
+/*
+   Copyright 2021 VMware, Inc.
+   SPDX-License-Identifier: Apache-2.0
+*/
+
+package vcdcsiclient
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWithFailoverHosts(t *testing.T) {
+	primary, primaryLogins := newFakeVCDServer("org", "vdc")
+	defer primary.Close()
+	standby, standbyLogins := newFakeVCDServer("org", "vdc")
+	defer standby.Close()
+	// the url of a closed server refuses connections
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	client, err := NewVCDClientFromSecrets(down.URL, "org", "vdc", "org", "user", "password", "", true, true,
+		WithRetry(1, time.Millisecond), WithFailoverHosts(primary.URL, standby.URL))
+	require.NoError(t, err, "client should fail over from an unreachable host")
+	defer EvictClient(client)
+	assert.Equal(t, strings.TrimPrefix(primary.URL, "http://"), client.currentHost().Host,
+		"client should fail over to the first reachable host")
+	assert.Equal(t, int32(1), atomic.LoadInt32(primaryLogins), "client should authenticate with the failover host")
+	assert.True(t, strings.HasPrefix(client.GetVDC().Vdc.HREF, primary.URL), "VDC should be read from the failover host")
+
+	primary.Close()
+	_, err = client.VCDClient.Client.Http.Get(primary.URL + "/api/vdc/1")
+	assert.True(t, IsHostUnreachableError(err), "request to the failed host should fail with a retryable error")
+	assert.False(t, client.TokenValid(), "client should be refreshed once its host is unreachable")
+
+	require.NoError(t, client.RefreshBearerTokenWithContext(context.Background()),
+		"refresh should fail over to the standby host")
+	assert.Equal(t, strings.TrimPrefix(standby.URL, "http://"), client.currentHost().Host,
+		"standby host should be remembered")
+	assert.Equal(t, int32(1), atomic.LoadInt32(standbyLogins), "client should authenticate with the standby host")
+	assert.True(t, strings.HasPrefix(client.GetVDC().Vdc.HREF, standby.URL), "VDC should be read from the standby host")
+	assert.True(t, client.TokenValid(), "token of the standby host should be valid")
+
+	require.NoError(t, client.RefreshBearerTokenWithContext(context.Background()),
+		"refresh should stay on the standby host")
+	assert.Equal(t, int32(2), atomic.LoadInt32(standbyLogins), "client should refresh with the standby host")
+
+	_, err = NewVCDClientFromSecrets(down.URL, "other-org", "vdc", "org", "user", "password", "", true, true,
+		WithRetry(1, time.Millisecond), WithFailoverHosts(primary.URL))
+	assert.Error(t, err, "client should not be created if no host is reachable")
+	assert.Error(t, WithFailoverHosts("vcd.example.com")(&Client{}), "failover host should be a url")
+}
+
+func TestIsHostUnreachableError(t *testing.T) {
+	for err, expected := range map[error]bool{
+		fmt.Errorf("dial tcp 10.0.0.1:443: connect: connection refused"): true,
+		fmt.Errorf("dial tcp: lookup vcd.example.com: no such host"):     true,
+		fmt.Errorf("unexpected response status [401 Unauthorized]"):      false,
+		context.Canceled: false,
+	} {
+		assert.Equal(t, expected, IsHostUnreachableError(err), "unexpected result for error [%v]", err)
+	}
+}
@@ -0,0 +1,889 @@
+/*
+   Copyright 2021 VMware, Inc.
+   SPDX-License-Identifier: Apache-2.0
+*/
+
+// Package fake has an in-memory vcdcsiclient.VCDDiskManager for the unit tests of the users of the VCD client
+package fake
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/vmware/cloud-director-named-disk-csi-driver/pkg/vcdcsiclient"
+	"github.com/vmware/go-vcloud-director/v2/govcd"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// operations that the errors of a DiskManager can be set for
+	OperationRefresh        = "Refresh"
+	OperationCreateDisk     = "CreateDisk"
+	OperationDeleteDisk     = "DeleteDisk"
+	OperationResizeDisk     = "ResizeDisk"
+	OperationGetDisk        = "GetDisk"
+	OperationListDisks      = "ListDisks"
+	OperationSetMetadata    = "SetDiskMetadata"
+	OperationGetMetadata    = "GetDiskMetadata"
+	OperationFindVM         = "FindVM"
+	OperationAttachDisk     = "AttachDisk"
+	OperationDetachDisk     = "DetachDisk"
+	OperationGetVDCCapacity = "GetVDCCapacity"
+	// OperationCreateSnapshot, OperationDeleteSnapshot and OperationListSnapshots are the operations of the snapshots
+	// of disks, of which OperationListSnapshots also gets snapshots
+	OperationCreateSnapshot = "CreateSnapshot"
+	OperationDeleteSnapshot = "DeleteSnapshot"
+	OperationListSnapshots  = "ListSnapshots"
+	// OperationCreateDiskFromSnapshot fails the restores of disks, whereas OperationCreateDisk fails the other creates
+	OperationCreateDiskFromSnapshot = "CreateDiskFromSnapshot"
+	OperationCloneDisk              = "CloneDisk"
+	// OperationGetVDCThinProvisioned is the operation of GetVDCThinProvisioned
+	OperationGetVDCThinProvisioned = "GetVDCThinProvisioned"
+	// OperationWaitForDiskDetached is the operation of WaitForDiskDetached
+	OperationWaitForDiskDetached = "WaitForDiskDetached"
+	// OperationForVDC is the operation of ForVDC for another VDC
+	OperationForVDC = "ForVDC"
+	// OperationFindVMByID is the operation of FindVMByID
+	OperationFindVMByID = "FindVMByID"
+)
+
+// DiskManager manages disks in memory. Disks are attached to the VMs added with AddVM, and the operations fail with
+// the errors set with SetError.
+type DiskManager struct {
+	ClusterID        string
+	VDCName          string
+	VolumeNamePrefix string
+	// Capacity is returned as the available capacity of every storage profile of the VDC that is not in
+	// StorageProfileCapacities, which has the available capacities of the storage profiles by their names
+	Capacity                 int64
+	StorageProfileCapacities map[string]int64
+	// ThinProvisioned is returned as the provisioning of the disks of the VDC
+	ThinProvisioned bool
+	// DetachPolls is how many checks of WaitForDiskDetached still find a detached disk attached, as VCD does until
+	// it releases the disk
+	DetachPolls int
+	// AllowOfflineAttach allows the disks to be attached to the VMs that are powered off with PowerOffVM
+	AllowOfflineAttach bool
+
+	lock        sync.Mutex
+	disks       map[string]*vcdcsiclient.Disk
+	metadata    map[string]map[string]string
+	attachments map[string]map[string]bool
+	vms         map[string]bool
+	// poweredOffVMs are the VMs that are powered off, whereas the others are powered on
+	poweredOffVMs map[string]bool
+	errors        map[string]error
+	errorTimes    map[string]int
+	diskCount     int
+	// snapshots are the snapshots of the disks by their URN
+	snapshots     map[string]*vcdcsiclient.DiskSnapshot
+	snapshotCount int
+	// vdcs are the disk managers of all the VDCs, which are shared by the disk managers returned by ForVDC
+	vdcs map[string]*DiskManager
+}
+
+var _ vcdcsiclient.VCDDiskManager = &DiskManager{}
+
+// NewDiskManager creates a DiskManager without disks for the cluster clusterID in the VDC vdcName
+func NewDiskManager(clusterID string, vdcName string) *DiskManager {
+	diskManager := newDiskManager(clusterID, vdcName, make(map[string]*DiskManager))
+	diskManager.vdcs[vdcName] = diskManager
+	return diskManager
+}
+
+func newDiskManager(clusterID string, vdcName string, vdcs map[string]*DiskManager) *DiskManager {
+	return &DiskManager{
+		ClusterID:     clusterID,
+		VDCName:       vdcName,
+		disks:         make(map[string]*vcdcsiclient.Disk),
+		metadata:      make(map[string]map[string]string),
+		attachments:   make(map[string]map[string]bool),
+		vms:           make(map[string]bool),
+		poweredOffVMs: make(map[string]bool),
+		errors:        make(map[string]error),
+		errorTimes:    make(map[string]int),
+		snapshots:     make(map[string]*vcdcsiclient.DiskSnapshot),
+		vdcs:          vdcs,
+	}
+}
+
+// AddVM adds the VM of the node nodeID, to which disks can be attached
+func (diskManager *DiskManager) AddVM(nodeID string) {
+	diskManager.lock.Lock()
+	defer diskManager.lock.Unlock()
+
+	diskManager.vms[nodeID] = true
+}
+
+// PowerOffVM powers off the VM of the node nodeID, to which disks are only attached if AllowOfflineAttach is set
+func (diskManager *DiskManager) PowerOffVM(nodeID string) {
+	diskManager.lock.Lock()
+	defer diskManager.lock.Unlock()
+
+	diskManager.poweredOffVMs[nodeID] = true
+}
+
+// SetError makes operation fail with err until it is set to nil
+func (diskManager *DiskManager) SetError(operation string, err error) {
+	diskManager.SetErrorTimes(operation, err, 0)
+}
+
+// SetErrorTimes makes the next times calls of operation fail with err, or every call until it is set to nil if times
+// is 0
+func (diskManager *DiskManager) SetErrorTimes(operation string, err error, times int) {
+	diskManager.lock.Lock()
+	defer diskManager.lock.Unlock()
+
+	delete(diskManager.errorTimes, operation)
+	if err == nil {
+		delete(diskManager.errors, operation)
+		return
+	}
+	diskManager.errors[operation] = err
+	if times > 0 {
+		diskManager.errorTimes[operation] = times
+	}
+}
+
+// operationError returns the error set for a call of operation, counting the call against the times of the error.
+// The caller should hold diskManager.lock.
+func (diskManager *DiskManager) operationError(operation string) error {
+	err := diskManager.errors[operation]
+	if times, ok := diskManager.errorTimes[operation]; ok {
+		if times <= 1 {
+			delete(diskManager.errors, operation)
+			delete(diskManager.errorTimes, operation)
+		} else {
+			diskManager.errorTimes[operation] = times - 1
+		}
+	}
+
+	return err
+}
+
+// AttachedVMs returns the names of the VMs that the disk diskName is attached to, in order
+func (diskManager *DiskManager) AttachedVMs(diskName string) []string {
+	diskManager.lock.Lock()
+	defer diskManager.lock.Unlock()
+
+	var vmNames []string
+	for vmName := range diskManager.attachments[diskName] {
+		vmNames = append(vmNames, vmName)
+	}
+	sort.Strings(vmNames)
+	return vmNames
+}
+
+func (diskManager *DiskManager) GetClusterID() string {
+	return diskManager.ClusterID
+}
+
+func (diskManager *DiskManager) GetVDCName() string {
+	return diskManager.VDCName
+}
+
+func (diskManager *DiskManager) GetDiskName(volumeName string) string {
+	return diskManager.VolumeNamePrefix + volumeName
+}
+
+// ForVDC returns the disk manager of the VDC vdcName, which is created with the settings of this one the first time
+func (diskManager *DiskManager) ForVDC(vdcName string) (vcdcsiclient.VCDDiskManager, error) {
+	diskManager.lock.Lock()
+	defer diskManager.lock.Unlock()
+
+	vdcDiskManager, ok := diskManager.vdcs[vdcName]
+	if !ok {
+		if err := diskManager.operationError(OperationForVDC); err != nil {
+			return nil, err
+		}
+		vdcDiskManager = newDiskManager(diskManager.ClusterID, vdcName, diskManager.vdcs)
+		vdcDiskManager.VolumeNamePrefix = diskManager.VolumeNamePrefix
+		vdcDiskManager.Capacity = diskManager.Capacity
+		vdcDiskManager.AllowOfflineAttach = diskManager.AllowOfflineAttach
+		diskManager.vdcs[vdcName] = vdcDiskManager
+	}
+
+	return vdcDiskManager, nil
+}
+
+func (diskManager *DiskManager) RefreshBearerTokenWithContext(ctx context.Context) error {
+	diskManager.lock.Lock()
+	defer diskManager.lock.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return diskManager.operationError(OperationRefresh)
+}
+
+// CreateDiskWithContext creates the disk diskName, or returns it if it exists with the same storage profile and
+// encryption policy. The disks with an encryption policy are encrypted.
+func (diskManager *DiskManager) CreateDiskWithContext(ctx context.Context, diskName string, sizeMB int64,
+	busType string, busSubType string, description string, storageProfile string, shareable bool,
+	sharingType string, encryptionPolicy string, iops int64) (*vcdcsiclient.Disk, error) {
+
+	diskManager.lock.Lock()
+	defer diskManager.lock.Unlock()
+
+	// the operations of a caller that has given up fail as they do with VCD
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := diskManager.operationError(OperationCreateDisk); err != nil {
+		return nil, err
+	}
+
+	return diskManager.createDisk(diskName, sizeMB, busType, busSubType, description, storageProfile, shareable,
+		sharingType, encryptionPolicy, iops)
+}
+
+// createDisk creates the disk diskName as CreateDiskWithContext does. The caller should hold diskManager.lock.
+func (diskManager *DiskManager) createDisk(diskName string, sizeMB int64, busType string, busSubType string,
+	description string, storageProfile string, shareable bool, sharingType string, encryptionPolicy string,
+	iops int64) (*vcdcsiclient.Disk, error) {
+	if disk, ok := diskManager.disks[diskName]; ok {
+		if storageProfile != "" && !disk.HasStorageProfile(storageProfile) {
+			return nil, vcdcsiclient.NewDiskError(vcdcsiclient.ErrDiskExists, diskName,
+				fmt.Errorf("disk [%s] already exists with another storage profile", diskName))
+		}
+		if encryptionPolicy != "" && !disk.HasEncryptionPolicy(encryptionPolicy) {
+			return nil, vcdcsiclient.NewDiskError(vcdcsiclient.ErrDiskExists, diskName,
+				fmt.Errorf("disk [%s] already exists with another encryption policy", diskName))
+		}
+		return copyDisk(disk), nil
+	}
+
+	diskManager.diskCount++
+	id := fmt.Sprintf("%08d-0000-0000-0000-000000000000", diskManager.diskCount)
+	disk := &vcdcsiclient.Disk{
+		HREF:        "https://vcd.example.com/api/disk/" + id,
+		ID:          vcdcsiclient.DiskURNPrefix + id,
+		Name:        diskName,
+		SizeMB:      sizeMB,
+		IOPS:        iops,
+		BusType:     busType,
+		BusSubType:  busSubType,
+		Shareable:   shareable,
+		SharingType: sharingType,
+		Encrypted:   encryptionPolicy != "",
+		UUID:        id,
+		Description: description,
+	}
+	if vcdcsiclient.IsStorageProfileURN(storageProfile) {
+		disk.StorageProfileID = storageProfile
+	} else {
+		disk.StorageProfile = storageProfile
+	}
+	if strings.HasPrefix(encryptionPolicy, "urn:") {
+		disk.EncryptionPolicyID = encryptionPolicy
+	} else {
+		disk.EncryptionPolicy = encryptionPolicy
+	}
+	diskManager.disks[diskName] = disk
+
+	return copyDisk(disk), nil
+}
+
+// DeleteDiskWithContext deletes the disk name if it is not attached, and succeeds if it does not exist
+func (diskManager *DiskManager) DeleteDiskWithContext(ctx context.Context, name string) error {
+	diskManager.lock.Lock()
+	defer diskManager.lock.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := diskManager.operationError(OperationDeleteDisk); err != nil {
+		return err
+	}
+	diskName, ok := diskManager.findDiskName(name)
+	if !ok {
+		return nil
+	}
+	if len(diskManager.attachments[diskName]) > 0 {
+		return vcdcsiclient.NewDiskError(vcdcsiclient.ErrDiskAttached, diskName,
+			fmt.Errorf("unable to delete disk [%s] that is attached to VMs", diskName))
+	}
+	delete(diskManager.disks, diskName)
+	delete(diskManager.metadata, diskName)
+
+	return nil
+}
+
+// CreateDiskSnapshotWithContext takes the snapshot snapName of the disk diskName, or returns the snapshot of the disk
+// that is already named snapName
+func (diskManager *DiskManager) CreateDiskSnapshotWithContext(ctx context.Context, diskName string,
+	snapName string) (*vcdcsiclient.DiskSnapshot, error) {
+
+	diskManager.lock.Lock()
+	defer diskManager.lock.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := diskManager.operationError(OperationCreateSnapshot); err != nil {
+		return nil, err
+	}
+	name, ok := diskManager.findDiskName(diskName)
+	if !ok {
+		return nil, vcdcsiclient.NewDiskError(vcdcsiclient.ErrDiskNotFound, diskName, nil)
+	}
+	disk := diskManager.disks[name]
+	for _, snapshot := range diskManager.snapshots {
+		if snapshot.DiskID == disk.ID && snapshot.Name == snapName {
+			snapshotCopy := *snapshot
+			return &snapshotCopy, nil
+		}
+	}
+
+	diskManager.snapshotCount++
+	id := fmt.Sprintf("%08d-0000-0000-0000-000000000000", diskManager.snapshotCount)
+	snapshot := &vcdcsiclient.DiskSnapshot{
+		ID:           vcdcsiclient.DiskSnapshotURNPrefix + id,
+		HREF:         "https://vcd.example.com/api/diskSnapshot/" + id,
+		Name:         snapName,
+		DiskID:       disk.ID,
+		DiskName:     disk.Name,
+		SizeMB:       disk.SizeMB,
+		CreationTime: time.Now().UTC(),
+		ReadyToUse:   true,
+	}
+	diskManager.snapshots[snapshot.ID] = snapshot
+
+	snapshotCopy := *snapshot
+	return &snapshotCopy, nil
+}
+
+// DeleteDiskSnapshotWithContext deletes the snapshot snapID, and succeeds if it does not exist
+func (diskManager *DiskManager) DeleteDiskSnapshotWithContext(ctx context.Context, snapID string) error {
+	diskManager.lock.Lock()
+	defer diskManager.lock.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := diskManager.operationError(OperationDeleteSnapshot); err != nil {
+		return err
+	}
+	delete(diskManager.snapshots, snapID)
+
+	return nil
+}
+
+// ListDiskSnapshots returns the snapshots of the disk diskName in the order they were taken
+func (diskManager *DiskManager) ListDiskSnapshots(diskName string) ([]vcdcsiclient.DiskSnapshot, error) {
+	diskManager.lock.Lock()
+	defer diskManager.lock.Unlock()
+
+	if err := diskManager.operationError(OperationListSnapshots); err != nil {
+		return nil, err
+	}
+	name, ok := diskManager.findDiskName(diskName)
+	if !ok {
+		return nil, vcdcsiclient.NewDiskError(vcdcsiclient.ErrDiskNotFound, diskName, nil)
+	}
+	snapshots := make([]vcdcsiclient.DiskSnapshot, 0)
+	for _, snapshot := range diskManager.snapshots {
+		if snapshot.DiskID == diskManager.disks[name].ID {
+			snapshots = append(snapshots, *snapshot)
+		}
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].ID < snapshots[j].ID })
+
+	return snapshots, nil
+}
+
+// GetDiskSnapshot returns the snapshot snapshotID
+func (diskManager *DiskManager) GetDiskSnapshot(snapshotID string) (*vcdcsiclient.DiskSnapshot, error) {
+	diskManager.lock.Lock()
+	defer diskManager.lock.Unlock()
+
+	if err := diskManager.operationError(OperationListSnapshots); err != nil {
+		return nil, err
+	}
+	snapshot, ok := diskManager.snapshots[snapshotID]
+	if !ok {
+		return nil, vcdcsiclient.NewDiskError(vcdcsiclient.ErrSnapshotNotFound, snapshotID, nil)
+	}
+
+	snapshotCopy := *snapshot
+	return &snapshotCopy, nil
+}
+
+// CreateDiskFromSnapshotWithContext creates the disk name from the snapshot snapshotID with the bus and the sharing
+// of the disk of the snapshot, and with sizeBytes, rounded up to MB, or the size of the snapshot if it is larger
+func (diskManager *DiskManager) CreateDiskFromSnapshotWithContext(ctx context.Context, name string,
+	snapshotID string, storageProfile string, sizeBytes int64) (*vcdcsiclient.Disk, error) {
+
+	diskManager.lock.Lock()
+	defer diskManager.lock.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := diskManager.operationError(OperationCreateDiskFromSnapshot); err != nil {
+		return nil, err
+	}
+	snapshot, ok := diskManager.snapshots[snapshotID]
+	if !ok {
+		return nil, vcdcsiclient.NewDiskError(vcdcsiclient.ErrSnapshotNotFound, snapshotID, nil)
+	}
+	var sourceDisk *vcdcsiclient.Disk
+	for _, disk := range diskManager.disks {
+		if disk.ID == snapshot.DiskID {
+			sourceDisk = disk
+		}
+	}
+	if sourceDisk == nil {
+		return nil, fmt.Errorf("unable to find disk [%s] of snapshot [%s]", snapshot.DiskName, snapshotID)
+	}
+	sizeMB := (sizeBytes + mbToBytes - 1) / mbToBytes
+	if sizeMB < snapshot.SizeMB {
+		sizeMB = snapshot.SizeMB
+	}
+
+	return diskManager.createDisk(name, sizeMB, sourceDisk.BusType, sourceDisk.BusSubType, sourceDisk.Description,
+		storageProfile, sourceDisk.Shareable, sourceDisk.SharingType, "", 0)
+}
+
+// CloneDiskWithContext creates the disk newDiskName as a copy of the disk sourceDiskName, with sizeBytes, rounded up
+// to MB, or the size of the source disk if it is larger, and fails if the source disk is attached to VMs
+func (diskManager *DiskManager) CloneDiskWithContext(ctx context.Context, sourceDiskName string, newDiskName string,
+	storageProfile string, sizeBytes int64) (*vcdcsiclient.Disk, error) {
+
+	diskManager.lock.Lock()
+	defer diskManager.lock.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := diskManager.operationError(OperationCloneDisk); err != nil {
+		return nil, err
+	}
+	name, ok := diskManager.findDiskName(sourceDiskName)
+	if !ok {
+		return nil, vcdcsiclient.NewDiskError(vcdcsiclient.ErrDiskNotFound, sourceDiskName, nil)
+	}
+	if _, exists := diskManager.disks[newDiskName]; !exists && len(diskManager.attachments[name]) > 0 {
+		return nil, vcdcsiclient.NewDiskError(vcdcsiclient.ErrDiskAttached, name,
+			fmt.Errorf("disk [%s] cannot be copied while it is attached to VMs", name))
+	}
+	sourceDisk := diskManager.disks[name]
+	sizeMB := (sizeBytes + mbToBytes - 1) / mbToBytes
+	if sizeMB < sourceDisk.SizeMB {
+		sizeMB = sourceDisk.SizeMB
+	}
+
+	return diskManager.createDisk(newDiskName, sizeMB, sourceDisk.BusType, sourceDisk.BusSubType,
+		sourceDisk.Description, storageProfile, sourceDisk.Shareable, sourceDisk.SharingType, "", 0)
+}
+
+// ResizeDiskWithContext grows the disk diskName to newSizeBytes, rounded up to MB
+func (diskManager *DiskManager) ResizeDiskWithContext(ctx context.Context, diskName string,
+	newSizeBytes int64) error {
+
+	diskManager.lock.Lock()
+	defer diskManager.lock.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := diskManager.operationError(OperationResizeDisk); err != nil {
+		return err
+	}
+	if newSizeBytes <= 0 {
+		return fmt.Errorf("new size [%d] of disk [%s] should be positive", newSizeBytes, diskName)
+	}
+	name, ok := diskManager.findDiskName(diskName)
+	if !ok {
+		return vcdcsiclient.NewDiskError(vcdcsiclient.ErrDiskNotFound, diskName, nil)
+	}
+	disk := diskManager.disks[name]
+	if sizeMB := (newSizeBytes + mbToBytes - 1) / mbToBytes; sizeMB > disk.SizeMB {
+		disk.SizeMB = sizeMB
+	}
+
+	return nil
+}
+
+// GetDisk returns the disk whose ID is diskID
+func (diskManager *DiskManager) GetDisk(diskID string) (*vcdcsiclient.Disk, error) {
+	diskManager.lock.Lock()
+	defer diskManager.lock.Unlock()
+
+	if err := diskManager.operationError(OperationGetDisk); err != nil {
+		return nil, err
+	}
+	for _, disk := range diskManager.disks {
+		if disk.ID == diskID {
+			return diskManager.getDisk(disk), nil
+		}
+	}
+
+	return nil, vcdcsiclient.NewDiskError(vcdcsiclient.ErrDiskNotFound, diskID, nil)
+}
+
+// GetDiskByName returns the disk whose name or URN is name
+func (diskManager *DiskManager) GetDiskByName(name string) (*vcdcsiclient.Disk, error) {
+	diskManager.lock.Lock()
+	defer diskManager.lock.Unlock()
+
+	if err := diskManager.operationError(OperationGetDisk); err != nil {
+		return nil, err
+	}
+	diskName, ok := diskManager.findDiskName(name)
+	if !ok {
+		return nil, vcdcsiclient.NewDiskError(vcdcsiclient.ErrDiskNotFound, name, nil)
+	}
+
+	return diskManager.getDisk(diskManager.disks[diskName]), nil
+}
+
+// FindDiskByName is the same as GetDiskByName but returns nil if the disk does not exist
+func (diskManager *DiskManager) FindDiskByName(name string) (*vcdcsiclient.Disk, error) {
+	disk, err := diskManager.GetDiskByName(name)
+	if errors.Is(err, vcdcsiclient.ErrDiskNotFound) {
+		return nil, nil
+	}
+
+	return disk, err
+}
+
+// ListDisks returns the disks in the order of their names from the offset pageToken
+func (diskManager *DiskManager) ListDisks(pageToken string, maxEntries int) ([]vcdcsiclient.Disk, string, error) {
+	diskManager.lock.Lock()
+	defer diskManager.lock.Unlock()
+
+	if err := diskManager.operationError(OperationListDisks); err != nil {
+		return nil, "", err
+	}
+	offset := 0
+	if pageToken != "" {
+		var err error
+		if offset, err = strconv.Atoi(pageToken); err != nil || offset < 0 {
+			return nil, "", fmt.Errorf("invalid page token [%s]", pageToken)
+		}
+	}
+
+	var diskNames []string
+	for diskName := range diskManager.disks {
+		diskNames = append(diskNames, diskName)
+	}
+	sort.Strings(diskNames)
+	if offset > len(diskNames) {
+		offset = len(diskNames)
+	}
+	end := len(diskNames)
+	nextPageToken := ""
+	if maxEntries > 0 && offset+maxEntries < end {
+		end = offset + maxEntries
+		nextPageToken = strconv.Itoa(end)
+	}
+
+	disks := make([]vcdcsiclient.Disk, 0, end-offset)
+	for _, diskName := range diskNames[offset:end] {
+		disks = append(disks, *diskManager.getDisk(diskManager.disks[diskName]))
+	}
+
+	return disks, nextPageToken, nil
+}
+
+// ListDisksForCluster returns the disks in the order of their names whose cluster ID metadata is clusterID
+func (diskManager *DiskManager) ListDisksForCluster(clusterID string) ([]vcdcsiclient.Disk, error) {
+	diskManager.lock.Lock()
+	defer diskManager.lock.Unlock()
+
+	if err := diskManager.operationError(OperationListDisks); err != nil {
+		return nil, err
+	}
+	var diskNames []string
+	for diskName := range diskManager.disks {
+		if diskManager.metadata[diskName][vcdcsiclient.ClusterIDMetadataKey] == clusterID {
+			diskNames = append(diskNames, diskName)
+		}
+	}
+	sort.Strings(diskNames)
+
+	var disks []vcdcsiclient.Disk
+	for _, diskName := range diskNames {
+		disks = append(disks, *diskManager.getDisk(diskManager.disks[diskName]))
+	}
+
+	return disks, nil
+}
+
+func (diskManager *DiskManager) GetDiskMetadata(diskName string) (map[string]string, error) {
+	diskManager.lock.Lock()
+	defer diskManager.lock.Unlock()
+
+	if err := diskManager.operationError(OperationGetMetadata); err != nil {
+		return nil, err
+	}
+	name, ok := diskManager.findDiskName(diskName)
+	if !ok {
+		return nil, vcdcsiclient.NewDiskError(vcdcsiclient.ErrDiskNotFound, diskName, nil)
+	}
+	metadata := make(map[string]string)
+	for key, value := range diskManager.metadata[name] {
+		metadata[key] = value
+	}
+
+	return metadata, nil
+}
+
+func (diskManager *DiskManager) SetDiskMetadata(ctx context.Context, diskName string, kv map[string]string) error {
+	diskManager.lock.Lock()
+	defer diskManager.lock.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := diskManager.operationError(OperationSetMetadata); err != nil {
+		return err
+	}
+	name, ok := diskManager.findDiskName(diskName)
+	if !ok {
+		return vcdcsiclient.NewDiskError(vcdcsiclient.ErrDiskNotFound, diskName, nil)
+	}
+	if diskManager.metadata[name] == nil {
+		diskManager.metadata[name] = make(map[string]string)
+	}
+	for key, value := range kv {
+		diskManager.metadata[name][key] = value
+	}
+
+	return nil
+}
+
+func (diskManager *DiskManager) GetVDCCapacity(storageProfile string) (int64, error) {
+	diskManager.lock.Lock()
+	defer diskManager.lock.Unlock()
+
+	if capacity, ok := diskManager.StorageProfileCapacities[storageProfile]; ok {
+		return capacity, diskManager.operationError(OperationGetVDCCapacity)
+	}
+	return diskManager.Capacity, diskManager.operationError(OperationGetVDCCapacity)
+}
+
+func (diskManager *DiskManager) GetVDCThinProvisioned() (bool, error) {
+	diskManager.lock.Lock()
+	defer diskManager.lock.Unlock()
+
+	return diskManager.ThinProvisioned, diskManager.operationError(OperationGetVDCThinProvisioned)
+}
+
+// FindVMByNodeID returns the VM added for nodeID
+func (diskManager *DiskManager) FindVMByNodeID(nodeID string) (*govcd.VM, error) {
+	diskManager.lock.Lock()
+	defer diskManager.lock.Unlock()
+
+	if err := diskManager.operationError(OperationFindVM); err != nil {
+		return nil, err
+	}
+	if !diskManager.vms[nodeID] {
+		return nil, fmt.Errorf("unable to find VM for node [%s]", nodeID)
+	}
+
+	return diskManager.newVM(nodeID), nil
+}
+
+// FindVMByID returns the VM added for the node whose name is the UUID of vmID
+func (diskManager *DiskManager) FindVMByID(vmID string) (*govcd.VM, error) {
+	diskManager.lock.Lock()
+	defer diskManager.lock.Unlock()
+
+	if err := diskManager.operationError(OperationFindVMByID); err != nil {
+		return nil, err
+	}
+	nodeID := strings.TrimPrefix(vmID, vcdcsiclient.VMURNPrefix)
+	if !diskManager.vms[nodeID] {
+		return nil, fmt.Errorf("unable to find VM [%s]", vmID)
+	}
+
+	return diskManager.newVM(nodeID), nil
+}
+
+// newVM returns the VM of the node nodeID, whose UUID is the node ID. The caller should hold diskManager.lock.
+func (diskManager *DiskManager) newVM(nodeID string) *govcd.VM {
+	// the statuses of VMs that are powered on and off
+	status := 4
+	if diskManager.poweredOffVMs[nodeID] {
+		status = 8
+	}
+
+	return &govcd.VM{
+		VM: &types.Vm{
+			ID:     vcdcsiclient.VMURNPrefix + nodeID,
+			Name:   nodeID,
+			HREF:   "https://vcd.example.com/api/vApp/vm-" + nodeID,
+			Status: status,
+		},
+	}
+}
+
+// AttachmentState returns the VMs in order that the disk diskName is attached to
+func (diskManager *DiskManager) AttachmentState(diskName string) ([]string, error) {
+	diskManager.lock.Lock()
+	defer diskManager.lock.Unlock()
+
+	name, ok := diskManager.findDiskName(diskName)
+	if !ok {
+		return nil, vcdcsiclient.NewDiskError(vcdcsiclient.ErrDiskNotFound, diskName, nil)
+	}
+	var vmNames []string
+	for vmName := range diskManager.attachments[name] {
+		vmNames = append(vmNames, vmName)
+	}
+	sort.Strings(vmNames)
+
+	return vmNames, nil
+}
+
+// AttachVolumeAtWithContext attaches disk to vm, which should be the only VM of a disk that is not shareable
+func (diskManager *DiskManager) AttachVolumeAtWithContext(ctx context.Context, vm *govcd.VM, disk *vcdcsiclient.Disk,
+	busNumber *int, unitNumber *int) error {
+
+	diskManager.lock.Lock()
+	defer diskManager.lock.Unlock()
+
+	if disk == nil {
+		return fmt.Errorf("disk passed should not be nil")
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := diskManager.operationError(OperationAttachDisk); err != nil {
+		return err
+	}
+	existingDisk, ok := diskManager.disks[disk.Name]
+	if !ok {
+		return vcdcsiclient.NewDiskError(vcdcsiclient.ErrDiskNotFound, disk.Name, nil)
+	}
+	attachments := diskManager.attachments[disk.Name]
+	if attachments[vm.VM.Name] {
+		return nil
+	}
+	if len(attachments) > 0 && !existingDisk.Shareable {
+		return vcdcsiclient.NewDiskError(vcdcsiclient.ErrDiskAttached, disk.Name,
+			fmt.Errorf("disk [%s] that is not shareable is attached to another VM", disk.Name))
+	}
+	if err := vcdcsiclient.CheckAttachPowerState(vm.VM.Name, vm.VM.Status, disk.Name, existingDisk.BusType,
+		diskManager.AllowOfflineAttach); err != nil {
+		return err
+	}
+	if attachments == nil {
+		attachments = make(map[string]bool)
+		diskManager.attachments[disk.Name] = attachments
+	}
+	attachments[vm.VM.Name] = true
+
+	return nil
+}
+
+// DetachVolumeWithContext detaches the disk diskName from vm, and succeeds if it is not attached or does not exist
+func (diskManager *DiskManager) DetachVolumeWithContext(ctx context.Context, vm *govcd.VM, diskName string) error {
+	diskManager.lock.Lock()
+	defer diskManager.lock.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := diskManager.operationError(OperationDetachDisk); err != nil {
+		return err
+	}
+	if name, ok := diskManager.findDiskName(diskName); ok {
+		delete(diskManager.attachments[name], vm.VM.Name)
+	}
+
+	return nil
+}
+
+// WaitForDiskDetached returns once the disk diskName is not attached to vm, after the DetachPolls of the disk manager
+func (diskManager *DiskManager) WaitForDiskDetached(ctx context.Context, vm *govcd.VM, diskName string,
+	pollInterval time.Duration) error {
+
+	diskManager.lock.Lock()
+	err := diskManager.operationError(OperationWaitForDiskDetached)
+	diskManager.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	for poll := 0; ; poll++ {
+		diskManager.lock.Lock()
+		name, ok := diskManager.findDiskName(diskName)
+		attached := ok && (diskManager.attachments[name][vm.VM.Name] || poll < diskManager.DetachPolls)
+		diskManager.lock.Unlock()
+		if !attached {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("disk [%s] is still attached to VM [%s]: [%v]", diskName, vm.VM.Name, ctx.Err())
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// AddToErrorSet, RemoveFromErrorSet and AddToEventSet do nothing, since the fake has no RDE of the cluster
+func (diskManager *DiskManager) AddToErrorSet(errorType string, vcdResourceId string, vcdResourceName string,
+	detailMap map[string]interface{}) error {
+	return nil
+}
+
+func (diskManager *DiskManager) RemoveFromErrorSet(errorType string, vcdResourceId string,
+	vcdResourceName string) error {
+	return nil
+}
+
+func (diskManager *DiskManager) AddToEventSet(eventType string, vcdResourceId string, vcdResourceName string,
+	detailMap map[string]interface{}) error {
+	return nil
+}
+
+const mbToBytes = int64(1024 * 1024)
+
+// findDiskName returns the name of the disk whose name or URN is name
+func (diskManager *DiskManager) findDiskName(name string) (string, bool) {
+	if _, ok := diskManager.disks[name]; ok {
+		return name, true
+	}
+	if vcdcsiclient.IsDiskURN(name) {
+		for diskName, disk := range diskManager.disks {
+			if disk.ID == name {
+				return diskName, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// getDisk returns a copy of disk with the VMs that it is attached to and its metadata
+func (diskManager *DiskManager) getDisk(disk *vcdcsiclient.Disk) *vcdcsiclient.Disk {
+	diskCopy := copyDisk(disk)
+	for vmName := range diskManager.attachments[disk.Name] {
+		diskCopy.AttachedVMs = append(diskCopy.AttachedVMs, vmName)
+	}
+	sort.Strings(diskCopy.AttachedVMs)
+	if metadata, ok := diskManager.metadata[disk.Name]; ok {
+		diskCopy.Metadata = make(map[string]string, len(metadata))
+		for key, value := range metadata {
+			diskCopy.Metadata[key] = value
+		}
+	}
+
+	return diskCopy
+}
+
+func copyDisk(disk *vcdcsiclient.Disk) *vcdcsiclient.Disk {
+	diskCopy := *disk
+	diskCopy.AttachedVMs = nil
+	diskCopy.Metadata = nil
+
+	return &diskCopy
+}
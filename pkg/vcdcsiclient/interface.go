@@ -0,0 +1,107 @@
+/*
+   Copyright 2021 VMware, Inc.
+   SPDX-License-Identifier: Apache-2.0
+*/
+
+package vcdcsiclient
+
+import (
+	"context"
+	"github.com/vmware/go-vcloud-director/v2/govcd"
+	"time"
+)
+
+// VCDDiskManager manages the named disks of a VDC and their attachments to the VMs of the nodes of a cluster.
+// DiskManager implements it with VCD, and fake.DiskManager in memory for the unit tests of its users.
+type VCDDiskManager interface {
+	// GetClusterID returns the ID of the cluster that the disks are created for
+	GetClusterID() string
+	// GetVDCName returns the name of the VDC of the disks
+	GetVDCName() string
+	// GetDiskName returns the name of the disk of the volume volumeName
+	GetDiskName(volumeName string) string
+	// ForVDC returns a disk manager for the VDC vdcName with the settings of this one
+	ForVDC(vdcName string) (VCDDiskManager, error)
+	// RefreshBearerTokenWithContext refreshes the credentials used to manage the disks
+	RefreshBearerTokenWithContext(ctx context.Context) error
+
+	CreateDiskWithContext(ctx context.Context, diskName string, sizeMB int64, busType string, busSubType string,
+		description string, storageProfile string, shareable bool, sharingType string, encryptionPolicy string,
+		iops int64) (*Disk, error)
+	DeleteDiskWithContext(ctx context.Context, name string) error
+	ResizeDiskWithContext(ctx context.Context, diskName string, newSizeBytes int64) error
+	GetDisk(diskID string) (*Disk, error)
+	GetDiskByName(name string) (*Disk, error)
+	FindDiskByName(name string) (*Disk, error)
+	ListDisks(pageToken string, maxEntries int) ([]Disk, string, error)
+	ListDisksForCluster(clusterID string) ([]Disk, error)
+	GetDiskMetadata(diskName string) (map[string]string, error)
+	SetDiskMetadata(ctx context.Context, diskName string, kv map[string]string) error
+	GetVDCCapacity(storageProfile string) (int64, error)
+	GetVDCThinProvisioned() (bool, error)
+
+	CreateDiskSnapshotWithContext(ctx context.Context, diskName string, snapName string) (*DiskSnapshot, error)
+	DeleteDiskSnapshotWithContext(ctx context.Context, snapID string) error
+	ListDiskSnapshots(diskName string) ([]DiskSnapshot, error)
+	GetDiskSnapshot(snapshotID string) (*DiskSnapshot, error)
+	CreateDiskFromSnapshotWithContext(ctx context.Context, name string, snapshotID string, storageProfile string,
+		sizeBytes int64) (*Disk, error)
+	CloneDiskWithContext(ctx context.Context, sourceDiskName string, newDiskName string, storageProfile string,
+		sizeBytes int64) (*Disk, error)
+
+	FindVMByNodeID(nodeID string) (*govcd.VM, error)
+	FindVMByID(vmID string) (*govcd.VM, error)
+	AttachmentState(diskName string) ([]string, error)
+	AttachVolumeAtWithContext(ctx context.Context, vm *govcd.VM, disk *Disk, busNumber *int,
+		unitNumber *int) error
+	DetachVolumeWithContext(ctx context.Context, vm *govcd.VM, diskName string) error
+	// WaitForDiskDetached returns once VCD no longer reports the disk diskName as attached to vm
+	WaitForDiskDetached(ctx context.Context, vm *govcd.VM, diskName string, pollInterval time.Duration) error
+
+	AddToErrorSet(errorType string, vcdResourceId string, vcdResourceName string,
+		detailMap map[string]interface{}) error
+	RemoveFromErrorSet(errorType string, vcdResourceId string, vcdResourceName string) error
+	AddToEventSet(eventType string, vcdResourceId string, vcdResourceName string,
+		detailMap map[string]interface{}) error
+}
+
+var _ VCDDiskManager = &DiskManager{}
+
+// GetClusterID returns the ID of the cluster that the disks are created for
+func (diskManager *DiskManager) GetClusterID() string {
+	return diskManager.ClusterID
+}
+
+// GetVDCName returns the name of the VDC of the client of the disk manager
+func (diskManager *DiskManager) GetVDCName() string {
+	return diskManager.VCDClient.ClusterOVDCName
+}
+
+// ForVDC returns a disk manager for the VDC vdcName with the settings of this one, whose client authenticates with
+// the credentials of the client of this one. The disk manager itself is returned for its own VDC.
+func (diskManager *DiskManager) ForVDC(vdcName string) (VCDDiskManager, error) {
+	if vdcName == diskManager.GetVDCName() {
+		return diskManager, nil
+	}
+
+	vdcClient, err := diskManager.VCDClient.NewVCDClientForVDC(vdcName)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DiskManager{
+		VCDClient:               vdcClient,
+		ClusterID:               diskManager.ClusterID,
+		VAppName:                diskManager.VAppName,
+		DryRun:                  diskManager.DryRun,
+		VolumeNamePrefix:        diskManager.VolumeNamePrefix,
+		VAppScopedVMSearch:      diskManager.VAppScopedVMSearch,
+		AllowOfflineAttach:      diskManager.AllowOfflineAttach,
+		DeleteTransitionTimeout: diskManager.DeleteTransitionTimeout,
+	}, nil
+}
+
+// RefreshBearerTokenWithContext refreshes the bearer token of the client of the disk manager
+func (diskManager *DiskManager) RefreshBearerTokenWithContext(ctx context.Context) error {
+	return diskManager.VCDClient.RefreshBearerTokenWithContext(ctx)
+}
@@ -0,0 +1,59 @@
+/*
+   Copyright 2021 VMware, Inc.
+   SPDX-License-Identifier: Apache-2.0
+*/
+
+package vcdcsiclient
+
+import (
+	"context"
+	"github.com/go-logr/logr"
+	"github.com/google/uuid"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// requestIDKey is the log key of the ID shared by the log lines of one operation
+	requestIDKey = "requestID"
+)
+
+// requestIDContextKey is the key of the request ID of a context
+type requestIDContextKey struct{}
+
+// NewRequestContext returns a copy of ctx with a new request ID. Operations that are given the returned context, and
+// the VCD calls they make, log with that request ID.
+func NewRequestContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, requestIDContextKey{}, uuid.New().String())
+}
+
+// RequestID returns the request ID of ctx, or an empty string if ctx has none
+func RequestID(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDContextKey{}).(string)
+	return requestID
+}
+
+// requestContext returns ctx and its logger if it has one. Otherwise it returns a copy of ctx whose logger is the
+// client's logger with the request ID of ctx, or with a new request ID if ctx has none.
+func (client *Client) requestContext(ctx context.Context) (context.Context, logr.Logger) {
+	if logger, err := logr.FromContext(ctx); err == nil {
+		return ctx, logger
+	}
+
+	requestID := RequestID(ctx)
+	if requestID == "" {
+		requestID = uuid.New().String()
+	}
+	logger := client.logger
+	if logger.GetSink() == nil {
+		logger = klog.Background()
+	}
+	logger = logger.WithValues(requestIDKey, requestID)
+	return logr.NewContext(ctx, logger), logger
+}
+
+// operationContext returns a context and logger for operation, with the request ID of ctx
+func (client *Client) operationContext(ctx context.Context, operation string) (context.Context, logr.Logger) {
+	ctx, logger := client.requestContext(ctx)
+	logger = logger.WithValues("operation", operation)
+	return logr.NewContext(ctx, logger), logger
+}
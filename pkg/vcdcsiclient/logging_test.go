@@ -0,0 +1,46 @@
+/*
+   Copyright 2021 VMware, Inc.
+   SPDX-License-Identifier: Apache-2.0
+*/
+
+package vcdcsiclient
+
+import (
+	"context"
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestContext(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	assert.Empty(t, RequestID(context.Background()), "context without a request should have no request ID")
+	ctx := NewRequestContext(context.Background())
+	requestID := RequestID(ctx)
+	assert.NotEmpty(t, requestID, "request context should have a request ID")
+	assert.NotEqual(t, requestID, RequestID(NewRequestContext(context.Background())),
+		"every request should have its own request ID")
+
+	sink := newRecordingLogSink(4)
+	client := &Client{logger: logr.New(sink)}
+	ctx, _ = client.operationContext(ctx, operationRefresh)
+	rt := &contextRoundTripper{ctx: ctx, next: http.DefaultTransport}
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/api/query", nil)
+	require.NoError(t, err, "request should be created")
+	resp, err := rt.RoundTrip(req)
+	require.NoError(t, err, "request should be sent")
+	resp.Body.Close()
+	assert.Contains(t, sink.logged(), "VCD call", "VCD call should be logged")
+	assert.Contains(t, sink.logged(), requestID, "VCD call should be logged with the request ID of the context")
+
+	boundCtx, logger := client.requestContext(ctx)
+	assert.Equal(t, ctx, boundCtx, "context with a logger should be kept")
+	assert.NotNil(t, logger.GetSink(), "logger of the context should be returned")
+	_, logger = (&Client{}).requestContext(context.Background())
+	assert.NotNil(t, logger.GetSink(), "client without a logger should log with klog")
+}
@@ -0,0 +1,209 @@
+/*
+   Copyright 2021 VMware, Inc.
+   SPDX-License-Identifier: Apache-2.0
+*/
+
+package vcdcsiclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/vmware/go-vcloud-director/v2/govcd"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	metricsNamespace = "vcd_csi"
+
+	// operations recorded in the VCD API call metrics
+	operationAuthenticate      = "authenticate"
+	operationRefresh           = "refresh"
+	operationCheckConnectivity = "check-connectivity"
+	operationCreateDisk        = "create-disk"
+	operationDeleteDisk        = "delete-disk"
+	operationResizeDisk        = "resize-disk"
+	operationSetDiskMetadata   = "set-disk-metadata"
+	operationAttachDisk        = "attach"
+	operationDetachDisk        = "detach"
+	operationCreateSnapshot    = "create-snapshot"
+	operationDeleteSnapshot    = "delete-snapshot"
+
+	// classes of the errors of VCD calls, to tell apart an overloaded VCD from broken credentials and from bugs
+	errorClassAuth      = "auth"
+	errorClassThrottle  = "throttle"
+	errorClassQuota     = "quota"
+	errorClassNotFound  = "not-found"
+	errorClassDuplicate = "duplicate"
+	errorClassConflict  = "conflict"
+	errorClassInvalid   = "invalid"
+	errorClassTimeout   = "timeout"
+	errorClassUnknown   = "unknown"
+)
+
+// errorClassesByStatus are the error classes of the HTTP statuses of VCD responses
+var errorClassesByStatus = map[int]string{
+	http.StatusUnauthorized:       errorClassAuth,
+	http.StatusForbidden:          errorClassAuth,
+	http.StatusTooManyRequests:    errorClassThrottle,
+	http.StatusNotFound:           errorClassNotFound,
+	http.StatusConflict:           errorClassConflict,
+	http.StatusRequestTimeout:     errorClassTimeout,
+	http.StatusGatewayTimeout:     errorClassTimeout,
+	http.StatusServiceUnavailable: errorClassThrottle,
+}
+
+// errorClassMessages are fragments of the messages of errors that govcd and the swagger client return as plain
+// strings, or that lost their type in a wrapping error, by error class. The swagger client reports the status of a
+// failed response as its message, e.g. "404 Not Found". Classes are matched in order, so that a timeout wrapped in an
+// error mentioning another class is still a timeout.
+var errorClassMessages = []struct {
+	class     string
+	fragments []string
+}{
+	{errorClassTimeout, []string{"i/o timeout", "TLS handshake timeout", "deadline exceeded", "timed out",
+		http.StatusText(http.StatusRequestTimeout), http.StatusText(http.StatusGatewayTimeout)}},
+	{errorClassThrottle, []string{http.StatusText(http.StatusTooManyRequests),
+		http.StatusText(http.StatusServiceUnavailable), "throttled"}},
+	{errorClassQuota, []string{"quota", "exceed the storage", "exceeds the storage", "storage limit",
+		"not enough storage", "insufficient storage"}},
+	{errorClassAuth, []string{http.StatusText(http.StatusUnauthorized), http.StatusText(http.StatusForbidden),
+		"ACCESS_TO_RESOURCE_IS_FORBIDDEN", "following rights"}},
+	{errorClassNotFound, []string{"[ENF]", http.StatusText(http.StatusNotFound)}},
+	{errorClassDuplicate, []string{"DUPLICATE_NAME", "already exists"}},
+	{errorClassConflict, []string{http.StatusText(http.StatusConflict), "BUSY_ENTITY", "is busy"}},
+	{errorClassInvalid, []string{"BAD_REQUEST", http.StatusText(http.StatusBadRequest)}},
+}
+
+var (
+	vcdAPICallDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "vcd_api_call_duration_seconds",
+			Help:      "Duration of calls to VCD by operation, including waiting for the VCD task to complete.",
+			Buckets:   []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+		},
+		[]string{"operation"},
+	)
+	vcdAPICallErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "vcd_api_call_errors_total",
+			Help:      "Number of failed calls to VCD by operation.",
+		},
+		[]string{"operation"},
+	)
+	vcdAPICallErrorsByClass = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "vcd_api_call_errors_by_class_total",
+			Help: "Number of failed calls to VCD by operation and class of error: " + strings.Join([]string{
+				errorClassAuth, errorClassThrottle, errorClassQuota, errorClassNotFound, errorClassDuplicate,
+				errorClassConflict, errorClassInvalid, errorClassTimeout, errorClassUnknown}, ", ") + ".",
+		},
+		[]string{"operation", "class"},
+	)
+	vcdAPIRequestsThrottled = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "vcd_api_requests_throttled_total",
+			Help:      "Number of requests to VCD delayed by the client-side rate limit.",
+		},
+	)
+	vcdAPIThrottleSeconds = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "vcd_api_throttle_seconds_total",
+			Help:      "Total time that requests to VCD were delayed by the client-side rate limit.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(vcdAPICallDuration, vcdAPICallErrors, vcdAPICallErrorsByClass, vcdAPIRequestsThrottled,
+		vcdAPIThrottleSeconds)
+}
+
+// observeVCDCall calls fn and records its duration and failure, with the class of its error, under operation
+func observeVCDCall(operation string, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	vcdAPICallDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		vcdAPICallErrors.WithLabelValues(operation).Inc()
+		vcdAPICallErrorsByClass.WithLabelValues(operation, classifyVCDError(err)).Inc()
+	}
+
+	return err
+}
+
+// classifyVCDError returns the class of err from the HTTP status or the type of the errors that it wraps, and
+// otherwise from its message, since govcd and the swagger client mostly return errors as strings
+func classifyVCDError(err error) string {
+	if err == nil {
+		return ""
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return errorClassTimeout
+	}
+	if errors.Is(err, govcd.ErrorEntityNotFound) {
+		return errorClassNotFound
+	}
+
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) {
+		if class, ok := errorClassesByStatus[statusErr.statusCode]; ok {
+			return class
+		}
+	}
+	var apiErr *types.Error
+	if errors.As(err, &apiErr) {
+		if class, ok := errorClassesByStatus[apiErr.MajorErrorCode]; ok {
+			return class
+		}
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return errorClassTimeout
+	}
+
+	message := err.Error()
+	// govcd reports the status of a failed response in the message of its API error, e.g. "API Error: 404: ..."
+	for statusCode, class := range errorClassesByStatus {
+		if strings.Contains(message, fmt.Sprintf("API Error: %d:", statusCode)) {
+			return class
+		}
+	}
+	for _, classMessages := range errorClassMessages {
+		for _, fragment := range classMessages.fragments {
+			if strings.Contains(message, fragment) {
+				return classMessages.class
+			}
+		}
+	}
+	// VCD rejects requests with a 400 status for many reasons, e.g. a busy entity or an exceeded quota, which are
+	// told apart by their message, so that only the other rejections are invalid requests
+	if isBadRequestError(err) {
+		return errorClassInvalid
+	}
+	return errorClassUnknown
+}
+
+// isBadRequestError returns true if VCD rejected the request of err with a 400 status
+func isBadRequestError(err error) bool {
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.statusCode == http.StatusBadRequest
+	}
+	var apiErr *types.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.MajorErrorCode == http.StatusBadRequest
+	}
+
+	return strings.Contains(err.Error(), fmt.Sprintf("API Error: %d:", http.StatusBadRequest))
+}
@@ -0,0 +1,52 @@
+/*
+   Copyright 2021 VMware, Inc.
+   SPDX-License-Identifier: Apache-2.0
+*/
+
+package vcdcsiclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/vmware/go-vcloud-director/v2/govcd"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+	"net/http"
+	"testing"
+)
+
+func TestClassifyVCDError(t *testing.T) {
+	for _, testCase := range []struct {
+		err   error
+		class string
+	}{
+		{nil, ""},
+		{&httpStatusError{statusCode: http.StatusUnauthorized, status: "401 Unauthorized"}, errorClassAuth},
+		{fmt.Errorf("unable to create disk: %w", &types.Error{MajorErrorCode: http.StatusForbidden}),
+			errorClassAuth},
+		{&httpStatusError{statusCode: http.StatusTooManyRequests, status: "429 Too Many Requests"},
+			errorClassThrottle},
+		{fmt.Errorf("unable to find disk: [%w]", govcd.ErrorEntityNotFound), errorClassNotFound},
+		{fmt.Errorf("unable to find disk: [%v]", govcd.ErrorEntityNotFound), errorClassNotFound},
+		{errors.New("404 Not Found"), errorClassNotFound},
+		{fmt.Errorf("unable to attach disk: [%v]", &types.Error{MajorErrorCode: http.StatusBadRequest,
+			MinorErrorCode: "BUSY_ENTITY", Message: "the entity is busy"}), errorClassConflict},
+		{&types.Error{MajorErrorCode: http.StatusConflict}, errorClassConflict},
+		{fmt.Errorf("unable to delete disk: [%v]", types.Error{MajorErrorCode: http.StatusConflict}),
+			errorClassConflict},
+		{fmt.Errorf("request gave up: [%w]", context.DeadlineExceeded), errorClassTimeout},
+		{errors.New("failed waiting for disk: dial tcp: i/o timeout (Not Found)"), errorClassTimeout},
+		{errors.New("API Error: 400: The requested operation will exceed the VDC's storage quota"), errorClassQuota},
+		{&types.Error{MajorErrorCode: http.StatusBadRequest, MinorErrorCode: "DUPLICATE_NAME",
+			Message: "disk with name [pvc-1] already exists"}, errorClassDuplicate},
+		{fmt.Errorf("unable to create disk: [%v]", &types.Error{MajorErrorCode: http.StatusBadRequest,
+			MinorErrorCode: "BAD_REQUEST", Message: "size of the disk should be positive"}), errorClassInvalid},
+		{&httpStatusError{statusCode: http.StatusBadRequest, status: "400"}, errorClassInvalid},
+		{errors.New("Either you need some or all of the following rights [Disk: Create]"), errorClassAuth},
+		{errors.New("unexpected end of JSON input"), errorClassUnknown},
+	} {
+		assert.Equal(t, testCase.class, classifyVCDError(testCase.err), "error [%v] should be classified",
+			testCase.err)
+	}
+}
@@ -0,0 +1,193 @@
+/*
+   Copyright 2021 VMware, Inc.
+   SPDX-License-Identifier: Apache-2.0
+*/
+
+package vcdcsiclient
+
+import (
+	"fmt"
+	"github.com/go-logr/logr"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ClientOption customizes a Client created by NewVCDClientFromSecrets
+type ClientOption func(*Client) error
+
+// WithCACert verifies the VCD endpoint against the PEM encoded CA certificate caCert instead of the system roots.
+// It cannot be combined with an insecure connection.
+func WithCACert(caCert []byte) ClientOption {
+	return func(client *Client) error {
+		if len(caCert) == 0 {
+			return fmt.Errorf("CA certificate should not be empty")
+		}
+		client.caCert = caCert
+		return nil
+	}
+}
+
+// WithAPIVersion sets the VCD API version used by the client instead of vcdsdk.VCloudApiVersion
+func WithAPIVersion(apiVersion string) ClientOption {
+	return func(client *Client) error {
+		if apiVersion == "" {
+			return fmt.Errorf("API version should not be empty")
+		}
+		client.apiVersion = apiVersion
+		return nil
+	}
+}
+
+// WithProxyURL sends requests to VCD through the proxy at proxyURL instead of the proxy set in the environment
+func WithProxyURL(proxyURL string) ClientOption {
+	return func(client *Client) error {
+		u, err := url.Parse(proxyURL)
+		if err != nil {
+			return fmt.Errorf("unable to parse proxy url [%s]: [%v]", proxyURL, err)
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("proxy url [%s] should have a scheme and a host", proxyURL)
+		}
+		client.proxyURL = u
+		return nil
+	}
+}
+
+// WithHTTPTransport sends the requests of the govcd and swagger clients to VCD through transport instead of a transport
+// built from the TLS and proxy settings, e.g. to record and replay requests or to trace them. The insecure flag of
+// the client is then ignored, and the option cannot be combined with WithCACert or WithProxyURL.
+func WithHTTPTransport(transport http.RoundTripper) ClientOption {
+	return func(client *Client) error {
+		if transport == nil {
+			return fmt.Errorf("http transport should not be nil")
+		}
+		client.customTransport = transport
+		return nil
+	}
+}
+
+// WithOperationOrg runs the requests of a system administrator in the tenant context of the org orgName, so that
+// disks are managed with the permissions of the tenant instead of the provider. Authentication, the admin API and
+// admin queries still run in the system org. A tenant user can only set its own org.
+func WithOperationOrg(orgName string) ClientOption {
+	return func(client *Client) error {
+		if orgName == "" {
+			return fmt.Errorf("operation org should not be empty")
+		}
+		client.operationOrg = orgName
+		return nil
+	}
+}
+
+// WithFailoverHosts sets the hosts that the client fails over to, in order, when the VCD host that it authenticated
+// with last is unreachable. The hosts should serve the same VCD, such as the standby of an active/standby pair.
+func WithFailoverHosts(hosts ...string) ClientOption {
+	return func(client *Client) error {
+		for _, host := range hosts {
+			hostURL, err := parseHostURL(host)
+			if err != nil {
+				return fmt.Errorf("invalid failover host: [%v]", err)
+			}
+			client.hosts = append(client.hosts, hostURL)
+		}
+		return nil
+	}
+}
+
+// WithHTTPTimeout sets the timeout of every request to VCD instead of the default of 30s
+func WithHTTPTimeout(timeout time.Duration) ClientOption {
+	return func(client *Client) error {
+		if timeout <= 0 {
+			return fmt.Errorf("http timeout [%v] should be positive", timeout)
+		}
+		client.httpTimeout = timeout
+		return nil
+	}
+}
+
+// WithOrgVDCCacheTTL reuses the org and VDC of the client for ttl instead of the default of 5m when the bearer token
+// is refreshed. They are resolved on every refresh if ttl is 0.
+func WithOrgVDCCacheTTL(ttl time.Duration) ClientOption {
+	return func(client *Client) error {
+		if ttl < 0 {
+			return fmt.Errorf("org and VDC cache ttl [%v] should not be negative", ttl)
+		}
+		client.orgVDCCacheTTL = ttl
+		return nil
+	}
+}
+
+// WithRetry retries transient failures of the auth, org and VDC calls up to maxAttempts times in total, backing off
+// exponentially from baseDelay between attempts
+func WithRetry(maxAttempts int, baseDelay time.Duration) ClientOption {
+	return func(client *Client) error {
+		if maxAttempts < 1 {
+			return fmt.Errorf("retry attempts [%d] should be at least 1", maxAttempts)
+		}
+		if baseDelay < 0 {
+			return fmt.Errorf("retry base delay [%v] should not be negative", baseDelay)
+		}
+		client.retryMaxAttempts, client.retryBaseDelay = maxAttempts, baseDelay
+		return nil
+	}
+}
+
+// WithLogger sets the logger of the operations of the client instead of the klog logger
+func WithLogger(logger logr.Logger) ClientOption {
+	return func(client *Client) error {
+		if logger.GetSink() == nil {
+			return fmt.Errorf("logger should not be empty")
+		}
+		client.logger = logger
+		return nil
+	}
+}
+
+// WithRefreshTokenFile reads the refresh token from tokenFile whenever the bearer token is obtained, instead of using
+// the refresh token that the client was created with, so that a rotated token is picked up
+func WithRefreshTokenFile(tokenFile string) ClientOption {
+	return func(client *Client) error {
+		if tokenFile == "" {
+			return fmt.Errorf("refresh token file should not be empty")
+		}
+		client.refreshTokenFile = tokenFile
+		return nil
+	}
+}
+
+// WithTracer traces the refreshes of the bearer token, and the creations, deletions, attachments and detachments of
+// disks, in spans started by tracer
+func WithTracer(tracer Tracer) ClientOption {
+	return func(client *Client) error {
+		if tracer == nil {
+			return fmt.Errorf("tracer should not be nil")
+		}
+		client.tracer = tracer
+		return nil
+	}
+}
+
+// WithDebugLogMaxBodyBytes truncates the bodies of the requests to VCD and of its responses, which are logged at
+// verbosity 6, to maxBodyBytes instead of 4096 bytes. The bodies are not truncated if maxBodyBytes is 0.
+func WithDebugLogMaxBodyBytes(maxBodyBytes int) ClientOption {
+	return func(client *Client) error {
+		if maxBodyBytes < 0 {
+			return fmt.Errorf("debug log max body bytes [%d] should not be negative", maxBodyBytes)
+		}
+		client.debugLogMaxBodyBytes = maxBodyBytes
+		return nil
+	}
+}
+
+// WithMaxAPIRequestsPerSecond limits the requests of the client to VCD to maxRequestsPerSecond, delaying the requests
+// beyond the limit
+func WithMaxAPIRequestsPerSecond(maxRequestsPerSecond float64) ClientOption {
+	return func(client *Client) error {
+		if maxRequestsPerSecond <= 0 {
+			return fmt.Errorf("max API requests per second [%v] should be positive", maxRequestsPerSecond)
+		}
+		client.limiter = newRateLimiter(maxRequestsPerSecond)
+		return nil
+	}
+}
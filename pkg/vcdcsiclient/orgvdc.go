@@ -0,0 +1,82 @@
+/*
+   Copyright 2021 VMware, Inc.
+   SPDX-License-Identifier: Apache-2.0
+*/
+
+package vcdcsiclient
+
+import (
+	"context"
+	"fmt"
+	"github.com/vmware/go-vcloud-director/v2/govcd"
+	"k8s.io/klog/v2"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// orgVDCCached returns true if the org and VDC of the client can be reused. They share the govcd client of the
+// client, so they keep working with the bearer tokens that it obtains. The caller should hold client.RWLock.
+func (client *Client) orgVDCCached() bool {
+	return client.org != nil && client.VDC != nil && atomic.LoadInt32(&client.orgVDCInvalid) == 0 &&
+		time.Since(client.orgVDCResolvedAt) < client.orgVDCCacheTTL
+}
+
+// invalidateOrgVDC makes the next operation of the client resolve its org and VDC again. It can be called while
+// client.RWLock is held for reading.
+func (client *Client) invalidateOrgVDC() {
+	atomic.StoreInt32(&client.orgVDCInvalid, 1)
+}
+
+// invalidateOrgVDCIfNotFound invalidates the org and VDC of the client if err is a not found error of a request for
+// either of them, so that a recreated VDC is picked up by the next operation. It returns err.
+func (client *Client) invalidateOrgVDCIfNotFound(err error) error {
+	if err == nil {
+		return nil
+	}
+	if err == govcd.ErrorEntityNotFound || govcd.ContainsNotFound(err) ||
+		strings.Contains(err.Error(), fmt.Sprintf("API Error: %d:", http.StatusNotFound)) {
+		client.logger.Info("Org or VDC of client was not found; resolving them again", "org",
+			client.ClusterOrgName, "vdc", client.ClusterOVDCName)
+		client.invalidateOrgVDC()
+	}
+
+	return err
+}
+
+// resolveOrgVDC gets the org and VDC of the client again, unless the cached ones can still be reused. The caller
+// should hold client.RWLock for writing.
+func (client *Client) resolveOrgVDC(ctx context.Context) error {
+	logger := klog.FromContext(ctx)
+	if client.orgVDCCached() {
+		logger.V(3).Info("Reusing cached org and VDC", "org", client.ClusterOrgName, "vdc",
+			client.ClusterOVDCName, "resolvedAt", client.orgVDCResolvedAt)
+		return nil
+	}
+
+	defer client.bindToContext(ctx)()
+
+	var org *govcd.Org
+	err := client.retry(ctx, "get org", func() (err error) {
+		org, err = client.VCDClient.GetOrgByNameOrId(client.ClusterOrgName)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("unable to get vcd organization [%s]: [%v]",
+			client.ClusterOrgName, err)
+	}
+
+	vdc, err := client.getVDC(ctx, org, client.ClusterOVDCName)
+	if err != nil {
+		return fmt.Errorf("unable to get VDC from org [%s], VDC [%s]: [%v]",
+			client.ClusterOrgName, client.ClusterOVDCName, err)
+	}
+
+	client.org = org
+	client.VDC = vdc
+	client.orgVDCResolvedAt = time.Now()
+	atomic.StoreInt32(&client.orgVDCInvalid, 0)
+	logger.V(3).Info("Resolved org and VDC", "org", client.ClusterOrgName, "vdc", client.ClusterOVDCName)
+	return nil
+}
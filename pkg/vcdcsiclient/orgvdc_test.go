@@ -0,0 +1,75 @@
+/*
+   Copyright 2021 VMware, Inc.
+   SPDX-License-Identifier: Apache-2.0
+*/
+
+package vcdcsiclient
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware/go-vcloud-director/v2/govcd"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// orgRequestCountingRoundTripper counts the requests for the org of the fake VCD that it sends through
+// http.DefaultTransport
+type orgRequestCountingRoundTripper struct {
+	orgRequests int32
+}
+
+func (rt *orgRequestCountingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == http.MethodGet && req.URL.Path == "/api/org/1" {
+		atomic.AddInt32(&rt.orgRequests, 1)
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestOrgVDCCache(t *testing.T) {
+	server, _ := newFakeVCDServer("org", "vdc")
+	defer server.Close()
+
+	transport := &orgRequestCountingRoundTripper{}
+	client, err := NewVCDClientFromSecrets(server.URL, "org", "vdc", "org", "user", "password", "", true, true,
+		WithHTTPTransport(transport))
+	require.NoError(t, err, "client should be created against the fake VCD")
+	defer EvictClient(client)
+	require.Equal(t, int32(1), atomic.LoadInt32(&transport.orgRequests), "client should get its org once")
+	vdc := client.GetVDC()
+
+	require.NoError(t, client.RefreshBearerToken(), "bearer token should be refreshed")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&transport.orgRequests), "refresh should reuse the cached org")
+	assert.Same(t, vdc, client.GetVDC(), "refresh should reuse the cached VDC")
+
+	assert.Error(t, client.invalidateOrgVDCIfNotFound(fmt.Errorf("API Error: 500: internal error")),
+		"error should be returned")
+	require.NoError(t, client.CheckConnectivity(context.Background()), "connectivity should be checked")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&transport.orgRequests),
+		"errors other than not found should not invalidate the cache")
+
+	assert.Equal(t, govcd.ErrorEntityNotFound, client.invalidateOrgVDCIfNotFound(govcd.ErrorEntityNotFound),
+		"not found error should be returned")
+	require.NoError(t, client.CheckConnectivity(context.Background()), "connectivity should be checked")
+	assert.Equal(t, int32(2), atomic.LoadInt32(&transport.orgRequests),
+		"org should be resolved again once it is not found")
+	assert.NotSame(t, vdc, client.GetVDC(), "VDC should be resolved again once it is not found")
+
+	client.RWLock.Lock()
+	client.orgVDCResolvedAt = time.Now().Add(-defaultOrgVDCCacheTTL)
+	client.RWLock.Unlock()
+	require.NoError(t, client.CheckConnectivity(context.Background()), "connectivity should be checked")
+	assert.Equal(t, int32(3), atomic.LoadInt32(&transport.orgRequests),
+		"org should be resolved again once the cache expires")
+
+	require.NoError(t, WithOrgVDCCacheTTL(0)(client), "cache should be disabled")
+	require.NoError(t, client.RefreshBearerToken(), "bearer token should be refreshed")
+	assert.Equal(t, int32(4), atomic.LoadInt32(&transport.orgRequests),
+		"org should be resolved on every refresh without a cache")
+
+	assert.Error(t, WithOrgVDCCacheTTL(-time.Second)(&Client{}), "negative cache ttl should not be accepted")
+}
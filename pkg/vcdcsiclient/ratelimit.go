@@ -0,0 +1,95 @@
+/*
+   Copyright 2021 VMware, Inc.
+   SPDX-License-Identifier: Apache-2.0
+*/
+
+package vcdcsiclient
+
+import (
+	"fmt"
+	"golang.org/x/time/rate"
+	"k8s.io/klog/v2"
+	"math"
+	"net/http"
+	"time"
+)
+
+// newRateLimiter returns a limiter of maxRequestsPerSecond that allows bursts of a second's worth of requests
+func newRateLimiter(maxRequestsPerSecond float64) *rate.Limiter {
+	burst := int(math.Ceil(maxRequestsPerSecond))
+	if burst < 1 {
+		burst = 1
+	}
+
+	return rate.NewLimiter(rate.Limit(maxRequestsPerSecond), burst)
+}
+
+// rateLimitedRoundTripper delays requests so that at most the rate of limiter is sent to VCD. A request waits at
+// most until its context is done.
+type rateLimitedRoundTripper struct {
+	limiter *rate.Limiter
+	next    http.RoundTripper
+}
+
+func (rt *rateLimitedRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	reservation := rt.limiter.Reserve()
+	if !reservation.OK() {
+		return nil, fmt.Errorf("request to [%s] exceeds the burst of the rate limit", req.URL.Host)
+	}
+
+	delay := reservation.Delay()
+	if delay > 0 {
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			reservation.Cancel()
+			return nil, fmt.Errorf("request to [%s] would be throttled for [%v], beyond its deadline", req.URL.Host,
+				delay)
+		}
+
+		vcdAPIRequestsThrottled.Inc()
+		vcdAPIThrottleSeconds.Add(delay.Seconds())
+		klog.FromContext(ctx).V(3).Info("Throttling request to VCD", "method", req.Method, "path", req.URL.Path,
+			"delay", delay)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			reservation.Cancel()
+			return nil, fmt.Errorf("request to [%s] gave up while throttled: [%v]", req.URL.Host, ctx.Err())
+		case <-timer.C:
+		}
+	}
+
+	return rt.next.RoundTrip(req)
+}
+
+// roundTripper returns the round tripper of the govcd and swagger clients, which is rate limited if the client has a
+// limiter, adds the tenant context of its operation org if it has one, detects unreachable hosts if it has failover
+// hosts, and logs the requests and responses with their bodies at debugLogLevel
+func (client *Client) roundTripper() http.RoundTripper {
+	var transport http.RoundTripper = &debugLogRoundTripper{
+		maxBodyBytes: client.debugLogMaxBodyBytes,
+		next:         client.transport,
+	}
+	if len(client.hosts) > 1 {
+		transport = &failoverRoundTripper{
+			client: client,
+			next:   transport,
+		}
+	}
+	if client.operationOrg != "" {
+		transport = &tenantContextRoundTripper{
+			client: client,
+			next:   transport,
+		}
+	}
+	if client.limiter == nil {
+		return transport
+	}
+
+	return &rateLimitedRoundTripper{
+		limiter: client.limiter,
+		next:    transport,
+	}
+}
@@ -0,0 +1,50 @@
+/*
+   Copyright 2021 VMware, Inc.
+   SPDX-License-Identifier: Apache-2.0
+*/
+
+package vcdcsiclient
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimitedRoundTripper(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	// a burst of 1 request is allowed, then 1 request every 100ms
+	rt := &rateLimitedRoundTripper{
+		limiter: rate.NewLimiter(10, 1),
+		next:    http.DefaultTransport,
+	}
+	httpClient := &http.Client{Transport: rt}
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		resp, err := httpClient.Get(server.URL)
+		require.NoError(t, err, "rate limited request should succeed")
+		resp.Body.Close()
+	}
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(100*time.Millisecond),
+		"requests beyond the burst should be delayed")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	require.NoError(t, err, "request should be created")
+	_, err = httpClient.Do(req)
+	assert.Error(t, err, "request should not wait for the limiter beyond its deadline")
+}
+
+func TestNewRateLimiter(t *testing.T) {
+	assert.Equal(t, 1, newRateLimiter(0.5).Burst(), "burst should be at least 1 request")
+	assert.Equal(t, 3, newRateLimiter(2.5).Burst(), "burst should be a second's worth of requests")
+}
@@ -0,0 +1,102 @@
+/*
+   Copyright 2021 VMware, Inc.
+   SPDX-License-Identifier: Apache-2.0
+*/
+
+package vcdcsiclient
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"k8s.io/klog/v2"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// unauthorizedRetryRoundTripper retries a request of the swagger client that VCD rejects with a 401 response, which
+// happens when the bearer token expires between its proactive refresh and the request, once with a new bearer
+// token. The requests that authenticate are not retried.
+type unauthorizedRetryRoundTripper struct {
+	client *Client
+	next   http.RoundTripper
+}
+
+func (rt *unauthorizedRetryRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := rt.next.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || isAuthRequest(req) {
+		return resp, err
+	}
+	// a request whose body cannot be sent again is not retried
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return resp, nil
+	}
+
+	ctx := req.Context()
+	logger := klog.FromContext(ctx)
+	rejectedToken := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	token, err := rt.client.reauthenticate(ctx, rejectedToken)
+	if err != nil {
+		logger.Error(err, "Unable to get a new bearer token for request rejected by VCD", "method", req.Method,
+			"path", req.URL.Path)
+		return resp, nil
+	}
+
+	retryReq := req.Clone(ctx)
+	if req.GetBody != nil {
+		if retryReq.Body, err = req.GetBody(); err != nil {
+			return resp, nil
+		}
+	}
+	retryReq.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	logger.Info("VCD rejected bearer token; retrying request with a new one", "method", req.Method,
+		"path", req.URL.Path)
+	return rt.next.RoundTrip(retryReq)
+}
+
+// isAuthRequest returns true if req authenticates to VCD, which cannot be fixed by a new bearer token
+func isAuthRequest(req *http.Request) bool {
+	for _, authPath := range []string{"/api/sessions", "/cloudapi/1.0.0/sessions", "/oauth/"} {
+		if strings.Contains(req.URL.Path, authPath) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// reauthenticate returns a bearer token other than rejectedToken, which concurrent callers share. The requests of
+// the swagger client can be sent while client.RWLock is held, so the clients are not refreshed here; the new token
+// is obtained by a separate login, and the token of the client is marked invalid so that the next operation refreshes
+// the clients.
+func (client *Client) reauthenticate(ctx context.Context, rejectedToken string) (string, error) {
+	client.reauthLock.Lock()
+	defer client.reauthLock.Unlock()
+
+	if client.reauthToken != "" && client.reauthToken != rejectedToken {
+		return client.reauthToken, nil
+	}
+
+	ctx, _ = client.operationContext(ctx, operationAuthenticate)
+	var token string
+	err := observeVCDCall(operationAuthenticate, func() error {
+		vcdClient, err := client.getBearerToken(ctx)
+		if err != nil {
+			return err
+		}
+		token = vcdClient.Client.VCDToken
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to get bearer token: [%v]", err)
+	}
+
+	client.reauthToken = token
+	atomic.StoreInt32(&client.tokenRejected, 1)
+	return token, nil
+}
@@ -0,0 +1,79 @@
+/*
+   Copyright 2021 VMware, Inc.
+   SPDX-License-Identifier: Apache-2.0
+*/
+
+package vcdcsiclient
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestUnauthorizedRetryRoundTripper(t *testing.T) {
+	server, logins := newFakeVCDServer("org", "vdc")
+	defer server.Close()
+
+	client, err := NewVCDClientFromSecrets(server.URL, "org", "vdc", "org", "user", "password", "", true, true)
+	require.NoError(t, err, "client should be created against the fake VCD")
+	defer EvictClient(client)
+	rejectedToken := client.VCDClient.Client.VCDToken
+
+	// the API rejects the bearer token of the client, and every token of the paths under /rejected
+	var requests int32
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if strings.HasPrefix(r.URL.Path, "/rejected") || r.Header.Get("Authorization") == "Bearer "+rejectedToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}))
+	defer api.Close()
+	httpClient := &http.Client{
+		Transport: &unauthorizedRetryRoundTripper{
+			client: client,
+			next:   http.DefaultTransport,
+		},
+	}
+	send := func(path string) *http.Response {
+		req, err := http.NewRequest(http.MethodPut, api.URL+path, strings.NewReader("{}"))
+		require.NoError(t, err, "request should be created")
+		req.Header.Set("Authorization", "Bearer "+rejectedToken)
+		resp, err := httpClient.Do(req)
+		require.NoError(t, err, "request should be sent")
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := send("/entity")
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "request should be retried with a new token")
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests), "request should be retried once")
+	assert.Equal(t, int32(2), atomic.LoadInt32(logins), "client should log in again for the new token")
+	assert.False(t, client.TokenValid(), "rejected token of the client should be refreshed by the next operation")
+
+	resp = send("/entity")
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "request should be retried with the shared new token")
+	assert.Equal(t, int32(2), atomic.LoadInt32(logins), "new token should be shared by later requests")
+
+	atomic.StoreInt32(&requests, 0)
+	resp = send("/rejected")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, "request rejected again should fail")
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests), "request should be retried at most once")
+
+	atomic.StoreInt32(&requests, 0)
+	resp = send("/cloudapi/1.0.0/sessions")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, "rejected authentication should fail")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests), "rejected authentication should not be retried")
+
+	client.RWLock.Lock()
+	err = client.refreshBearerTokenIfExpiring(context.Background())
+	client.RWLock.Unlock()
+	require.NoError(t, err, "clients should be refreshed")
+	assert.True(t, client.TokenValid(), "refreshed token should be valid")
+}
@@ -0,0 +1,253 @@
+/*
+   Copyright 2021 VMware, Inc.
+   SPDX-License-Identifier: Apache-2.0
+*/
+
+package vcdcsiclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+	"io"
+	"io/ioutil"
+	"k8s.io/klog/v2"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRetryMaxAttempts = 3
+	defaultRetryBaseDelay   = time.Second
+	// retryMaxDelay caps the backoff between two attempts
+	retryMaxDelay = 30 * time.Second
+	// retryAfterMaxDelay caps the Retry-After of a throttled response that is waited for before retrying. A longer
+	// Retry-After is returned to the caller as is.
+	retryAfterMaxDelay = 2 * time.Minute
+)
+
+// retryableMessages are fragments of the messages of transient errors that govcd returns as plain strings
+var retryableMessages = []string{
+	"connection reset by peer",
+	"connection refused",
+	"broken pipe",
+	"EOF",
+	"i/o timeout",
+	"TLS handshake timeout",
+	http.StatusText(http.StatusTooManyRequests),
+	http.StatusText(http.StatusInternalServerError),
+	http.StatusText(http.StatusBadGateway),
+	http.StatusText(http.StatusServiceUnavailable),
+	http.StatusText(http.StatusGatewayTimeout),
+}
+
+// busyEntityMinorErrorCode is the minor error code of the VCD errors of operations on an entity that is busy with
+// another task, such as a VM that is being reconfigured
+const busyEntityMinorErrorCode = "BUSY_ENTITY"
+
+// IsEntityBusyError returns true if err is the error of an operation that VCD rejected because the entity, such as
+// the VM of an attach or detach, is busy with another task. The operation can succeed once the task is done.
+func IsEntityBusyError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var apiErr *types.Error
+	if errors.As(err, &apiErr) && apiErr.MinorErrorCode == busyEntityMinorErrorCode {
+		return true
+	}
+	// govcd mostly reports the errors of VCD as text
+	return strings.Contains(err.Error(), busyEntityMinorErrorCode) || strings.Contains(err.Error(), "is busy")
+}
+
+// diskInTransitionMessages are fragments of the messages of the VCD errors of operations on a disk that is in use by
+// or in transition with another task, such as a detach that VCD has not completed yet
+var diskInTransitionMessages = []string{"in use", "in transition", "being detached"}
+
+// isDiskInTransitionError returns true if err is the error of an operation on a disk that VCD rejected because the
+// disk is busy, in use or in transition. The operation can succeed once the disk has settled.
+func isDiskInTransitionError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if IsEntityBusyError(err) {
+		return true
+	}
+
+	for _, fragment := range diskInTransitionMessages {
+		if strings.Contains(err.Error(), fragment) {
+			return true
+		}
+	}
+	return false
+}
+
+// httpStatusError is returned for a VCD response that has an unexpected status code
+type httpStatusError struct {
+	statusCode int
+	status     string
+}
+
+func (err *httpStatusError) Error() string {
+	return fmt.Sprintf("unexpected response status [%s]", err.status)
+}
+
+func isRetryableStatus(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode >= http.StatusInternalServerError
+}
+
+// isRetryableError returns true for throttling, server side and network errors. Other errors such as authentication
+// failures are not retried since retrying them cannot succeed.
+func isRetryableError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) {
+		return isRetryableStatus(statusErr.statusCode)
+	}
+	var apiErr *types.Error
+	if errors.As(err, &apiErr) {
+		return isRetryableStatus(apiErr.MajorErrorCode)
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	for _, message := range retryableMessages {
+		if strings.Contains(err.Error(), message) {
+			return true
+		}
+	}
+	return false
+}
+
+// backoffDelay returns the jittered exponential delay before the attempt following the given one
+func backoffDelay(baseDelay time.Duration, attempt int) time.Duration {
+	if baseDelay <= 0 {
+		return 0
+	}
+
+	delay := baseDelay << uint(attempt)
+	if delay <= 0 || delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+
+	// wait between half and all of the delay so that concurrent callers do not retry in lockstep
+	half := int64(delay / 2)
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+// retryWithBackoff calls fn up to maxAttempts times until it succeeds or returns an error that is not retryable.
+// It stops waiting once ctx is done.
+func retryWithBackoff(ctx context.Context, maxAttempts int, baseDelay time.Duration, operation string,
+	fn func() error) error {
+
+	var err error
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		if err = fn(); err == nil || !isRetryableError(err) {
+			return err
+		}
+		if attempt == maxAttempts-1 {
+			break
+		}
+
+		delay := backoffDelay(baseDelay, attempt)
+		klog.FromContext(ctx).Info("VCD call failed; retrying", "call", operation, "attempt", attempt+1,
+			"maxAttempts", maxAttempts, "delay", delay, "err", err)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("gave up retrying [%s]: [%v]: [%v]", operation, ctx.Err(), err)
+		case <-time.After(delay):
+		}
+	}
+
+	return err
+}
+
+// retry calls fn with the retry settings of the client
+func (client *Client) retry(ctx context.Context, operation string, fn func() error) error {
+	return retryWithBackoff(ctx, client.retryMaxAttempts, client.retryBaseDelay, operation, fn)
+}
+
+// parseRetryAfter returns the delay of a Retry-After header value at time now. The value is either a number of
+// seconds or an HTTP date.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if delay := date.Sub(now); delay > 0 {
+			return delay, true
+		}
+		return 0, true
+	}
+
+	return 0, false
+}
+
+// retryAfterRoundTripper retries a request that VCD throttles with a 429 response after the Retry-After of the
+// response, up to maxAttempts times in total. Throttled responses without a usable Retry-After are returned as is.
+type retryAfterRoundTripper struct {
+	next        http.RoundTripper
+	maxAttempts int
+}
+
+func (rt *retryAfterRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	for attempt := 1; ; attempt++ {
+		resp, err := rt.next.RoundTrip(req)
+		if err != nil || resp.StatusCode != http.StatusTooManyRequests || attempt >= rt.maxAttempts {
+			return resp, err
+		}
+
+		delay, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		if !ok || delay > retryAfterMaxDelay {
+			return resp, nil
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			return resp, nil
+		}
+		// a request whose body cannot be sent again is not retried
+		if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+			return resp, nil
+		}
+
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		klog.FromContext(ctx).Info("VCD throttled request; retrying after Retry-After", "method", req.Method,
+			"path", req.URL.Path, "attempt", attempt, "maxAttempts", rt.maxAttempts, "delay", delay)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, fmt.Errorf("gave up retrying throttled request to [%s]: [%v]", req.URL.Path, ctx.Err())
+		case <-timer.C:
+		}
+
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, fmt.Errorf("unable to rewind body of throttled request to [%s]: [%v]", req.URL.Path, err)
+			}
+			req = req.Clone(ctx)
+			req.Body = body
+		}
+	}
+}
@@ -0,0 +1,168 @@
+/*
+   Copyright 2021 VMware, Inc.
+   SPDX-License-Identifier: Apache-2.0
+*/
+
+package vcdcsiclient
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIsRetryableError(t *testing.T) {
+	assert.True(t, isRetryableError(&httpStatusError{statusCode: http.StatusServiceUnavailable}),
+		"503 response should be retried")
+	assert.True(t, isRetryableError(&httpStatusError{statusCode: http.StatusTooManyRequests}),
+		"429 response should be retried")
+	assert.False(t, isRetryableError(&httpStatusError{statusCode: http.StatusUnauthorized}),
+		"401 response should not be retried")
+	assert.True(t, isRetryableError(fmt.Errorf("error getting org: %w", &types.Error{MajorErrorCode: 502})),
+		"wrapped 502 API error should be retried")
+	assert.False(t, isRetryableError(&types.Error{MajorErrorCode: 403}), "403 API error should not be retried")
+	assert.True(t, isRetryableError(fmt.Errorf("read tcp: connection reset by peer")),
+		"connection reset should be retried")
+	assert.False(t, isRetryableError(context.DeadlineExceeded), "context errors should not be retried")
+}
+
+func TestIsEntityBusyError(t *testing.T) {
+	assert.True(t, IsEntityBusyError(fmt.Errorf("failed to attach: %w",
+		&types.Error{MajorErrorCode: 400, MinorErrorCode: "BUSY_ENTITY"})), "busy API error should be detected")
+	assert.True(t, IsEntityBusyError(fmt.Errorf(`API Error: 400: The requested operation could not be executed `+
+		`since VM "node-1" is busy, please try again later.`)), "busy error reported as text should be detected")
+	assert.False(t, IsEntityBusyError(&types.Error{MajorErrorCode: 400, MinorErrorCode: "BAD_REQUEST"}),
+		"other API errors should not be busy errors")
+	assert.False(t, IsEntityBusyError(nil), "nil error should not be a busy error")
+}
+
+func TestIsDiskInTransitionError(t *testing.T) {
+	assert.True(t, isDiskInTransitionError(fmt.Errorf("unable to issue delete disk call: [%w]",
+		&types.Error{MajorErrorCode: 400, MinorErrorCode: "BUSY_ENTITY"})), "busy API error should be detected")
+	assert.True(t, isDiskInTransitionError(fmt.Errorf(`API Error: 400: Disk "pvc-1" is in use by another task.`)),
+		"disk in use should be detected")
+	assert.True(t, isDiskInTransitionError(fmt.Errorf(`API Error: 400: Disk "pvc-1" is being detached.`)),
+		"disk being detached should be detected")
+	assert.False(t, isDiskInTransitionError(fmt.Errorf("API Error: 403: access to the disk is forbidden")),
+		"other errors should not be transition errors")
+	assert.False(t, isDiskInTransitionError(nil), "nil error should not be a transition error")
+}
+
+func TestRetryWithBackoff(t *testing.T) {
+	attempts := 0
+	err := retryWithBackoff(context.Background(), 3, 0, "test", func() error {
+		attempts++
+		if attempts < 3 {
+			return &httpStatusError{statusCode: http.StatusBadGateway}
+		}
+		return nil
+	})
+	assert.NoError(t, err, "operation that succeeds on the last attempt should not fail")
+	assert.Equal(t, 3, attempts, "operation should be attempted until it succeeds")
+
+	attempts = 0
+	err = retryWithBackoff(context.Background(), 3, 0, "test", func() error {
+		attempts++
+		return &httpStatusError{statusCode: http.StatusUnauthorized}
+	})
+	assert.Error(t, err, "error that is not retryable should be returned")
+	assert.Equal(t, 1, attempts, "error that is not retryable should not be retried")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	attempts = 0
+	err = retryWithBackoff(ctx, 3, time.Hour, "test", func() error {
+		attempts++
+		return &httpStatusError{statusCode: http.StatusServiceUnavailable}
+	})
+	assert.Error(t, err, "retry should give up once the context is done")
+	assert.Equal(t, 1, attempts, "operation should not be retried once the context is done")
+}
+
+func TestBackoffDelay(t *testing.T) {
+	for attempt := 0; attempt < 10; attempt++ {
+		delay := backoffDelay(time.Second, attempt)
+		assert.LessOrEqual(t, int64(delay), int64(retryMaxDelay), "delay should not exceed the cap")
+	}
+	delay := backoffDelay(time.Second, 2)
+	assert.GreaterOrEqual(t, int64(delay), int64(2*time.Second), "delay of third attempt should be at least 2s")
+	assert.LessOrEqual(t, int64(delay), int64(4*time.Second), "delay of third attempt should be at most 4s")
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2021, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	delay, ok := parseRetryAfter("5", now)
+	assert.True(t, ok, "seconds should be parsed")
+	assert.Equal(t, 5*time.Second, delay, "delay should be the seconds")
+
+	delay, ok = parseRetryAfter(now.Add(time.Minute).Format(http.TimeFormat), now)
+	assert.True(t, ok, "HTTP date should be parsed")
+	assert.Equal(t, time.Minute, delay, "delay should last until the date")
+
+	delay, ok = parseRetryAfter(now.Add(-time.Minute).Format(http.TimeFormat), now)
+	assert.True(t, ok, "past HTTP date should be parsed")
+	assert.Equal(t, time.Duration(0), delay, "past date should not delay")
+
+	for _, value := range []string{"", "-1", "soon"} {
+		_, ok = parseRetryAfter(value, now)
+		assert.False(t, ok, "invalid Retry-After [%s] should not be parsed", value)
+	}
+}
+
+func TestRetryAfterRoundTripper(t *testing.T) {
+	requests := 0
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		switch r.URL.Path {
+		case "/throttled-once":
+			if requests == 1 {
+				w.Header().Set("Retry-After", "0")
+				w.WriteHeader(http.StatusTooManyRequests)
+			}
+		case "/throttled-long":
+			w.Header().Set("Retry-After", "3600")
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer server.Close()
+
+	httpClient := &http.Client{
+		Transport: &retryAfterRoundTripper{
+			next:        http.DefaultTransport,
+			maxAttempts: 3,
+		},
+	}
+
+	resp, err := httpClient.Post(server.URL+"/throttled-once", "text/plain", strings.NewReader("body"))
+	require.NoError(t, err, "throttled request should be retried")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "retried request should succeed")
+	assert.Equal(t, []string{"body", "body"}, bodies, "body should be sent again with the retry")
+
+	requests, bodies = 0, nil
+	resp, err = httpClient.Get(server.URL + "/throttled-long")
+	require.NoError(t, err, "throttled response should be returned")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode, "long Retry-After should not be waited for")
+	assert.Equal(t, 1, requests, "request with a long Retry-After should not be retried")
+
+	requests = 0
+	resp, err = httpClient.Get(server.URL + "/throttled-without-retry-after")
+	require.NoError(t, err, "throttled response should be returned")
+	resp.Body.Close()
+	assert.Equal(t, 1, requests, "request without a Retry-After should not be retried")
+}
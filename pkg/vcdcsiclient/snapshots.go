@@ -0,0 +1,420 @@
+/*
+   Copyright 2021 VMware, Inc.
+   SPDX-License-Identifier: Apache-2.0
+*/
+
+package vcdcsiclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/vmware/cloud-director-named-disk-csi-driver/pkg/vcdtypes"
+	"github.com/vmware/go-vcloud-director/v2/govcd"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+	"k8s.io/klog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The snapshots of a named disk are taken by posting to the snapshot:create link of the disk, and listed from its down
+// link of type MimeDiskSnapshots. A snapshot is found by its URN with the entity resolver of VCD and deleted with its
+// remove link. An ErrSnapshotsUnsupported error is returned for the disks that VCD returns without these links.
+const (
+	// DiskSnapshotURNPrefix prefixes the UUID of a snapshot of a disk in its ID
+	DiskSnapshotURNPrefix = "urn:vcloud:disksnapshot:"
+	// dryRunSnapshotURNPrefix prefixes the IDs of the snapshots that a dry run reports as created, which VCD does not
+	// have
+	dryRunSnapshotURNPrefix = DiskSnapshotURNPrefix + "dry-run-"
+
+	MimeDiskSnapshot             = "application/vnd.vmware.vcloud.diskSnapshot+xml"
+	MimeDiskSnapshots            = "application/vnd.vmware.vcloud.diskSnapshots+xml"
+	MimeDiskSnapshotCreateParams = "application/vnd.vmware.vcloud.diskSnapshotCreateParams+xml"
+)
+
+// DiskSnapshot is a snapshot of a named disk as returned by a VCDDiskManager
+type DiskSnapshot struct {
+	// ID is the URN of the snapshot, e.g. urn:vcloud:disksnapshot:<uuid>
+	ID   string
+	HREF string
+	Name string
+	// DiskID and DiskName are those of the disk that the snapshot was taken of
+	DiskID   string
+	DiskName string
+	SizeMB   int64
+	// CreationTime is when VCD took the snapshot. It is zero if VCD does not report it.
+	CreationTime time.Time
+	// ReadyToUse is true once VCD has no task in progress on the snapshot
+	ReadyToUse bool
+}
+
+// newDiskSnapshot converts a snapshot returned by VCD of the disk disk, which is taken from the snapshot if nil
+func newDiskSnapshot(vcdSnapshot *vcdtypes.DiskSnapshot, disk *vcdtypes.Disk) *DiskSnapshot {
+	snapshot := &DiskSnapshot{
+		ID:         vcdSnapshot.Id,
+		HREF:       vcdSnapshot.HREF,
+		Name:       vcdSnapshot.Name,
+		SizeMB:     vcdSnapshot.SizeMb,
+		ReadyToUse: vcdSnapshot.Tasks == nil || len(vcdSnapshot.Tasks.Task) == 0,
+	}
+	if disk != nil {
+		snapshot.DiskID, snapshot.DiskName = disk.Id, disk.Name
+		if snapshot.SizeMB == 0 {
+			snapshot.SizeMB = disk.SizeMb
+		}
+	} else if vcdSnapshot.Disk != nil {
+		snapshot.DiskID, snapshot.DiskName = vcdSnapshot.Disk.ID, vcdSnapshot.Disk.Name
+	}
+	if created, err := time.Parse(time.RFC3339, vcdSnapshot.Created); err == nil {
+		snapshot.CreationTime = created
+	}
+
+	return snapshot
+}
+
+// IsDiskSnapshotURN returns true if snapshotID is the URN of a snapshot of a disk
+func IsDiskSnapshotURN(snapshotID string) bool {
+	return strings.HasPrefix(snapshotID, DiskSnapshotURNPrefix)
+}
+
+// findLink returns the link of links with the relation rel, and with the type mimeType if it is not empty
+func findLink(links []*types.Link, rel string, mimeType string) *types.Link {
+	for _, link := range links {
+		if link != nil && link.Rel == rel && (mimeType == "" || link.Type == mimeType) {
+			return link
+		}
+	}
+
+	return nil
+}
+
+// govcdGetDiskSnapshots returns the snapshots of disk, or an ErrSnapshotsUnsupported error if VCD does not list them
+func (diskManager *DiskManager) govcdGetDiskSnapshots(disk *vcdtypes.Disk) ([]*vcdtypes.DiskSnapshot, error) {
+	snapshotsLink := findLink(disk.Link, types.RelDown, MimeDiskSnapshots)
+	if snapshotsLink == nil {
+		return nil, NewDiskError(ErrSnapshotsUnsupported, disk.Name,
+			fmt.Errorf("disk [%s] has no link to its snapshots, hence VCD does not snapshot it", disk.Name))
+	}
+
+	snapshots := &vcdtypes.DiskSnapshots{}
+	if _, err := diskManager.VCDClient.VCDClient.Client.ExecuteRequestWithApiVersion(snapshotsLink.HREF,
+		http.MethodGet, snapshotsLink.Type, "error getting snapshots of disk: %s", nil, snapshots,
+		diskManager.VCDClient.VCDClient.Client.APIVersion); err != nil {
+		return nil, fmt.Errorf("unable to get snapshots of disk [%s]: [%v]", disk.Name, err)
+	}
+
+	return snapshots.DiskSnapshot, nil
+}
+
+// ListDiskSnapshots returns the snapshots of the disk diskName, or ErrDiskNotFound if there is no such disk
+func (diskManager *DiskManager) ListDiskSnapshots(diskName string) ([]DiskSnapshot, error) {
+	diskManager.VCDClient.RWLock.Lock()
+	defer diskManager.VCDClient.RWLock.Unlock()
+
+	klog.Infof("Entered ListDiskSnapshots for disk [%s]", diskName)
+
+	if err := diskManager.VCDClient.refreshBearerTokenIfExpiring(context.Background()); err != nil {
+		return nil, fmt.Errorf("unable to refresh bearer token to list snapshots of disk [%s]: [%v]", diskName, err)
+	}
+
+	disk, err := diskManager.getDiskByName(diskName)
+	if err != nil {
+		if errors.Is(err, ErrDiskNotFound) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("unable to find disk with name [%s]: [%v]", diskName, err)
+	}
+	vcdSnapshots, err := diskManager.govcdGetDiskSnapshots(disk)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := make([]DiskSnapshot, 0, len(vcdSnapshots))
+	for _, vcdSnapshot := range vcdSnapshots {
+		if vcdSnapshot != nil {
+			snapshots = append(snapshots, *newDiskSnapshot(vcdSnapshot, disk))
+		}
+	}
+
+	return snapshots, nil
+}
+
+// GetDiskSnapshot returns the snapshot with the URN snapshotID, or ErrSnapshotNotFound if there is no such snapshot
+func (diskManager *DiskManager) GetDiskSnapshot(snapshotID string) (*DiskSnapshot, error) {
+	diskManager.VCDClient.RWLock.Lock()
+	defer diskManager.VCDClient.RWLock.Unlock()
+
+	if err := diskManager.VCDClient.refreshBearerTokenIfExpiring(context.Background()); err != nil {
+		return nil, fmt.Errorf("unable to refresh bearer token to get snapshot [%s]: [%v]", snapshotID, err)
+	}
+
+	vcdSnapshot, err := diskManager.getDiskSnapshotByURN(snapshotID)
+	if err != nil {
+		return nil, err
+	}
+
+	return newDiskSnapshot(vcdSnapshot, nil), nil
+}
+
+// getDiskSnapshotByURN returns the snapshot with the URN urn, which the entity resolver of VCD links to. The caller
+// should hold diskManager.VCDClient.RWLock.
+func (diskManager *DiskManager) getDiskSnapshotByURN(urn string) (*vcdtypes.DiskSnapshot, error) {
+	klog.Infof("Entered GetDiskSnapshotByURN for urn [%s]", urn)
+
+	snapshotUUID := strings.TrimPrefix(urn, DiskSnapshotURNPrefix)
+	if !IsDiskSnapshotURN(urn) || snapshotUUID == "" || strings.Contains(snapshotUUID, "/") {
+		return nil, NewDiskError(ErrSnapshotNotFound, urn, fmt.Errorf("[%s] is not the URN of a snapshot", urn))
+	}
+
+	// VCD forbids access to the entities that do not exist
+	isNotFound := func(err error) bool {
+		return govcd.ContainsNotFound(err) || strings.Contains(err.Error(), fmt.Sprintf("API Error: %d:",
+			http.StatusNotFound)) || strings.Contains(err.Error(), fmt.Sprintf("API Error: %d:",
+			http.StatusForbidden))
+	}
+	entity := &types.Entity{}
+	entityHref := fmt.Sprintf("%s/entity/%s", diskManager.VCDClient.VCDClient.Client.VCDHREF.String(), urn)
+	if _, err := diskManager.VCDClient.VCDClient.Client.ExecuteRequestWithApiVersion(entityHref, http.MethodGet,
+		types.MimeEntity, "error resolving snapshot: %s", nil, entity,
+		diskManager.VCDClient.VCDClient.Client.APIVersion); err != nil {
+		if isNotFound(err) {
+			return nil, NewDiskError(ErrSnapshotNotFound, urn, nil)
+		}
+		return nil, fmt.Errorf("unable to resolve snapshot with urn [%s]: [%v]", urn, err)
+	}
+	snapshotLink := findLink(entity.Link, types.RelAlternate, MimeDiskSnapshot)
+	if snapshotLink == nil {
+		return nil, NewDiskError(ErrSnapshotNotFound, urn,
+			fmt.Errorf("entity with urn [%s] is not a snapshot of a disk", urn))
+	}
+
+	snapshot := &vcdtypes.DiskSnapshot{}
+	if _, err := diskManager.VCDClient.VCDClient.Client.ExecuteRequestWithApiVersion(snapshotLink.HREF,
+		http.MethodGet, snapshotLink.Type, "error getting snapshot: %s", nil, snapshot,
+		diskManager.VCDClient.VCDClient.Client.APIVersion); err != nil {
+		if isNotFound(err) {
+			return nil, NewDiskError(ErrSnapshotNotFound, urn, nil)
+		}
+		return nil, fmt.Errorf("unable to get snapshot with urn [%s]: [%v]", urn, err)
+	}
+
+	return snapshot, nil
+}
+
+// CreateDiskSnapshot takes the snapshot snapName of the disk diskName
+func (diskManager *DiskManager) CreateDiskSnapshot(diskName string, snapName string) (*DiskSnapshot, error) {
+	return diskManager.CreateDiskSnapshotWithContext(context.Background(), diskName, snapName)
+}
+
+// CreateDiskSnapshotWithContext is the same as CreateDiskSnapshot but traces the snapshot in a child span of the span
+// of ctx. The snapshot of the disk that is already named snapName is returned, so that retries take one snapshot.
+func (diskManager *DiskManager) CreateDiskSnapshotWithContext(ctx context.Context, diskName string,
+	snapName string) (_ *DiskSnapshot, err error) {
+	ctx, span := diskManager.VCDClient.startSpan(ctx, operationCreateSnapshot, diskName)
+	defer func() { span.end(err) }()
+
+	diskManager.VCDClient.RWLock.Lock()
+	defer diskManager.VCDClient.RWLock.Unlock()
+	defer diskManager.VCDClient.bindToContext(ctx)()
+	defer func() { err = contextError(ctx, err) }()
+	defer func() { err = diskOperationError(diskName, err) }()
+
+	klog.Infof("Entered CreateDiskSnapshot for disk [%s] with snapshot name [%s]", diskName, snapName)
+
+	if snapName == "" {
+		return nil, fmt.Errorf("name of snapshot of disk [%s] should not be empty", diskName)
+	}
+	if err := diskManager.VCDClient.refreshBearerTokenIfExpiring(ctx); err != nil {
+		return nil, fmt.Errorf("unable to refresh bearer token to snapshot disk [%s]: [%v]", diskName, err)
+	}
+
+	disk, err := diskManager.getDiskByName(diskName)
+	if err != nil {
+		if errors.Is(err, ErrDiskNotFound) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("unable to find disk with name [%s]: [%v]", diskName, err)
+	}
+	findSnapshot := func() (*DiskSnapshot, error) {
+		vcdSnapshots, err := diskManager.govcdGetDiskSnapshots(disk)
+		if err != nil {
+			return nil, err
+		}
+		for _, vcdSnapshot := range vcdSnapshots {
+			if vcdSnapshot != nil && vcdSnapshot.Name == snapName {
+				return newDiskSnapshot(vcdSnapshot, disk), nil
+			}
+		}
+		return nil, nil
+	}
+	snapshot, err := findSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	if snapshot != nil {
+		klog.Infof("Snapshot [%s] of disk [%s] already exists", snapName, diskName)
+		return snapshot, nil
+	}
+
+	createLink := findLink(disk.Link, types.RelSnapshotCreate, "")
+	if createLink == nil {
+		return nil, NewDiskError(ErrSnapshotsUnsupported, diskName,
+			fmt.Errorf("disk [%s] has no link to create its snapshots, hence VCD does not snapshot it", diskName))
+	}
+	if diskManager.DryRun {
+		klog.Infof("Dry run: not creating snapshot [%s] of disk [%s]", snapName, diskName)
+		return &DiskSnapshot{ID: dryRunSnapshotURNPrefix + snapName, Name: snapName, DiskID: disk.Id,
+			DiskName: disk.Name, SizeMB: disk.SizeMb, ReadyToUse: true}, nil
+	}
+
+	err = observeVCDCall(operationCreateSnapshot, func() error {
+		task, err := diskManager.VCDClient.VCDClient.Client.ExecuteTaskRequestWithApiVersion(createLink.HREF,
+			http.MethodPost, MimeDiskSnapshotCreateParams, "error creating snapshot of disk: %s",
+			&vcdtypes.DiskSnapshotCreateParams{
+				Xmlns: types.XMLNamespaceVCloud,
+				Name:  snapName,
+			}, diskManager.VCDClient.VCDClient.Client.APIVersion)
+		if err != nil {
+			return fmt.Errorf("unable to create snapshot [%s] of disk [%s]: [%v]", snapName, diskName, err)
+		}
+
+		klog.Infof("START: Waiting for snapshot [%s] of disk [%s]", snapName, diskName)
+		if err = waitForTask(ctx, &task); err != nil {
+			return fmt.Errorf("failed to wait for snapshot task of disk [%s]: [%v]", diskName, err)
+		}
+		klog.Infof("END  : Waiting for snapshot [%s] of disk [%s]", snapName, diskName)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if snapshot, err = findSnapshot(); err != nil {
+		return nil, err
+	}
+	if snapshot == nil {
+		return nil, fmt.Errorf("snapshot [%s] of disk [%s] was created but is not listed", snapName, diskName)
+	}
+	klog.Infof("Snapshot created: [%#v]", snapshot)
+
+	return snapshot, nil
+}
+
+// DeleteDiskSnapshot deletes the snapshot with the URN snapID, and succeeds if it does not exist
+func (diskManager *DiskManager) DeleteDiskSnapshot(snapID string) error {
+	return diskManager.DeleteDiskSnapshotWithContext(context.Background(), snapID)
+}
+
+// DeleteDiskSnapshotWithContext is the same as DeleteDiskSnapshot but traces the deletion in a child span of the span
+// of ctx
+func (diskManager *DiskManager) DeleteDiskSnapshotWithContext(ctx context.Context, snapID string) (err error) {
+	ctx, span := diskManager.VCDClient.startSpan(ctx, operationDeleteSnapshot, snapID)
+	defer func() { span.end(err) }()
+
+	diskManager.VCDClient.RWLock.Lock()
+	defer diskManager.VCDClient.RWLock.Unlock()
+	defer diskManager.VCDClient.bindToContext(ctx)()
+	defer func() { err = contextError(ctx, err) }()
+	defer func() { err = diskOperationError(snapID, err) }()
+
+	klog.Infof("Entered DeleteDiskSnapshot for snapshot [%s]", snapID)
+
+	if err := diskManager.VCDClient.refreshBearerTokenIfExpiring(ctx); err != nil {
+		return fmt.Errorf("unable to refresh bearer token to delete snapshot [%s]: [%v]", snapID, err)
+	}
+	if diskManager.DryRun && strings.HasPrefix(snapID, dryRunSnapshotURNPrefix) {
+		klog.Infof("Dry run: not deleting snapshot [%s] that the dry run did not create", snapID)
+		return nil
+	}
+
+	snapshot, err := diskManager.getDiskSnapshotByURN(snapID)
+	if err != nil {
+		if errors.Is(err, ErrSnapshotNotFound) {
+			// ignore deletes for non-existent entities
+			klog.Infof("Unable to find snapshot [%s]: [%v]", snapID, err)
+			return nil
+		}
+		return err
+	}
+	deleteLink := findLink(snapshot.Link, types.RelRemove, "")
+	if deleteLink == nil {
+		return fmt.Errorf("could not find request URL for delete snapshot in snapshot Link")
+	}
+	if diskManager.DryRun {
+		klog.Infof("Dry run: not deleting snapshot [%s] with href [%s]", snapID, snapshot.HREF)
+		return nil
+	}
+
+	return observeVCDCall(operationDeleteSnapshot, func() error {
+		task, err := diskManager.VCDClient.VCDClient.Client.ExecuteTaskRequestWithApiVersion(deleteLink.HREF,
+			http.MethodDelete, "", "error deleting snapshot: %s", nil,
+			diskManager.VCDClient.VCDClient.Client.APIVersion)
+		if err != nil {
+			return fmt.Errorf("unable to delete snapshot [%s]: [%v]", snapID, err)
+		}
+		if err = waitForTask(ctx, &task); err != nil {
+			return fmt.Errorf("failed to wait for delete task of snapshot [%s]: [%v]", snapID, err)
+		}
+		return nil
+	})
+}
+
+// CreateDiskFromSnapshot creates the disk name in storageProfile with the data of the snapshot snapshotID, and with
+// the bus and the sharing of the disk of the snapshot. The disk has sizeBytes, rounded up to MB, or the size of the
+// snapshot if it is larger.
+func (diskManager *DiskManager) CreateDiskFromSnapshot(name string, snapshotID string, storageProfile string,
+	sizeBytes int64) (*Disk, error) {
+	return diskManager.CreateDiskFromSnapshotWithContext(context.Background(), name, snapshotID, storageProfile,
+		sizeBytes)
+}
+
+// CreateDiskFromSnapshotWithContext is the same as CreateDiskFromSnapshot but traces the creation in a child span of
+// the span of ctx
+func (diskManager *DiskManager) CreateDiskFromSnapshotWithContext(ctx context.Context, name string,
+	snapshotID string, storageProfile string, sizeBytes int64) (_ *Disk, err error) {
+	ctx, span := diskManager.VCDClient.startSpan(ctx, operationCreateDisk, name)
+	defer func() { span.end(err) }()
+
+	diskManager.VCDClient.RWLock.Lock()
+	defer diskManager.VCDClient.RWLock.Unlock()
+	defer diskManager.VCDClient.bindToContext(ctx)()
+	defer func() { err = contextError(ctx, err) }()
+	defer func() { err = diskOperationError(name, err) }()
+
+	klog.Infof("Entered CreateDiskFromSnapshot with name [%s] snapshot [%s] storageProfile [%s] size [%d]B", name,
+		snapshotID, storageProfile, sizeBytes)
+
+	if sizeBytes < 0 {
+		return nil, fmt.Errorf("size [%d] of disk [%s] should not be negative", sizeBytes, name)
+	}
+	if err := diskManager.VCDClient.refreshBearerTokenIfExpiring(ctx); err != nil {
+		return nil, fmt.Errorf("unable to refresh bearer token to create disk [%s]: [%v]", name, err)
+	}
+
+	snapshot, err := diskManager.getDiskSnapshotByURN(snapshotID)
+	if err != nil {
+		return nil, err
+	}
+	if snapshot.Disk == nil || snapshot.Disk.HREF == "" {
+		return nil, fmt.Errorf("snapshot [%s] does not reference the disk that it was taken of", snapshotID)
+	}
+	// the restored disk is attached as the disk of the snapshot was
+	sourceDisk, err := diskManager.govcdGetDiskByHref(snapshot.Disk.HREF)
+	if err != nil {
+		return nil, fmt.Errorf("unable to find disk [%s] of snapshot [%s]: [%v]", snapshot.Disk.Name, snapshotID,
+			err)
+	}
+
+	sizeMB := (sizeBytes + mbToBytes - 1) / mbToBytes
+	snapshotSizeMB := newDiskSnapshot(snapshot, sourceDisk).SizeMB
+	if sizeMB < snapshotSizeMB {
+		sizeMB = snapshotSizeMB
+	}
+
+	return diskManager.createDiskFromSource(ctx, name, &types.Reference{
+		HREF: snapshot.HREF,
+		ID:   snapshot.Id,
+		Type: MimeDiskSnapshot,
+	}, sourceDisk, storageProfile, sizeMB)
+}
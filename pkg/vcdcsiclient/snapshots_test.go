@@ -0,0 +1,107 @@
+/*
+   Copyright 2021 VMware, Inc.
+   SPDX-License-Identifier: Apache-2.0
+*/
+
+package vcdcsiclient
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware/cloud-director-named-disk-csi-driver/pkg/vcdtypes"
+	"strings"
+	"testing"
+)
+
+func TestDiskSnapshots(t *testing.T) {
+	newDisk := func(name string) *vcdtypes.Disk {
+		return &vcdtypes.Disk{Name: name, SizeMb: 100, BusType: VCDBusTypeSCSI, BusSubType: VCDBusSubTypeVirtualSCSI}
+	}
+	server, _ := newFakeVCDServer("org", "vdc", newDisk("test-pvc"), newDisk("legacy-pvc"))
+	defer server.Close()
+
+	client, err := NewVCDClientFromSecrets(server.URL, "org", "vdc", "org", "user", "password", "",
+		true, true)
+	require.NoError(t, err, "client should be created against the fake VCD")
+	defer EvictClient(client)
+	diskManager := &DiskManager{VCDClient: client}
+
+	snapshot, err := diskManager.CreateDiskSnapshot("test-pvc", "snap-1")
+	require.NoError(t, err, "disk should be snapshotted")
+	assert.True(t, strings.HasPrefix(snapshot.ID, DiskSnapshotURNPrefix), "snapshot should have a snapshot URN")
+	assert.Equal(t, "snap-1", snapshot.Name, "snapshot should have the requested name")
+	assert.Equal(t, "test-pvc", snapshot.DiskName, "snapshot should reference its disk")
+	assert.EqualValues(t, 100, snapshot.SizeMB, "snapshot should have the size of its disk")
+	assert.False(t, snapshot.CreationTime.IsZero(), "snapshot should have a creation time")
+	assert.True(t, snapshot.ReadyToUse, "snapshot without a running task should be ready to use")
+
+	sameSnapshot, err := diskManager.CreateDiskSnapshot("test-pvc", "snap-1")
+	require.NoError(t, err, "snapshot that already exists should be returned")
+	assert.Equal(t, snapshot.ID, sameSnapshot.ID, "snapshot with the same name should not be created again")
+
+	snapshots, err := diskManager.ListDiskSnapshots("test-pvc")
+	require.NoError(t, err, "snapshots of the disk should be listed")
+	require.Len(t, snapshots, 1, "disk should have a single snapshot")
+	assert.Equal(t, snapshot.ID, snapshots[0].ID, "listed snapshot should be the created one")
+
+	foundSnapshot, err := diskManager.GetDiskSnapshot(snapshot.ID)
+	require.NoError(t, err, "snapshot should be found by its URN")
+	assert.Equal(t, "snap-1", foundSnapshot.Name, "found snapshot should have its name")
+	assert.Equal(t, "test-pvc", foundSnapshot.DiskName, "found snapshot should reference its disk")
+
+	require.NoError(t, diskManager.DeleteDiskSnapshot(snapshot.ID), "snapshot should be deleted")
+	assert.NoError(t, diskManager.DeleteDiskSnapshot(snapshot.ID), "deleting a deleted snapshot should succeed")
+	_, err = diskManager.GetDiskSnapshot(snapshot.ID)
+	assert.ErrorIs(t, err, ErrSnapshotNotFound, "deleted snapshot should not be found")
+	snapshots, err = diskManager.ListDiskSnapshots("test-pvc")
+	require.NoError(t, err, "snapshots of the disk should be listed")
+	assert.Empty(t, snapshots, "deleted snapshot should not be listed")
+
+	_, err = diskManager.GetDiskSnapshot("urn:vcloud:disk:1")
+	assert.ErrorIs(t, err, ErrSnapshotNotFound, "URN that is not of a snapshot should not be found")
+
+	_, err = diskManager.CreateDiskSnapshot("legacy-pvc", "snap-1")
+	assert.ErrorIs(t, err, ErrSnapshotsUnsupported, "disk that VCD does not snapshot should fail clearly")
+	_, err = diskManager.ListDiskSnapshots("legacy-pvc")
+	assert.ErrorIs(t, err, ErrSnapshotsUnsupported, "disk that VCD does not snapshot should not list snapshots")
+
+	_, err = diskManager.CreateDiskSnapshot("missing-pvc", "snap-1")
+	assert.ErrorIs(t, err, ErrDiskNotFound, "snapshotting a missing disk should fail with not found")
+	_, err = diskManager.ListDiskSnapshots("missing-pvc")
+	assert.ErrorIs(t, err, ErrDiskNotFound, "listing snapshots of a missing disk should fail with not found")
+}
+
+func TestCreateDiskFromSnapshot(t *testing.T) {
+	disk := &vcdtypes.Disk{
+		Name:       "test-pvc",
+		SizeMb:     100,
+		BusType:    VCDBusTypeSCSI,
+		BusSubType: VCDBusSubTypeLsiLogicSAS,
+	}
+	server, _ := newFakeVCDServer("org", "vdc", disk)
+	defer server.Close()
+
+	client, err := NewVCDClientFromSecrets(server.URL, "org", "vdc", "org", "user", "password", "",
+		true, true)
+	require.NoError(t, err, "client should be created against the fake VCD")
+	defer EvictClient(client)
+	diskManager := &DiskManager{VCDClient: client}
+
+	snapshot, err := diskManager.CreateDiskSnapshot(disk.Name, "snap-1")
+	require.NoError(t, err, "disk should be snapshotted")
+
+	restoredDisk, err := diskManager.CreateDiskFromSnapshot("restored-pvc", snapshot.ID, "", 50*mbToBytes)
+	require.NoError(t, err, "disk should be restored from the snapshot")
+	assert.EqualValues(t, 100, restoredDisk.SizeMB, "disk smaller than the snapshot should have its size")
+	assert.Equal(t, VCDBusSubTypeLsiLogicSAS, restoredDisk.BusSubType, "disk should have the bus of the snapshot")
+	sameDisk, err := diskManager.CreateDiskFromSnapshot("restored-pvc", snapshot.ID, "", 50*mbToBytes)
+	require.NoError(t, err, "restored disk that exists should be returned")
+	assert.Equal(t, restoredDisk.ID, sameDisk.ID, "disk should not be restored again")
+
+	largerDisk, err := diskManager.CreateDiskFromSnapshot("larger-pvc", snapshot.ID, "", 200*mbToBytes)
+	require.NoError(t, err, "larger disk should be restored from the snapshot")
+	assert.EqualValues(t, 200, largerDisk.SizeMB, "disk should have the requested size larger than the snapshot")
+
+	_, err = diskManager.CreateDiskFromSnapshot("missing-pvc", DiskSnapshotURNPrefix+"404", "", 0)
+	assert.ErrorIs(t, err, ErrSnapshotNotFound, "restoring a missing snapshot should fail with not found")
+}
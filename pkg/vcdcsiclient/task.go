@@ -0,0 +1,87 @@
+/*
+   Copyright 2021 VMware, Inc.
+   SPDX-License-Identifier: Apache-2.0
+*/
+
+package vcdcsiclient
+
+import (
+	"context"
+	"fmt"
+	"github.com/vmware/go-vcloud-director/v2/govcd"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+	"time"
+)
+
+const (
+	// taskPollBaseDelay is the delay before the second poll of a task, which doubles after every poll
+	taskPollBaseDelay = 500 * time.Millisecond
+	// taskPollMaxDelay caps the delay between two polls of a task
+	taskPollMaxDelay = 10 * time.Second
+	// defaultTaskTimeout bounds the wait for a task whose context has no deadline
+	defaultTaskTimeout = 30 * time.Minute
+
+	taskStatusSuccess = "success"
+)
+
+// taskPendingStatuses are the statuses of the VCD tasks that have not completed yet
+var taskPendingStatuses = map[string]bool{
+	"queued":     true,
+	"preRunning": true,
+	"running":    true,
+}
+
+// taskPollDelay returns the delay after the given poll of a task
+func taskPollDelay(poll int) time.Duration {
+	delay := taskPollBaseDelay << uint(poll)
+	if delay <= 0 || delay > taskPollMaxDelay {
+		delay = taskPollMaxDelay
+	}
+
+	return delay
+}
+
+// waitForTask polls task with exponential backoff until it completes, and returns the error detail of a task that
+// did not succeed. It gives up once ctx is done, or after defaultTaskTimeout if ctx has no deadline.
+func waitForTask(ctx context.Context, task *govcd.Task) error {
+	if task == nil || task.Task == nil {
+		return fmt.Errorf("task should not be nil")
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultTaskTimeout)
+		defer cancel()
+	}
+
+	taskHREF := task.Task.HREF
+	for poll := 0; ; poll++ {
+		if err := task.Refresh(); err != nil {
+			return fmt.Errorf("unable to get status of task [%s]: [%v]", taskHREF, err)
+		}
+		if !taskPendingStatuses[task.Task.Status] {
+			if task.Task.Status == taskStatusSuccess {
+				return nil
+			}
+			return fmt.Errorf("task [%s] of operation [%s] ended with status [%s]: [%w]", taskHREF,
+				task.Task.Operation, task.Task.Status, getTaskError(task.Task))
+		}
+
+		timer := time.NewTimer(taskPollDelay(poll))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("gave up waiting for task [%s] in status [%s]: [%v]", taskHREF,
+				task.Task.Status, ctx.Err())
+		case <-timer.C:
+		}
+	}
+}
+
+// getTaskError returns the error of a task that did not succeed, which VCD may omit for an aborted task
+func getTaskError(task *types.Task) error {
+	if task.Error == nil {
+		return fmt.Errorf("no error detail")
+	}
+
+	return task.Error
+}
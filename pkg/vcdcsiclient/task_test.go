@@ -0,0 +1,96 @@
+/*
+   Copyright 2021 VMware, Inc.
+   SPDX-License-Identifier: Apache-2.0
+*/
+
+package vcdcsiclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware/go-vcloud-director/v2/govcd"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTaskPollDelay(t *testing.T) {
+	assert.Equal(t, taskPollBaseDelay, taskPollDelay(0), "first poll should be followed by the base delay")
+	assert.Equal(t, 2*taskPollBaseDelay, taskPollDelay(1), "delay should double after every poll")
+	assert.Equal(t, taskPollMaxDelay, taskPollDelay(10), "delay should be capped")
+	assert.Equal(t, taskPollMaxDelay, taskPollDelay(100), "delay should be capped when the shift overflows")
+}
+
+func TestWaitForTask(t *testing.T) {
+	// the tasks are served with each of their statuses in turn, and then with their last status
+	tasksLock := sync.Mutex{}
+	taskStatuses := map[string][]string{
+		"/api/task/success": {"queued", "running", "success"},
+		"/api/task/error":   {"error"},
+		"/api/task/aborted": {"aborted"},
+		"/api/task/running": {"running"},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tasksLock.Lock()
+		defer tasksLock.Unlock()
+		statuses, ok := taskStatuses[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		taskError := ""
+		if statuses[0] == "error" {
+			taskError = `<Error majorErrorCode="400" minorErrorCode="BAD_REQUEST" message="disk is busy"/>`
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		fmt.Fprintf(w, `<Task href="http://%s%s" status="%s" operation="Creating Disk">%s</Task>`, r.Host,
+			r.URL.Path, statuses[0], taskError)
+		if len(statuses) > 1 {
+			taskStatuses[r.URL.Path] = statuses[1:]
+		}
+	}))
+	defer server.Close()
+
+	serverURL, err := url.Parse(server.URL)
+	require.NoError(t, err, "URL of the fake server should be parsed")
+	vcdClient := govcd.NewVCDClient(*serverURL, true)
+	newTask := func(path string) *govcd.Task {
+		task := govcd.NewTask(&vcdClient.Client)
+		task.Task.HREF = server.URL + path
+		return task
+	}
+
+	start := time.Now()
+	assert.NoError(t, waitForTask(context.Background(), newTask("/api/task/success")),
+		"waiting for a task that succeeds should succeed")
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(3*taskPollBaseDelay),
+		"the polls of a running task should back off")
+
+	err = waitForTask(context.Background(), newTask("/api/task/error"))
+	require.Error(t, err, "waiting for a task that fails should fail")
+	assert.True(t, strings.Contains(err.Error(), "disk is busy"), "error [%v] should have the detail of the task",
+		err)
+	var apiErr *types.Error
+	assert.True(t, errors.As(err, &apiErr), "error should wrap the error of the task")
+
+	assert.Error(t, waitForTask(context.Background(), newTask("/api/task/aborted")),
+		"waiting for an aborted task should fail")
+	assert.Error(t, waitForTask(context.Background(), newTask("/api/task/missing")),
+		"waiting for a missing task should fail")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	assert.Error(t, waitForTask(ctx, newTask("/api/task/running")),
+		"waiting for a task beyond the deadline should fail")
+	assert.Less(t, int64(time.Since(start)), int64(taskPollBaseDelay),
+		"waiting should stop at the deadline of the context")
+}
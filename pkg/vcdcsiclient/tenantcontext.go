@@ -0,0 +1,98 @@
+/*
+   Copyright 2021 VMware, Inc.
+   SPDX-License-Identifier: Apache-2.0
+*/
+
+package vcdcsiclient
+
+import (
+	"context"
+	"fmt"
+	"github.com/vmware/go-vcloud-director/v2/govcd"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+	"k8s.io/klog/v2"
+	"net/http"
+	"strings"
+)
+
+// orgURNPrefix is the prefix of the URNs of orgs, whose UUID is the ID of the tenant context of the org
+const orgURNPrefix = "urn:vcloud:org:"
+
+// tenantContext is the org that the requests of a system administrator operate in
+type tenantContext struct {
+	orgID   string
+	orgName string
+}
+
+// tenantContextRoundTripper adds the tenant context of the operation org of the client to its requests, except for
+// the requests of the provider: authentication, the admin API and admin queries, which stay in the system org
+type tenantContextRoundTripper struct {
+	client *Client
+	next   http.RoundTripper
+}
+
+func (rt *tenantContextRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	tenantContext, _ := rt.client.tenantContext.Load().(*tenantContext)
+	if tenantContext == nil || isProviderRequest(req) {
+		return rt.next.RoundTrip(req)
+	}
+
+	// a round tripper should not modify the request it is given
+	req = req.Clone(req.Context())
+	req.Header.Set(types.HeaderTenantContext, tenantContext.orgID)
+	req.Header.Set(types.HeaderAuthContext, tenantContext.orgName)
+	return rt.next.RoundTrip(req)
+}
+
+// isProviderRequest returns true if req has to run in the system org of a system administrator
+func isProviderRequest(req *http.Request) bool {
+	path := req.URL.Path
+	for _, providerPath := range []string{"/api/sessions", "/api/admin/", "/api/versions", "/oauth/",
+		"/cloudapi/1.0.0/sessions"} {
+		if strings.Contains(path, providerPath) {
+			return true
+		}
+	}
+	if strings.HasSuffix(path, "/api/query") {
+		return strings.HasPrefix(strings.ToLower(req.URL.Query().Get("type")), "admin")
+	}
+
+	return false
+}
+
+// resolveTenantContext sets the tenant context of the operation org of the client, if it has one, once it is
+// authenticated. A tenant user can only operate in its own org.
+func (client *Client) resolveTenantContext(ctx context.Context) error {
+	if client.operationOrg == "" {
+		return nil
+	}
+	if !client.VCDClient.Client.IsSysAdmin {
+		if strings.EqualFold(client.operationOrg, client.VCDAuthConfig.UserOrg) {
+			return nil
+		}
+		return fmt.Errorf("only a system administrator can operate in org [%s] instead of org [%s]",
+			client.operationOrg, client.VCDAuthConfig.UserOrg)
+	}
+	if tenantContext, _ := client.tenantContext.Load().(*tenantContext); tenantContext != nil {
+		return nil
+	}
+
+	var org *govcd.Org
+	err := client.retry(ctx, "get operation org", func() (err error) {
+		org, err = client.VCDClient.GetOrgByName(client.operationOrg)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("unable to get operation org [%s]: [%v]", client.operationOrg, err)
+	}
+	if !strings.HasPrefix(org.Org.ID, orgURNPrefix) {
+		return fmt.Errorf("operation org [%s] has an invalid ID [%s]", client.operationOrg, org.Org.ID)
+	}
+
+	client.tenantContext.Store(&tenantContext{
+		orgID:   strings.TrimPrefix(org.Org.ID, orgURNPrefix),
+		orgName: org.Org.Name,
+	})
+	klog.FromContext(ctx).Info("Operating in tenant context of org", "org", org.Org.Name)
+	return nil
+}
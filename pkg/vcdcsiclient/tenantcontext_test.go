@@ -0,0 +1,85 @@
+/*
+   Copyright 2021 VMware, Inc.
+   SPDX-License-Identifier: Apache-2.0
+*/
+
+package vcdcsiclient
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+// headerRecordingRoundTripper records the tenant context header of the requests that it sends through
+// http.DefaultTransport, by method and path
+type headerRecordingRoundTripper struct {
+	lock           sync.Mutex
+	tenantContexts map[string]string
+}
+
+func (rt *headerRecordingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.lock.Lock()
+	rt.tenantContexts[req.Method+" "+req.URL.Path] = req.Header.Get(types.HeaderTenantContext)
+	rt.lock.Unlock()
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func (rt *headerRecordingRoundTripper) tenantContext(request string) (string, bool) {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+
+	tenantContext, ok := rt.tenantContexts[request]
+	return tenantContext, ok
+}
+
+func TestWithOperationOrg(t *testing.T) {
+	server, _ := newFakeVCDServer("org", "vdc")
+	defer server.Close()
+
+	transport := &headerRecordingRoundTripper{tenantContexts: make(map[string]string)}
+	client, err := NewVCDClientFromSecrets(server.URL, "org", "vdc", "system", "admin", "password", "", true, true,
+		WithHTTPTransport(transport), WithOperationOrg("org"))
+	require.NoError(t, err, "client of a system administrator should be created with an operation org")
+	defer EvictClient(client)
+
+	tenantContext, ok := transport.tenantContext(http.MethodPost + " /cloudapi/1.0.0/sessions/provider")
+	require.True(t, ok, "client should authenticate")
+	assert.Empty(t, tenantContext, "authentication should run in the system org")
+	tenantContext, ok = transport.tenantContext(http.MethodGet + " /api/vdc/1")
+	require.True(t, ok, "VDC should be read")
+	assert.Equal(t, "1", tenantContext, "VDC should be read in the tenant context of the operation org")
+
+	require.NoError(t, client.RefreshBearerToken(), "bearer token should be refreshed")
+
+	_, err = NewVCDClientFromSecrets(server.URL, "org", "vdc", "org", "user", "password", "", true, true,
+		WithOperationOrg("other-org"))
+	assert.Error(t, err, "tenant user should not operate in another org")
+	client, err = NewVCDClientFromSecrets(server.URL, "org", "vdc", "org", "user", "password", "", true, true,
+		WithOperationOrg("org"))
+	require.NoError(t, err, "tenant user should operate in its own org")
+	defer EvictClient(client)
+	assert.Nil(t, client.tenantContext.Load(), "tenant user should have no tenant context")
+
+	assert.Error(t, WithOperationOrg("")(&Client{}), "empty operation org should not be accepted")
+}
+
+func TestIsProviderRequest(t *testing.T) {
+	for path, expected := range map[string]bool{
+		"/api/sessions":                     true,
+		"/cloudapi/1.0.0/sessions/provider": true,
+		"/oauth/provider/token":             true,
+		"/api/admin/org/1":                  true,
+		"/api/query?type=adminDisk":         true,
+		"/api/query?type=disk":              false,
+		"/api/vdc/1/disk":                   false,
+		"/api/disk/1/action/attach":         false,
+	} {
+		req, err := http.NewRequest(http.MethodGet, "https://vcd.example.com"+path, nil)
+		require.NoError(t, err, "request should be created")
+		assert.Equal(t, expected, isProviderRequest(req), "unexpected provider request [%s]", path)
+	}
+}
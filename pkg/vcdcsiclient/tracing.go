@@ -0,0 +1,73 @@
+/*
+   Copyright 2021 VMware, Inc.
+   SPDX-License-Identifier: Apache-2.0
+*/
+
+package vcdcsiclient
+
+import (
+	"context"
+)
+
+const (
+	// attributes of the spans of VCD operations
+	SpanAttributeOperation = "vcd.operation"
+	SpanAttributeDiskName  = "vcd.disk.name"
+	SpanAttributeVDC       = "vcd.vdc"
+
+	// spanNamePrefix prefixes the operation in the names of the spans
+	spanNamePrefix = "vcd."
+)
+
+// Tracer starts the spans of the VCD operations of a client, which should be children of the span of ctx if it has
+// one. It can be implemented by an OpenTelemetry tracer, with the attributes as string attributes of the span.
+type Tracer interface {
+	StartSpan(ctx context.Context, name string, attributes map[string]string) (context.Context, Span)
+}
+
+// Span is the span of a VCD operation started by a Tracer
+type Span interface {
+	// RecordError marks the span as failed with err
+	RecordError(err error)
+	// End ends the span
+	End()
+}
+
+// startSpan starts the span of operation of the client on the disk diskName, if diskName is not empty. It returns
+// ctx and a span that does nothing if the client has no tracer.
+func (client *Client) startSpan(ctx context.Context, operation string,
+	diskName string) (context.Context, *operationSpan) {
+
+	if client.tracer == nil {
+		return ctx, &operationSpan{}
+	}
+
+	attributes := map[string]string{
+		SpanAttributeOperation: operation,
+		SpanAttributeVDC:       client.ClusterOVDCName,
+	}
+	if diskName != "" {
+		attributes[SpanAttributeDiskName] = diskName
+	}
+	ctx, span := client.tracer.StartSpan(ctx, spanNamePrefix+operation, attributes)
+
+	return ctx, &operationSpan{
+		span: span,
+	}
+}
+
+// operationSpan ends the span of a Tracer, if any, with the error of the operation
+type operationSpan struct {
+	span Span
+}
+
+// end records err on the span if it is not nil, and ends the span
+func (s *operationSpan) end(err error) {
+	if s.span == nil {
+		return
+	}
+	if err != nil {
+		s.span.RecordError(err)
+	}
+	s.span.End()
+}
@@ -0,0 +1,119 @@
+/*
+   Copyright 2021 VMware, Inc.
+   SPDX-License-Identifier: Apache-2.0
+*/
+
+package vcdcsiclient
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+)
+
+type parentSpanKey struct{}
+
+// recordedSpan is a span of a recordingTracer
+type recordedSpan struct {
+	name       string
+	parent     string
+	attributes map[string]string
+	err        error
+	ended      bool
+}
+
+func (span *recordedSpan) RecordError(err error) {
+	span.err = err
+}
+
+func (span *recordedSpan) End() {
+	span.ended = true
+}
+
+// recordingTracer records its spans, whose parents are the names of the spans of their contexts
+type recordingTracer struct {
+	lock  sync.Mutex
+	spans []*recordedSpan
+}
+
+func (tracer *recordingTracer) StartSpan(ctx context.Context, name string,
+	attributes map[string]string) (context.Context, Span) {
+
+	tracer.lock.Lock()
+	defer tracer.lock.Unlock()
+
+	parent, _ := ctx.Value(parentSpanKey{}).(string)
+	span := &recordedSpan{
+		name:       name,
+		parent:     parent,
+		attributes: attributes,
+	}
+	tracer.spans = append(tracer.spans, span)
+	return context.WithValue(ctx, parentSpanKey{}, name), span
+}
+
+// findSpan returns the last span named name
+func (tracer *recordingTracer) findSpan(name string) *recordedSpan {
+	tracer.lock.Lock()
+	defer tracer.lock.Unlock()
+
+	for i := len(tracer.spans) - 1; i >= 0; i-- {
+		if tracer.spans[i].name == name {
+			return tracer.spans[i]
+		}
+	}
+	return nil
+}
+
+func TestWithTracer(t *testing.T) {
+	server, _ := newFakeVCDServer("org", "vdc")
+	defer server.Close()
+
+	tracer := &recordingTracer{}
+	client, err := NewVCDClientFromSecrets(server.URL, "org", "vdc", "org", "user", "password", "", true, true,
+		WithTracer(tracer))
+	require.NoError(t, err, "client with a tracer should be created against the fake VCD")
+	defer EvictClient(client)
+	diskManager := &DiskManager{VCDClient: client}
+	vm := newFakeVM(server, client, "node-1")
+
+	ctx := context.WithValue(context.Background(), parentSpanKey{}, "grpc")
+	disk, err := diskManager.CreateDiskWithContext(ctx, "test-pvc-traced", 100, VCDBusTypeSCSI,
+		VCDBusSubTypeVirtualSCSI, "", "", false, "", "", 0)
+	require.NoError(t, err, "disk should be created")
+
+	span := tracer.findSpan("vcd.create-disk")
+	require.NotNil(t, span, "creation should be traced")
+	assert.Equal(t, "grpc", span.parent, "span should be a child of the span of the context")
+	assert.Equal(t, map[string]string{
+		SpanAttributeOperation: operationCreateDisk,
+		SpanAttributeDiskName:  "test-pvc-traced",
+		SpanAttributeVDC:       "vdc",
+	}, span.attributes, "span should have the operation, disk and VDC")
+	assert.NoError(t, span.err, "span of a successful creation should have no error")
+	assert.True(t, span.ended, "span should be ended")
+
+	foundDisk, err := diskManager.GetDiskByName(disk.Name)
+	require.NoError(t, err, "created disk should be found")
+	require.NoError(t, diskManager.AttachVolumeAtWithContext(ctx, vm, foundDisk, nil, nil),
+		"disk should be attached")
+	require.NotNil(t, tracer.findSpan("vcd.attach"), "attachment should be traced")
+
+	assert.Error(t, diskManager.DeleteDiskWithContext(ctx, disk.Name), "deleting an attached disk should fail")
+	span = tracer.findSpan("vcd.delete-disk")
+	require.NotNil(t, span, "deletion should be traced")
+	assert.Error(t, span.err, "span of a failed deletion should record the error")
+	assert.True(t, span.ended, "span of a failed deletion should be ended")
+
+	require.NoError(t, diskManager.DetachVolumeWithContext(ctx, vm, disk.Name), "disk should be detached")
+	require.NotNil(t, tracer.findSpan("vcd.detach"), "detachment should be traced")
+
+	require.NoError(t, client.RefreshBearerTokenWithContext(ctx), "bearer token should be refreshed")
+	span = tracer.findSpan("vcd.refresh")
+	require.NotNil(t, span, "refresh should be traced")
+	assert.NotContains(t, span.attributes, SpanAttributeDiskName, "span of a refresh should have no disk")
+
+	assert.Error(t, WithTracer(nil)(&Client{}), "nil tracer should not be accepted")
+}
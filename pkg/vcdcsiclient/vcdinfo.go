@@ -0,0 +1,88 @@
+/*
+   Copyright 2021 VMware, Inc.
+   SPDX-License-Identifier: Apache-2.0
+*/
+
+package vcdcsiclient
+
+import (
+	"encoding/json"
+	"k8s.io/klog/v2"
+	"net/http"
+	"time"
+)
+
+// VCDInfoPath is the path that the handler returned by NewVCDInfoHandler is meant to be served at
+const VCDInfoPath = "/debug/vcdinfo"
+
+const (
+	// AuthMethodRefreshToken and AuthMethodPassword are the ways a client authenticates to VCD
+	AuthMethodRefreshToken = "refreshToken"
+	AuthMethodPassword     = "password"
+)
+
+// VCDInfo is what a disk manager uses in VCD, to confirm the org, user and VDC of a running driver. It has no secrets:
+// neither the password, the refresh token nor the bearer token of the client.
+type VCDInfo struct {
+	Host         string `json:"host"`
+	Org          string `json:"org"`
+	VDC          string `json:"vdc"`
+	VApp         string `json:"vApp"`
+	APIVersion   string `json:"apiVersion"`
+	UserOrg      string `json:"userOrg"`
+	User         string `json:"user"`
+	SysAdmin     bool   `json:"sysAdmin"`
+	OperationOrg string `json:"operationOrg,omitempty"`
+	// AuthMethod is AuthMethodRefreshToken or AuthMethodPassword
+	AuthMethod string `json:"authMethod"`
+	// TokenExpiresAt is nil if the expiry of the bearer token is not known
+	TokenExpiresAt *time.Time `json:"tokenExpiresAt"`
+	// LastRefreshAt is when the client last obtained a bearer token
+	LastRefreshAt time.Time `json:"lastRefreshAt"`
+}
+
+// VCDInfo returns what the disk manager uses in VCD
+func (diskManager *DiskManager) VCDInfo() VCDInfo {
+	client := diskManager.VCDClient
+	client.RWLock.RLock()
+	defer client.RWLock.RUnlock()
+
+	info := VCDInfo{
+		Host:          client.currentHost().String(),
+		Org:           client.ClusterOrgName,
+		VDC:           client.ClusterOVDCName,
+		VApp:          diskManager.VAppName,
+		APIVersion:    client.apiVersion,
+		UserOrg:       client.VCDAuthConfig.UserOrg,
+		User:          client.VCDAuthConfig.User,
+		SysAdmin:      client.VCDAuthConfig.IsSysAdmin,
+		OperationOrg:  client.operationOrg,
+		AuthMethod:    AuthMethodPassword,
+		LastRefreshAt: client.refreshedAt,
+	}
+	if client.VCDAuthConfig.RefreshToken != "" {
+		info.AuthMethod = AuthMethodRefreshToken
+	}
+	if !client.tokenExpiresAt.IsZero() {
+		tokenExpiresAt := client.tokenExpiresAt
+		info.TokenExpiresAt = &tokenExpiresAt
+	}
+
+	return info
+}
+
+// NewVCDInfoHandler returns a handler that responds with the VCDInfo of diskManager as JSON
+func NewVCDInfoHandler(diskManager *DiskManager) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(diskManager.VCDInfo()); err != nil {
+			klog.ErrorS(err, "Unable to write VCD info")
+		}
+	})
+}
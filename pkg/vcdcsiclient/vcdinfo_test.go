@@ -0,0 +1,48 @@
+/*
+   Copyright 2021 VMware, Inc.
+   SPDX-License-Identifier: Apache-2.0
+*/
+
+package vcdcsiclient
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestVCDInfoHandler(t *testing.T) {
+	server, _ := newFakeVCDServer("org", "vdc")
+	defer server.Close()
+
+	client, err := NewVCDClientFromSecrets(server.URL, "org", "vdc", "org", "user", "secret-password", "", true,
+		true)
+	require.NoError(t, err, "client should be created against the fake VCD")
+	defer EvictClient(client)
+	handler := NewVCDInfoHandler(&DiskManager{VCDClient: client, VAppName: "cluster"})
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, VCDInfoPath, nil))
+	require.Equal(t, http.StatusOK, recorder.Code, "VCD info should be returned")
+	assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"), "VCD info should be JSON")
+	body := recorder.Body.String()
+	assert.NotContains(t, body, "secret-password", "password should be redacted")
+	assert.NotContains(t, body, client.VCDClient.Client.VCDToken, "bearer token should be redacted")
+
+	var info VCDInfo
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &info), "VCD info should be decoded")
+	assert.Equal(t, server.URL, info.Host, "host should be returned")
+	assert.Equal(t, "org", info.Org, "org should be returned")
+	assert.Equal(t, "vdc", info.VDC, "VDC should be returned")
+	assert.Equal(t, "cluster", info.VApp, "vApp should be returned")
+	assert.Equal(t, "user", info.User, "user should be returned")
+	assert.Equal(t, AuthMethodPassword, info.AuthMethod, "authentication by password should be returned")
+	assert.False(t, info.LastRefreshAt.IsZero(), "time of the last refresh should be returned")
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, VCDInfoPath, nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, recorder.Code, "VCD info should only be read")
+}
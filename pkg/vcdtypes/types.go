@@ -48,20 +48,22 @@ type DiskRecordType struct {
 // Reference: vCloud API 35.0 - DiskType
 // https://code.vmware.com/apis/287/vcloud?h=Director#/doc/doc/types/DiskType.html
 type Disk struct {
-	HREF         string `xml:"href,attr,omitempty"`
-	Type         string `xml:"type,attr,omitempty"`
-	Id           string `xml:"id,attr,omitempty"`
-	OperationKey string `xml:"operationKey,attr,omitempty"`
-	Name         string `xml:"name,attr"`
-	Status       int    `xml:"status,attr,omitempty"`
-	SizeMb       int64  `xml:"sizeMb,attr"`
-	Iops         int64  `xml:"iops,attr,omitempty"`
-	Encrypted    bool   `xml:"encrypted,attr,omitempty"`
-	BusType      string `xml:"busType,attr,omitempty"`
-	BusSubType   string `xml:"busSubType,attr,omitempty"`
-	Shareable    bool   `xml:"shareable,attr,omitempty"`
-	SharingType  string `xml:"sharingType,attr,omitempty"`
-	UUID         string `xml:"uuid,attr,omitempty"`
+	XMLName      xml.Name `xml:"Disk"`
+	Xmlns        string   `xml:"xmlns,attr,omitempty"`
+	HREF         string   `xml:"href,attr,omitempty"`
+	Type         string   `xml:"type,attr,omitempty"`
+	Id           string   `xml:"id,attr,omitempty"`
+	OperationKey string   `xml:"operationKey,attr,omitempty"`
+	Name         string   `xml:"name,attr"`
+	Status       int      `xml:"status,attr,omitempty"`
+	SizeMb       int64    `xml:"sizeMb,attr"`
+	Iops         int64    `xml:"iops,attr,omitempty"`
+	Encrypted    bool     `xml:"encrypted,attr,omitempty"`
+	BusType      string   `xml:"busType,attr,omitempty"`
+	BusSubType   string   `xml:"busSubType,attr,omitempty"`
+	Shareable    bool     `xml:"shareable,attr,omitempty"`
+	SharingType  string   `xml:"sharingType,attr,omitempty"`
+	UUID         string   `xml:"uuid,attr,omitempty"`
 
 	Description     string                 `xml:"Description,omitempty"`
 	Files           *types.FilesList       `xml:"Files,omitempty"`
@@ -70,6 +72,11 @@ type Disk struct {
 	StorageProfile  *types.Reference       `xml:"StorageProfile,omitempty"`
 	Tasks           *types.TasksInProgress `xml:"Tasks,omitempty"`
 	VCloudExtension *types.VCloudExtension `xml:"VCloudExtension,omitempty"`
+	// EncryptionPolicy is the encryption policy that the disk is encrypted at rest with, which VCD 10.4 added
+	EncryptionPolicy *types.Reference `xml:"EncryptionPolicy,omitempty"`
+
+	// AttachedVMs are the VMs that the disk is attached to. VCD returns them from a separate API.
+	AttachedVMs []*types.Reference `xml:"-"`
 }
 
 // DiskCreateParams Parameters for creating or updating an independent disk.
@@ -80,9 +87,53 @@ type DiskCreateParams struct {
 	Xmlns           string                 `xml:"xmlns,attr,omitempty"`
 	Disk            *Disk                  `xml:"Disk"`
 	Locality        *types.Reference       `xml:"Locality,omitempty"`
+	Source          *types.Reference       `xml:"Source,omitempty"`
 	VCloudExtension *types.VCloudExtension `xml:"VCloudExtension,omitempty"`
 }
 
+// DiskSnapshot is a snapshot of an independent disk, which VCD lists in the down link of the disk of type
+// DiskSnapshots
+type DiskSnapshot struct {
+	XMLName xml.Name `xml:"DiskSnapshot"`
+	Xmlns   string   `xml:"xmlns,attr,omitempty"`
+	HREF    string   `xml:"href,attr,omitempty"`
+	Type    string   `xml:"type,attr,omitempty"`
+	Id      string   `xml:"id,attr,omitempty"`
+	Name    string   `xml:"name,attr"`
+	SizeMb  int64    `xml:"sizeMb,attr,omitempty"`
+	Created string   `xml:"created,attr,omitempty"`
+
+	Description string                 `xml:"Description,omitempty"`
+	Link        []*types.Link          `xml:"Link,omitempty"`
+	Disk        *types.Reference       `xml:"Disk,omitempty"`
+	Tasks       *types.TasksInProgress `xml:"Tasks,omitempty"`
+}
+
+// DiskSnapshots lists the snapshots of an independent disk
+type DiskSnapshots struct {
+	XMLName      xml.Name        `xml:"DiskSnapshots"`
+	Xmlns        string          `xml:"xmlns,attr,omitempty"`
+	HREF         string          `xml:"href,attr,omitempty"`
+	Type         string          `xml:"type,attr,omitempty"`
+	Link         []*types.Link   `xml:"Link,omitempty"`
+	DiskSnapshot []*DiskSnapshot `xml:"DiskSnapshot,omitempty"`
+}
+
+// DiskSnapshotCreateParams are the parameters of the snapshot of an independent disk
+type DiskSnapshotCreateParams struct {
+	XMLName     xml.Name `xml:"DiskSnapshotCreateParams"`
+	Xmlns       string   `xml:"xmlns,attr,omitempty"`
+	Name        string   `xml:"name,attr"`
+	Description string   `xml:"Description,omitempty"`
+}
+
+// EncryptionPolicy is a policy of VCD that disks can be encrypted at rest with, which VCD 10.4 added to the OpenAPI
+type EncryptionPolicy struct {
+	ID          string `json:"id,omitempty"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+}
+
 // Represents a list of virtual machines
 // Reference: vCloud API 35.0 - VmsType
 // https://code.vmware.com/apis/1046/vmware-cloud-director/doc/doc/types/VmsType.html
@@ -98,3 +149,30 @@ type Vms struct {
 	VCloudExtension *types.VCloudExtension `xml:"VCloudExtension,omitempty"`
 	VmReference     []*types.Reference      `xml:"VmReference,omitempty"`
 }
+
+// VdcStorageProfile represents a storage profile of a VDC. The type in govcd does not decode the IOPS settings.
+// Reference: vCloud API 35.0 - VdcStorageProfileType
+// https://code.vmware.com/apis/1046/vmware-cloud-director/doc/doc/types/VdcStorageProfileType.html
+type VdcStorageProfile struct {
+	Xmlns         string                         `xml:"xmlns,attr"`
+	HREF          string                         `xml:"href,attr,omitempty"`
+	Name          string                         `xml:"name,attr"`
+	Enabled       bool                           `xml:"Enabled,omitempty"`
+	Units         string                         `xml:"Units"`
+	Limit         int64                          `xml:"Limit"`
+	Default       bool                           `xml:"Default"`
+	IopsSettings  *VdcStorageProfileIopsSettings `xml:"IopsSettings,omitempty"`
+	StorageUsedMB int64                          `xml:"StorageUsedMB"`
+	IopsAllocated int64                          `xml:"IopsAllocated"`
+}
+
+// VdcStorageProfileIopsSettings represents the IOPS settings of the disks of a storage profile
+// Reference: vCloud API 35.0 - VdcStorageProfileIopsSettingsType
+// https://code.vmware.com/apis/1046/vmware-cloud-director/doc/doc/types/VdcStorageProfileIopsSettingsType.html
+type VdcStorageProfileIopsSettings struct {
+	Enabled                 bool  `xml:"Enabled"`
+	DiskIopsMax             int64 `xml:"DiskIopsMax"`
+	DiskIopsDefault         int64 `xml:"DiskIopsDefault"`
+	StorageProfileIopsLimit int64 `xml:"StorageProfileIopsLimit,omitempty"`
+	DiskIopsPerGbMax        int64 `xml:"DiskIopsPerGbMax"`
+}